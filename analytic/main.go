@@ -1,7 +1,8 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -15,14 +16,17 @@ import (
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
 var logger *shared.Logger
-var rabbitmq *shared.RabbitMQ
+var bus shared.Bus
 var metrics *shared.Metrics
 var requestPerSecond *prometheus.CounterVec
 var tracer *shared.Tracer
 var analyticRepo *repo.AnalyticRepo
+var deduplicator *shared.EventDeduplicator
+var duplicateEvents *prometheus.CounterVec
 
 func init() {
 	// Init logger
@@ -33,13 +37,26 @@ func init() {
 	analyticRepo = repo.NewAnalyticRepo("")
 	analyticRepo.DB.Migrate(&model.AnalyticRecord{})
 
-	// Init rabbitmq
-	rabbitmq = shared.NewRabbitMQ("")
-	rabbitmq.Connect(10 * time.Second)
+	// Init deduplication of the redelivered events
+	deduplicator = shared.NewEventDeduplicator(&analyticRepo.DB, "analytic")
+	deduplicator.Migrate()
+
+	// Init message bus, selected by BUS_DRIVER
+	var err error
+	bus, err = shared.ConnectBus(10 * time.Second)
+	if bus == nil {
+		logger.Error("Cannot init message bus", zap.Error(err))
+		panic(err)
+	}
+	if err != nil {
+		logger.Error("Cannot connect to message bus, retrying in background", zap.Error(err))
+	}
+	bus.SetRetryPolicy(os.Getenv("ANALYTIC_QUEUE"), shared.RetryPolicyFromEnv("ANALYTIC"))
 
 	// Init metrics
 	metrics = shared.NewMetrics()
 	requestPerSecond = metrics.RegisterCounter("request_per_second", "Request per second", []string{"method", "path"})
+	duplicateEvents = metrics.RegisterCounter("duplicate_events_dropped", "Redelivered events dropped because they were already processed", []string{"consumer", "type"})
 
 	// Init tracer
 	tracer = shared.NewTracer("analytic", "")
@@ -47,45 +64,92 @@ func init() {
 	logger.Info("Init done!!!")
 }
 
-func handleAnalytic(msg []byte, headers amqp091.Table) error {
-	ctx := shared.ExtractAmqpTraceHeader(headers)
-	ctx, span := tracer.StartSpan("handleAnalytic", ctx, trace.WithSpanKind(trace.SpanKindConsumer))
+func handleAnalytic(ctx context.Context, msg []byte, headers amqp091.Table) error {
+	event, err := shared.DecodeEvent(msg)
+	ctx, span := tracer.StartSpan("handleAnalytic", event.Context(ctx), trace.WithSpanKind(trace.SpanKindConsumer))
 	defer span.End()
 	metrics.IncCounter(requestPerSecond, "QUEUE", "analytic")
-	var analytic shared.AnalyticMessage
 	innerLogger := shared.NewLogger("analytic.log", 3, 1024, "info", "analytic")
 	innerLogger.Init()
 
-	innerRepo := repo.NewAnalyticRepo("")
-	defer innerRepo.DB.Close()
-
-	err := json.Unmarshal(msg, &analytic)
+	// Events of other types are not for this service, retrying them would not help
+	if errors.Is(err, shared.ErrUnknownEventType) {
+		innerLogger.Info("Skip event", zap.String("eventId", event.Id), zap.String("type", event.Type))
+		return nil
+	}
 	if err != nil {
 		span.RecordError(err)
-		span.SetStatus(codes.Error, "Cannot unmarshal analytic message")
-		innerLogger.Error("Cannot unmarshal analytic message: %s", zap.Error(err))
+		span.SetStatus(codes.Error, "Cannot decode analytic event")
+		innerLogger.Error("Cannot decode analytic event", zap.String("eventId", event.Id), zap.String("type", event.Type), zap.Int("schemaVersion", event.SchemaVersion), zap.Error(err))
 		return err
 	}
 
 	_, updateDBSpan := tracer.StartSpan("updateDB", ctx, trace.WithSpanKind(trace.SpanKindInternal))
-	if analytic.Type == "map" {
-		// Create new record
-		analyticRecord := model.AnalyticRecord{
-			ShortUrl:      analytic.Shorten,
-			OriginalUrl:   analytic.Url,
-			RedirectCount: 0,
+	defer updateDBSpan.End()
+
+	// A redelivered event was already counted, it is only acked
+	var shortUrl string
+	processed, err := deduplicator.Process(event.Id, func(tx *gorm.DB) error {
+		innerRepo := analyticRepo.WithTx(tx)
+		switch event.Type {
+		case shared.EventLinkCreated:
+			// Create new record
+			var link shared.LinkCreatedV1
+			err := event.DecodeData(&link)
+			if err != nil {
+				return err
+			}
+			shortUrl = link.ShortUrl
+			return innerRepo.Add(&model.AnalyticRecord{
+				ShortUrl:      link.ShortUrl,
+				OriginalUrl:   link.Url,
+				OwnerId:       link.OwnerId,
+				RedirectCount: 0,
+			})
+		case shared.EventLinkClicked:
+			// Increase redirect count
+			var click shared.LinkClickedV1
+			err := event.DecodeData(&click)
+			if err != nil {
+				return err
+			}
+			shortUrl = click.ShortUrl
+			return innerRepo.IncAccessCount(click.ShortUrl)
+		case shared.EventLinkUpdated:
+			// Follow the new target of the link
+			var link shared.LinkUpdatedV1
+			err := event.DecodeData(&link)
+			if err != nil {
+				return err
+			}
+			shortUrl = link.ShortUrl
+			return innerRepo.UpdateOriginalUrl(link.ShortUrl, link.Url)
+		case shared.EventLinkDeleted:
+			// Keep the record for history, only flag it
+			var link shared.LinkDeletedV1
+			err := event.DecodeData(&link)
+			if err != nil {
+				return err
+			}
+			shortUrl = link.ShortUrl
+			return innerRepo.MarkDeleted(link.ShortUrl, event.OccurredAt)
 		}
-		innerRepo.DB.Create(&analyticRecord)
-		updateDBSpan.End()
+		return nil
+	})
+	if err != nil {
+		updateDBSpan.RecordError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Cannot handle analytic event")
+		innerLogger.Error("Cannot handle analytic event", zap.String("eventId", event.Id), zap.String("type", event.Type), zap.Error(err))
+		return err
 	}
-
-	if analytic.Type == "redirect" {
-		// Increase redirect count
-		innerRepo.IncAccessCount(analytic.Shorten)
-		updateDBSpan.End()
+	if !processed {
+		metrics.IncCounter(duplicateEvents, "analytic", event.Type)
+		innerLogger.Info("Drop duplicate event", zap.String("eventId", event.Id), zap.String("type", event.Type))
+		return nil
 	}
 
-	innerLogger.Info("Analytic message: %s", zap.String("id", analytic.Id), zap.String("url", analytic.Url), zap.String("shorten", analytic.Shorten), zap.String("type", analytic.Type))
+	innerLogger.Info("Analytic event", zap.String("eventId", event.Id), zap.String("type", event.Type), zap.String("shorten", shortUrl))
 
 	return nil
 }
@@ -98,6 +162,68 @@ func metricsHandler(c *fiber.Ctx) error {
 	return c.Type("text/plain").SendString(metrics)
 }
 
+// Return the statistics of the caller's links, the gateway tells who the caller is
+func statsHandler(c *fiber.Ctx) error {
+	_, statsSpan := tracer.StartSpan("Stats", tracer.Ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer statsSpan.End()
+
+	ownerId := c.Get("X-Owner-Id")
+	if ownerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	records, err := analyticRepo.ListByOwner(ownerId, c.Query("shortUrl"), limit)
+	if err != nil {
+		statsSpan.RecordError(err)
+		statsSpan.SetStatus(codes.Error, "Cannot list stats")
+		logger.Error("Cannot list stats", zap.String("ownerId", ownerId), zap.Int("code", 500), zap.Error(err))
+		return c.Status(500).JSON(map[string]interface{}{
+			"error": "Internal server error",
+		})
+	}
+
+	stats := make([]shared.LinkStats, 0, len(records))
+	for _, record := range records {
+		stats = append(stats, record.ToLinkStats())
+	}
+	return c.Status(200).JSON(stats)
+}
+
+// Return the statistics of the most visited links of every owner, for the internal
+// services: the gateway does not route to it
+func topHandler(c *fiber.Ctx) error {
+	_, topSpan := tracer.StartSpan("Top", tracer.Ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer topSpan.End()
+
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 || limit > 10000 {
+		limit = 100
+	}
+
+	records, err := analyticRepo.ListTop(limit)
+	if err != nil {
+		topSpan.RecordError(err)
+		topSpan.SetStatus(codes.Error, "Cannot list top links")
+		logger.Error("Cannot list top links", zap.Int("code", 500), zap.Error(err))
+		return c.Status(500).JSON(map[string]interface{}{
+			"error": "Internal server error",
+		})
+	}
+
+	stats := make([]shared.LinkStats, 0, len(records))
+	for _, record := range records {
+		stats = append(stats, record.ToLinkStats())
+	}
+	return c.Status(200).JSON(stats)
+}
+
 func onGratefulShutDown() {
 	fmt.Println("Shutting down...")
 	analyticRepo.Close()
@@ -109,11 +235,24 @@ func main() {
 	analyticService.Init()
 
 	analyticService.Routes("/metrics", metricsHandler, "GET")
+	analyticService.Routes("/stats", statsHandler, "GET")
+	analyticService.Routes("/top", topHandler, "GET")
 
 	analyticQueue := os.Getenv("ANALYTIC_QUEUE")
-	go func() {
-		rabbitmq.Consume(analyticQueue, handleAnalytic, 9)
-	}()
+	shared.RegisterDeadLetterRoutes(analyticService, bus, analyticQueue)
+
+	analyticService.Background(func(ctx context.Context) {
+		deduplicator.PurgeLoop(ctx, func(err error) {
+			logger.Error("Cannot purge processed events", zap.Error(err))
+		})
+	})
+
+	analyticService.Background(func(ctx context.Context) {
+		err := bus.Subscribe(ctx, analyticQueue, handleAnalytic, 9)
+		if err != nil {
+			logger.Error("Cannot drain analytic queue", zap.Error(err))
+		}
+	})
 
 	analyticService.Start(onGratefulShutDown)
 }
@@ -1,12 +1,28 @@
 package model
 
-import "time"
+import (
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
 
 type AnalyticRecord struct {
-	ID            int       `gorm:"primaryKey,autoIncrement" json:"id"`
-	ShortUrl      string    `json:"short_url"`
-	OriginalUrl   string    `json:"original_url"`
-	RedirectCount int       `json:"redirect_count"`
-	CreatedAt     time.Time `gorm:"autoCreateTime" json:"created_at"`
-	LatestAccess  time.Time `gorm:"autoUpdateTime" json:"latest_access"`
+	ID            int        `gorm:"primaryKey,autoIncrement" json:"id"`
+	ShortUrl      string     `json:"short_url"`
+	OriginalUrl   string     `json:"original_url"`
+	OwnerId       string     `gorm:"index" json:"owner_id"`
+	RedirectCount int        `json:"redirect_count"`
+	CreatedAt     time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	LatestAccess  time.Time  `gorm:"autoUpdateTime" json:"latest_access"`
+	DeletedAt     *time.Time `gorm:"index" json:"deleted_at"` // Set when the link is deleted, the record is kept for history
+}
+
+func (r AnalyticRecord) ToLinkStats() shared.LinkStats {
+	return shared.LinkStats{
+		Shortened:     r.ShortUrl,
+		Url:           r.OriginalUrl,
+		RedirectCount: r.RedirectCount,
+		CreatedAt:     r.CreatedAt.Unix(),
+		LatestAccess:  r.LatestAccess.Unix(),
+	}
 }
@@ -1,8 +1,11 @@
 package repo
 
 import (
+	"time"
+
 	"github.com/HungTP-Play/lru/analytic/model"
 	"github.com/HungTP-Play/lru/shared"
+	"gorm.io/gorm"
 )
 
 type AnalyticRepo struct {
@@ -23,6 +26,14 @@ func (repo *AnalyticRepo) Close() error {
 	return repo.DB.Close()
 }
 
+// Same repo, running its queries in the transaction
+func (repo *AnalyticRepo) WithTx(tx *gorm.DB) *AnalyticRepo {
+	return &AnalyticRepo{
+		ConnectionString: repo.ConnectionString,
+		DB:               shared.PostgresDB{ConnectionString: repo.ConnectionString, DB: tx},
+	}
+}
+
 func (repo *AnalyticRepo) Add(record *model.AnalyticRecord) error {
 	return repo.DB.Create(record)
 }
@@ -37,3 +48,36 @@ func (repo *AnalyticRepo) IncAccessCount(shortUrl string) error {
 	record.RedirectCount += 1
 	return repo.DB.DB.Save(&record).Error
 }
+
+// Follow a change of the link target
+func (repo *AnalyticRepo) UpdateOriginalUrl(shortUrl string, originalUrl string) error {
+	return repo.DB.DB.Model(&model.AnalyticRecord{}).
+		Where("short_url = ? AND deleted_at IS NULL", shortUrl).
+		Update("original_url", originalUrl).Error
+}
+
+// Flag the record of a deleted link, its counters are kept
+func (repo *AnalyticRepo) MarkDeleted(shortUrl string, deletedAt time.Time) error {
+	return repo.DB.DB.Model(&model.AnalyticRecord{}).
+		Where("short_url = ? AND deleted_at IS NULL", shortUrl).
+		Update("deleted_at", deletedAt).Error
+}
+
+// Return the records of the owner's live links, most visited first.
+// A short url restricts the result to that link.
+func (repo *AnalyticRepo) ListByOwner(ownerId string, shortUrl string, limit int) ([]model.AnalyticRecord, error) {
+	var records []model.AnalyticRecord
+	query := repo.DB.DB.Where("owner_id = ? AND deleted_at IS NULL", ownerId)
+	if shortUrl != "" {
+		query = query.Where("short_url = ?", shortUrl)
+	}
+	err := query.Order("redirect_count DESC, id").Limit(limit).Find(&records).Error
+	return records, err
+}
+
+// Return the records of the most visited live links, of every owner
+func (repo *AnalyticRepo) ListTop(limit int) ([]model.AnalyticRecord, error) {
+	var records []model.AnalyticRecord
+	err := repo.DB.DB.Where("deleted_at IS NULL").Order("redirect_count DESC, id").Limit(limit).Find(&records).Error
+	return records, err
+}
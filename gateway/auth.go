@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HungTP-Play/lru/gateway/client"
+	"github.com/HungTP-Play/lru/gateway/util"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// How long a verified key is trusted without asking the mapper again
+var apiKeyCacheTTL = time.Minute
+
+// How long an unknown key is rejected without asking the mapper again
+var unknownApiKeyCacheTTL = 30 * time.Second
+
+// Cached in place of a key the mapper does not know
+const unknownApiKey = "-"
+
+// Identity attached to the request by AuthMiddleware
+type caller struct {
+	OwnerId string
+	KeyId   int64
+	Admin   bool
+}
+
+func apiKeyCacheKey(keyHash string) string {
+	return "apikey:" + keyHash
+}
+
+// Return the API key sent in X-API-Key or as a bearer token
+func apiKeyFromRequest(c *fiber.Ctx) string {
+	if key := c.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if authorization := c.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	return ""
+}
+
+// Check the X-Admin-Token header against ADMIN_TOKEN, admin access is off when it is not set
+func isAdminRequest(c *fiber.Ctx) bool {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	token := c.Get("X-Admin-Token")
+	return adminToken != "" && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// Return the caller attached by AuthMiddleware, nil for an anonymous request
+func requireCaller(c *fiber.Ctx) *caller {
+	identity, _ := c.Locals("caller").(*caller)
+	return identity
+}
+
+// Owner of the links created by the request, empty for anonymous and admin requests
+func callerOwnerId(c *fiber.Ctx) string {
+	if identity := requireCaller(c); identity != nil {
+		return identity.OwnerId
+	}
+	return ""
+}
+
+func unauthorizedResponse(c *fiber.Ctx) error {
+	return c.Status(401).JSON(map[string]interface{}{
+		"error": "A valid API key is required",
+	})
+}
+
+// Return the key with the given hash from the cache, nil when it is unknown or revoked.
+// Return false when the cache does not know it either way.
+func cachedApiKey(keyHash string) (*shared.ApiKeyResponse, bool) {
+	cached, err := cacheClient.Get(apiKeyCacheKey(keyHash))
+	if err != nil {
+		return nil, false
+	}
+	if cached == unknownApiKey {
+		return nil, true
+	}
+
+	var apiKey shared.ApiKeyResponse
+	if json.Unmarshal([]byte(cached), &apiKey) != nil {
+		return nil, false
+	}
+	return &apiKey, true
+}
+
+// Return the key with the given hash, from the cache or the mapper. Nil when the key is unknown or revoked.
+func lookupApiKey(ctx context.Context, requestId string, keyHash string) (*shared.ApiKeyResponse, error) {
+	if apiKey, ok := cachedApiKey(keyHash); ok {
+		return apiKey, nil
+	}
+
+	ctx, verifySpan := tracer.StartSpan("VerifyApiKey", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer verifySpan.End()
+
+	apiKey, err := mapperClient.VerifyApiKey(ctx, requestId, keyHash)
+	if shared.ServiceErrorStatus(err) == 404 {
+		err = cacheClient.Set(apiKeyCacheKey(keyHash), unknownApiKey, unknownApiKeyCacheTTL)
+		if err != nil {
+			logger.Error("CannotCacheApiKey", zap.String("id", requestId), zap.Error(err))
+		}
+		return nil, nil
+	}
+	if err != nil {
+		verifySpan.RecordError(err)
+		verifySpan.SetStatus(codes.Error, "Cannot verify api key")
+		return nil, err
+	}
+
+	encoded, _ := json.Marshal(apiKey)
+	err = cacheClient.Set(apiKeyCacheKey(keyHash), encoded, apiKeyCacheTTL)
+	if err != nil {
+		logger.Error("CannotCacheApiKey", zap.String("id", requestId), zap.Error(err))
+	}
+	return &apiKey, nil
+}
+
+// AuthMiddleware attaches the identity of the caller to the request.
+//
+// Requests with the X-Admin-Token header matching ADMIN_TOKEN act as admin. Others are
+// identified by their API key (X-API-Key header or bearer token); an unknown or revoked
+// key is rejected with a 401. Requests without a key stay anonymous, unless AUTH_REQUIRED
+// is "true". Endpoints that need an identity check it with requireCaller.
+func AuthMiddleware(c *fiber.Ctx) error {
+	if isAdminRequest(c) {
+		c.Locals("caller", &caller{Admin: true})
+		return c.Next()
+	}
+
+	key := apiKeyFromRequest(c)
+	if key == "" {
+		if os.Getenv("AUTH_REQUIRED") == "true" {
+			return unauthorizedResponse(c)
+		}
+		return c.Next()
+	}
+
+	requestId := util.GenUUID()
+	apiKey, err := lookupApiKey(tracer.Ctx, requestId, shared.HashApiKey(key))
+	if err != nil {
+		logger.Error("CannotVerifyApiKey", zap.String("id", requestId), zap.Int("code", 503), zap.Error(err))
+		return c.Status(503).JSON(map[string]interface{}{
+			"error": "Cannot verify the API key, try again later",
+		})
+	}
+	if apiKey == nil {
+		logger.Info("InvalidApiKey", zap.String("id", requestId), zap.Int("code", 401), zap.String("path", c.Path()))
+		return unauthorizedResponse(c)
+	}
+
+	c.Locals("caller", &caller{OwnerId: apiKey.OwnerId, KeyId: apiKey.Id})
+	return c.Next()
+}
+
+// Issue a key: an admin issues it for any owner, a caller for itself
+func issueApiKeyHandler(c *fiber.Ctx) error {
+	ctx, issueSpan := tracer.StartSpan("IssueApiKeyHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer issueSpan.End()
+
+	identity := requireCaller(c)
+	if identity == nil {
+		return unauthorizedResponse(c)
+	}
+
+	requestId := util.GenUUID()
+	var issueRequest shared.IssueApiKeyRequest
+	err := json.Unmarshal(c.Body(), &issueRequest)
+	if err != nil {
+		logger.Error("CannotParseBody", zap.String("id", requestId), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Cannot parse body",
+		})
+	}
+
+	issueRequest.Id = requestId
+	if !identity.Admin {
+		issueRequest.OwnerId = identity.OwnerId
+	}
+	if issueRequest.OwnerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	apiKey, err := mapperClient.IssueApiKey(ctx, issueRequest)
+	return serviceResponse(c, issueSpan, requestId, "issue api key", 201, apiKey, err)
+}
+
+// List the keys of the caller, or of the ownerId query param for an admin
+func listApiKeysHandler(c *fiber.Ctx) error {
+	ctx, listSpan := tracer.StartSpan("ListApiKeysHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer listSpan.End()
+
+	identity := requireCaller(c)
+	if identity == nil {
+		return unauthorizedResponse(c)
+	}
+
+	ownerId := identity.OwnerId
+	if identity.Admin {
+		ownerId = c.Query("ownerId")
+	}
+	if ownerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	requestId := util.GenUUID()
+	apiKeys, err := mapperClient.ListApiKeys(ctx, requestId, ownerId)
+	return serviceResponse(c, listSpan, requestId, "list api keys", 200, apiKeys, err)
+}
+
+// Revoke a key of the caller, or any key for an admin
+func revokeApiKeyHandler(c *fiber.Ctx) error {
+	ctx, revokeSpan := tracer.StartSpan("RevokeApiKeyHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer revokeSpan.End()
+
+	identity := requireCaller(c)
+	if identity == nil {
+		return unauthorizedResponse(c)
+	}
+
+	requestId := util.GenUUID()
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(404).JSON(map[string]interface{}{
+			"error": "Not found",
+		})
+	}
+
+	// An admin has no owner id and revokes any key
+	apiKey, err := mapperClient.RevokeApiKey(ctx, requestId, identity.OwnerId, id)
+	if err != nil {
+		return serviceResponse(c, revokeSpan, requestId, "revoke api key", 0, nil, err)
+	}
+
+	// Drop the key from the cache so it stops working right away
+	if apiKey.KeyHash != "" {
+		err = cacheClient.Del(apiKeyCacheKey(apiKey.KeyHash))
+	}
+	if err != nil {
+		logger.Error("CannotUncacheApiKey", zap.String("id", requestId), zap.Int64("keyId", id), zap.Error(err))
+	}
+
+	logger.Info("RevokeApiKey", zap.String("id", requestId), zap.Int("code", 204), zap.Int64("keyId", id))
+	return c.SendStatus(204)
+}
+
+// Statistics of the caller's links, or of the ownerId query param for an admin
+func statsHandler(c *fiber.Ctx) error {
+	ctx, statsSpan := tracer.StartSpan("StatsHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer statsSpan.End()
+
+	identity := requireCaller(c)
+	if identity == nil {
+		return unauthorizedResponse(c)
+	}
+
+	ownerId := identity.OwnerId
+	if identity.Admin {
+		ownerId = c.Query("ownerId")
+	}
+	if ownerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	requestId := util.GenUUID()
+	stats, err := analyticClient.Stats(ctx, client.StatsRequest{
+		RequestId: requestId,
+		OwnerId:   ownerId,
+		ShortUrl:  c.Query("shortUrl"),
+		Limit:     c.QueryInt("limit", 0),
+	})
+	return serviceResponse(c, statsSpan, requestId, "list stats", 200, stats, err)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/HungTP-Play/lru/gateway/dto"
+	"github.com/HungTP-Play/lru/gateway/util"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Read the items of a batch from a JSON array, a CSV body or a CSV file uploaded as "file"
+func parseShortenBatch(c *fiber.Ctx) ([]dto.ShortenRequestDto, error) {
+	var items []dto.ShortenRequestDto
+
+	if c.Is("json") {
+		err := json.Unmarshal(c.Body(), &items)
+		return items, err
+	}
+
+	if c.Is("csv") || c.Is("text") {
+		return util.ParseShortenCsv(bytes.NewReader(c.Body()))
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return util.ParseShortenCsv(file)
+}
+
+func shortenBatchHandler(c *fiber.Ctx) error {
+	shortenCtx, shortenSpan := tracer.StartSpan("ShortenBatchHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer shortenSpan.End()
+
+	requestID := util.GenUUID()
+	items, err := parseShortenBatch(c)
+	if err != nil {
+		logger.Error("CannotParseBody", zap.String("id", requestID), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": fmt.Sprintf("Cannot parse body: %v", err),
+		})
+	}
+
+	maxItems := shared.GetEnvInt("SHORTEN_BATCH_MAX_ITEMS", 1000)
+	logger.Info("RequestShortenBatch", zap.String("id", requestID), zap.Int("count", len(items)), zap.String("method", c.Method()), zap.String("path", c.Path()))
+	if len(items) == 0 || len(items) > maxItems {
+		logger.Error("InvalidBatchSize", zap.String("id", requestID), zap.Int("code", 400), zap.Int("count", len(items)))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": fmt.Sprintf("A batch must contain between 1 and %d urls", maxItems),
+		})
+	}
+
+	// Items rejected here never reach the mapper, the others keep track of their position
+	results := make([]shared.MapBatchResult, len(items))
+	mapBatchRequest := shared.MapBatchRequest{Id: requestID}
+	var indexes []int
+	ownerId := callerOwnerId(c)
+	for i, item := range items {
+		mapUrlRequest, message := buildMapUrlRequest(requestID, ownerId, item)
+		results[i] = shared.MapBatchResult{Index: i, Url: item.Url}
+		if message != "" {
+			results[i].Status = 400
+			results[i].Error = message
+			continue
+		}
+		mapBatchRequest.Items = append(mapBatchRequest.Items, mapUrlRequest)
+		indexes = append(indexes, i)
+	}
+
+	if len(indexes) > 0 {
+		ctx, mapperCallSpan := tracer.StartSpan("SendToMapper", shortenCtx, trace.WithSpanKind(trace.SpanKindClient))
+		defer mapperCallSpan.End()
+
+		mapBatchResponse, err := mapperClient.MapBatch(ctx, mapBatchRequest)
+		status := shared.ServiceErrorStatus(err)
+		if err != nil && status >= 500 {
+			mapperCallSpan.RecordError(err)
+			mapperCallSpan.SetStatus(codes.Error, "Mapper batch error")
+			logger.Error("MapperBatchError__ServerError", zap.String("id", requestID), zap.Int("code", status), zap.Error(err))
+			return c.Status(status).JSON(map[string]interface{}{
+				"error": upstreamErrorMessage(status),
+			})
+		}
+
+		// The mapper rejected the whole batch, e.g. too many items
+		if err != nil {
+			logger.Error("MapperBatchError__ClientError", zap.String("id", requestID), zap.Int("code", status), zap.Error(err))
+			return shared.ServiceErrorResponse(c, err)
+		}
+
+		if len(mapBatchResponse.Results) != len(indexes) {
+			mapperCallSpan.SetStatus(codes.Error, "Mapper batch error")
+			logger.Error("MapperBatchError__MissingResults", zap.String("id", requestID), zap.Int("code", 500), zap.Int("count", len(mapBatchResponse.Results)))
+			return c.Status(500).JSON(map[string]interface{}{
+				"error": "Internal server error",
+			})
+		}
+
+		for j, result := range mapBatchResponse.Results {
+			result.Index = indexes[j]
+			results[indexes[j]] = result
+		}
+	}
+
+	logger.Info("ShortenBatch", zap.String("id", requestID), zap.Int("code", 200), zap.Int("count", len(results)))
+	return c.Status(200).JSON(shared.MapBatchResponse{
+		Id:      requestID,
+		Results: results,
+	})
+}
@@ -0,0 +1,165 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// Returned without calling the upstream while its breaker is open
+var ErrCircuitOpen = shared.NewServiceError(503, "Service unavailable")
+
+// Stop calling an upstream that keeps failing, so its outage fails fast instead of
+// holding the requests of the gateway until they time out.
+//
+// The breaker opens after FailureThreshold failures in a row. Once OpenTimeout has
+// passed, a single call is let through to probe the upstream (half-open): the breaker
+// closes when it succeeds and opens again when it fails. Each change of state starts a
+// new generation, the outcome of a call let through by an earlier one is ignored.
+type CircuitBreaker struct {
+	Name             string
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	// Called on every change of state, e.g. to export it as a metric
+	OnStateChange func(name string, state BreakerState)
+
+	mutex      sync.Mutex
+	state      BreakerState
+	generation uint64
+	failures   int
+	openedAt   time.Time
+	probing    bool
+	now        func() time.Time
+}
+
+func NewCircuitBreaker(name string, failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	return &CircuitBreaker{
+		Name:             name,
+		FailureThreshold: failureThreshold,
+		OpenTimeout:      openTimeout,
+		now:              time.Now,
+	}
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+// Return ErrCircuitOpen when the call must not be sent. A call that is let through
+// must be followed by Record or Abandon, given the returned generation.
+func (b *CircuitBreaker) Allow() (uint64, error) {
+	b.mutex.Lock()
+	changed := false
+	defer func() {
+		state := b.state
+		b.mutex.Unlock()
+		if changed {
+			b.notify(state)
+		}
+	}()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.OpenTimeout {
+			return b.generation, ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		changed = true
+		return b.generation, nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return b.generation, ErrCircuitOpen
+		}
+		b.probing = true
+		return b.generation, nil
+	}
+	return b.generation, nil
+}
+
+// Record the outcome of a call let through by Allow in the given generation
+func (b *CircuitBreaker) Record(generation uint64, failed bool) {
+	b.mutex.Lock()
+	if generation != b.generation {
+		b.mutex.Unlock()
+		return
+	}
+
+	previous := b.state
+	switch {
+	case b.state == BreakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			b.setState(BreakerClosed)
+			b.failures = 0
+		}
+	case failed:
+		b.failures++
+		if b.failures >= b.FailureThreshold {
+			b.open()
+		}
+	default:
+		b.failures = 0
+	}
+	state := b.state
+	b.mutex.Unlock()
+
+	if state != previous {
+		b.notify(state)
+	}
+}
+
+// Forget a call let through by Allow whose outcome tells nothing about the upstream,
+// e.g. because the caller gave up on it
+func (b *CircuitBreaker) Abandon(generation uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if generation == b.generation && b.state == BreakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.state = state
+	b.generation++
+}
+
+func (b *CircuitBreaker) open() {
+	b.setState(BreakerOpen)
+	b.openedAt = b.now()
+	b.failures = 0
+}
+
+func (b *CircuitBreaker) notify(state BreakerState) {
+	if b.OnStateChange != nil {
+		b.OnStateChange(b.Name, state)
+	}
+}
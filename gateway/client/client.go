@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+// Transports of the calls from the gateway to the internal services
+const (
+	TransportHttp = "http"
+	TransportGrpc = "grpc"
+)
+
+// Link managed on behalf of its owner (empty for an admin)
+type LinkRef struct {
+	RequestId string
+	Domain    string
+	Code      string
+	OwnerId   string
+}
+
+// Calls to the mapper. A failure answered by the mapper is a *shared.ServiceError
+// carrying its HTTP status, shared.ErrBackendUnavailable means it could not be reached.
+//
+// The calls taking an ownerId act on behalf of that owner, empty for an admin.
+type MapperClient interface {
+	Map(ctx context.Context, request shared.MapUrlRequest) (shared.MapUrlResponse, error)
+	MapBatch(ctx context.Context, request shared.MapBatchRequest) (shared.MapBatchResponse, error)
+	GetLink(ctx context.Context, link LinkRef) (shared.LinkResponse, error)
+	UpdateLink(ctx context.Context, link LinkRef, request shared.UpdateLinkRequest) (shared.LinkResponse, error)
+	DeleteLink(ctx context.Context, link LinkRef) error
+
+	// A 404 *shared.ServiceError means the key is unknown or revoked
+	VerifyApiKey(ctx context.Context, requestId string, keyHash string) (shared.ApiKeyResponse, error)
+	IssueApiKey(ctx context.Context, request shared.IssueApiKeyRequest) (shared.ApiKeyResponse, error)
+	ListApiKeys(ctx context.Context, requestId string, ownerId string) ([]shared.ApiKeyResponse, error)
+	RevokeApiKey(ctx context.Context, requestId string, ownerId string, id int64) (shared.ApiKeyResponse, error)
+
+	CreateWorkspace(ctx context.Context, request shared.WorkspaceRequest) (shared.WorkspaceResponse, error)
+	ListWorkspaces(ctx context.Context, requestId string, ownerId string) ([]shared.WorkspaceResponse, error)
+	AddDomain(ctx context.Context, workspaceId int64, request shared.DomainRequest) (shared.WorkspaceResponse, error)
+	RemoveDomain(ctx context.Context, requestId string, ownerId string, workspaceId int64, host string) error
+	// A 404 *shared.ServiceError means no workspace registered the host
+	GetDomain(ctx context.Context, requestId string, host string) (shared.DomainResponse, error)
+
+	Close() error
+}
+
+// Calls to the redirect service, failing like the MapperClient
+type RedirectClient interface {
+	Resolve(ctx context.Context, requestId string, domain string, code string) (shared.RedirectResponse, error)
+	Redirect(ctx context.Context, request shared.RedirectRequest) (shared.RedirectResponse, error)
+	Close() error
+}
+
+// Statistics of the links of an owner, optionally of a single short url
+type StatsRequest struct {
+	RequestId string
+	OwnerId   string
+	ShortUrl  string
+	Limit     int // 0 for the default of the analytic service
+}
+
+// Calls to the analytic service, failing like the MapperClient
+type AnalyticClient interface {
+	Stats(ctx context.Context, request StatsRequest) ([]shared.LinkStats, error)
+	Close() error
+}
@@ -0,0 +1,327 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+func testGuard(maxAttempts int, failures int) *Guard {
+	policy := CallPolicy{
+		Timeout:      200 * time.Millisecond,
+		BatchTimeout: time.Second,
+		Retry: shared.RetryPolicy{
+			MaxAttempts:  maxAttempts,
+			InitialDelay: time.Millisecond,
+			MaxDelay:     5 * time.Millisecond,
+		},
+	}
+	return NewGuard("mapper", policy, NewCircuitBreaker("mapper", failures, time.Hour))
+}
+
+func TestHttpMapperClientGetLink(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/links/abc" || r.URL.Query().Get("domain") != "go.example.com" || r.Header.Get("X-Owner-Id") != "owner" || r.Header.Get("X-Request-Id") != "req-1" {
+			t.Errorf("unexpected request %v %v %v", r.URL, r.Header.Get("X-Owner-Id"), r.Header.Get("X-Request-Id"))
+		}
+		json.NewEncoder(w).Encode(shared.LinkResponse{Code: "abc", Url: "https://example.com"})
+	}))
+	defer server.Close()
+
+	mapper := NewHttpMapperClient(server.URL, server.Client())
+	link, err := mapper.GetLink(context.Background(), LinkRef{RequestId: "req-1", Domain: "go.example.com", Code: "abc", OwnerId: "owner"})
+	if err != nil || link.Code != "abc" || link.Url != "https://example.com" {
+		t.Errorf("GetLink() = %+v, %v", link, err)
+	}
+}
+
+func TestHttpMapperClientServiceError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(409)
+		w.Write([]byte(`{"error":"Alias is already taken"}`))
+	}))
+	defer server.Close()
+
+	_, err := NewHttpMapperClient(server.URL, server.Client()).Map(context.Background(), shared.MapUrlRequest{Url: "https://example.com", Alias: "promo"})
+	var serviceError *shared.ServiceError
+	if !errors.As(err, &serviceError) || serviceError.Status != 409 || serviceError.Message != "Alias is already taken" {
+		t.Errorf("Map() error = %v, want 409", err)
+	}
+}
+
+func TestHttpMapperClientVerifyApiKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/keys/verify/known" {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(shared.ApiKeyResponse{Id: 1, OwnerId: "owner"})
+	}))
+	defer server.Close()
+
+	mapper := NewHttpMapperClient(server.URL, server.Client())
+	apiKey, err := mapper.VerifyApiKey(context.Background(), "req-1", "known")
+	if err != nil || apiKey.OwnerId != "owner" {
+		t.Errorf("VerifyApiKey() = %+v, %v", apiKey, err)
+	}
+
+	// The mapper answers an unknown key without a body
+	_, err = mapper.VerifyApiKey(context.Background(), "req-1", "unknown")
+	var serviceError *shared.ServiceError
+	if !errors.As(err, &serviceError) || serviceError.Status != 404 || serviceError.Message != "Not Found" {
+		t.Errorf("VerifyApiKey() error = %v, want 404 Not Found", err)
+	}
+}
+
+func TestHttpAnalyticClientStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stats" || r.URL.Query().Get("shortUrl") != "abc" || r.URL.Query().Get("limit") != "10" || r.Header.Get("X-Owner-Id") != "owner" {
+			t.Errorf("unexpected request %v %v", r.URL, r.Header.Get("X-Owner-Id"))
+		}
+		json.NewEncoder(w).Encode([]shared.LinkStats{{Shortened: "abc", RedirectCount: 3}})
+	}))
+	defer server.Close()
+
+	analytic := NewHttpAnalyticClient(server.URL, server.Client())
+	stats, err := analytic.Stats(context.Background(), StatsRequest{RequestId: "req-1", OwnerId: "owner", ShortUrl: "abc", Limit: 10})
+	if err != nil || len(stats) != 1 || stats[0].RedirectCount != 3 {
+		t.Errorf("Stats() = %+v, %v", stats, err)
+	}
+}
+
+func TestHttpClientUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	_, err := NewHttpRedirectClient(url, http.DefaultClient).Resolve(context.Background(), "req-1", "", "abc")
+	var serviceError *shared.ServiceError
+	if !errors.Is(err, shared.ErrBackendUnavailable) || errors.As(err, &serviceError) {
+		t.Errorf("Resolve() error = %v, want ErrBackendUnavailable", err)
+	}
+	if shared.ServiceErrorStatus(err) != 503 {
+		t.Errorf("ServiceErrorStatus() = %d, want 503", shared.ServiceErrorStatus(err))
+	}
+}
+
+func TestGuardRetriesIdempotentCalls(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(503)
+			return
+		}
+		json.NewEncoder(w).Encode(shared.LinkResponse{Code: "abc"})
+	}))
+	defer server.Close()
+
+	guard := testGuard(3, 10)
+	var retries int32
+	guard.OnRetry = func(upstream string, attempt int, err error) {
+		atomic.AddInt32(&retries, 1)
+	}
+	mapper := GuardMapperClient(NewHttpMapperClient(server.URL, server.Client()), guard)
+
+	link, err := mapper.GetLink(context.Background(), LinkRef{Code: "abc"})
+	if err != nil || link.Code != "abc" || calls != 3 || retries != 2 {
+		t.Errorf("GetLink() = %+v, %v after %d calls and %d retries", link, err, calls, retries)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	_, err = mapper.Map(context.Background(), shared.MapUrlRequest{Url: "https://example.com"})
+	if shared.ServiceErrorStatus(err) != 503 || calls != 1 {
+		t.Errorf("Map() error = %v after %d calls, want a single call", err, calls)
+	}
+}
+
+func TestGuardDoesNotRetryRejectedRequests(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(404)
+		w.Write([]byte(`{"error":"Not found"}`))
+	}))
+	defer server.Close()
+
+	guard := testGuard(3, 1)
+	mapper := GuardMapperClient(NewHttpMapperClient(server.URL, server.Client()), guard)
+	_, err := mapper.GetLink(context.Background(), LinkRef{Code: "abc"})
+	if shared.ServiceErrorStatus(err) != 404 || calls != 1 || guard.Breaker.State() != BreakerClosed {
+		t.Errorf("GetLink() error = %v after %d calls, breaker %v", err, calls, guard.Breaker.State())
+	}
+}
+
+func TestGuardAppliesTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+
+	guard := testGuard(1, 10)
+	guard.Policy.Timeout = 20 * time.Millisecond
+	redirect := GuardRedirectClient(NewHttpRedirectClient(server.URL, server.Client()), guard)
+
+	start := time.Now()
+	_, err := redirect.Resolve(context.Background(), "req-1", "", "abc")
+	if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Resolve() error = %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Resolve() took %v, the timeout was not applied", elapsed)
+	}
+}
+
+func TestGuardAppliesBatchTimeoutToBatches(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		json.NewEncoder(w).Encode(shared.MapBatchResponse{Id: "req-1"})
+	}))
+	defer server.Close()
+
+	guard := testGuard(1, 10)
+	guard.Policy.Timeout = 20 * time.Millisecond
+	mapper := GuardMapperClient(NewHttpMapperClient(server.URL, server.Client()), guard)
+
+	response, err := mapper.MapBatch(context.Background(), shared.MapBatchRequest{Id: "req-1"})
+	if err != nil || response.Id != "req-1" {
+		t.Errorf("MapBatch() = %+v, %v, want the batch deadline", response, err)
+	}
+	_, err = mapper.Map(context.Background(), shared.MapUrlRequest{Url: "https://example.com"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Map() error = %v, want a deadline error", err)
+	}
+}
+
+func TestCircuitBreakerOpensAndProbes(t *testing.T) {
+	var healthy int32
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(500)
+			return
+		}
+		json.NewEncoder(w).Encode(shared.RedirectResponse{Code: "abc", OriginalUrl: "https://example.com"})
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	guard := testGuard(1, 2)
+	guard.Breaker.OpenTimeout = 10 * time.Second
+	guard.Breaker.now = func() time.Time { return now }
+	var states []BreakerState
+	guard.Breaker.OnStateChange = func(name string, state BreakerState) {
+		states = append(states, state)
+	}
+	redirect := GuardRedirectClient(NewHttpRedirectClient(server.URL, server.Client()), guard)
+
+	for i := 0; i < 2; i++ {
+		redirect.Resolve(context.Background(), "req", "", "abc")
+	}
+	if guard.Breaker.State() != BreakerOpen {
+		t.Fatalf("breaker = %v after 2 failures, want open", guard.Breaker.State())
+	}
+
+	_, err := redirect.Resolve(context.Background(), "req", "", "abc")
+	if err != ErrCircuitOpen || calls != 2 {
+		t.Errorf("Resolve() error = %v after %d calls, want ErrCircuitOpen without calling", err, calls)
+	}
+
+	// The probe fails and the breaker opens again
+	now = now.Add(11 * time.Second)
+	redirect.Resolve(context.Background(), "req", "", "abc")
+	if guard.Breaker.State() != BreakerOpen || calls != 3 {
+		t.Errorf("breaker = %v after a failed probe (%d calls), want open", guard.Breaker.State(), calls)
+	}
+
+	// Only one probe at a time once half-open
+	now = now.Add(11 * time.Second)
+	generation, err := guard.Breaker.Allow()
+	if err != nil {
+		t.Fatalf("Allow() error = %v, want the probe", err)
+	}
+	if _, err := guard.Breaker.Allow(); err != ErrCircuitOpen {
+		t.Errorf("Allow() error = %v during the probe, want ErrCircuitOpen", err)
+	}
+	guard.Breaker.Abandon(generation)
+
+	atomic.StoreInt32(&healthy, 1)
+	response, err := redirect.Resolve(context.Background(), "req", "", "abc")
+	if err != nil || response.OriginalUrl != "https://example.com" || guard.Breaker.State() != BreakerClosed {
+		t.Errorf("Resolve() = %+v, %v, breaker %v, want closed after the probe", response, err, guard.Breaker.State())
+	}
+
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if len(states) != len(want) {
+		t.Fatalf("states = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Errorf("states = %v, want %v", states, want)
+			break
+		}
+	}
+}
+
+func TestGuardCancelledCallerDoesNotTripBreaker(t *testing.T) {
+	guard := testGuard(3, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := guard.Call(ctx, true, func(ctx context.Context) error {
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) || guard.Breaker.State() != BreakerClosed {
+		t.Errorf("Call() error = %v, breaker %v, want closed", err, guard.Breaker.State())
+	}
+}
+
+func TestCircuitBreakerIgnoresCallsOfEarlierGenerations(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker("test", 1, 10*time.Second)
+	breaker.now = func() time.Time { return now }
+
+	// A slow call is let through while closed, another one opens the breaker
+	slow, _ := breaker.Allow()
+	failing, _ := breaker.Allow()
+	breaker.Record(failing, true)
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("breaker = %v, want open", breaker.State())
+	}
+
+	// The slow call succeeds while open: the breaker stays open
+	breaker.Record(slow, false)
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("breaker = %v after a late success, want open", breaker.State())
+	}
+
+	// It fails once half-open: neither the probe nor the opening time is touched
+	now = now.Add(11 * time.Second)
+	probe, err := breaker.Allow()
+	if err != nil {
+		t.Fatalf("Allow() error = %v, want the probe", err)
+	}
+	breaker.Record(slow, true)
+	breaker.Abandon(slow)
+	if _, err := breaker.Allow(); err != ErrCircuitOpen {
+		t.Errorf("Allow() error = %v after a late call, want ErrCircuitOpen during the probe", err)
+	}
+	if breaker.State() != BreakerHalfOpen {
+		t.Errorf("breaker = %v after a late failure, want half-open", breaker.State())
+	}
+
+	breaker.Record(probe, false)
+	if breaker.State() != BreakerClosed {
+		t.Errorf("breaker = %v after the probe, want closed", breaker.State())
+	}
+}
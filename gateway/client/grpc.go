@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/HungTP-Play/lru/shared/pb"
+	"google.golang.org/grpc"
+)
+
+func linkRefToProto(link LinkRef) *pb.LinkRef {
+	return &pb.LinkRef{
+		Id:      link.RequestId,
+		Domain:  link.Domain,
+		Code:    link.Code,
+		OwnerId: link.OwnerId,
+	}
+}
+
+type grpcMapperClient struct {
+	// Calls the gRPC API has no method for: shortening in bulk, API keys and workspaces
+	MapperClient
+	conn   *grpc.ClientConn
+	client pb.MapperServiceClient
+}
+
+// MapperClient calling the gRPC API of the mapper at target (host:port), and fallback
+// for the calls the gRPC API does not offer
+func NewGrpcMapperClient(target string, fallback MapperClient) (MapperClient, error) {
+	conn, err := shared.DialGrpc(target)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcMapperClient{
+		MapperClient: fallback,
+		conn:         conn,
+		client:       pb.NewMapperServiceClient(conn),
+	}, nil
+}
+
+func (m *grpcMapperClient) Map(ctx context.Context, request shared.MapUrlRequest) (shared.MapUrlResponse, error) {
+	response, err := m.client.Map(ctx, shared.MapUrlRequestToProto(request))
+	if err != nil {
+		return shared.MapUrlResponse{}, shared.ServiceErrorFromGrpc(err)
+	}
+	return shared.MapUrlResponseFromProto(response), nil
+}
+
+func (m *grpcMapperClient) GetLink(ctx context.Context, link LinkRef) (shared.LinkResponse, error) {
+	response, err := m.client.GetLink(ctx, linkRefToProto(link))
+	if err != nil {
+		return shared.LinkResponse{}, shared.ServiceErrorFromGrpc(err)
+	}
+	return shared.LinkResponseFromProto(response), nil
+}
+
+func (m *grpcMapperClient) UpdateLink(ctx context.Context, link LinkRef, request shared.UpdateLinkRequest) (shared.LinkResponse, error) {
+	request.Id = link.RequestId
+	request.Domain = link.Domain
+	request.OwnerId = link.OwnerId
+	response, err := m.client.UpdateLink(ctx, shared.UpdateLinkRequestToProto(link.Code, request))
+	if err != nil {
+		return shared.LinkResponse{}, shared.ServiceErrorFromGrpc(err)
+	}
+	return shared.LinkResponseFromProto(response), nil
+}
+
+func (m *grpcMapperClient) DeleteLink(ctx context.Context, link LinkRef) error {
+	_, err := m.client.DeleteLink(ctx, linkRefToProto(link))
+	if err != nil {
+		return shared.ServiceErrorFromGrpc(err)
+	}
+	return nil
+}
+
+func (m *grpcMapperClient) Close() error {
+	m.MapperClient.Close()
+	return m.conn.Close()
+}
+
+type grpcRedirectClient struct {
+	conn   *grpc.ClientConn
+	client pb.RedirectServiceClient
+}
+
+// RedirectClient calling the gRPC API of the redirect service at target (host:port)
+func NewGrpcRedirectClient(target string) (RedirectClient, error) {
+	conn, err := shared.DialGrpc(target)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcRedirectClient{
+		conn:   conn,
+		client: pb.NewRedirectServiceClient(conn),
+	}, nil
+}
+
+func (r *grpcRedirectClient) Resolve(ctx context.Context, requestId string, domain string, code string) (shared.RedirectResponse, error) {
+	response, err := r.client.Resolve(ctx, &pb.ResolveRequest{Id: requestId, Domain: domain, Code: code})
+	if err != nil {
+		return shared.RedirectResponse{}, shared.ServiceErrorFromGrpc(err)
+	}
+	return shared.RedirectResponseFromProto(response), nil
+}
+
+func (r *grpcRedirectClient) Redirect(ctx context.Context, request shared.RedirectRequest) (shared.RedirectResponse, error) {
+	response, err := r.client.Redirect(ctx, &pb.RedirectRequest{Id: request.Id, Url: request.Url})
+	if err != nil {
+		return shared.RedirectResponse{}, shared.ServiceErrorFromGrpc(err)
+	}
+	return shared.RedirectResponseFromProto(response), nil
+}
+
+func (r *grpcRedirectClient) Close() error {
+	return r.conn.Close()
+}
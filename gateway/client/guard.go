@@ -0,0 +1,376 @@
+package client
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+// Deadline and retries of the calls to an upstream
+type CallPolicy struct {
+	// Deadline of each attempt, within the deadline of the caller
+	Timeout time.Duration
+	// Deadline of the calls carrying a whole batch
+	BatchTimeout time.Duration
+	// Attempts of the idempotent calls and the backoff between them
+	Retry shared.RetryPolicy
+}
+
+func DefaultCallPolicy() CallPolicy {
+	return CallPolicy{
+		Timeout:      2 * time.Second,
+		BatchTimeout: 30 * time.Second,
+		Retry: shared.RetryPolicy{
+			MaxAttempts:  3,
+			InitialDelay: 50 * time.Millisecond,
+			MaxDelay:     time.Second,
+		},
+	}
+}
+
+// Read the policy of an upstream from <PREFIX>_TIMEOUT, <PREFIX>_BATCH_TIMEOUT,
+// <PREFIX>_RETRY_MAX_ATTEMPTS, <PREFIX>_RETRY_INITIAL_DELAY and <PREFIX>_RETRY_MAX_DELAY,
+// e.g. MAPPER_TIMEOUT
+func CallPolicyFromEnv(prefix string) CallPolicy {
+	policy := DefaultCallPolicy()
+	prefix = strings.ToUpper(prefix) + "_"
+	policy.Timeout = shared.GetEnvDuration(prefix+"TIMEOUT", policy.Timeout)
+	policy.BatchTimeout = shared.GetEnvDuration(prefix+"BATCH_TIMEOUT", policy.BatchTimeout)
+	policy.Retry.MaxAttempts = shared.GetEnvInt(prefix+"RETRY_MAX_ATTEMPTS", policy.Retry.MaxAttempts)
+	policy.Retry.InitialDelay = shared.GetEnvDuration(prefix+"RETRY_INITIAL_DELAY", policy.Retry.InitialDelay)
+	policy.Retry.MaxDelay = shared.GetEnvDuration(prefix+"RETRY_MAX_DELAY", policy.Retry.MaxDelay)
+	if policy.Retry.MaxAttempts < 1 {
+		policy.Retry.MaxAttempts = 1
+	}
+	return policy
+}
+
+// Read the breaker of an upstream from <PREFIX>_BREAKER_FAILURES (default 5) and
+// <PREFIX>_BREAKER_OPEN_TIMEOUT (default 10s)
+func CircuitBreakerFromEnv(name string) *CircuitBreaker {
+	prefix := strings.ToUpper(name) + "_BREAKER_"
+	return NewCircuitBreaker(
+		name,
+		shared.GetEnvInt(prefix+"FAILURES", 5),
+		shared.GetEnvDuration(prefix+"OPEN_TIMEOUT", 10*time.Second),
+	)
+}
+
+// Protect the calls to an upstream with a deadline, retries and a circuit breaker
+type Guard struct {
+	Upstream string
+	Policy   CallPolicy
+	Breaker  *CircuitBreaker
+	// Called before each retry with the failure of the previous attempt
+	OnRetry func(upstream string, attempt int, err error)
+
+	randMutex sync.Mutex
+	rand      *rand.Rand
+}
+
+func NewGuard(upstream string, policy CallPolicy, breaker *CircuitBreaker) *Guard {
+	return &Guard{
+		Upstream: upstream,
+		Policy:   policy,
+		Breaker:  breaker,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Guard of the upstream configured from the environment, see CallPolicyFromEnv and
+// CircuitBreakerFromEnv
+func GuardFromEnv(upstream string) *Guard {
+	return NewGuard(upstream, CallPolicyFromEnv(upstream), CircuitBreakerFromEnv(upstream))
+}
+
+// The upstream failed to answer, as opposed to rejecting the request
+func isUpstreamFailure(err error) bool {
+	return err != nil && shared.ServiceErrorStatus(err) >= 500
+}
+
+// Run call with a deadline. Idempotent calls are retried after a jittered backoff
+// while the upstream fails, the others are sent once since the upstream may have
+// applied them before failing.
+func (g *Guard) Call(ctx context.Context, idempotent bool, call func(ctx context.Context) error) error {
+	return g.call(ctx, g.Policy.Timeout, idempotent, call)
+}
+
+// Same as Call with the deadline of the batch calls
+func (g *Guard) CallBatch(ctx context.Context, idempotent bool, call func(ctx context.Context) error) error {
+	return g.call(ctx, g.Policy.BatchTimeout, idempotent, call)
+}
+
+func (g *Guard) call(ctx context.Context, timeout time.Duration, idempotent bool, call func(ctx context.Context) error) error {
+	attempts := 1
+	if idempotent {
+		attempts = g.Policy.Retry.MaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		generation, err := g.Breaker.Allow()
+		if err != nil {
+			return err
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = call(attemptCtx)
+		cancel()
+
+		// The caller gave up, the upstream is not to blame
+		if ctx.Err() != nil {
+			g.Breaker.Abandon(generation)
+			return err
+		}
+
+		failed := isUpstreamFailure(err)
+		g.Breaker.Record(generation, failed)
+		if !failed || attempt >= attempts {
+			return err
+		}
+
+		if g.OnRetry != nil {
+			g.OnRetry(g.Upstream, attempt, err)
+		}
+
+		timer := time.NewTimer(g.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Random wait up to the exponential delay of the attempt (full jitter), so the
+// retries of concurrent requests do not hit a recovering upstream at once
+func (g *Guard) backoff(attempt int) time.Duration {
+	delay := g.Policy.Retry.Delay(attempt)
+	if delay <= 0 {
+		return 0
+	}
+	g.randMutex.Lock()
+	defer g.randMutex.Unlock()
+	return time.Duration(g.rand.Int63n(int64(delay) + 1))
+}
+
+type guardedMapperClient struct {
+	client MapperClient
+	guard  *Guard
+}
+
+// MapperClient calling client through the guard. Reading and updating a link, and the
+// other reads, are retried. Map, MapBatch and the calls creating something are sent
+// once since a retry may create it twice, and so are the deletions since a retry
+// answers 404 when the first attempt went through.
+func GuardMapperClient(client MapperClient, guard *Guard) MapperClient {
+	return &guardedMapperClient{
+		client: client,
+		guard:  guard,
+	}
+}
+
+func (m *guardedMapperClient) Map(ctx context.Context, request shared.MapUrlRequest) (shared.MapUrlResponse, error) {
+	var response shared.MapUrlResponse
+	err := m.guard.Call(ctx, false, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.Map(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) MapBatch(ctx context.Context, request shared.MapBatchRequest) (shared.MapBatchResponse, error) {
+	var response shared.MapBatchResponse
+	err := m.guard.CallBatch(ctx, false, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.MapBatch(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) GetLink(ctx context.Context, link LinkRef) (shared.LinkResponse, error) {
+	var response shared.LinkResponse
+	err := m.guard.Call(ctx, true, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.GetLink(ctx, link)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) UpdateLink(ctx context.Context, link LinkRef, request shared.UpdateLinkRequest) (shared.LinkResponse, error) {
+	var response shared.LinkResponse
+	err := m.guard.Call(ctx, true, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.UpdateLink(ctx, link, request)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) DeleteLink(ctx context.Context, link LinkRef) error {
+	return m.guard.Call(ctx, false, func(ctx context.Context) error {
+		return m.client.DeleteLink(ctx, link)
+	})
+}
+
+func (m *guardedMapperClient) VerifyApiKey(ctx context.Context, requestId string, keyHash string) (shared.ApiKeyResponse, error) {
+	var response shared.ApiKeyResponse
+	err := m.guard.Call(ctx, true, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.VerifyApiKey(ctx, requestId, keyHash)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) IssueApiKey(ctx context.Context, request shared.IssueApiKeyRequest) (shared.ApiKeyResponse, error) {
+	var response shared.ApiKeyResponse
+	err := m.guard.Call(ctx, false, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.IssueApiKey(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) ListApiKeys(ctx context.Context, requestId string, ownerId string) ([]shared.ApiKeyResponse, error) {
+	var response []shared.ApiKeyResponse
+	err := m.guard.Call(ctx, true, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.ListApiKeys(ctx, requestId, ownerId)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) RevokeApiKey(ctx context.Context, requestId string, ownerId string, id int64) (shared.ApiKeyResponse, error) {
+	var response shared.ApiKeyResponse
+	err := m.guard.Call(ctx, false, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.RevokeApiKey(ctx, requestId, ownerId, id)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) CreateWorkspace(ctx context.Context, request shared.WorkspaceRequest) (shared.WorkspaceResponse, error) {
+	var response shared.WorkspaceResponse
+	err := m.guard.Call(ctx, false, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.CreateWorkspace(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) ListWorkspaces(ctx context.Context, requestId string, ownerId string) ([]shared.WorkspaceResponse, error) {
+	var response []shared.WorkspaceResponse
+	err := m.guard.Call(ctx, true, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.ListWorkspaces(ctx, requestId, ownerId)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) AddDomain(ctx context.Context, workspaceId int64, request shared.DomainRequest) (shared.WorkspaceResponse, error) {
+	var response shared.WorkspaceResponse
+	err := m.guard.Call(ctx, false, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.AddDomain(ctx, workspaceId, request)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) RemoveDomain(ctx context.Context, requestId string, ownerId string, workspaceId int64, host string) error {
+	return m.guard.Call(ctx, false, func(ctx context.Context) error {
+		return m.client.RemoveDomain(ctx, requestId, ownerId, workspaceId, host)
+	})
+}
+
+func (m *guardedMapperClient) GetDomain(ctx context.Context, requestId string, host string) (shared.DomainResponse, error) {
+	var response shared.DomainResponse
+	err := m.guard.Call(ctx, true, func(ctx context.Context) error {
+		var err error
+		response, err = m.client.GetDomain(ctx, requestId, host)
+		return err
+	})
+	return response, err
+}
+
+func (m *guardedMapperClient) Close() error {
+	return m.client.Close()
+}
+
+type guardedRedirectClient struct {
+	client RedirectClient
+	guard  *Guard
+}
+
+// RedirectClient calling client through the guard. Resolving a link counts a click
+// for the click-limited ones, so no call is retried.
+func GuardRedirectClient(client RedirectClient, guard *Guard) RedirectClient {
+	return &guardedRedirectClient{
+		client: client,
+		guard:  guard,
+	}
+}
+
+func (r *guardedRedirectClient) Resolve(ctx context.Context, requestId string, domain string, code string) (shared.RedirectResponse, error) {
+	var response shared.RedirectResponse
+	err := r.guard.Call(ctx, false, func(ctx context.Context) error {
+		var err error
+		response, err = r.client.Resolve(ctx, requestId, domain, code)
+		return err
+	})
+	return response, err
+}
+
+func (r *guardedRedirectClient) Redirect(ctx context.Context, request shared.RedirectRequest) (shared.RedirectResponse, error) {
+	var response shared.RedirectResponse
+	err := r.guard.Call(ctx, false, func(ctx context.Context) error {
+		var err error
+		response, err = r.client.Redirect(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (r *guardedRedirectClient) Close() error {
+	return r.client.Close()
+}
+
+type guardedAnalyticClient struct {
+	client AnalyticClient
+	guard  *Guard
+}
+
+// AnalyticClient calling client through the guard, its reads are retried
+func GuardAnalyticClient(client AnalyticClient, guard *Guard) AnalyticClient {
+	return &guardedAnalyticClient{
+		client: client,
+		guard:  guard,
+	}
+}
+
+func (a *guardedAnalyticClient) Stats(ctx context.Context, request StatsRequest) ([]shared.LinkStats, error) {
+	var response []shared.LinkStats
+	err := a.guard.Call(ctx, true, func(ctx context.Context) error {
+		var err error
+		response, err = a.client.Stats(ctx, request)
+		return err
+	})
+	return response, err
+}
+
+func (a *guardedAnalyticClient) Close() error {
+	return a.client.Close()
+}
@@ -0,0 +1,250 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+// Send the request to the service and decode its answer into out (ignored when nil).
+// An answer with a status >= 400 is returned as a *shared.ServiceError, a service that
+// cannot be reached as shared.ErrBackendUnavailable.
+func doJson(ctx context.Context, httpClient *http.Client, method string, serviceUrl string, headers map[string]string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewBuffer(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, serviceUrl, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		if value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	shared.InjectPropagationHeader(ctx, req)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return shared.BackendError(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return shared.BackendError(err)
+	}
+
+	if resp.StatusCode >= 400 {
+		var errorBody struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(respBody, &errorBody)
+		if errorBody.Error == "" {
+			errorBody.Error = http.StatusText(resp.StatusCode)
+		}
+		return shared.NewServiceError(resp.StatusCode, errorBody.Error)
+	}
+
+	if out == nil || resp.StatusCode == 204 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// Url of the link on the service, with its domain when it lives on a custom one
+func linkUrl(baseUrl string, path string, domain string, code string) string {
+	linkUrl := fmt.Sprintf("%v/%v/%v", baseUrl, path, url.PathEscape(code))
+	if domain != "" {
+		linkUrl += "?domain=" + url.QueryEscape(domain)
+	}
+	return linkUrl
+}
+
+// Headers of a call made on behalf of the owner, empty for an admin
+func ownerHeaders(requestId string, ownerId string) map[string]string {
+	return map[string]string{
+		"X-Request-Id": requestId,
+		"X-Owner-Id":   ownerId,
+	}
+}
+
+func linkHeaders(link LinkRef) map[string]string {
+	return ownerHeaders(link.RequestId, link.OwnerId)
+}
+
+type httpMapperClient struct {
+	baseUrl    string
+	httpClient *http.Client
+}
+
+// MapperClient calling the HTTP API of the mapper at baseUrl
+func NewHttpMapperClient(baseUrl string, httpClient *http.Client) MapperClient {
+	return &httpMapperClient{
+		baseUrl:    baseUrl,
+		httpClient: httpClient,
+	}
+}
+
+func (m *httpMapperClient) Map(ctx context.Context, request shared.MapUrlRequest) (shared.MapUrlResponse, error) {
+	var response shared.MapUrlResponse
+	err := doJson(ctx, m.httpClient, "POST", fmt.Sprintf("%v/map", m.baseUrl), nil, request, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) MapBatch(ctx context.Context, request shared.MapBatchRequest) (shared.MapBatchResponse, error) {
+	var response shared.MapBatchResponse
+	err := doJson(ctx, m.httpClient, "POST", fmt.Sprintf("%v/map/batch", m.baseUrl), ownerHeaders(request.Id, ""), request, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) GetLink(ctx context.Context, link LinkRef) (shared.LinkResponse, error) {
+	var response shared.LinkResponse
+	err := doJson(ctx, m.httpClient, "GET", linkUrl(m.baseUrl, "links", link.Domain, link.Code), linkHeaders(link), nil, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) UpdateLink(ctx context.Context, link LinkRef, request shared.UpdateLinkRequest) (shared.LinkResponse, error) {
+	var response shared.LinkResponse
+	err := doJson(ctx, m.httpClient, "PATCH", linkUrl(m.baseUrl, "links", link.Domain, link.Code), linkHeaders(link), request, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) DeleteLink(ctx context.Context, link LinkRef) error {
+	return doJson(ctx, m.httpClient, "DELETE", linkUrl(m.baseUrl, "links", link.Domain, link.Code), linkHeaders(link), nil, nil)
+}
+
+func (m *httpMapperClient) VerifyApiKey(ctx context.Context, requestId string, keyHash string) (shared.ApiKeyResponse, error) {
+	var response shared.ApiKeyResponse
+	err := doJson(ctx, m.httpClient, "GET", fmt.Sprintf("%v/keys/verify/%v", m.baseUrl, url.PathEscape(keyHash)), ownerHeaders(requestId, ""), nil, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) IssueApiKey(ctx context.Context, request shared.IssueApiKeyRequest) (shared.ApiKeyResponse, error) {
+	var response shared.ApiKeyResponse
+	err := doJson(ctx, m.httpClient, "POST", fmt.Sprintf("%v/keys", m.baseUrl), ownerHeaders(request.Id, ""), request, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) ListApiKeys(ctx context.Context, requestId string, ownerId string) ([]shared.ApiKeyResponse, error) {
+	var response []shared.ApiKeyResponse
+	err := doJson(ctx, m.httpClient, "GET", fmt.Sprintf("%v/keys", m.baseUrl), ownerHeaders(requestId, ownerId), nil, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) RevokeApiKey(ctx context.Context, requestId string, ownerId string, id int64) (shared.ApiKeyResponse, error) {
+	var response shared.ApiKeyResponse
+	err := doJson(ctx, m.httpClient, "DELETE", fmt.Sprintf("%v/keys/%d", m.baseUrl, id), ownerHeaders(requestId, ownerId), nil, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) CreateWorkspace(ctx context.Context, request shared.WorkspaceRequest) (shared.WorkspaceResponse, error) {
+	var response shared.WorkspaceResponse
+	err := doJson(ctx, m.httpClient, "POST", fmt.Sprintf("%v/workspaces", m.baseUrl), ownerHeaders(request.Id, ""), request, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) ListWorkspaces(ctx context.Context, requestId string, ownerId string) ([]shared.WorkspaceResponse, error) {
+	var response []shared.WorkspaceResponse
+	err := doJson(ctx, m.httpClient, "GET", fmt.Sprintf("%v/workspaces", m.baseUrl), ownerHeaders(requestId, ownerId), nil, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) AddDomain(ctx context.Context, workspaceId int64, request shared.DomainRequest) (shared.WorkspaceResponse, error) {
+	var response shared.WorkspaceResponse
+	err := doJson(ctx, m.httpClient, "POST", fmt.Sprintf("%v/workspaces/%d/domains", m.baseUrl, workspaceId), ownerHeaders(request.Id, request.OwnerId), request, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) RemoveDomain(ctx context.Context, requestId string, ownerId string, workspaceId int64, host string) error {
+	removeUrl := fmt.Sprintf("%v/workspaces/%d/domains/%v", m.baseUrl, workspaceId, url.PathEscape(host))
+	return doJson(ctx, m.httpClient, "DELETE", removeUrl, ownerHeaders(requestId, ownerId), nil, nil)
+}
+
+func (m *httpMapperClient) GetDomain(ctx context.Context, requestId string, host string) (shared.DomainResponse, error) {
+	var response shared.DomainResponse
+	err := doJson(ctx, m.httpClient, "GET", fmt.Sprintf("%v/domains/%v", m.baseUrl, url.PathEscape(host)), ownerHeaders(requestId, ""), nil, &response)
+	return response, err
+}
+
+func (m *httpMapperClient) Close() error {
+	m.httpClient.CloseIdleConnections()
+	return nil
+}
+
+type httpRedirectClient struct {
+	baseUrl    string
+	httpClient *http.Client
+}
+
+// RedirectClient calling the HTTP API of the redirect service at baseUrl
+func NewHttpRedirectClient(baseUrl string, httpClient *http.Client) RedirectClient {
+	return &httpRedirectClient{
+		baseUrl:    baseUrl,
+		httpClient: httpClient,
+	}
+}
+
+func (r *httpRedirectClient) Resolve(ctx context.Context, requestId string, domain string, code string) (shared.RedirectResponse, error) {
+	var response shared.RedirectResponse
+	headers := map[string]string{"X-Request-Id": requestId}
+	err := doJson(ctx, r.httpClient, "GET", linkUrl(r.baseUrl, "resolve", domain, code), headers, nil, &response)
+	return response, err
+}
+
+func (r *httpRedirectClient) Redirect(ctx context.Context, request shared.RedirectRequest) (shared.RedirectResponse, error) {
+	var response shared.RedirectResponse
+	err := doJson(ctx, r.httpClient, "GET", fmt.Sprintf("%v/redirect", r.baseUrl), nil, request, &response)
+	return response, err
+}
+
+func (r *httpRedirectClient) Close() error {
+	r.httpClient.CloseIdleConnections()
+	return nil
+}
+
+type httpAnalyticClient struct {
+	baseUrl    string
+	httpClient *http.Client
+}
+
+// AnalyticClient calling the HTTP API of the analytic service at baseUrl
+func NewHttpAnalyticClient(baseUrl string, httpClient *http.Client) AnalyticClient {
+	return &httpAnalyticClient{
+		baseUrl:    baseUrl,
+		httpClient: httpClient,
+	}
+}
+
+func (a *httpAnalyticClient) Stats(ctx context.Context, request StatsRequest) ([]shared.LinkStats, error) {
+	query := url.Values{}
+	if request.ShortUrl != "" {
+		query.Set("shortUrl", request.ShortUrl)
+	}
+	if request.Limit > 0 {
+		query.Set("limit", strconv.Itoa(request.Limit))
+	}
+
+	var response []shared.LinkStats
+	err := doJson(ctx, a.httpClient, "GET", fmt.Sprintf("%v/stats?%v", a.baseUrl, query.Encode()), ownerHeaders(request.RequestId, request.OwnerId), nil, &response)
+	return response, err
+}
+
+func (a *httpAnalyticClient) Close() error {
+	a.httpClient.CloseIdleConnections()
+	return nil
+}
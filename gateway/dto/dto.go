@@ -1,7 +1,15 @@
 package dto
 
+import "time"
+
 type ShortenRequestDto struct {
-	Url string `json:"url"`
+	Url          string     `json:"url"`
+	Alias        string     `json:"alias"`
+	RedirectType int        `json:"redirectType"`
+	ExpiresAt    *time.Time `json:"expiresAt"` // RFC 3339, e.g. 2023-12-31T23:59:59Z
+	MaxClicks    int64      `json:"maxClicks"`
+	Dedup        *bool      `json:"dedup"`  // Return the existing link of the same url instead of a new one
+	Domain       string     `json:"domain"` // Custom domain of a workspace of the caller, e.g. "go.acme.com"
 }
 
 type ShortenResponseDto struct {
@@ -13,3 +21,12 @@ type RedirectResponseDto struct {
 	Url         string `json:"url"`
 	OriginalUrl string `json:"originalUrl"`
 }
+
+// Partial update of a short link, omitted fields are left untouched
+type UpdateLinkRequestDto struct {
+	Url          *string    `json:"url"`
+	RedirectType *int       `json:"redirectType"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	MaxClicks    *int64     `json:"maxClicks"`
+	Disabled     *bool      `json:"disabled"`
+}
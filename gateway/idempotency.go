@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/HungTP-Play/lru/gateway/client"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+const idempotencyPending = "pending"
+
+var idempotencyKeyTTL = 24 * time.Hour
+
+// The key is reserved a little longer than the slowest upstream call of a request,
+// so a gateway dying before it stored the response does not keep the key locked
+//
+// - IDEMPOTENCY_PENDING_TTL: time the key is reserved (default the longest of
+// MAPPER_TIMEOUT and MAPPER_BATCH_TIMEOUT, plus 5s)
+var idempotencyPendingTTL = shared.GetEnvDuration("IDEMPOTENCY_PENDING_TTL", defaultIdempotencyPendingTTL())
+
+func defaultIdempotencyPendingTTL() time.Duration {
+	policy := client.CallPolicyFromEnv("mapper")
+	deadline := policy.Timeout
+	if deadline < policy.BatchTimeout {
+		deadline = policy.BatchTimeout
+	}
+	return deadline + 5*time.Second
+}
+
+// Response stored under an Idempotency-Key, replayed to retries of the same request
+type idempotentResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+// Keys are scoped to the owner of the API key, two callers can use the same key
+func idempotencyCacheKey(c *fiber.Ctx, key string) string {
+	return "idempotency:" + callerOwnerId(c) + ":" + key
+}
+
+// Hash of the request, a key reused for a different request is rejected
+func requestFingerprint(c *fiber.Ctx) string {
+	hash := sha256.New()
+	hash.Write([]byte(c.Method()))
+	hash.Write([]byte(c.Path()))
+	hash.Write(c.Body())
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// IdempotencyMiddleware makes POST requests carrying an Idempotency-Key header safe to retry.
+//
+// The first request reserves the key, runs, and stores its response for 24 hours.
+// Retries with the same key get the stored response back (with Idempotent-Replayed: true),
+// or a 409 while the first request is still running. Server errors release the key so
+// the request can be tried again, and so does the end of the reservation when the gateway
+// died before storing the response. When Redis is unavailable requests go through as is.
+func IdempotencyMiddleware(c *fiber.Ctx) error {
+	key := c.Get("Idempotency-Key")
+	if key == "" || c.Method() != fiber.MethodPost {
+		return c.Next()
+	}
+
+	if len(key) > 255 {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Idempotency-Key must be at most 255 characters",
+		})
+	}
+
+	cacheKey := idempotencyCacheKey(c, key)
+	fingerprint := requestFingerprint(c)
+
+	reserved, err := cacheClient.SetNX(cacheKey, idempotencyPending, idempotencyPendingTTL)
+	if err != nil {
+		logger.Error("CannotReserveIdempotencyKey", zap.String("key", key), zap.Error(err))
+		return c.Next()
+	}
+
+	if !reserved {
+		return replayIdempotentResponse(c, key, fingerprint)
+	}
+
+	err = c.Next()
+	status := c.Response().StatusCode()
+	if err != nil || status >= 500 {
+		delErr := cacheClient.Del(cacheKey)
+		if delErr != nil {
+			logger.Error("CannotReleaseIdempotencyKey", zap.String("key", key), zap.Error(delErr))
+		}
+		return err
+	}
+
+	stored, _ := json.Marshal(idempotentResponse{
+		Fingerprint: fingerprint,
+		Status:      status,
+		ContentType: string(c.Response().Header.ContentType()),
+		Body:        c.Response().Body(),
+	})
+	err = cacheClient.Set(cacheKey, string(stored), idempotencyKeyTTL)
+	if err != nil {
+		logger.Error("CannotStoreIdempotentResponse", zap.String("key", key), zap.Error(err))
+	}
+
+	return nil
+}
+
+func replayIdempotentResponse(c *fiber.Ctx, key string, fingerprint string) error {
+	value, err := cacheClient.Get(idempotencyCacheKey(c, key))
+	if err != nil {
+		logger.Error("CannotGetIdempotentResponse", zap.String("key", key), zap.Error(err))
+		return c.Status(409).JSON(map[string]interface{}{
+			"error": "A request with this Idempotency-Key is being processed",
+		})
+	}
+
+	if value == idempotencyPending {
+		return c.Status(409).JSON(map[string]interface{}{
+			"error": "A request with this Idempotency-Key is being processed",
+		})
+	}
+
+	var stored idempotentResponse
+	err = json.Unmarshal([]byte(value), &stored)
+	if err != nil {
+		logger.Error("CannotDecodeIdempotentResponse", zap.String("key", key), zap.Error(err))
+		return c.Status(500).JSON(map[string]interface{}{
+			"error": "Internal server error",
+		})
+	}
+
+	if stored.Fingerprint != fingerprint {
+		return c.Status(422).JSON(map[string]interface{}{
+			"error": "Idempotency-Key was already used for a different request",
+		})
+	}
+
+	logger.Info("ReplayIdempotentResponse", zap.String("key", key), zap.Int("code", stored.Status))
+	c.Set("Idempotent-Replayed", "true")
+	c.Set(fiber.HeaderContentType, stored.ContentType)
+	return c.Status(stored.Status).Send(stored.Body)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+)
+
+// App answering POST /shorten behind IdempotencyMiddleware, with the cache on the Redis
+// server of REDIS_TEST_ADDR (host:port). The test is skipped when it is not set.
+func newIdempotencyTestApp(t *testing.T, handler fiber.Handler) *fiber.App {
+	addr := os.Getenv("REDIS_TEST_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_TEST_ADDR is not set")
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("Invalid REDIS_TEST_ADDR: %v", err)
+	}
+
+	cache := shared.NewCacheClient(&shared.CacheConfig{Host: host, Port: port})
+	err = cache.Connect()
+	if err != nil {
+		t.Fatalf("Cannot connect to test cache: %v", err)
+	}
+	previous := cacheClient
+	cacheClient = cache
+	t.Cleanup(func() {
+		cacheClient = previous
+		cache.Close()
+	})
+
+	app := fiber.New()
+	app.Use("/shorten", IdempotencyMiddleware)
+	app.Post("/shorten", handler)
+	return app
+}
+
+// Idempotency-Key of its own for each test run
+func testIdempotencyKey(t *testing.T) string {
+	return t.Name() + "-" + time.Now().Format(time.RFC3339Nano)
+}
+
+func sendIdempotent(t *testing.T, app *fiber.App, key string, body string) (int, string, string) {
+	req := httptest.NewRequest("POST", "/shorten", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("app.Test() error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(respBody), resp.Header.Get("Idempotent-Replayed")
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	var calls int32
+	app := newIdempotencyTestApp(t, func(c *fiber.Ctx) error {
+		atomic.AddInt32(&calls, 1)
+		return c.Status(201).JSON(map[string]interface{}{"calls": atomic.LoadInt32(&calls)})
+	})
+	key := testIdempotencyKey(t)
+
+	status, body, replayed := sendIdempotent(t, app, key, `{"url":"https://example.com"}`)
+	if status != 201 || body != `{"calls":1}` || replayed != "" {
+		t.Fatalf("first request = %d %s (replayed %q)", status, body, replayed)
+	}
+
+	status, body, replayed = sendIdempotent(t, app, key, `{"url":"https://example.com"}`)
+	if status != 201 || body != `{"calls":1}` || replayed != "true" || calls != 1 {
+		t.Fatalf("retry = %d %s (replayed %q) after %d calls, want the stored response", status, body, replayed, calls)
+	}
+}
+
+func TestIdempotencyRejectsDifferentRequest(t *testing.T) {
+	app := newIdempotencyTestApp(t, func(c *fiber.Ctx) error {
+		return c.Status(201).Send(c.Body())
+	})
+	key := testIdempotencyKey(t)
+
+	status, _, _ := sendIdempotent(t, app, key, `{"url":"https://example.com"}`)
+	if status != 201 {
+		t.Fatalf("first request = %d, want 201", status)
+	}
+	status, body, _ := sendIdempotent(t, app, key, `{"url":"https://example.org"}`)
+	if status != 422 {
+		t.Fatalf("request with another body = %d %s, want 422", status, body)
+	}
+}
+
+func TestIdempotencyRejectsRequestInFlight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app := newIdempotencyTestApp(t, func(c *fiber.Ctx) error {
+		close(started)
+		<-release
+		return c.Status(201).SendString("created")
+	})
+	key := testIdempotencyKey(t)
+
+	done := make(chan int)
+	go func() {
+		req := httptest.NewRequest("POST", "/shorten", strings.NewReader(`{}`))
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	<-started
+
+	// The key is reserved for the pending TTL while the first request runs
+	value, ttl, err := cacheClient.GetWithTTL("idempotency::" + key)
+	if err != nil || value != idempotencyPending || ttl <= 0 || ttl > idempotencyPendingTTL {
+		t.Errorf("GetWithTTL() = %q, %v, %v; want %q within %v", value, ttl, err, idempotencyPending, idempotencyPendingTTL)
+	}
+
+	status, body, _ := sendIdempotent(t, app, key, `{}`)
+	if status != 409 {
+		t.Errorf("concurrent request = %d %s, want 409", status, body)
+	}
+
+	close(release)
+	if status := <-done; status != 201 {
+		t.Fatalf("first request = %d, want 201", status)
+	}
+	status, body, replayed := sendIdempotent(t, app, key, `{}`)
+	if status != 201 || body != "created" || replayed != "true" {
+		t.Fatalf("retry = %d %s (replayed %q), want the stored response", status, body, replayed)
+	}
+}
+
+func TestIdempotencyReleasesKey(t *testing.T) {
+	var calls int32
+	app := newIdempotencyTestApp(t, func(c *fiber.Ctx) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return c.Status(503).SendString("unavailable")
+		}
+		return c.Status(201).SendString("created")
+	})
+
+	// A server error releases the key
+	key := testIdempotencyKey(t)
+	sendIdempotent(t, app, key, `{}`)
+	status, body, _ := sendIdempotent(t, app, key, `{}`)
+	if status != 201 || body != "created" || calls != 2 {
+		t.Fatalf("retry after a server error = %d %s after %d calls, want the request to run again", status, body, calls)
+	}
+
+	// So does the end of the reservation of a gateway that died before storing the response
+	previousTTL := idempotencyPendingTTL
+	idempotencyPendingTTL = 200 * time.Millisecond
+	t.Cleanup(func() {
+		idempotencyPendingTTL = previousTTL
+	})
+	key = testIdempotencyKey(t)
+	_, err := cacheClient.SetNX("idempotency::"+key, idempotencyPending, idempotencyPendingTTL)
+	if err != nil {
+		t.Fatalf("SetNX() error = %v", err)
+	}
+	status, _, _ = sendIdempotent(t, app, key, `{}`)
+	if status != 409 {
+		t.Fatalf("request while the key is reserved = %d, want 409", status)
+	}
+	time.Sleep(300 * time.Millisecond)
+	status, _, _ = sendIdempotent(t, app, key, `{}`)
+	if status != 201 || calls != 3 {
+		t.Fatalf("request after the reservation = %d after %d calls, want the request to run", status, calls)
+	}
+}
+
+func TestDefaultIdempotencyPendingTTL(t *testing.T) {
+	t.Setenv("MAPPER_TIMEOUT", "2s")
+	t.Setenv("MAPPER_BATCH_TIMEOUT", "45s")
+	if ttl := defaultIdempotencyPendingTTL(); ttl != 50*time.Second {
+		t.Errorf("defaultIdempotencyPendingTTL() = %v, want the batch deadline plus 5s", ttl)
+	}
+
+	t.Setenv("MAPPER_TIMEOUT", "1m")
+	if ttl := defaultIdempotencyPendingTTL(); ttl != 65*time.Second {
+		t.Errorf("defaultIdempotencyPendingTTL() = %v, want the mapper deadline plus 5s", ttl)
+	}
+}
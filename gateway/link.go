@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/HungTP-Play/lru/gateway/client"
+	"github.com/HungTP-Play/lru/gateway/dto"
+	"github.com/HungTP-Play/lru/gateway/util"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Link addressed by the request on behalf of the caller. Return the status and the
+// reason when the request is rejected, or 0.
+func requestedLink(c *fiber.Ctx, requestId string) (client.LinkRef, int, string) {
+	caller := requireCaller(c)
+	if caller == nil {
+		return client.LinkRef{}, 401, ""
+	}
+
+	code := c.Params("code")
+	if !util.IsShortCodeValid(code) {
+		return client.LinkRef{}, 404, "Not found"
+	}
+
+	// Links on a custom domain are addressed with the domain query param
+	domain, err := util.NormalizeDomain(c.Query("domain"))
+	if err != nil {
+		return client.LinkRef{}, 400, "Invalid domain: " + err.Error()
+	}
+
+	return client.LinkRef{
+		RequestId: requestId,
+		Domain:    domain,
+		Code:      code,
+		OwnerId:   caller.OwnerId,
+	}, 0, ""
+}
+
+func rejectLinkRequest(c *fiber.Ctx, status int, message string) error {
+	if status == 401 {
+		return unauthorizedResponse(c)
+	}
+	return c.Status(status).JSON(map[string]interface{}{
+		"error": message,
+	})
+}
+
+// Relay the answer of the mapper to a link management request
+func linkResponse(c *fiber.Ctx, span trace.Span, link client.LinkRef, operation string, response interface{}, err error) error {
+	if err != nil {
+		status := shared.ServiceErrorStatus(err)
+		if status >= 500 {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Cannot "+operation+" link")
+		}
+		logger.Info("MapperResponse", zap.String("id", link.RequestId), zap.String("operation", operation), zap.String("shortCode", link.Code), zap.Int("code", status), zap.Error(err))
+		return shared.ServiceErrorResponse(c, err)
+	}
+
+	logger.Info("MapperResponse", zap.String("id", link.RequestId), zap.String("operation", operation), zap.String("shortCode", link.Code), zap.Int("code", 200))
+	if response == nil {
+		return c.SendStatus(204)
+	}
+	return c.Status(200).JSON(response)
+}
+
+// Relay the answer of an internal service: the response with the given status, or the error
+func serviceResponse(c *fiber.Ctx, span trace.Span, requestId string, operation string, status int, response interface{}, err error) error {
+	if err != nil {
+		status = shared.ServiceErrorStatus(err)
+		if status >= 500 {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Cannot "+operation)
+		}
+		logger.Info("ServiceResponse", zap.String("id", requestId), zap.String("operation", operation), zap.Int("code", status), zap.Error(err))
+		return shared.ServiceErrorResponse(c, err)
+	}
+
+	logger.Info("ServiceResponse", zap.String("id", requestId), zap.String("operation", operation), zap.Int("code", status))
+	if response == nil {
+		return c.SendStatus(status)
+	}
+	return c.Status(status).JSON(response)
+}
+
+func getLinkHandler(c *fiber.Ctx) error {
+	ctx, getLinkSpan := tracer.StartSpan("GetLinkHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer getLinkSpan.End()
+
+	link, status, message := requestedLink(c, util.GenUUID())
+	if status != 0 {
+		return rejectLinkRequest(c, status, message)
+	}
+
+	ctx, mapperCallSpan := tracer.StartSpan("SendToMapper", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer mapperCallSpan.End()
+	response, err := mapperClient.GetLink(ctx, link)
+	return linkResponse(c, mapperCallSpan, link, "get", response, err)
+}
+
+func updateLinkHandler(c *fiber.Ctx) error {
+	ctx, updateLinkSpan := tracer.StartSpan("UpdateLinkHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer updateLinkSpan.End()
+
+	requestId := util.GenUUID()
+	var updateDto dto.UpdateLinkRequestDto
+	err := json.Unmarshal(c.Body(), &updateDto)
+	if err != nil {
+		logger.Error("CannotParseBody", zap.String("id", requestId), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Cannot parse body",
+		})
+	}
+
+	if updateDto.Url != nil && *updateDto.Url == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Url cannot be empty",
+		})
+	}
+
+	if updateDto.Url != nil {
+		normalizedUrl, err := util.NormalizeUrl(*updateDto.Url, urlRules)
+		if err != nil {
+			return c.Status(400).JSON(map[string]interface{}{
+				"error": "Invalid url: " + err.Error(),
+			})
+		}
+		updateDto.Url = &normalizedUrl
+	}
+
+	if updateDto.RedirectType != nil && !shared.IsRedirectTypeValid(*updateDto.RedirectType) {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Redirect type must be one of 301, 302, 307, 308",
+		})
+	}
+
+	updateRequest := shared.UpdateLinkRequest{
+		Id:           requestId,
+		Url:          updateDto.Url,
+		RedirectType: updateDto.RedirectType,
+		MaxClicks:    updateDto.MaxClicks,
+		Disabled:     updateDto.Disabled,
+	}
+
+	if updateDto.ExpiresAt != nil {
+		if !updateDto.ExpiresAt.After(time.Now()) {
+			return c.Status(400).JSON(map[string]interface{}{
+				"error": "Expiry must be in the future",
+			})
+		}
+		expiresAt := updateDto.ExpiresAt.Unix()
+		updateRequest.ExpiresAt = &expiresAt
+	}
+
+	link, status, message := requestedLink(c, requestId)
+	if status != 0 {
+		return rejectLinkRequest(c, status, message)
+	}
+
+	ctx, mapperCallSpan := tracer.StartSpan("SendToMapper", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer mapperCallSpan.End()
+	response, err := mapperClient.UpdateLink(ctx, link, updateRequest)
+	return linkResponse(c, mapperCallSpan, link, "update", response, err)
+}
+
+func deleteLinkHandler(c *fiber.Ctx) error {
+	ctx, deleteLinkSpan := tracer.StartSpan("DeleteLinkHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer deleteLinkSpan.End()
+
+	link, status, message := requestedLink(c, util.GenUUID())
+	if status != 0 {
+		return rejectLinkRequest(c, status, message)
+	}
+
+	ctx, mapperCallSpan := tracer.StartSpan("SendToMapper", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer mapperCallSpan.End()
+	err := mapperClient.DeleteLink(ctx, link)
+	return linkResponse(c, mapperCallSpan, link, "delete", nil, err)
+}
@@ -1,14 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"net/url"
 	"os"
 	"strconv"
+	"time"
 
+	"github.com/HungTP-Play/lru/gateway/client"
 	"github.com/HungTP-Play/lru/gateway/dto"
 	"github.com/HungTP-Play/lru/gateway/util"
 	"github.com/HungTP-Play/lru/shared"
@@ -26,6 +25,15 @@ var TwoXXStatusCode *prometheus.GaugeVec
 var FourXXStatusCode *prometheus.GaugeVec
 var FiveXXStatusCode *prometheus.GaugeVec
 var tracer *shared.Tracer
+var cacheClient *shared.CacheClient
+var urlRules *util.UrlRules
+var rateLimitConfig *util.RateLimitConfig
+var rateLimitedRequests *prometheus.CounterVec
+var upstreamBreakerState *prometheus.GaugeVec
+var upstreamRetries *prometheus.CounterVec
+var mapperClient client.MapperClient
+var redirectClient client.RedirectClient
+var analyticClient client.AnalyticClient
 
 func init() {
 
@@ -38,6 +46,33 @@ func init() {
 	TwoXXStatusCode = metrics.RegisterGauge("status_code_2xx", "2xx status code", []string{"method", "path", "code"})
 	FourXXStatusCode = metrics.RegisterGauge("status_code_4xx", "4xx status code", []string{"method", "path", "code"})
 	FiveXXStatusCode = metrics.RegisterGauge("status_code_5xx", "5xx status code", []string{"method", "path", "code"})
+	rateLimitedRequests = metrics.RegisterCounter("rate_limited_requests", "Requests rejected by the rate limit", []string{"method", "path"})
+	upstreamBreakerState = metrics.RegisterGauge("upstream_breaker_state", "Circuit breaker state of the upstream (0 closed, 1 half-open, 2 open)", []string{"upstream"})
+	upstreamRetries = metrics.RegisterCounter("upstream_retries", "Calls to the upstream retried after a failure", []string{"upstream"})
+
+	// Init cache
+	cacheClient = shared.NewCacheClient(shared.RedisDefaultConfig())
+	err := cacheClient.Connect()
+	if err != nil {
+		logger.Error("Cannot connect to cache", zap.Error(err))
+	}
+
+	// Init url rules
+	urlRules = util.UrlRulesFromEnv()
+
+	// Init rate limit
+	rateLimitConfig, err = util.RateLimitConfigFromEnv()
+	if err != nil {
+		logger.Error("Invalid rate limit config", zap.Error(err))
+		panic(err)
+	}
+
+	// Init clients of the internal services
+	mapperClient, redirectClient, analyticClient, err = newServiceClients(util.GetInternalTransport())
+	if err != nil {
+		logger.Error("Cannot create internal service clients", zap.Error(err))
+		panic(err)
+	}
 
 	// Init tracer
 	tracer = shared.NewTracer("gateway", "")
@@ -67,8 +102,116 @@ func ResponseStatusCodeMiddleware(c *fiber.Ctx) error {
 	return nil
 }
 
+// Clients of the mapper and the redirect service over the transport, and of the
+// analytic service over HTTP, each behind its own deadline, retries and circuit breaker
+func newServiceClients(transport string) (client.MapperClient, client.RedirectClient, client.AnalyticClient, error) {
+	httpClient := util.GetHttpClient()
+	var mapper client.MapperClient
+	var redirect client.RedirectClient
+	switch transport {
+	case client.TransportHttp:
+		mapper = client.NewHttpMapperClient(util.GetMapperUrl(), httpClient)
+		redirect = client.NewHttpRedirectClient(util.GetRedirectUrl(), httpClient)
+	case client.TransportGrpc:
+		var err error
+		mapper, err = client.NewGrpcMapperClient(util.GetMapperGrpcTarget(), client.NewHttpMapperClient(util.GetMapperUrl(), httpClient))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		redirect, err = client.NewGrpcRedirectClient(util.GetRedirectGrpcTarget())
+		if err != nil {
+			mapper.Close()
+			return nil, nil, nil, err
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown internal transport %q", transport)
+	}
+	analytic := client.NewHttpAnalyticClient(util.GetAnalyticUrl(), httpClient)
+
+	return client.GuardMapperClient(mapper, newUpstreamGuard("mapper")),
+		client.GuardRedirectClient(redirect, newUpstreamGuard("redirect")),
+		client.GuardAnalyticClient(analytic, newUpstreamGuard("analytic")),
+		nil
+}
+
+func newUpstreamGuard(upstream string) *client.Guard {
+	guard := client.GuardFromEnv(upstream)
+	metrics.SetGauge(upstreamBreakerState, float64(client.BreakerClosed), upstream)
+	guard.Breaker.OnStateChange = func(name string, state client.BreakerState) {
+		logger.Info("UpstreamBreakerState", zap.String("upstream", name), zap.String("state", state.String()))
+		metrics.SetGauge(upstreamBreakerState, float64(state), name)
+	}
+	guard.OnRetry = func(name string, attempt int, err error) {
+		logger.Info("RetryUpstream", zap.String("upstream", name), zap.Int("attempt", attempt), zap.Error(err))
+		metrics.IncCounter(upstreamRetries, name)
+	}
+	return guard
+}
+
 func onGratefulShutDown() {
 	logger.Info("Shutting down...")
+	mapperClient.Close()
+	redirectClient.Close()
+	analyticClient.Close()
+	cacheClient.Close()
+}
+
+// Validate a shorten request and convert it to a mapper request.
+// Return the reason the request is rejected, or an empty string.
+func buildMapUrlRequest(requestID string, ownerId string, shortenDto dto.ShortenRequestDto) (shared.MapUrlRequest, string) {
+	mapUrlRequest := shared.MapUrlRequest{
+		Id:           requestID,
+		OwnerId:      ownerId,
+		Url:          shortenDto.Url,
+		Alias:        shortenDto.Alias,
+		RedirectType: shortenDto.RedirectType,
+		MaxClicks:    shortenDto.MaxClicks,
+		Dedup:        shortenDto.Dedup,
+	}
+
+	if shortenDto.Url == "" {
+		return mapUrlRequest, "Url cannot be empty"
+	}
+
+	normalizedUrl, err := util.NormalizeUrl(shortenDto.Url, urlRules)
+	if err != nil {
+		return mapUrlRequest, "Invalid url: " + err.Error()
+	}
+	mapUrlRequest.Url = normalizedUrl
+
+	if shortenDto.RedirectType != 0 && !shared.IsRedirectTypeValid(shortenDto.RedirectType) {
+		return mapUrlRequest, "Redirect type must be one of 301, 302, 307, 308"
+	}
+
+	if shortenDto.Alias != "" && !util.IsAliasValid(shortenDto.Alias) {
+		return mapUrlRequest, "Alias must be 3 to 32 letters, digits, '-' or '_' and start and end with a letter or digit"
+	}
+
+	if util.IsAliasReserved(shortenDto.Alias) {
+		return mapUrlRequest, "Alias is reserved"
+	}
+
+	if shortenDto.ExpiresAt != nil {
+		if !shortenDto.ExpiresAt.After(time.Now()) {
+			return mapUrlRequest, "Expiry must be in the future"
+		}
+		mapUrlRequest.ExpiresAt = shortenDto.ExpiresAt.Unix()
+	}
+
+	if shortenDto.MaxClicks < 0 {
+		return mapUrlRequest, "Max clicks cannot be negative"
+	}
+
+	domain, err := util.NormalizeDomain(shortenDto.Domain)
+	if err != nil {
+		return mapUrlRequest, "Invalid domain: " + err.Error()
+	}
+	if domain != "" && ownerId == "" {
+		return mapUrlRequest, "A custom domain requires an API key"
+	}
+	mapUrlRequest.Domain = domain
+
+	return mapUrlRequest, ""
 }
 
 func shortenHandler(c *fiber.Ctx) error {
@@ -88,57 +231,45 @@ func shortenHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	if shortenDto.Url == "" {
-		logger.Error("EmptyString", zap.Int("code", 400), zap.Error(err))
+	mapUrlRequest, message := buildMapUrlRequest(requestID, callerOwnerId(c), shortenDto)
+	if message != "" {
+		logger.Error("InvalidShortenRequest", zap.String("id", requestID), zap.Int("code", 400), zap.String("error", message))
 		return c.Status(400).JSON(map[string]interface{}{
-			"error": "Cannot parse body",
+			"error": message,
 		})
 	}
 
-	mapUrlRequest := shared.MapUrlRequest{
-		Id:  requestID,
-		Url: shortenDto.Url,
-	}
-
-	httpClient := util.GetHttpClient()
-	mapperUrl := util.GetMapperUrl()
-
-	var mapUrlResponse shared.MapUrlResponse
 	logger.Info("SendToMapper", zap.String("id", requestID), zap.String("url", mapUrlRequest.Url))
 
 	ctx, mapperCallSpan := tracer.StartSpan("SendToMapper", shortenCtx, trace.WithSpanKind(trace.SpanKindClient))
 	defer mapperCallSpan.End()
-	mapperUrl = fmt.Sprintf("%v/map", mapperUrl)
-	reqBody, _ := json.Marshal(mapUrlRequest)
-
-	req, _ := http.NewRequest("POST", mapperUrl, bytes.NewBuffer(reqBody))
-	req.Header.Set("Content-Type", "application/json")
-	shared.InjectPropagationHeader(ctx, req)
-	resp, err := httpClient.Do(req)
-	if err != nil {
+	mapUrlResponse, err := mapperClient.Map(ctx, mapUrlRequest)
+	status := shared.ServiceErrorStatus(err)
+	if err != nil && status >= 500 {
 		mapperCallSpan.RecordError(err)
 		mapperCallSpan.SetStatus(codes.Error, "Cannot send to mapper")
-		logger.Error("CannotSendToMapper", zap.String("id", requestID), zap.Int("code", 500), zap.Error(err))
-		return c.Status(500).JSON(map[string]interface{}{
-			"error": "Internal server error",
+		logger.Error("MapperResultError__ServerError", zap.String("id", requestID), zap.Int("code", status), zap.Error(err))
+		return c.Status(status).JSON(map[string]interface{}{
+			"error": upstreamErrorMessage(status),
 		})
 	}
 
-	json.NewDecoder(resp.Body).Decode(&mapUrlResponse)
-
-	if resp.StatusCode >= 500 {
-		mapperCallSpan.RecordError(err)
-		mapperCallSpan.SetStatus(codes.Error, "Internal server error")
-		logger.Error("MapperResultError__ServerError", zap.String("id", requestID), zap.Int("code", resp.StatusCode), zap.Error(err))
-		return c.Status(resp.StatusCode).JSON(map[string]interface{}{
-			"error": "Internal server error",
+	if status == 409 {
+		logger.Info("AliasTaken", zap.String("id", requestID), zap.Int("code", 409), zap.String("alias", mapUrlRequest.Alias))
+		return c.Status(409).JSON(map[string]interface{}{
+			"error": "Alias is already taken",
 		})
 	}
 
-	if resp.StatusCode >= 400 {
+	if status == 422 {
+		logger.Info("UrlBlocked", zap.String("id", requestID), zap.Int("code", 422), zap.String("url", mapUrlRequest.Url))
+		return shared.ServiceErrorResponse(c, err)
+	}
+
+	if err != nil {
 		mapperCallSpan.RecordError(err)
-		logger.Error("MapperResultError__ClientError", zap.String("id", requestID), zap.Int("code", resp.StatusCode), zap.Error(err))
-		return c.Status(resp.StatusCode).JSON(map[string]interface{}{
+		logger.Error("MapperResultError__ClientError", zap.String("id", requestID), zap.Int("code", status), zap.Error(err))
+		return c.Status(status).JSON(map[string]interface{}{
 			"error": "Bad request",
 		})
 	}
@@ -165,48 +296,27 @@ func redirectHandler(c *fiber.Ctx) error {
 		Url: body["url"],
 	}
 
-	httpClient := util.GetHttpClient()
-	mapperUrl := util.GetRedirectUrl()
-
-	var redirectResponse shared.RedirectResponse
 	logger.Info("SendToRedirect", zap.String("id", requestId), zap.String("url", redirectRequest.Url))
 
 	ctx, redirectCallSpan := tracer.StartSpan("SendToRedirect", ctx, trace.WithSpanKind(trace.SpanKindClient))
 	defer redirectCallSpan.End()
 
-	mapperUrl = fmt.Sprintf("%v/redirect", mapperUrl)
-	reqBody, _ := json.Marshal(redirectRequest)
-	url, _ := url.Parse(mapperUrl)
-	req, _ := http.NewRequest("GET", url.String(), bytes.NewBuffer(reqBody))
-	req.Header.Set("Content-Type", "application/json")
-	shared.InjectPropagationHeader(ctx, req)
-	resp, err := httpClient.Do(req)
-
-	_ = json.NewDecoder(resp.Body).Decode(&redirectResponse)
-
-	if err != nil {
-		redirectSpan.RecordError(err)
-		redirectSpan.SetStatus(codes.Error, "Cannot send to redirect")
-		logger.Error("CannotSendToRedirect", zap.String("id", requestId), zap.Int("code", 500), zap.Error(err))
-		return c.Status(500).JSON(map[string]interface{}{
-			"error": "Internal server error",
-		})
-	}
-
-	if resp.StatusCode >= 500 {
+	redirectResponse, err := redirectClient.Redirect(ctx, redirectRequest)
+	status := shared.ServiceErrorStatus(err)
+	if err != nil && status >= 500 {
 		redirectCallSpan.RecordError(err)
 		redirectCallSpan.SetStatus(codes.Error, "Internal server error")
-		logger.Error("RedirectResultError__ServerError", zap.String("id", requestId), zap.Int("code", resp.StatusCode), zap.Error(err))
-		return c.Status(resp.StatusCode).JSON(map[string]interface{}{
-			"error": "Internal server error",
+		logger.Error("RedirectResultError__ServerError", zap.String("id", requestId), zap.Int("code", status), zap.Error(err))
+		return c.Status(status).JSON(map[string]interface{}{
+			"error": upstreamErrorMessage(status),
 		})
 	}
 
-	if resp.StatusCode >= 400 {
+	if err != nil {
 		redirectCallSpan.RecordError(err)
 		redirectCallSpan.SetStatus(codes.Error, "Bad request")
-		logger.Error("RedirectResultError__ClientError", zap.String("id", requestId), zap.Int("code", resp.StatusCode), zap.Error(err))
-		return c.Status(resp.StatusCode).JSON(map[string]interface{}{
+		logger.Error("RedirectResultError__ClientError", zap.String("id", requestId), zap.Int("code", status), zap.Error(err))
+		return c.Status(status).JSON(map[string]interface{}{
 			"error": "Bad request",
 		})
 	}
@@ -215,6 +325,80 @@ func redirectHandler(c *fiber.Ctx) error {
 	return c.Status(200).JSON(redirectResponse)
 
 }
+
+// Message answering the failure of an upstream, which is not told to the client
+func upstreamErrorMessage(status int) string {
+	if status == 503 {
+		return "Service unavailable"
+	}
+	return "Internal server error"
+}
+
+func notFoundPage(c *fiber.Ctx, code string) error {
+	return c.Status(404).Type("html").SendString(util.NotFoundPage(code))
+}
+
+func shortLinkHandler(c *fiber.Ctx) error {
+	ctx, shortLinkSpan := tracer.StartSpan("ShortLinkHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer shortLinkSpan.End()
+
+	requestId := util.GenUUID()
+	code := c.Params("code")
+	if !util.IsShortCodeValid(code) {
+		logger.Info("InvalidShortCode", zap.String("id", requestId), zap.Int("code", 404), zap.String("shortCode", code))
+		return notFoundPage(c, code)
+	}
+
+	// Codes are unique per domain, the Host header tells which one the link lives on
+	domain, err := resolveDomain(ctx, requestId, util.RequestHost(c.Hostname()))
+	if err != nil {
+		logger.Error("CannotResolveDomain", zap.String("id", requestId), zap.Int("code", 503), zap.String("host", c.Hostname()), zap.Error(err))
+		return c.Status(503).JSON(map[string]interface{}{
+			"error": "Service unavailable",
+		})
+	}
+
+	logger.Info("SendToRedirect", zap.String("id", requestId), zap.String("domain", domain), zap.String("shortCode", code))
+	ctx, resolveCallSpan := tracer.StartSpan("SendToRedirect", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer resolveCallSpan.End()
+
+	redirectResponse, err := redirectClient.Resolve(ctx, requestId, domain, code)
+	status := shared.ServiceErrorStatus(err)
+	if status == 404 {
+		logger.Info("ShortLinkNotFound", zap.String("id", requestId), zap.Int("code", 404), zap.String("shortCode", code))
+		return notFoundPage(c, code)
+	}
+
+	if status == 410 {
+		logger.Info("ShortLinkGone", zap.String("id", requestId), zap.Int("code", 410), zap.String("shortCode", code))
+		return c.Status(410).Type("html").SendString(util.GonePage(code))
+	}
+
+	if err != nil {
+		resolveCallSpan.RecordError(err)
+		resolveCallSpan.SetStatus(codes.Error, "Cannot resolve short link")
+		logger.Error("RedirectResultError", zap.String("id", requestId), zap.Int("code", status), zap.Error(err))
+		return c.Status(status).JSON(map[string]interface{}{
+			"error": upstreamErrorMessage(status),
+		})
+	}
+
+	if redirectResponse.OriginalUrl == "" {
+		logger.Error("EmptyRedirect", zap.String("id", requestId), zap.Int("code", 500), zap.String("shortCode", code))
+		return c.Status(500).JSON(map[string]interface{}{
+			"error": "Internal server error",
+		})
+	}
+
+	redirectType := redirectResponse.RedirectType
+	if !shared.IsRedirectTypeValid(redirectType) {
+		redirectType = shared.DefaultRedirectType
+	}
+
+	logger.Info("RedirectShortLink", zap.String("id", requestId), zap.Int("code", redirectType), zap.String("shortCode", code), zap.String("location", redirectResponse.OriginalUrl))
+	return c.Redirect(redirectResponse.OriginalUrl, redirectType)
+}
+
 func metricsHandler(c *fiber.Ctx) error {
 	metrics, err := metrics.GetPrometheusMetrics()
 	if err != nil {
@@ -234,10 +418,28 @@ func main() {
 
 	gatewayService.Use(RequestCounterMiddleware)
 	gatewayService.Use(ResponseStatusCodeMiddleware)
+	gatewayService.Use(RateLimitMiddleware, rateLimitConfig.Paths...)
+	gatewayService.Use(AuthMiddleware, "/shorten", "/links", "/account")
+	gatewayService.Use(IdempotencyMiddleware, "/shorten")
 
 	gatewayService.Routes("/shorten", shortenHandler, "POST")
+	gatewayService.Routes("/shorten/batch", shortenBatchHandler, "POST")
 	gatewayService.Routes("/redirect", redirectHandler, "GET")
 	gatewayService.Routes("/metrics", metricsHandler, "GET")
+	gatewayService.Routes("/links/:code", getLinkHandler, "GET")
+	gatewayService.Routes("/links/:code", updateLinkHandler, "PATCH")
+	gatewayService.Routes("/links/:code", deleteLinkHandler, "DELETE")
+	gatewayService.Routes("/account/keys", issueApiKeyHandler, "POST")
+	gatewayService.Routes("/account/keys", listApiKeysHandler, "GET")
+	gatewayService.Routes("/account/keys/:id", revokeApiKeyHandler, "DELETE")
+	gatewayService.Routes("/account/stats", statsHandler, "GET")
+	gatewayService.Routes("/account/workspaces", createWorkspaceHandler, "POST")
+	gatewayService.Routes("/account/workspaces", listWorkspacesHandler, "GET")
+	gatewayService.Routes("/account/workspaces/:id/domains", addDomainHandler, "POST")
+	gatewayService.Routes("/account/workspaces/:id/domains/:host", removeDomainHandler, "DELETE")
+
+	// Must stay last so it does not shadow the routes above
+	gatewayService.Routes("/:code", shortLinkHandler, "GET")
 
 	gatewayService.Start(onGratefulShutDown)
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/HungTP-Play/lru/gateway/util"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// Whole seconds in the duration, rounded up
+func ceilSeconds(duration time.Duration) int64 {
+	return int64(math.Ceil(duration.Seconds()))
+}
+
+func clientIP(c *fiber.Ctx) string {
+	if rateLimitConfig.TrustForwardedFor {
+		if ips := c.IPs(); len(ips) > 0 {
+			return ips[0]
+		}
+	}
+	return c.IP()
+}
+
+// Id of the API key of the request when the key is known to be valid, 0 otherwise.
+// Only the cache is asked: a key not verified yet is limited with the IP, so
+// made-up keys cannot get a limit of their own.
+func verifiedApiKeyId(c *fiber.Ctx) int64 {
+	key := apiKeyFromRequest(c)
+	if key == "" {
+		return 0
+	}
+	apiKey, _ := cachedApiKey(shared.HashApiKey(key))
+	if apiKey == nil {
+		return 0
+	}
+	return apiKey.Id
+}
+
+// RateLimitMiddleware limits the requests of each client, identified by its verified
+// API key or its IP. The state lives in Redis so the limit holds across gateway replicas.
+//
+// Every answer carries X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+// (seconds until the limit is fully available again). Rejected requests get a 429 with
+// Retry-After. When Redis is unavailable requests go through as is.
+func RateLimitMiddleware(c *fiber.Ctx) error {
+	if rateLimitConfig.Limit == 0 {
+		return c.Next()
+	}
+
+	key := util.RateLimitKey(rateLimitConfig.Algorithm, verifiedApiKeyId(c), clientIP(c))
+	result, err := cacheClient.RateLimit(rateLimitConfig.Algorithm, key, rateLimitConfig.Limit, rateLimitConfig.Period)
+	if err != nil {
+		logger.Error("CannotRateLimit", zap.String("algorithm", rateLimitConfig.Algorithm), zap.Error(err))
+		return c.Next()
+	}
+
+	c.Set("X-RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+	c.Set("X-RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+	c.Set("X-RateLimit-Reset", strconv.FormatInt(ceilSeconds(result.ResetAfter), 10))
+
+	if !result.Allowed {
+		retryAfter := ceilSeconds(result.RetryAfter)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		c.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		metrics.IncCounter(rateLimitedRequests, c.Method(), c.Path())
+		logger.Info("RateLimited", zap.String("ip", c.IP()), zap.String("path", c.Path()), zap.Int("code", 429), zap.Int64("retryAfter", retryAfter))
+		return c.Status(429).JSON(map[string]interface{}{
+			"error": "Too many requests",
+		})
+	}
+
+	return c.Next()
+}
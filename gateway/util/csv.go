@@ -0,0 +1,89 @@
+package util
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HungTP-Play/lru/gateway/dto"
+)
+
+// Columns of a shorten CSV file, in their default order
+var ShortenCsvColumns = []string{"url", "alias", "redirectType", "expiresAt", "maxClicks", "domain"}
+
+// Check if every cell of the row is a column name
+func isShortenCsvHeader(record []string) bool {
+	for _, cell := range record {
+		known := false
+		for _, column := range ShortenCsvColumns {
+			if strings.EqualFold(strings.TrimSpace(cell), column) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return false
+		}
+	}
+	return len(record) > 0
+}
+
+// Parse a CSV file of urls to shorten.
+//
+// The file may start with a header row naming its columns (any subset of
+// ShortenCsvColumns, in any order), otherwise the columns are read in the order of
+// ShortenCsvColumns. Only the url is required, empty cells are left unset.
+func ParseShortenCsv(reader io.Reader) ([]dto.ShortenRequestDto, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := ShortenCsvColumns
+	if len(records) > 0 && isShortenCsvHeader(records[0]) {
+		columns = records[0]
+		records = records[1:]
+	}
+
+	items := make([]dto.ShortenRequestDto, 0, len(records))
+	for line, record := range records {
+		var item dto.ShortenRequestDto
+		for i, cell := range record {
+			cell = strings.TrimSpace(cell)
+			if i >= len(columns) || cell == "" {
+				continue
+			}
+
+			switch strings.ToLower(strings.TrimSpace(columns[i])) {
+			case "url":
+				item.Url = cell
+			case "alias":
+				item.Alias = cell
+			case "redirecttype":
+				item.RedirectType, err = strconv.Atoi(cell)
+			case "expiresat":
+				var expiresAt time.Time
+				expiresAt, err = time.Parse(time.RFC3339, cell)
+				item.ExpiresAt = &expiresAt
+			case "maxclicks":
+				item.MaxClicks, err = strconv.ParseInt(cell, 10, 64)
+			case "domain":
+				item.Domain = cell
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("row %d, column %s: %w", line+1, columns[i], err)
+			}
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseShortenCsv(t *testing.T) {
+	input := "https://google.com\nhttps://example.com,summer-sale,301,2030-01-02T15:04:05Z,10\n"
+	items, err := ParseShortenCsv(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Cannot parse csv: %v", err)
+	}
+
+	if len(items) != 2 {
+		t.Fatalf("Should parse 2 items, got %d", len(items))
+	}
+
+	if items[0].Url != "https://google.com" || items[0].Alias != "" {
+		t.Errorf("First item is not correct: %+v", items[0])
+	}
+
+	second := items[1]
+	if second.Alias != "summer-sale" || second.RedirectType != 301 || second.MaxClicks != 10 || second.ExpiresAt == nil || second.ExpiresAt.Year() != 2030 {
+		t.Errorf("Second item is not correct: %+v", second)
+	}
+}
+
+func TestParseShortenCsvHeader(t *testing.T) {
+	input := "alias,URL\npromo,https://google.com\n"
+	items, err := ParseShortenCsv(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Cannot parse csv: %v", err)
+	}
+
+	if len(items) != 1 || items[0].Url != "https://google.com" || items[0].Alias != "promo" {
+		t.Errorf("Items are not correct: %+v", items)
+	}
+}
+
+func TestParseShortenCsvInvalid(t *testing.T) {
+	_, err := ParseShortenCsv(strings.NewReader("https://google.com,,abc\n"))
+	if err == nil {
+		t.Errorf("Invalid redirect type should return an error")
+	}
+}
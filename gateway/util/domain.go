@@ -0,0 +1,57 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var ErrDomainInvalid = errors.New("domain must be a host name, without scheme, port or path")
+
+// Host of BASE_HOST, the domain of the links created without a custom domain
+func DefaultDomain() string {
+	baseHost := os.Getenv("BASE_HOST")
+	if baseHost == "" {
+		baseHost = "http://localhost/"
+	}
+
+	parsed, err := url.Parse(baseHost)
+	if err != nil || parsed.Hostname() == "" {
+		return "localhost"
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// Normalize a custom short domain, e.g. "Go.Acme.com." becomes "go.acme.com".
+// The default domain is returned as "".
+func NormalizeDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" {
+		return "", nil
+	}
+
+	if strings.ContainsAny(domain, ":/?#@ ") || net.ParseIP(domain) != nil {
+		return "", ErrDomainInvalid
+	}
+
+	host, err := normalizeHost(domain, false)
+	if err != nil {
+		return "", err
+	}
+
+	if host == DefaultDomain() {
+		return "", nil
+	}
+	return host, nil
+}
+
+// Host a request was sent to, from its Host header: lower cased, without port or trailing dot
+func RequestHost(hostHeader string) string {
+	host := hostHeader
+	if splitHost, _, err := net.SplitHostPort(hostHeader); err == nil {
+		host = splitHost
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -7,9 +7,12 @@ import (
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+// Deadline of the calls made with GetHttpClient
+const HttpClientTimeout = 30 * time.Second
+
 func GetHttpClient() *http.Client {
 	return &http.Client{
-		Timeout:   time.Second * 30,
+		Timeout:   HttpClientTimeout,
 		Transport: otelhttp.NewTransport(http.DefaultTransport),
 	}
 }
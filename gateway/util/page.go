@@ -0,0 +1,32 @@
+package util
+
+import (
+	"fmt"
+	"html"
+)
+
+const pageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<title>%s</title>
+	<style>
+		body { font-family: sans-serif; text-align: center; margin-top: 15vh; color: #333; }
+		code { background: #f2f2f2; padding: 2px 6px; border-radius: 4px; }
+	</style>
+</head>
+<body>
+	<h1>%d</h1>
+	<p>The short link <code>/%s</code> %s.</p>
+</body>
+</html>`
+
+// Render the page returned to browsers following an unknown short link
+func NotFoundPage(code string) string {
+	return fmt.Sprintf(pageTemplate, "Link not found", 404, html.EscapeString(code), "does not exist")
+}
+
+// Render the page returned to browsers following an expired or disabled short link
+func GonePage(code string) string {
+	return fmt.Sprintf(pageTemplate, "Link unavailable", 410, html.EscapeString(code), "is no longer available")
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+type RateLimitConfig struct {
+	// shared.TokenBucketAlgorithm or shared.SlidingWindowAlgorithm
+	Algorithm string
+	// Requests allowed per period, 0 turns rate limiting off
+	Limit  int64
+	Period time.Duration
+	// Path prefixes the limit applies to
+	Paths []string
+	// Take the client IP from X-Forwarded-For, only safe behind a trusted proxy
+	TrustForwardedFor bool
+}
+
+// Build the rate limit configuration from the environment:
+//
+// - RATE_LIMIT_ALGORITHM: token_bucket (default) or sliding_window
+// - RATE_LIMIT_REQUESTS: requests allowed per period (default 60, 0 to turn it off)
+// - RATE_LIMIT_PERIOD: period of the limit (default 1m)
+// - RATE_LIMIT_PATHS: comma separated path prefixes (default /shorten)
+// - RATE_LIMIT_TRUST_FORWARDED_FOR: "true" to key by the X-Forwarded-For client IP
+func RateLimitConfigFromEnv() (*RateLimitConfig, error) {
+	config := &RateLimitConfig{
+		Algorithm:         os.Getenv("RATE_LIMIT_ALGORITHM"),
+		Limit:             int64(shared.GetEnvInt("RATE_LIMIT_REQUESTS", 60)),
+		Period:            shared.GetEnvDuration("RATE_LIMIT_PERIOD", time.Minute),
+		Paths:             []string{"/shorten"},
+		TrustForwardedFor: os.Getenv("RATE_LIMIT_TRUST_FORWARDED_FOR") == "true",
+	}
+
+	if config.Algorithm == "" {
+		config.Algorithm = shared.TokenBucketAlgorithm
+	}
+	if config.Algorithm != shared.TokenBucketAlgorithm && config.Algorithm != shared.SlidingWindowAlgorithm {
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", config.Algorithm)
+	}
+	if config.Limit < 0 {
+		return nil, fmt.Errorf("rate limit requests cannot be negative")
+	}
+	if config.Period < time.Millisecond {
+		return nil, fmt.Errorf("rate limit period must be at least 1ms")
+	}
+
+	if paths := os.Getenv("RATE_LIMIT_PATHS"); paths != "" {
+		config.Paths = nil
+		for _, path := range strings.Split(paths, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				config.Paths = append(config.Paths, path)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// Redis key holding the rate limit state of a client: the id of its API key once the
+// key was verified, or its IP. 0 is no verified key.
+func RateLimitKey(algorithm string, keyId int64, ip string) string {
+	if keyId != 0 {
+		return fmt.Sprintf("ratelimit:%s:key:%d", algorithm, keyId)
+	}
+	return fmt.Sprintf("ratelimit:%s:ip:%s", algorithm, ip)
+}
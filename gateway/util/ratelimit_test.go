@@ -0,0 +1,62 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+func TestRateLimitConfigFromEnv(t *testing.T) {
+	config, err := RateLimitConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Default config should be valid: %v", err)
+	}
+	if config.Algorithm != shared.TokenBucketAlgorithm || config.Limit != 60 || config.Period != time.Minute {
+		t.Errorf("Default config is not correct: %+v", config)
+	}
+	if len(config.Paths) != 1 || config.Paths[0] != "/shorten" {
+		t.Errorf("Default paths should be /shorten, got %v", config.Paths)
+	}
+
+	t.Setenv("RATE_LIMIT_ALGORITHM", shared.SlidingWindowAlgorithm)
+	t.Setenv("RATE_LIMIT_REQUESTS", "10")
+	t.Setenv("RATE_LIMIT_PERIOD", "30s")
+	t.Setenv("RATE_LIMIT_PATHS", "/shorten, /links")
+	config, err = RateLimitConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Config should be valid: %v", err)
+	}
+	if config.Algorithm != shared.SlidingWindowAlgorithm || config.Limit != 10 || config.Period != 30*time.Second {
+		t.Errorf("Config is not correct: %+v", config)
+	}
+	if strings.Join(config.Paths, ",") != "/shorten,/links" {
+		t.Errorf("Paths should be /shorten,/links, got %v", config.Paths)
+	}
+
+	t.Setenv("RATE_LIMIT_ALGORITHM", "leaky_bucket")
+	if _, err := RateLimitConfigFromEnv(); err == nil {
+		t.Errorf("Unknown algorithm should be rejected")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	ipKey := RateLimitKey(shared.TokenBucketAlgorithm, 0, "10.1.2.3")
+	if ipKey != "ratelimit:token_bucket:ip:10.1.2.3" {
+		t.Errorf("Key without verified API key should use the IP, got %s", ipKey)
+	}
+
+	apiKey := RateLimitKey(shared.TokenBucketAlgorithm, 42, "10.1.2.3")
+	if apiKey != "ratelimit:token_bucket:key:42" {
+		t.Errorf("Key with verified API key should use its id, got %s", apiKey)
+	}
+
+	if apiKey != RateLimitKey(shared.TokenBucketAlgorithm, 42, "10.9.9.9") {
+		t.Errorf("Same API key should share its limit across IPs")
+	}
+
+	if apiKey == RateLimitKey(shared.SlidingWindowAlgorithm, 42, "10.1.2.3") {
+		t.Errorf("Algorithms should not share their state")
+	}
+}
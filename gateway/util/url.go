@@ -0,0 +1,305 @@
+package util
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/HungTP-Play/lru/shared"
+	"golang.org/x/net/idna"
+)
+
+var (
+	ErrUrlEmpty          = errors.New("url cannot be empty")
+	ErrUrlTooLong        = errors.New("url is too long")
+	ErrUrlMalformed      = errors.New("url is malformed")
+	ErrSchemeNotAllowed  = errors.New("url scheme is not allowed")
+	ErrUrlHasCredentials = errors.New("url cannot contain credentials")
+	ErrHostInvalid       = errors.New("url host is invalid")
+	ErrHostNotAllowed    = errors.New("url host is private or loopback")
+	ErrPortInvalid       = errors.New("url port is invalid")
+)
+
+// Rules applied by NormalizeUrl
+type UrlRules struct {
+	// Lower case schemes that can be shortened
+	AllowedSchemes []string
+	// Maximum length of the url, before and after normalization
+	MaxLength int
+	// Allow loopback, private, link local and single label hosts
+	AllowPrivateHosts bool
+	// Query params removed from the url, a trailing "*" matches a prefix (e.g. "utm_*")
+	StripParams []string
+	// Sort the remaining query params by key
+	SortQuery bool
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Same mapping as idna.Lookup, also rejecting empty and over long labels
+var hostProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true))
+
+// Hostnames that always point back to the local network
+var privateHostSuffixes = []string{
+	"localhost",
+	".localhost",
+	".local",
+	".internal",
+	".home.arpa",
+}
+
+func DefaultUrlRules() *UrlRules {
+	return &UrlRules{
+		AllowedSchemes: []string{"http", "https"},
+		MaxLength:      2048,
+		StripParams: []string{
+			"utm_*",
+			"fbclid",
+			"gclid",
+			"dclid",
+			"msclkid",
+			"yclid",
+			"mc_cid",
+			"mc_eid",
+			"_ga",
+			"_gl",
+		},
+		SortQuery: true,
+	}
+}
+
+// Build the rules from the environment, falling back to DefaultUrlRules:
+// URL_ALLOWED_SCHEMES and URL_STRIP_PARAMS are comma separated lists,
+// URL_MAX_LENGTH is an integer, URL_SORT_QUERY and URL_ALLOW_PRIVATE_HOSTS are "true" or "false"
+func UrlRulesFromEnv() *UrlRules {
+	rules := DefaultUrlRules()
+	if schemes := splitList(os.Getenv("URL_ALLOWED_SCHEMES")); len(schemes) > 0 {
+		rules.AllowedSchemes = schemes
+	}
+	if params, ok := os.LookupEnv("URL_STRIP_PARAMS"); ok {
+		rules.StripParams = splitList(params)
+	}
+	rules.MaxLength = shared.GetEnvInt("URL_MAX_LENGTH", rules.MaxLength)
+	if sortQuery := os.Getenv("URL_SORT_QUERY"); sortQuery != "" {
+		rules.SortQuery = sortQuery == "true"
+	}
+	rules.AllowPrivateHosts = os.Getenv("URL_ALLOW_PRIVATE_HOSTS") == "true"
+	return rules
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate the url against the rules and return its canonical form:
+// lower case scheme and punycode host, no default port, no fragment,
+// tracking params removed and the query sorted when configured
+func NormalizeUrl(rawUrl string, rules *UrlRules) (string, error) {
+	rawUrl = strings.TrimSpace(rawUrl)
+	if rawUrl == "" {
+		return "", ErrUrlEmpty
+	}
+	if rules.MaxLength > 0 && len(rawUrl) > rules.MaxLength {
+		return "", ErrUrlTooLong
+	}
+
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Opaque != "" {
+		return "", ErrUrlMalformed
+	}
+
+	parsed.Scheme = strings.ToLower(parsed.Scheme)
+	if !isSchemeAllowed(parsed.Scheme, rules.AllowedSchemes) {
+		return "", ErrSchemeNotAllowed
+	}
+
+	if parsed.User != nil {
+		return "", ErrUrlHasCredentials
+	}
+
+	host, err := normalizeHost(parsed.Hostname(), rules.AllowPrivateHosts)
+	if err != nil {
+		return "", err
+	}
+
+	port := parsed.Port()
+	if port != "" && !isPortValid(port) {
+		return "", ErrPortInvalid
+	}
+	if port == defaultPorts[parsed.Scheme] {
+		port = ""
+	}
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host = host + ":" + port
+	}
+	parsed.Host = host
+
+	if parsed.Path == "" {
+		parsed.Path = "/"
+	}
+	parsed.Fragment = ""
+	parsed.RawFragment = ""
+	parsed.ForceQuery = false
+	parsed.RawQuery = normalizeQuery(parsed.RawQuery, rules)
+
+	normalized := parsed.String()
+	if rules.MaxLength > 0 && len(normalized) > rules.MaxLength {
+		return "", ErrUrlTooLong
+	}
+	return normalized, nil
+}
+
+// Check if the provided url can be shortened with the default rules
+func IsUrlValid(url string) bool {
+	_, err := NormalizeUrl(url, DefaultUrlRules())
+	return err == nil
+}
+
+func isSchemeAllowed(scheme string, allowed []string) bool {
+	if scheme == "" {
+		return false
+	}
+	for _, s := range allowed {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func isPortValid(port string) bool {
+	if len(port) > 5 {
+		return false
+	}
+	value := 0
+	for _, r := range port {
+		if r < '0' || r > '9' {
+			return false
+		}
+		value = value*10 + int(r-'0')
+	}
+	return value > 0 && value <= 65535
+}
+
+// Lower case the host, convert IDNs to punycode and reject hosts
+// pointing to the local network unless allowed
+func normalizeHost(host string, allowPrivate bool) (string, error) {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" {
+		return "", ErrHostInvalid
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !allowPrivate && isPrivateIP(ip) {
+			return "", ErrHostNotAllowed
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String(), nil
+		}
+		return ip.String(), nil
+	}
+
+	ascii, err := hostProfile.ToASCII(host)
+	if err != nil || ascii == "" {
+		return "", ErrHostInvalid
+	}
+
+	if allowPrivate {
+		return ascii, nil
+	}
+
+	for _, suffix := range privateHostSuffixes {
+		if ascii == strings.TrimPrefix(suffix, ".") || strings.HasSuffix(ascii, suffix) {
+			return "", ErrHostNotAllowed
+		}
+	}
+
+	// A public host needs a TLD, and a TLD never starts with a digit: this also
+	// rejects the shorthand IPv4 forms browsers accept (e.g. "127.1", "0x7f.1")
+	dot := strings.LastIndex(ascii, ".")
+	if dot < 0 {
+		return "", ErrHostNotAllowed
+	}
+	tld := ascii[dot+1:]
+	if tld == "" || tld[0] < 'a' || tld[0] > 'z' {
+		return "", ErrHostInvalid
+	}
+
+	return ascii, nil
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast()
+}
+
+// Drop the tracking params and sort the rest by key, keeping the original encoding
+func normalizeQuery(rawQuery string, rules *UrlRules) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	params := make([]string, 0)
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		key := queryKey(param)
+		if isParamStripped(key, rules.StripParams) {
+			continue
+		}
+		params = append(params, param)
+	}
+
+	if rules.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return queryKey(params[i]) < queryKey(params[j])
+		})
+	}
+
+	return strings.Join(params, "&")
+}
+
+func queryKey(param string) string {
+	key, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(key); err == nil {
+		key = unescaped
+	}
+	return key
+}
+
+func isParamStripped(key string, stripParams []string) bool {
+	key = strings.ToLower(key)
+	for _, rule := range stripParams {
+		if strings.HasSuffix(rule, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(rule, "*")) {
+				return true
+			}
+		} else if key == rule {
+			return true
+		}
+	}
+	return false
+}
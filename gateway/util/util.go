@@ -9,7 +9,7 @@ import (
 
 func GetMapperUrl() string {
 	host := os.Getenv("MAPPER_HOST")
-	if host != "" {
+	if host == "" {
 		host = "mapper"
 	}
 
@@ -23,7 +23,7 @@ func GetMapperUrl() string {
 
 func GetRedirectUrl() string {
 	host := os.Getenv("REDIRECT_HOST")
-	if host != "" {
+	if host == "" {
 		host = "redirect"
 	}
 
@@ -35,6 +35,57 @@ func GetRedirectUrl() string {
 	return fmt.Sprintf("http://%s:%s", host, port)
 }
 
+func GetAnalyticUrl() string {
+	host := os.Getenv("ANALYTIC_HOST")
+	if host == "" {
+		host = "analytic"
+	}
+
+	port := os.Getenv("ANALYTIC_PORT")
+	if port == "" {
+		port = "4444"
+	}
+
+	return fmt.Sprintf("http://%s:%s", host, port)
+}
+
+// Transport of the calls to the mapper and the redirect service, "http" (default) or "grpc"
+func GetInternalTransport() string {
+	transport := os.Getenv("INTERNAL_TRANSPORT")
+	if transport == "" {
+		transport = "http"
+	}
+	return transport
+}
+
+func GetMapperGrpcTarget() string {
+	host := os.Getenv("MAPPER_HOST")
+	if host == "" {
+		host = "mapper"
+	}
+
+	port := os.Getenv("MAPPER_GRPC_PORT")
+	if port == "" {
+		port = "9111"
+	}
+
+	return fmt.Sprintf("%s:%s", host, port)
+}
+
+func GetRedirectGrpcTarget() string {
+	host := os.Getenv("REDIRECT_HOST")
+	if host == "" {
+		host = "redirect"
+	}
+
+	port := os.Getenv("REDIRECT_GRPC_PORT")
+	if port == "" {
+		port = "9222"
+	}
+
+	return fmt.Sprintf("%s:%s", host, port)
+}
+
 func GenUUID() string {
 	return shortuuid.New()
 }
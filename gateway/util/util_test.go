@@ -12,7 +12,7 @@ func TestGetMapperUrl(t *testing.T) {
 func TestGetRedirectUrl(t *testing.T) {
 	redirectUrl := GetRedirectUrl()
 	if redirectUrl != "http://redirect:2222" {
-		t.Errorf("Redirect url is not correct", redirectUrl)
+		t.Errorf("Redirect url is not correct: %s", redirectUrl)
 	}
 }
 
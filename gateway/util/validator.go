@@ -1,11 +1,24 @@
 package util
 
-import "regexp"
+import (
+	"regexp"
+	"strings"
+)
 
-// Check if the provided url is valid, can be http or https and have a valid format
-func IsUrlValid(url string) bool {
-	pattern := `^(http|https):\/\/[a-zA-Z0-9\-\.]+\.[a-zA-Z]{2,3}(\/\S*)?$`
-	return IsMatchRegex(pattern, url)
+// Words that cannot be used as an alias because they clash with gateway routes
+var ReservedAliases = []string{
+	"metrics",
+	"shorten",
+	"redirect",
+	"resolve",
+	"links",
+	"account",
+	"api",
+	"health",
+	"admin",
+	"static",
+	"favicon.ico",
+	"robots.txt",
 }
 
 // Check if the provided url is valid, can be http or https
@@ -13,3 +26,24 @@ func IsMatchRegex(pattern string, url string) bool {
 	regexp, _ := regexp.Compile(pattern)
 	return regexp.MatchString(url)
 }
+
+// Check if the provided short code only contains characters the mapper can generate
+func IsShortCodeValid(code string) bool {
+	return IsMatchRegex(`^[0-9a-zA-Z_\-]{1,64}$`, code)
+}
+
+// Check if the provided alias has a valid format: 3 to 32 letters, digits, "-" or "_",
+// starting and ending with a letter or a digit
+func IsAliasValid(alias string) bool {
+	return IsMatchRegex(`^[0-9a-zA-Z]([0-9a-zA-Z_\-]{1,30})[0-9a-zA-Z]$`, alias)
+}
+
+// Check if the provided alias is a reserved word (case insensitive)
+func IsAliasReserved(alias string) bool {
+	for _, reserved := range ReservedAliases {
+		if strings.EqualFold(alias, reserved) {
+			return true
+		}
+	}
+	return false
+}
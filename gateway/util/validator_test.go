@@ -1,6 +1,10 @@
 package util
 
-import "testing"
+import (
+	"errors"
+	"strings"
+	"testing"
+)
 
 func TestIsUrlValid(t *testing.T) {
 	passUrl := "https://google.com"
@@ -15,6 +19,126 @@ func TestIsUrlValid(t *testing.T) {
 	}
 }
 
+func TestNormalizeUrl(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		expected string
+		err      error
+	}{
+		{"simple", "https://google.com", "https://google.com/", nil},
+		{"long tld", "https://example.photography/a", "https://example.photography/a", nil},
+		{"trim spaces", "  https://google.com/a  ", "https://google.com/a", nil},
+		{"lower case scheme and host", "HTTPS://WWW.Google.COM/Path", "https://www.google.com/Path", nil},
+		{"trailing dot", "https://google.com./", "https://google.com/", nil},
+		{"strip http default port", "http://google.com:80/a", "http://google.com/a", nil},
+		{"strip https default port", "https://google.com:443/a", "https://google.com/a", nil},
+		{"keep custom port", "https://google.com:8443/a", "https://google.com:8443/a", nil},
+		{"strip fragment", "https://google.com/a#section", "https://google.com/a", nil},
+		{"idn to punycode", "https://bücher.example/", "https://xn--bcher-kva.example/", nil},
+		{"punycode kept", "https://xn--bcher-kva.example/", "https://xn--bcher-kva.example/", nil},
+		{"public ipv4", "http://8.8.8.8/dns", "http://8.8.8.8/dns", nil},
+		{"public ipv6", "http://[2001:4860:4860::8888]:8080/", "http://[2001:4860:4860::8888]:8080/", nil},
+		{"strip tracking params", "https://google.com/?utm_source=x&q=go&fbclid=1&UTM_Medium=y", "https://google.com/?q=go", nil},
+		{"sort query", "https://google.com/?b=2&a=1&c=3&a=0", "https://google.com/?a=1&a=0&b=2&c=3", nil},
+		{"keep encoding", "https://google.com/?q=a%20b&p=%2F", "https://google.com/?p=%2F&q=a%20b", nil},
+		{"only tracking params", "https://google.com/a?utm_source=x", "https://google.com/a", nil},
+		{"empty", "", "", ErrUrlEmpty},
+		{"no scheme", "google.com", "", ErrSchemeNotAllowed},
+		{"ftp scheme", "ftp://google.com/file", "", ErrSchemeNotAllowed},
+		{"javascript scheme", "javascript:alert(1)", "", ErrUrlMalformed},
+		{"mailto", "mailto:someone@google.com", "", ErrUrlMalformed},
+		{"credentials", "https://google.com@evil.com/", "", ErrUrlHasCredentials},
+		{"missing host", "https:///path", "", ErrHostInvalid},
+		{"invalid host", "https://goo gle.com/", "", ErrUrlMalformed},
+		{"invalid idn", "https://a..b.com/", "", ErrHostInvalid},
+		{"numeric tld", "http://127.1/", "", ErrHostInvalid},
+		{"hex ip", "http://0x7f.0x1/", "", ErrHostInvalid},
+		{"localhost", "http://localhost:8080/", "", ErrHostNotAllowed},
+		{"localhost subdomain", "http://app.localhost/", "", ErrHostNotAllowed},
+		{"mdns host", "http://printer.local/", "", ErrHostNotAllowed},
+		{"single label host", "http://intranet/", "", ErrHostNotAllowed},
+		{"loopback ipv4", "http://127.0.0.1/", "", ErrHostNotAllowed},
+		{"loopback ipv6", "http://[::1]/", "", ErrHostNotAllowed},
+		{"private ipv4", "http://192.168.1.1/admin", "", ErrHostNotAllowed},
+		{"private ipv4 mapped", "http://[::ffff:10.0.0.1]/", "", ErrHostNotAllowed},
+		{"link local metadata", "http://169.254.169.254/latest", "", ErrHostNotAllowed},
+		{"unspecified", "http://0.0.0.0/", "", ErrHostNotAllowed},
+		{"invalid port", "https://google.com:99999/", "", ErrPortInvalid},
+		{"zero port", "https://google.com:0/", "", ErrPortInvalid},
+		{"too long", "https://google.com/" + strings.Repeat("a", 2048), "", ErrUrlTooLong},
+	}
+
+	rules := DefaultUrlRules()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			normalized, err := NormalizeUrl(test.url, rules)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("NormalizeUrl(%q) error = %v, want %v", test.url, err, test.err)
+			}
+			if normalized != test.expected {
+				t.Errorf("NormalizeUrl(%q) = %q, want %q", test.url, normalized, test.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizeUrlRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    *UrlRules
+		url      string
+		expected string
+		err      error
+	}{
+		{"custom scheme", &UrlRules{AllowedSchemes: []string{"ftp"}}, "ftp://files.example.com/a", "ftp://files.example.com/a", nil},
+		{"scheme not in list", &UrlRules{AllowedSchemes: []string{"https"}}, "http://google.com/", "", ErrSchemeNotAllowed},
+		{"allow private hosts", &UrlRules{AllowedSchemes: []string{"http"}, AllowPrivateHosts: true}, "http://localhost:80/", "http://localhost/", nil},
+		{"allow private ip", &UrlRules{AllowedSchemes: []string{"http"}, AllowPrivateHosts: true}, "http://10.0.0.1:8080/", "http://10.0.0.1:8080/", nil},
+		{"no sort", &UrlRules{AllowedSchemes: []string{"https"}}, "https://google.com/?b=2&a=1", "https://google.com/?b=2&a=1", nil},
+		{"custom strip rules", &UrlRules{AllowedSchemes: []string{"https"}, StripParams: []string{"ref", "pk_*"}}, "https://google.com/?ref=x&pk_campaign=y&utm_source=z", "https://google.com/?utm_source=z", nil},
+		{"custom max length", &UrlRules{AllowedSchemes: []string{"https"}, MaxLength: 20}, "https://google.com/abcdef", "", ErrUrlTooLong},
+		{"max length after normalization", &UrlRules{AllowedSchemes: []string{"https"}, MaxLength: 18}, "https://google.com", "", ErrUrlTooLong},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			normalized, err := NormalizeUrl(test.url, test.rules)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("NormalizeUrl(%q) error = %v, want %v", test.url, err, test.err)
+			}
+			if normalized != test.expected {
+				t.Errorf("NormalizeUrl(%q) = %q, want %q", test.url, normalized, test.expected)
+			}
+		})
+	}
+}
+
+func TestUrlRulesFromEnv(t *testing.T) {
+	t.Setenv("URL_ALLOWED_SCHEMES", "HTTPS, ftp")
+	t.Setenv("URL_STRIP_PARAMS", "ref,pk_*")
+	t.Setenv("URL_MAX_LENGTH", "512")
+	t.Setenv("URL_SORT_QUERY", "false")
+	t.Setenv("URL_ALLOW_PRIVATE_HOSTS", "true")
+
+	rules := UrlRulesFromEnv()
+	if strings.Join(rules.AllowedSchemes, ",") != "https,ftp" {
+		t.Errorf("Allowed schemes should be https,ftp, got %v", rules.AllowedSchemes)
+	}
+	if strings.Join(rules.StripParams, ",") != "ref,pk_*" {
+		t.Errorf("Strip params should be ref,pk_*, got %v", rules.StripParams)
+	}
+	if rules.MaxLength != 512 {
+		t.Errorf("Max length should be 512, got %d", rules.MaxLength)
+	}
+	if rules.SortQuery {
+		t.Errorf("Sort query should be disabled")
+	}
+	if !rules.AllowPrivateHosts {
+		t.Errorf("Private hosts should be allowed")
+	}
+}
+
 func TestIsMatchRegex(t *testing.T) {
 	pattern := `^(http|https):\/\/[a-zA-Z0-9\-\.]+\.[a-zA-Z]{2,3}(\/\S*)?$`
 	passUrl := "https://google.com"
@@ -28,3 +152,115 @@ func TestIsMatchRegex(t *testing.T) {
 		t.Errorf("Url %s should be invalid", failUrl)
 	}
 }
+
+func TestIsShortCodeValid(t *testing.T) {
+	passCodes := []string{"a", "1bZ", "summer-sale", "x_1"}
+	failCodes := []string{"", "a/b", "a b", "é", "a.b"}
+
+	for _, code := range passCodes {
+		if !IsShortCodeValid(code) {
+			t.Errorf("Code %s should be valid", code)
+		}
+	}
+
+	for _, code := range failCodes {
+		if IsShortCodeValid(code) {
+			t.Errorf("Code %s should be invalid", code)
+		}
+	}
+}
+
+func TestIsAliasValid(t *testing.T) {
+	passAliases := []string{"summer-sale", "abc", "Promo_2023", "a1b"}
+	failAliases := []string{"", "ab", "-sale", "sale-", "summer sale", "summer/sale", "a123456789012345678901234567890123"}
+
+	for _, alias := range passAliases {
+		if !IsAliasValid(alias) {
+			t.Errorf("Alias %s should be valid", alias)
+		}
+	}
+
+	for _, alias := range failAliases {
+		if IsAliasValid(alias) {
+			t.Errorf("Alias %s should be invalid", alias)
+		}
+	}
+}
+
+func TestIsAliasReserved(t *testing.T) {
+	if !IsAliasReserved("metrics") {
+		t.Errorf("Alias metrics should be reserved")
+	}
+
+	if !IsAliasReserved("Shorten") {
+		t.Errorf("Alias Shorten should be reserved")
+	}
+
+	if IsAliasReserved("summer-sale") {
+		t.Errorf("Alias summer-sale should not be reserved")
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	t.Setenv("BASE_HOST", "https://lru.example/")
+
+	tests := []struct {
+		name     string
+		domain   string
+		expected string
+		err      error
+	}{
+		{"empty", "", "", nil},
+		{"simple", "go.acme.com", "go.acme.com", nil},
+		{"lower case and trailing dot", " Go.Acme.COM. ", "go.acme.com", nil},
+		{"idn to punycode", "bücher.example", "xn--bcher-kva.example", nil},
+		{"default domain", "LRU.example", "", nil},
+		{"scheme", "https://go.acme.com", "", ErrDomainInvalid},
+		{"port", "go.acme.com:8080", "", ErrDomainInvalid},
+		{"path", "go.acme.com/a", "", ErrDomainInvalid},
+		{"ip", "8.8.8.8", "", ErrDomainInvalid},
+		{"localhost", "localhost", "", ErrHostNotAllowed},
+		{"internal", "links.internal", "", ErrHostNotAllowed},
+		{"single label", "acme", "", ErrHostNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			domain, err := NormalizeDomain(test.domain)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("NormalizeDomain(%q) error = %v, want %v", test.domain, err, test.err)
+			}
+			if domain != test.expected {
+				t.Errorf("NormalizeDomain(%q) = %q, want %q", test.domain, domain, test.expected)
+			}
+		})
+	}
+}
+
+func TestDefaultDomain(t *testing.T) {
+	t.Setenv("BASE_HOST", "")
+	if domain := DefaultDomain(); domain != "localhost" {
+		t.Errorf("DefaultDomain() = %q, want localhost", domain)
+	}
+
+	t.Setenv("BASE_HOST", "https://LRU.example:8443/s/")
+	if domain := DefaultDomain(); domain != "lru.example" {
+		t.Errorf("DefaultDomain() = %q, want lru.example", domain)
+	}
+}
+
+func TestRequestHost(t *testing.T) {
+	tests := map[string]string{
+		"go.acme.com":      "go.acme.com",
+		"Go.Acme.com:3333": "go.acme.com",
+		"go.acme.com.":     "go.acme.com",
+		"[::1]:3333":       "::1",
+		"":                 "",
+	}
+
+	for hostHeader, expected := range tests {
+		if host := RequestHost(hostHeader); host != expected {
+			t.Errorf("RequestHost(%q) = %q, want %q", hostHeader, host, expected)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/HungTP-Play/lru/gateway/util"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// How long the gateway trusts what it knows of a host without asking the mapper again
+var domainCacheTTL = time.Minute
+
+func domainCacheKey(host string) string {
+	return "domain:" + host
+}
+
+// Return the domain the short links of the host live on: the host itself when a
+// workspace registered it, "" (the default domain) for any other host.
+func resolveDomain(ctx context.Context, requestId string, host string) (string, error) {
+	if host == "" || host == util.DefaultDomain() {
+		return "", nil
+	}
+
+	cached, err := cacheClient.Get(domainCacheKey(host))
+	if err == nil {
+		if cached == "1" {
+			return host, nil
+		}
+		return "", nil
+	}
+
+	ctx, domainSpan := tracer.StartSpan("ResolveDomain", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer domainSpan.End()
+
+	// Unknown hosts are cached too, they are what internal and local calls use
+	registered := "1"
+	_, err = mapperClient.GetDomain(ctx, requestId, host)
+	if shared.ServiceErrorStatus(err) == 404 {
+		registered = "0"
+	} else if err != nil {
+		domainSpan.RecordError(err)
+		domainSpan.SetStatus(codes.Error, "Cannot resolve domain")
+		return "", err
+	}
+
+	err = cacheClient.Set(domainCacheKey(host), registered, domainCacheTTL)
+	if err != nil {
+		logger.Error("CannotCacheDomain", zap.String("id", requestId), zap.String("host", host), zap.Error(err))
+	}
+
+	if registered == "1" {
+		return host, nil
+	}
+	return "", nil
+}
+
+// Create a workspace: an admin creates it for any owner, a caller for itself
+func createWorkspaceHandler(c *fiber.Ctx) error {
+	ctx, createSpan := tracer.StartSpan("CreateWorkspaceHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer createSpan.End()
+
+	identity := requireCaller(c)
+	if identity == nil {
+		return unauthorizedResponse(c)
+	}
+
+	requestId := util.GenUUID()
+	var workspaceRequest shared.WorkspaceRequest
+	err := json.Unmarshal(c.Body(), &workspaceRequest)
+	if err != nil {
+		logger.Error("CannotParseBody", zap.String("id", requestId), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Cannot parse body",
+		})
+	}
+
+	workspaceRequest.Id = requestId
+	if !identity.Admin {
+		workspaceRequest.OwnerId = identity.OwnerId
+	}
+	if workspaceRequest.OwnerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	workspace, err := mapperClient.CreateWorkspace(ctx, workspaceRequest)
+	return serviceResponse(c, createSpan, requestId, "create workspace", 201, workspace, err)
+}
+
+// List the workspaces of the caller, or of the ownerId query param for an admin
+func listWorkspacesHandler(c *fiber.Ctx) error {
+	ctx, listSpan := tracer.StartSpan("ListWorkspacesHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer listSpan.End()
+
+	identity := requireCaller(c)
+	if identity == nil {
+		return unauthorizedResponse(c)
+	}
+
+	ownerId := identity.OwnerId
+	if identity.Admin {
+		ownerId = c.Query("ownerId")
+	}
+	if ownerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	requestId := util.GenUUID()
+	workspaces, err := mapperClient.ListWorkspaces(ctx, requestId, ownerId)
+	return serviceResponse(c, listSpan, requestId, "list workspaces", 200, workspaces, err)
+}
+
+// Register a short domain for a workspace of the caller
+func addDomainHandler(c *fiber.Ctx) error {
+	ctx, addSpan := tracer.StartSpan("AddDomainHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer addSpan.End()
+
+	identity := requireCaller(c)
+	if identity == nil {
+		return unauthorizedResponse(c)
+	}
+
+	requestId := util.GenUUID()
+	workspaceId, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(404).JSON(map[string]interface{}{
+			"error": "Not found",
+		})
+	}
+
+	var domainRequest shared.DomainRequest
+	err = json.Unmarshal(c.Body(), &domainRequest)
+	if err != nil {
+		logger.Error("CannotParseBody", zap.String("id", requestId), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Cannot parse body",
+		})
+	}
+
+	host, err := util.NormalizeDomain(domainRequest.Host)
+	if err != nil {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Invalid domain: " + err.Error(),
+		})
+	}
+	if host == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Host cannot be empty or the default domain",
+		})
+	}
+
+	domainRequest.Id = requestId
+	domainRequest.Host = host
+	domainRequest.OwnerId = identity.OwnerId
+	workspace, err := mapperClient.AddDomain(ctx, workspaceId, domainRequest)
+
+	// The host may be cached as unknown, drop it so its links resolve right away
+	if err == nil {
+		uncacheDomain(requestId, host)
+	}
+	return serviceResponse(c, addSpan, requestId, "add domain", 201, workspace, err)
+}
+
+// Remove a short domain from a workspace of the caller
+func removeDomainHandler(c *fiber.Ctx) error {
+	ctx, removeSpan := tracer.StartSpan("RemoveDomainHandler", tracer.Ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer removeSpan.End()
+
+	identity := requireCaller(c)
+	if identity == nil {
+		return unauthorizedResponse(c)
+	}
+
+	requestId := util.GenUUID()
+	workspaceId, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(404).JSON(map[string]interface{}{
+			"error": "Not found",
+		})
+	}
+
+	host, err := util.NormalizeDomain(c.Params("host"))
+	if err != nil || host == "" {
+		return c.Status(404).JSON(map[string]interface{}{
+			"error": "Not found",
+		})
+	}
+
+	err = mapperClient.RemoveDomain(ctx, requestId, identity.OwnerId, workspaceId, host)
+	if err == nil {
+		uncacheDomain(requestId, host)
+	}
+	return serviceResponse(c, removeSpan, requestId, "remove domain", 204, nil, err)
+}
+
+func uncacheDomain(requestId string, host string) {
+	err := cacheClient.Del(domainCacheKey(host))
+	if err != nil {
+		logger.Error("CannotUncacheDomain", zap.String("id", requestId), zap.String("host", host), zap.Error(err))
+	}
+}
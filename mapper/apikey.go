@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/HungTP-Play/lru/mapper/repo"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Answer a repository error of the API key endpoints
+func apiKeyErrorResponse(c *fiber.Ctx, requestId string, err error) error {
+	if errors.Is(err, repo.ErrApiKeyNotFound) {
+		return c.Status(404).JSON(map[string]interface{}{
+			"error": "Not found",
+		})
+	}
+
+	logger.Error("Cannot access api key", zap.String("id", requestId), zap.Int("code", 500), zap.Error(err))
+	return c.Status(500).JSON(map[string]interface{}{
+		"error": "Internal server error",
+	})
+}
+
+func issueApiKeyHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	_, issueSpan := tracer.StartSpan("IssueApiKey", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer issueSpan.End()
+
+	var issueRequest shared.IssueApiKeyRequest
+	err := c.BodyParser(&issueRequest)
+	if err != nil {
+		logger.Error("Cannot parse body", zap.String("id", issueRequest.Id), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Cannot parse body",
+		})
+	}
+
+	if issueRequest.OwnerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	apiKey, key, err := apiKeyRepo.Issue(issueRequest.OwnerId, issueRequest.Name)
+	if err != nil {
+		issueSpan.RecordError(err)
+		issueSpan.SetStatus(codes.Error, "Cannot issue api key")
+		return apiKeyErrorResponse(c, issueRequest.Id, err)
+	}
+
+	logger.Info("Issue api key", zap.String("id", issueRequest.Id), zap.Int("code", 201), zap.Int64("keyId", apiKey.ID), zap.String("ownerId", apiKey.OwnerId))
+	response := apiKey.ToApiKeyResponse()
+	response.Key = key
+	return c.Status(201).JSON(response)
+}
+
+func listApiKeysHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	_, listSpan := tracer.StartSpan("ListApiKeys", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer listSpan.End()
+
+	requestId := c.Get("X-Request-Id")
+	ownerId := c.Get("X-Owner-Id")
+	if ownerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	apiKeys, err := apiKeyRepo.ListByOwner(ownerId)
+	if err != nil {
+		listSpan.RecordError(err)
+		return apiKeyErrorResponse(c, requestId, err)
+	}
+
+	responses := make([]shared.ApiKeyResponse, 0, len(apiKeys))
+	for _, apiKey := range apiKeys {
+		responses = append(responses, apiKey.ToApiKeyResponse())
+	}
+	return c.Status(200).JSON(responses)
+}
+
+func revokeApiKeyHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	_, revokeSpan := tracer.StartSpan("RevokeApiKey", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer revokeSpan.End()
+
+	requestId := c.Get("X-Request-Id")
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(404).JSON(map[string]interface{}{
+			"error": "Not found",
+		})
+	}
+
+	apiKey, err := apiKeyRepo.Revoke(id, c.Get("X-Owner-Id"))
+	if err != nil {
+		revokeSpan.RecordError(err)
+		return apiKeyErrorResponse(c, requestId, err)
+	}
+
+	logger.Info("Revoke api key", zap.String("id", requestId), zap.Int("code", 200), zap.Int64("keyId", apiKey.ID), zap.String("ownerId", apiKey.OwnerId))
+
+	// The hash lets the gateway drop the key from its cache
+	response := apiKey.ToApiKeyResponse()
+	response.KeyHash = apiKey.KeyHash
+	return c.Status(200).JSON(response)
+}
+
+func verifyApiKeyHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	_, verifySpan := tracer.StartSpan("VerifyApiKey", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer verifySpan.End()
+
+	apiKey, err := apiKeyRepo.GetByHash(c.Params("hash"))
+	if err != nil {
+		verifySpan.RecordError(err)
+		return apiKeyErrorResponse(c, c.Get("X-Request-Id"), err)
+	}
+
+	return c.Status(200).JSON(apiKey.ToApiKeyResponse())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/HungTP-Play/lru/mapper/repo"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+func mapBatchHandler(c *fiber.Ctx) error {
+	var mapBatchRequest shared.MapBatchRequest
+	ctx := shared.GetParentContext(c)
+	ctx, mapBatchSpan := tracer.StartSpan("MapBatch", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer mapBatchSpan.End()
+
+	err := c.BodyParser(&mapBatchRequest)
+	if err != nil {
+		logger.Error("Cannot parse body", zap.String("id", mapBatchRequest.Id), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Cannot parse body",
+		})
+	}
+
+	logger.Info("Map batch request", zap.String("id", mapBatchRequest.Id), zap.Int("count", len(mapBatchRequest.Items)))
+
+	results := make([]shared.MapBatchResult, len(mapBatchRequest.Items))
+	var valid []shared.MapUrlRequest
+	var validIndexes []int
+	for i, item := range mapBatchRequest.Items {
+		results[i] = shared.MapBatchResult{Index: i, Url: item.Url}
+		message := validateMapUrlRequest(item)
+		if message != "" {
+			results[i].Status = 400
+			results[i].Error = message
+			continue
+		}
+		if status, message, err := checkMapDomain(item); status != 0 {
+			if err != nil {
+				logger.Error("Cannot check domain", zap.String("id", mapBatchRequest.Id), zap.Int("index", i), zap.Error(err))
+			}
+			results[i].Status = status
+			results[i].Error = message
+			continue
+		}
+		if match := blockedUrl(mapBatchRequest.Id, item.Url); match != nil {
+			results[i].Status = 422
+			results[i].Error = blockedUrlMessage(match)
+			continue
+		}
+		valid = append(valid, item)
+		validIndexes = append(validIndexes, i)
+	}
+
+	storeCtx, storeSpan := tracer.StartSpan("StoreDB", ctx)
+	urlMappings, errs := mapRepo.MapBatch(valid, mappingEvents(storeCtx, shared.EventLinkCreated, true))
+	storeSpan.End()
+
+	mapped := 0
+	for j, i := range validIndexes {
+		if errs[j] != nil {
+			results[i].Status = 500
+			results[i].Error = "Internal server error"
+			if errors.Is(errs[j], repo.ErrAliasTaken) {
+				results[i].Status = 409
+				results[i].Error = "Alias is already taken"
+			} else if errors.Is(errs[j], repo.ErrDomainNotFound) {
+				results[i].Status = 422
+				results[i].Error = "Unknown domain"
+			} else {
+				storeSpan.RecordError(errs[j])
+				logger.Error("Cannot map url", zap.String("id", mapBatchRequest.Id), zap.Int("index", i), zap.Error(errs[j]))
+			}
+			continue
+		}
+
+		urlMapping := urlMappings[j]
+		results[i].Status = 200
+		results[i].Code = urlMapping.Code
+		results[i].Shortened = urlMapping.ShortUrl
+		mapped++
+	}
+
+	if mapped > 0 {
+		notifyOutbox()
+	} else if len(valid) > 0 {
+		mapBatchSpan.SetStatus(codes.Error, "No url mapped")
+	}
+
+	logger.Info("Map batch response", zap.String("id", mapBatchRequest.Id), zap.Int("code", 200), zap.Int("count", len(results)), zap.Int("mapped", mapped))
+	return c.Status(200).JSON(shared.MapBatchResponse{
+		Id:      mapBatchRequest.Id,
+		Results: results,
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/HungTP-Play/lru/mapper/screener"
+	"github.com/HungTP-Play/lru/shared"
+	"go.uber.org/zap"
+)
+
+// Screen the url against the blocklist, return a 422 error when it is blocked
+func checkBlockedUrl(requestId string, url string) error {
+	match := blockedUrl(requestId, url)
+	if match == nil {
+		return nil
+	}
+	return shared.NewServiceError(422, blockedUrlMessage(match))
+}
+
+// Screen the url against the blocklist and return the rule it matches, if any
+func blockedUrl(requestId string, url string) *screener.Match {
+	match := urlScreener.Screen(url)
+	if match != nil {
+		metrics.IncCounter(blockedUrls, "rejected", match.Kind)
+		logger.Info("Url blocked", zap.String("id", requestId), zap.Int("code", 422), zap.String("url", url), zap.String("kind", match.Kind), zap.String("rule", match.Rule))
+	}
+	return match
+}
+
+func blockedUrlMessage(match *screener.Match) string {
+	return "Url is blocked: it matches the " + match.Kind + " blocklist"
+}
+
+// Disable the existing links blocked by the blocklist loaded at startup, then reload it
+// when its file changes and disable the links it now blocks
+//
+// - BLOCKLIST_PATH: blocklist file, screening is off when empty
+// - BLOCKLIST_RELOAD_INTERVAL: time between two checks of the file (default 30s)
+func watchBlocklist(ctx context.Context) {
+	if os.Getenv("BLOCKLIST_PATH") == "" {
+		return
+	}
+
+	// Links created before a rule was added while the mapper was down
+	if blocklist := urlScreener.Blocklist(); blocklist != nil && blocklist.Len() > 0 {
+		disableBlockedLinks(blocklist)
+	}
+
+	interval := shared.GetEnvDuration("BLOCKLIST_RELOAD_INTERVAL", 30*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := urlScreener.Reload()
+		if err != nil {
+			logger.Error("Cannot reload blocklist", zap.String("path", urlScreener.Path), zap.Error(err))
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		blocklist := urlScreener.Blocklist()
+		logger.Info("Reload blocklist", zap.String("path", urlScreener.Path), zap.Int("rules", blocklist.Len()), zap.String("checksum", blocklist.Checksum))
+		disableBlockedLinks(blocklist)
+	}
+}
+
+// Disable the enabled links matching the blocklist and tell the redirect service about it
+func disableBlockedLinks(blocklist *screener.Blocklist) {
+	ctx, disableSpan := tracer.StartSpan("DisableBlockedLinks", context.Background())
+	defer disableSpan.End()
+
+	requestId := "blocklist-" + blocklist.Checksum[:12]
+	batchSize := 1000
+	disabled := true
+	events := mappingEvents(ctx, shared.EventLinkUpdated, false)
+	var afterId int64
+	var total int
+	for {
+		urlMappings, err := mapRepo.ListEnabled(afterId, batchSize)
+		if err != nil {
+			disableSpan.RecordError(err)
+			logger.Error("Cannot list links to screen", zap.String("id", requestId), zap.Error(err))
+			return
+		}
+
+		for _, urlMapping := range urlMappings {
+			afterId = urlMapping.ID
+			match := blocklist.Screen(urlMapping.LongUrl)
+			if match == nil {
+				continue
+			}
+
+			disabledMapping, err := mapRepo.Update(urlMapping.Code, shared.UpdateLinkRequest{Id: requestId, Domain: urlMapping.Domain, Disabled: &disabled}, events)
+			if err != nil {
+				disableSpan.RecordError(err)
+				logger.Error("Cannot disable blocked link", zap.String("id", requestId), zap.String("shortCode", urlMapping.Code), zap.Error(err))
+				continue
+			}
+
+			total++
+			metrics.IncCounter(blockedUrls, "disabled", match.Kind)
+			logger.Info("Disable blocked link", zap.String("id", requestId), zap.String("shortCode", disabledMapping.Code), zap.String("url", disabledMapping.LongUrl), zap.String("kind", match.Kind), zap.String("rule", match.Rule))
+			notifyOutbox()
+		}
+
+		if len(urlMappings) < batchSize {
+			break
+		}
+	}
+
+	logger.Info("Screen existing links", zap.String("id", requestId), zap.Int("disabled", total))
+}
@@ -0,0 +1,66 @@
+package generator
+
+import (
+	"sync"
+
+	"github.com/HungTP-Play/lru/mapper/util"
+	"gorm.io/gorm"
+)
+
+const codeRangeName = "url_mapping"
+
+// BlockGenerator leases ranges of ids from the database and hands them out
+// from memory, so every mapper instance only hits the database once per block.
+// Ids left in a block when an instance stops are simply never used.
+type BlockGenerator struct {
+	db        *gorm.DB
+	blockSize int64
+	mu        sync.Mutex
+	next      int64
+	end       int64
+	lease     func(size int64) (int64, error)
+}
+
+func NewBlockGenerator(db *gorm.DB, blockSize int64) *BlockGenerator {
+	g := &BlockGenerator{
+		db:        db,
+		blockSize: blockSize,
+	}
+	g.lease = g.leaseBlock
+	return g
+}
+
+// Create the range table and start it after the ids already in use
+func (g *BlockGenerator) Init() error {
+	err := g.db.Exec("CREATE TABLE IF NOT EXISTS code_ranges (name TEXT PRIMARY KEY, next_id BIGINT NOT NULL)").Error
+	if err != nil {
+		return err
+	}
+
+	return g.db.Exec("INSERT INTO code_ranges (name, next_id) VALUES (?, (SELECT COALESCE(MAX(id), 0) + 1 FROM url_mappings)) ON CONFLICT (name) DO NOTHING", codeRangeName).Error
+}
+
+// Atomically move the shared counter forward and return the start of the leased block
+func (g *BlockGenerator) leaseBlock(size int64) (int64, error) {
+	var start int64
+	err := g.db.Raw("UPDATE code_ranges SET next_id = next_id + ? WHERE name = ? RETURNING next_id - ?", size, codeRangeName, size).Scan(&start).Error
+	return start, err
+}
+
+func (g *BlockGenerator) Next() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.next >= g.end {
+		start, err := g.lease(g.blockSize)
+		if err != nil {
+			return "", err
+		}
+		g.next = start
+		g.end = start + g.blockSize
+	}
+
+	id := g.next
+	g.next++
+	return util.Base62Encode(id), nil
+}
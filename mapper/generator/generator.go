@@ -0,0 +1,96 @@
+package generator
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+const (
+	SequenceStrategy = "sequence"
+	BlockStrategy    = "block"
+	RandomStrategy   = "random"
+)
+
+// CodeGenerator produces the short code of a new url mapping.
+//
+// Codes are not guaranteed to be unique on their own (a random code can
+// collide, and legacy rows may already use a sequence value), the unique
+// index on the mapping table is the final arbiter and the caller is expected
+// to ask for another code when an insert hits it.
+type CodeGenerator interface {
+	// Init prepares whatever the generator needs in the database
+	Init() error
+	// Next returns a new short code
+	Next() (string, error)
+}
+
+// BatchCodeGenerator is implemented by generators able to produce several codes at once
+type BatchCodeGenerator interface {
+	NextN(n int) ([]string, error)
+}
+
+// Return n new codes, in a single call when the generator supports it
+func NextN(generator CodeGenerator, n int) ([]string, error) {
+	if batchGenerator, ok := generator.(BatchCodeGenerator); ok {
+		return batchGenerator.NextN(n)
+	}
+
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		code, err := generator.Next()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+type Config struct {
+	Strategy  string
+	BlockSize int64
+	Length    int
+}
+
+func getEnvInt(key string, fallback int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Return the generator configuration from the environment
+//
+// - CODE_GENERATOR: sequence (default), block or random
+// - CODE_BLOCK_SIZE: number of ids leased at once by the block generator (default 1000)
+// - CODE_LENGTH: length of the codes built by the random generator (default 7)
+func DefaultConfig() *Config {
+	strategy := os.Getenv("CODE_GENERATOR")
+	if strategy == "" {
+		strategy = SequenceStrategy
+	}
+
+	return &Config{
+		Strategy:  strategy,
+		BlockSize: getEnvInt("CODE_BLOCK_SIZE", 1000),
+		Length:    int(getEnvInt("CODE_LENGTH", 7)),
+	}
+}
+
+// Build the generator selected by the configuration
+func New(config *Config, db *gorm.DB) (CodeGenerator, error) {
+	switch config.Strategy {
+	case SequenceStrategy:
+		return NewSequenceGenerator(db), nil
+	case BlockStrategy:
+		return NewBlockGenerator(db, config.BlockSize), nil
+	case RandomStrategy:
+		return NewRandomGenerator(config.Length), nil
+	default:
+		return nil, fmt.Errorf("unknown code generator: %s", config.Strategy)
+	}
+}
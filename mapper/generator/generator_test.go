@@ -0,0 +1,77 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/HungTP-Play/lru/mapper/util"
+)
+
+func TestRandomGenerator(t *testing.T) {
+	generator := NewRandomGenerator(7)
+	seen := map[string]bool{}
+
+	for i := 0; i < 1000; i++ {
+		code, err := generator.Next()
+		if err != nil {
+			t.Fatalf("Cannot generate code: %v", err)
+		}
+		if len(code) != 7 {
+			t.Errorf("Code %s should have 7 characters", code)
+		}
+		for _, char := range code {
+			if !strings.ContainsRune(util.Base62Chars, char) {
+				t.Errorf("Code %s should only contain base62 characters", code)
+			}
+		}
+		if seen[code] {
+			t.Errorf("Code %s is duplicated", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestBlockGenerator(t *testing.T) {
+	generator := NewBlockGenerator(nil, 3)
+	leases := 0
+	nextStart := int64(10)
+	generator.lease = func(size int64) (int64, error) {
+		leases++
+		start := nextStart
+		nextStart += size
+		return start, nil
+	}
+
+	expected := []int64{10, 11, 12, 13, 14, 15, 16}
+	for _, id := range expected {
+		code, err := generator.Next()
+		if err != nil {
+			t.Fatalf("Cannot generate code: %v", err)
+		}
+		if code != util.Base62Encode(id) {
+			t.Errorf("Code should be %s, got %s", util.Base62Encode(id), code)
+		}
+	}
+
+	if leases != 3 {
+		t.Errorf("Generator should lease 3 blocks, leased %d", leases)
+	}
+}
+
+func TestNewUnknownStrategy(t *testing.T) {
+	_, err := New(&Config{Strategy: "unknown"}, nil)
+	if err == nil {
+		t.Errorf("Unknown strategy should return an error")
+	}
+}
+
+func TestNextN(t *testing.T) {
+	codes, err := NextN(NewRandomGenerator(5), 10)
+	if err != nil {
+		t.Fatalf("Cannot generate codes: %v", err)
+	}
+
+	if len(codes) != 10 {
+		t.Errorf("Should generate 10 codes, got %d", len(codes))
+	}
+}
@@ -0,0 +1,38 @@
+package generator
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/HungTP-Play/lru/mapper/util"
+)
+
+// RandomGenerator builds fixed length codes from a cryptographically secure source.
+// Codes are not guessable but may collide, in which case the insert is retried.
+type RandomGenerator struct {
+	length int
+}
+
+func NewRandomGenerator(length int) *RandomGenerator {
+	return &RandomGenerator{
+		length: length,
+	}
+}
+
+func (g *RandomGenerator) Init() error {
+	return nil
+}
+
+func (g *RandomGenerator) Next() (string, error) {
+	code := make([]byte, g.length)
+	max := big.NewInt(int64(len(util.Base62Chars)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = util.Base62Chars[n.Int64()]
+	}
+
+	return string(code), nil
+}
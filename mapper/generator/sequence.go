@@ -0,0 +1,59 @@
+package generator
+
+import (
+	"github.com/HungTP-Play/lru/mapper/util"
+	"gorm.io/gorm"
+)
+
+const codeSequence = "url_mapping_code_seq"
+
+// SequenceGenerator encodes the next value of a Postgres sequence.
+// Every call costs one round trip to the database.
+type SequenceGenerator struct {
+	db *gorm.DB
+}
+
+func NewSequenceGenerator(db *gorm.DB) *SequenceGenerator {
+	return &SequenceGenerator{
+		db: db,
+	}
+}
+
+// Create the sequence and move it past the ids already in use
+func (g *SequenceGenerator) Init() error {
+	err := g.db.Exec("CREATE SEQUENCE IF NOT EXISTS " + codeSequence).Error
+	if err != nil {
+		return err
+	}
+
+	return g.db.Exec("SELECT setval(?, GREATEST((SELECT last_value FROM "+codeSequence+"), (SELECT COALESCE(MAX(id), 1) FROM url_mappings)))", codeSequence).Error
+}
+
+func (g *SequenceGenerator) Next() (string, error) {
+	var id int64
+	err := g.db.Raw("SELECT nextval(?)", codeSequence).Scan(&id).Error
+	if err != nil {
+		return "", err
+	}
+
+	return util.Base62Encode(id), nil
+}
+
+// Reserve n values of the sequence in a single round trip
+func (g *SequenceGenerator) NextN(n int) ([]string, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	var ids []int64
+	err := g.db.Raw("SELECT nextval(?) FROM generate_series(1, ?)", codeSequence, n).Scan(&ids).Error
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, len(ids))
+	for _, id := range ids {
+		codes = append(codes, util.Base62Encode(id))
+	}
+	return codes, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/HungTP-Play/lru/shared/pb"
+)
+
+// gRPC API of the mapper, answering like the HTTP routes of the same operations
+type mapperServer struct {
+	pb.UnimplementedMapperServiceServer
+}
+
+func (s *mapperServer) Map(ctx context.Context, request *pb.MapRequest) (*pb.MapResponse, error) {
+	mapUrlResponse, err := mapUrl(ctx, shared.MapUrlRequestFromProto(request))
+	if err != nil {
+		return nil, shared.GrpcError(err)
+	}
+	return shared.MapUrlResponseToProto(mapUrlResponse), nil
+}
+
+func (s *mapperServer) GetLink(ctx context.Context, request *pb.LinkRef) (*pb.Link, error) {
+	link, err := getLink(ctx, request.GetId(), request.GetDomain(), request.GetCode(), request.GetOwnerId())
+	if err != nil {
+		return nil, shared.GrpcError(err)
+	}
+	return shared.LinkResponseToProto(link), nil
+}
+
+func (s *mapperServer) UpdateLink(ctx context.Context, request *pb.UpdateLinkRequest) (*pb.Link, error) {
+	code, updateRequest := shared.UpdateLinkRequestFromProto(request)
+	link, err := updateLink(ctx, code, updateRequest)
+	if err != nil {
+		return nil, shared.GrpcError(err)
+	}
+	return shared.LinkResponseToProto(link), nil
+}
+
+func (s *mapperServer) DeleteLink(ctx context.Context, request *pb.LinkRef) (*pb.DeleteLinkResponse, error) {
+	err := deleteLink(ctx, request.GetId(), request.GetDomain(), request.GetCode(), request.GetOwnerId())
+	if err != nil {
+		return nil, shared.GrpcError(err)
+	}
+	return &pb.DeleteLinkResponse{}, nil
+}
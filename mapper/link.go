@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/HungTP-Play/lru/mapper/model"
+	"github.com/HungTP-Play/lru/mapper/repo"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// ServiceError of a repository error of the link management endpoints
+func linkError(requestId string, code string, err error) error {
+	if errors.Is(err, repo.ErrNotFound) {
+		logger.Info("Link not found", zap.String("id", requestId), zap.Int("code", 404), zap.String("shortCode", code))
+		return shared.NewServiceError(404, "Not found")
+	}
+
+	logger.Error("Cannot access link", zap.String("id", requestId), zap.Int("code", 500), zap.String("shortCode", code), zap.Error(err))
+	return shared.NewServiceError(500, "Internal server error")
+}
+
+// Payload of the event announcing the change of the link, it carries the whole state
+// of the link but for a deletion
+func linkEventData(eventType string, urlMapping model.UrlMapping) interface{} {
+	if eventType == shared.EventLinkDeleted {
+		return shared.LinkDeletedV1{
+			Code:     urlMapping.Code,
+			Domain:   urlMapping.Domain,
+			Url:      urlMapping.LongUrl,
+			ShortUrl: urlMapping.ShortUrl,
+			OwnerId:  urlMapping.OwnerId,
+		}
+	}
+
+	link := shared.LinkCreatedV1{
+		Code:         urlMapping.Code,
+		Domain:       urlMapping.Domain,
+		Url:          urlMapping.LongUrl,
+		ShortUrl:     urlMapping.ShortUrl,
+		OwnerId:      urlMapping.OwnerId,
+		RedirectType: urlMapping.RedirectType,
+		ExpiresAt:    urlMapping.ExpiresAtUnix(),
+		MaxClicks:    urlMapping.MaxClicks,
+		Disabled:     urlMapping.Disabled,
+	}
+	if eventType == shared.EventLinkUpdated {
+		return shared.LinkUpdatedV1(link)
+	}
+	return link
+}
+
+func getLinkHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	ctx, getLinkSpan := tracer.StartSpan("GetLink", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer getLinkSpan.End()
+
+	link, err := getLink(ctx, c.Get("X-Request-Id"), c.Query("domain"), c.Params("code"), c.Get("X-Owner-Id"))
+	if err != nil {
+		return shared.ServiceErrorResponse(c, err)
+	}
+	return c.Status(200).JSON(link)
+}
+
+// Return the link of the owner, any link when the owner is empty
+func getLink(ctx context.Context, requestId string, domain string, code string, ownerId string) (shared.LinkResponse, error) {
+	urlMapping, err := mapRepo.GetByCode(domain, code, ownerId)
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(err)
+		return shared.LinkResponse{}, linkError(requestId, code, err)
+	}
+
+	return urlMapping.ToLinkResponse(), nil
+}
+
+func updateLinkHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	ctx, updateLinkSpan := tracer.StartSpan("UpdateLink", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer updateLinkSpan.End()
+
+	var updateRequest shared.UpdateLinkRequest
+	err := c.BodyParser(&updateRequest)
+	logger.Info("Update link request", zap.String("id", updateRequest.Id), zap.String("body", string(c.Body())), zap.String("shortCode", c.Params("code")))
+	if err != nil {
+		logger.Error("Cannot parse body", zap.String("id", updateRequest.Id), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Cannot parse body",
+		})
+	}
+
+	// Only the links of the caller can be changed, the gateway tells who it is
+	updateRequest.OwnerId = c.Get("X-Owner-Id")
+	updateRequest.Domain = c.Query("domain")
+
+	link, err := updateLink(ctx, c.Params("code"), updateRequest)
+	if err != nil {
+		return shared.ServiceErrorResponse(c, err)
+	}
+	return c.Status(200).JSON(link)
+}
+
+// Apply the partial update to the link of the owner, any link when the owner is empty
+func updateLink(ctx context.Context, code string, updateRequest shared.UpdateLinkRequest) (shared.LinkResponse, error) {
+	if updateRequest.Url != nil && *updateRequest.Url == "" {
+		return shared.LinkResponse{}, shared.NewServiceError(400, "Url cannot be empty")
+	}
+
+	if updateRequest.RedirectType != nil && !shared.IsRedirectTypeValid(*updateRequest.RedirectType) {
+		return shared.LinkResponse{}, shared.NewServiceError(400, "Invalid redirect type")
+	}
+
+	if updateRequest.ExpiresAt != nil && *updateRequest.ExpiresAt != 0 && *updateRequest.ExpiresAt <= time.Now().Unix() {
+		return shared.LinkResponse{}, shared.NewServiceError(400, "Expiry must be in the future")
+	}
+
+	if updateRequest.MaxClicks != nil && *updateRequest.MaxClicks < 0 {
+		return shared.LinkResponse{}, shared.NewServiceError(400, "Max clicks cannot be negative")
+	}
+
+	if updateRequest.Url != nil {
+		err := checkBlockedUrl(updateRequest.Id, *updateRequest.Url)
+		if err != nil {
+			return shared.LinkResponse{}, err
+		}
+	}
+
+	// A link disabled by the blocklist cannot be enabled again while its url is blocked
+	if updateRequest.Url == nil && updateRequest.Disabled != nil && !*updateRequest.Disabled {
+		urlMapping, err := mapRepo.GetByCode(updateRequest.Domain, code, updateRequest.OwnerId)
+		if err != nil {
+			return shared.LinkResponse{}, linkError(updateRequest.Id, code, err)
+		}
+		err = checkBlockedUrl(updateRequest.Id, urlMapping.LongUrl)
+		if err != nil {
+			return shared.LinkResponse{}, err
+		}
+	}
+
+	ctx, dbSpan := tracer.StartSpan("UpdateDB", ctx)
+	urlMapping, err := mapRepo.Update(code, updateRequest, mappingEvents(ctx, shared.EventLinkUpdated, true))
+	if err != nil {
+		dbSpan.RecordError(err)
+		dbSpan.SetStatus(codes.Error, "Cannot update link")
+		dbSpan.End()
+		return shared.LinkResponse{}, linkError(updateRequest.Id, code, err)
+	}
+	dbSpan.End()
+
+	notifyOutbox()
+
+	logger.Info("Update link response", zap.String("id", updateRequest.Id), zap.Int("code", 200), zap.String("shortCode", urlMapping.Code))
+	return urlMapping.ToLinkResponse(), nil
+}
+
+func deleteLinkHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	ctx, deleteLinkSpan := tracer.StartSpan("DeleteLink", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer deleteLinkSpan.End()
+
+	err := deleteLink(ctx, c.Get("X-Request-Id"), c.Query("domain"), c.Params("code"), c.Get("X-Owner-Id"))
+	if err != nil {
+		return shared.ServiceErrorResponse(c, err)
+	}
+	return c.SendStatus(204)
+}
+
+// Delete the link of the owner, any link when the owner is empty
+func deleteLink(ctx context.Context, requestId string, domain string, code string, ownerId string) error {
+	logger.Info("Delete link request", zap.String("id", requestId), zap.String("shortCode", code))
+
+	ctx, dbSpan := tracer.StartSpan("DeleteDB", ctx)
+	urlMapping, err := mapRepo.Delete(domain, code, ownerId, mappingEvents(ctx, shared.EventLinkDeleted, true))
+	if err != nil {
+		dbSpan.RecordError(err)
+		dbSpan.SetStatus(codes.Error, "Cannot delete link")
+		dbSpan.End()
+		return linkError(requestId, code, err)
+	}
+	dbSpan.End()
+
+	notifyOutbox()
+
+	logger.Info("Delete link response", zap.String("id", requestId), zap.Int("code", 204), zap.String("shortCode", urlMapping.Code))
+	return nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/HungTP-Play/lru/mapper/generator"
 	"github.com/HungTP-Play/lru/mapper/model"
 	"github.com/HungTP-Play/lru/mapper/repo"
+	"github.com/HungTP-Play/lru/mapper/screener"
 	"github.com/HungTP-Play/lru/shared"
+	"github.com/HungTP-Play/lru/shared/pb"
 	"github.com/gofiber/fiber/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel/codes"
@@ -16,28 +21,74 @@ import (
 )
 
 var mapRepo *repo.UrlMappingRepo
+var apiKeyRepo *repo.ApiKeyRepo
+var workspaceRepo *repo.WorkspaceRepo
+var outboxRepo *repo.OutboxRepo
 var logger *shared.Logger
-var rabbitmq *shared.RabbitMQ
+var bus shared.Bus
 var metrics *shared.Metrics
 var requestPerSecond *prometheus.CounterVec
 var TwoXXStatusCode *prometheus.GaugeVec
 var FourXXStatusCode *prometheus.GaugeVec
 var FiveXXStatusCode *prometheus.GaugeVec
+var blockedUrls *prometheus.CounterVec
+var outboxPending *prometheus.GaugeVec
+var outboxLag *prometheus.GaugeVec
+var outboxPublished *prometheus.CounterVec
+var outboxPublishErrors *prometheus.CounterVec
+var outboxParked *prometheus.CounterVec
+var urlScreener *screener.FileScreener
 
 var tracer *shared.Tracer
 
 func init() {
+	logger = shared.NewLogger("mapper.log", 3, 1024, "info", "mapper")
+	logger.Init()
+
 	mapRepo = repo.NewUrlMappingRepo("")
 
 	// Auto migrate
-	mapRepo.DB.Migrate(&model.UrlMapping{})
+	err := mapRepo.Migrate()
+	if err != nil {
+		logger.Error("Cannot migrate url mappings", zap.Error(err))
+		panic(err)
+	}
 
-	logger = shared.NewLogger("mapper.log", 3, 1024, "info", "mapper")
-	logger.Init()
+	apiKeyRepo = repo.NewApiKeyRepo("")
+	apiKeyRepo.DB.Migrate(&model.ApiKey{})
+
+	workspaceRepo = repo.NewWorkspaceRepo("")
+	workspaceRepo.DB.Migrate(&model.Workspace{})
+	workspaceRepo.DB.Migrate(&model.Domain{})
+
+	outboxRepo = repo.NewOutboxRepo("")
+	outboxRepo.DB.Migrate(&model.OutboxMessage{})
 
-	// Init rabbitmq
-	rabbitmq = shared.NewRabbitMQ("")
-	rabbitmq.Connect(10 * time.Second)
+	// Init code generator
+	generatorConfig := generator.DefaultConfig()
+	err = mapRepo.InitGenerator(generatorConfig)
+	if err != nil {
+		logger.Error("Cannot init code generator", zap.String("strategy", generatorConfig.Strategy), zap.Error(err))
+		panic(err)
+	}
+
+	// Init url screener
+	urlScreener = screener.NewFileScreener(os.Getenv("BLOCKLIST_PATH"))
+	_, err = urlScreener.Reload()
+	if err != nil {
+		logger.Error("Cannot load blocklist", zap.String("path", urlScreener.Path), zap.Error(err))
+		panic(err)
+	}
+
+	// Init message bus, selected by BUS_DRIVER
+	bus, err = shared.ConnectBus(10 * time.Second)
+	if bus == nil {
+		logger.Error("Cannot init message bus", zap.Error(err))
+		panic(err)
+	}
+	if err != nil {
+		logger.Error("Cannot connect to message bus, retrying in background", zap.Error(err))
+	}
 
 	// Init metrics
 	metrics = shared.NewMetrics()
@@ -45,6 +96,12 @@ func init() {
 	TwoXXStatusCode = metrics.RegisterGauge("status_code_2xx", "2xx status code", []string{"method", "path", "code"})
 	FourXXStatusCode = metrics.RegisterGauge("status_code_4xx", "4xx status code", []string{"method", "path", "code"})
 	FiveXXStatusCode = metrics.RegisterGauge("status_code_5xx", "5xx status code", []string{"method", "path", "code"})
+	blockedUrls = metrics.RegisterCounter("blocked_urls", "Urls rejected or disabled by the blocklist", []string{"action", "kind"})
+	outboxPending = metrics.RegisterGauge("outbox_pending", "Outbox messages waiting to be published", []string{})
+	outboxLag = metrics.RegisterGauge("outbox_lag_seconds", "Age of the oldest outbox message waiting to be published", []string{})
+	outboxPublished = metrics.RegisterCounter("outbox_published", "Outbox messages published", []string{"queue"})
+	outboxPublishErrors = metrics.RegisterCounter("outbox_publish_errors", "Failed attempts to publish an outbox message", []string{"queue"})
+	outboxParked = metrics.RegisterCounter("outbox_parked", "Outbox messages parked after too many failed attempts", []string{"queue"})
 
 	// Init tracer
 	tracer = shared.NewTracer("mapper", "")
@@ -56,7 +113,10 @@ func init() {
 func onGratefulShutDown() {
 	logger.Info("Shutting down...")
 	mapRepo.DB.Close()
-	rabbitmq.Close()
+	apiKeyRepo.Close()
+	workspaceRepo.Close()
+	outboxRepo.Close()
+	bus.Close()
 }
 
 func RequestPerSecondMiddleware(c *fiber.Ctx) error {
@@ -91,10 +151,31 @@ func metricsHandler(c *fiber.Ctx) error {
 	return c.Type("text/plain").SendString(metrics)
 }
 
+// Check the request can be mapped, return the reason when it cannot
+func validateMapUrlRequest(mapUrlRequest shared.MapUrlRequest) string {
+	if mapUrlRequest.Url == "" {
+		return "Url cannot be empty"
+	}
+
+	if mapUrlRequest.RedirectType != 0 && !shared.IsRedirectTypeValid(mapUrlRequest.RedirectType) {
+		return "Invalid redirect type"
+	}
+
+	if mapUrlRequest.ExpiresAt != 0 && mapUrlRequest.ExpiresAt <= time.Now().Unix() {
+		return "Expiry must be in the future"
+	}
+
+	if mapUrlRequest.MaxClicks < 0 {
+		return "Max clicks cannot be negative"
+	}
+
+	return ""
+}
+
 func mapHandler(c *fiber.Ctx) error {
 	var mapUrlRequest shared.MapUrlRequest
 	ctx := shared.GetParentContext(c)
-	_, mapSpan := tracer.StartSpan("Map", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	ctx, mapSpan := tracer.StartSpan("Map", ctx, trace.WithSpanKind(trace.SpanKindServer))
 	defer mapSpan.End()
 
 	body := c.Body()
@@ -107,70 +188,126 @@ func mapHandler(c *fiber.Ctx) error {
 		})
 	}
 
+	mapUrlResponse, err := mapUrl(ctx, mapUrlRequest)
+	if err != nil {
+		return shared.ServiceErrorResponse(c, err)
+	}
+	return c.Status(200).JSON(mapUrlResponse)
+}
+
+// Shorten the url of the request, for the HTTP and gRPC APIs.
+// Return a ServiceError when it cannot be mapped.
+func mapUrl(ctx context.Context, mapUrlRequest shared.MapUrlRequest) (shared.MapUrlResponse, error) {
+	span := trace.SpanFromContext(ctx)
+
+	message := validateMapUrlRequest(mapUrlRequest)
+	if message != "" {
+		logger.Error("Invalid map request", zap.String("id", mapUrlRequest.Id), zap.Int("code", 400), zap.String("error", message))
+		return shared.MapUrlResponse{}, shared.NewServiceError(400, message)
+	}
+
+	status, message, err := checkMapDomain(mapUrlRequest)
+	if status != 0 {
+		if err != nil {
+			span.RecordError(err)
+		}
+		logger.Info("Invalid map domain", zap.String("id", mapUrlRequest.Id), zap.Int("code", status), zap.String("domain", mapUrlRequest.Domain), zap.Error(err))
+		return shared.MapUrlResponse{}, shared.NewServiceError(status, message)
+	}
+
+	err = checkBlockedUrl(mapUrlRequest.Id, mapUrlRequest.Url)
+	if err != nil {
+		return shared.MapUrlResponse{}, err
+	}
+
 	ctx, mapUrlSpan := tracer.StartSpan("StoreDB", ctx)
-	shortUrl, err := mapRepo.Map(mapUrlRequest)
+	var urlMapping model.UrlMapping
+	deduplicated := false
+	events := mappingEvents(ctx, shared.EventLinkCreated, true)
+	if mapRepo.ShouldDedup(mapUrlRequest) {
+		urlMapping, deduplicated, err = mapRepo.MapDedup(mapUrlRequest, events)
+	} else {
+		urlMapping, err = mapRepo.Map(mapUrlRequest, events)
+	}
+	if errors.Is(err, repo.ErrAliasTaken) {
+		mapUrlSpan.End()
+		logger.Info("Alias taken", zap.String("id", mapUrlRequest.Id), zap.Int("code", 409), zap.String("alias", mapUrlRequest.Alias))
+		return shared.MapUrlResponse{}, shared.NewServiceError(409, "Alias is already taken")
+	}
+	// The domain was removed from its workspace after the request was checked
+	if errors.Is(err, repo.ErrDomainNotFound) {
+		mapUrlSpan.End()
+		logger.Info("Invalid map domain", zap.String("id", mapUrlRequest.Id), zap.Int("code", 422), zap.String("domain", mapUrlRequest.Domain))
+		return shared.MapUrlResponse{}, shared.NewServiceError(422, "Unknown domain")
+	}
 	if err != nil {
 		mapUrlSpan.RecordError(err)
 		mapUrlSpan.SetStatus(codes.Error, "Cannot map url")
+		mapUrlSpan.End()
 		logger.Error("Cannot map url", zap.String("id", mapUrlRequest.Id), zap.Int("code", 500), zap.Error(err))
-		mapSpan.End()
-		return c.Status(500).JSON(map[string]interface{}{
-			"error": "Internal server error",
-		})
+		return shared.MapUrlResponse{}, shared.NewServiceError(500, "Internal server error")
 	}
 	mapUrlSpan.End()
 
+	shortUrl := urlMapping.ShortUrl
 	mapUrlResponse := shared.MapUrlResponse{
-		Url:       mapUrlRequest.Url,
-		Shortened: shortUrl,
-		Id:        mapUrlRequest.Id,
-	}
-
-	ctx, publishRedirectSpan := tracer.StartSpan("PublishRedirect", ctx, trace.WithSpanKind(trace.SpanKindProducer))
-	headers := shared.InjectAmqpTraceHeader(ctx)
-	go func() {
-		redirectQueue := os.Getenv("REDIRECT_QUEUE")
-		redirectMessage := &shared.RedirectMessage{
-			Id:      mapUrlRequest.Id,
-			Url:     mapUrlRequest.Url,
-			Shorten: shortUrl,
-		}
-		err = rabbitmq.Publish(redirectQueue, redirectMessage, headers)
-		if err != nil {
-			publishRedirectSpan.RecordError(err)
-			publishRedirectSpan.SetStatus(codes.Error, "Cannot publish redirect")
-			publishRedirectSpan.End()
-			logger.Error("Cannot publish redirect", zap.String("id", redirectMessage.Id), zap.Int("code", 500), zap.Error(err))
-		}
-		publishRedirectSpan.End()
-		logger.Info("Publish redirect", zap.String("id", redirectMessage.Id), zap.String("shortUrl", shortUrl))
-	}()
-
-	// Publish to Analytic
-	ctx, publishAnalyticSpan := tracer.StartSpan("PublishAnalytic", ctx, trace.WithSpanKind(trace.SpanKindProducer))
-	headers = shared.InjectAmqpTraceHeader(ctx)
-	go func() {
-		analyticQueue := os.Getenv("ANALYTIC_QUEUE")
-		analyticMessage := &shared.AnalyticMessage{
-			Id:        mapUrlRequest.Id,
-			Url:       mapUrlRequest.Url,
-			Shorten:   shortUrl,
-			Type:      "map",
-			Timestamp: time.Now().Unix(),
+		Url:          mapUrlRequest.Url,
+		Code:         urlMapping.Code,
+		Shortened:    shortUrl,
+		Id:           mapUrlRequest.Id,
+		Deduplicated: deduplicated,
+	}
+
+	// The existing link is already known to the other services
+	if deduplicated {
+		logger.Info("Map response", zap.String("id", mapUrlRequest.Id), zap.Int("code", 200), zap.String("shortUrl", shortUrl), zap.Bool("deduplicated", true))
+		return mapUrlResponse, nil
+	}
+
+	// The events were stored with the mapping, the relay publishes them
+	notifyOutbox()
+
+	logger.Info("Map response", zap.String("id", mapUrlRequest.Id), zap.Int("code", 200), zap.String("shortUrl", shortUrl))
+	return mapUrlResponse, nil
+}
+
+// Periodically archive the mappings expired for longer than the retention period
+//
+// - EXPIRED_SWEEP_INTERVAL: time between two sweeps (default 10m)
+// - EXPIRED_LINK_RETENTION: how long an expired link is kept before being archived (default 168h)
+func sweepExpiredMappings(ctx context.Context) {
+	interval := shared.GetEnvDuration("EXPIRED_SWEEP_INTERVAL", 10*time.Minute)
+	retention := shared.GetEnvDuration("EXPIRED_LINK_RETENTION", 7*24*time.Hour)
+	batchSize := 1000
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		err = rabbitmq.Publish(analyticQueue, analyticMessage, headers)
-		if err != nil {
-			publishAnalyticSpan.RecordError(err)
-			publishAnalyticSpan.SetStatus(codes.Error, "Cannot publish analytic")
-			publishAnalyticSpan.End()
-			logger.Error("Cannot publish analytic", zap.String("id", mapUrlRequest.Id), zap.Int("code", 500), zap.Error(err))
+
+		before := time.Now().Add(-retention)
+		var total int64
+		for {
+			archived, err := mapRepo.ArchiveExpired(before, batchSize)
+			if err != nil {
+				logger.Error("Cannot archive expired mappings", zap.Error(err))
+				break
+			}
+			total += archived
+			if archived < int64(batchSize) {
+				break
+			}
 		}
-		publishAnalyticSpan.End()
-		logger.Info("Publish analytic", zap.String("id", mapUrlRequest.Id), zap.String("shortUrl", shortUrl))
-	}()
 
-	logger.Info("Map response", zap.String("id", mapUrlRequest.Id), zap.Int("code", 200), zap.String("shortUrl", shortUrl))
-	return c.Status(200).JSON(mapUrlResponse)
+		if total > 0 {
+			logger.Info("Archive expired mappings", zap.Int64("archived", total))
+		}
+	}
 }
 
 func main() {
@@ -187,7 +324,42 @@ func main() {
 	mapperService.Use(ResponseStatusCodeMiddleware)
 
 	mapperService.Routes("/map", mapHandler, "POST")
+	mapperService.Routes("/map/batch", mapBatchHandler, "POST")
+	mapperService.Routes("/links/:code", getLinkHandler, "GET")
+	mapperService.Routes("/links/:code", updateLinkHandler, "PATCH")
+	mapperService.Routes("/links/:code", deleteLinkHandler, "DELETE")
+	mapperService.Routes("/keys", issueApiKeyHandler, "POST")
+	mapperService.Routes("/keys", listApiKeysHandler, "GET")
+	mapperService.Routes("/keys/verify/:hash", verifyApiKeyHandler, "GET")
+	mapperService.Routes("/keys/:id", revokeApiKeyHandler, "DELETE")
+	mapperService.Routes("/workspaces", createWorkspaceHandler, "POST")
+	mapperService.Routes("/workspaces", listWorkspacesHandler, "GET")
+	mapperService.Routes("/workspaces/:id/domains", addDomainHandler, "POST")
+	mapperService.Routes("/workspaces/:id/domains/:host", removeDomainHandler, "DELETE")
+	mapperService.Routes("/domains/:host", getDomainHandler, "GET")
 	mapperService.Routes("/metrics", metricsHandler, "GET")
+	mapperService.Use(shared.AdminTokenMiddleware, "/admin")
+	mapperService.Routes("/admin/outbox/parked", listParkedOutboxHandler, "GET")
+	mapperService.Routes("/admin/outbox/parked/replay", replayParkedOutboxHandler, "POST")
+
+	mapperService.Background(sweepExpiredMappings)
+	mapperService.Background(relayOutbox)
+	mapperService.Background(purgeOutbox)
+	mapperService.Background(watchBlocklist)
+
+	// Internal gRPC API, alongside the HTTP routes
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "9111"
+	}
+	grpcServer := shared.NewGrpcServer()
+	pb.RegisterMapperServiceServer(grpcServer, &mapperServer{})
+	mapperService.Background(func(ctx context.Context) {
+		err := shared.ServeGrpc(ctx, grpcServer, grpcPort)
+		if err != nil {
+			logger.Error("Cannot serve gRPC", zap.String("port", grpcPort), zap.Error(err))
+		}
+	})
 
 	mapperService.Start(onGratefulShutDown)
 }
@@ -1,7 +1,160 @@
 package model
 
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+	"gorm.io/gorm"
+)
+
 type UrlMapping struct {
-	ID       int64  `gorm:"primary_key" json:"id"`
-	ShortUrl string `gorm:"index" json:"short_url" `
-	LongUrl  string `gorm:"index" json:"long_url"`
+	ID           int64      `gorm:"primary_key" json:"id"`
+	Domain       string     `gorm:"not null;default:'';uniqueIndex:idx_url_mappings_domain_code,priority:1" json:"domain"` // Empty for the default domain, codes are unique per domain
+	Code         string     `gorm:"uniqueIndex:idx_url_mappings_domain_code,priority:2" json:"code"`
+	ShortUrl     string     `gorm:"uniqueIndex" json:"short_url" `
+	LongUrl      string     `gorm:"index" json:"long_url"`
+	RedirectType int        `json:"redirect_type"`
+	IsAlias      bool       `json:"is_alias"`
+	ExpiresAt    *time.Time `gorm:"index" json:"expires_at"`
+	MaxClicks    int64      `json:"max_clicks"`
+	Disabled     bool       `json:"disabled"`
+	OwnerId      string     `gorm:"index" json:"owner_id"`
+	// Deleted codes are kept (soft delete) so they are never handed out again
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Expired mappings archived by the sweeper, kept for history. The mapping itself stays
+// soft-deleted in UrlMapping to hold its code.
+type ArchivedUrlMapping struct {
+	ID           int64      `gorm:"primary_key" json:"id"`
+	Domain       string     `json:"domain"`
+	Code         string     `gorm:"index" json:"code"`
+	ShortUrl     string     `json:"short_url"`
+	LongUrl      string     `json:"long_url"`
+	RedirectType int        `json:"redirect_type"`
+	IsAlias      bool       `json:"is_alias"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxClicks    int64      `json:"max_clicks"`
+	OwnerId      string     `gorm:"index" json:"owner_id"`
+	ArchivedAt   time.Time  `gorm:"autoCreateTime" json:"archived_at"`
+}
+
+// Unix timestamp of the expiry, 0 when the mapping never expires
+func (m UrlMapping) ExpiresAtUnix() int64 {
+	if m.ExpiresAt == nil {
+		return 0
+	}
+	return m.ExpiresAt.Unix()
+}
+
+func (m UrlMapping) ToLinkResponse() shared.LinkResponse {
+	return shared.LinkResponse{
+		Code:         m.Code,
+		Domain:       m.Domain,
+		Url:          m.LongUrl,
+		Shortened:    m.ShortUrl,
+		IsAlias:      m.IsAlias,
+		RedirectType: m.RedirectType,
+		ExpiresAt:    m.ExpiresAtUnix(),
+		MaxClicks:    m.MaxClicks,
+		Disabled:     m.Disabled,
+	}
+}
+
+// An API key, only its hash is stored
+type ApiKey struct {
+	ID        int64      `gorm:"primary_key" json:"id"`
+	OwnerId   string     `gorm:"index" json:"owner_id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	KeyHash   string     `gorm:"uniqueIndex" json:"-"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+func (k ApiKey) ToApiKeyResponse() shared.ApiKeyResponse {
+	response := shared.ApiKeyResponse{
+		Id:        k.ID,
+		OwnerId:   k.OwnerId,
+		Name:      k.Name,
+		Prefix:    k.Prefix,
+		CreatedAt: k.CreatedAt.Unix(),
+	}
+	if k.RevokedAt != nil {
+		response.RevokedAt = k.RevokedAt.Unix()
+	}
+	return response
+}
+
+// A workspace groups the branded short domains of an owner, e.g. one per client brand
+type Workspace struct {
+	ID        int64     `gorm:"primary_key" json:"id"`
+	OwnerId   string    `gorm:"index" json:"owner_id"`
+	Name      string    `json:"name"`
+	Domains   []Domain  `json:"domains"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// A short domain served by the deployment, e.g. "go.acme.com"
+type Domain struct {
+	ID          int64     `gorm:"primary_key" json:"id"`
+	Host        string    `gorm:"uniqueIndex" json:"host"`
+	WorkspaceId int64     `gorm:"index" json:"workspace_id"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (w Workspace) ToWorkspaceResponse() shared.WorkspaceResponse {
+	domains := make([]string, 0, len(w.Domains))
+	for _, domain := range w.Domains {
+		domains = append(domains, domain.Host)
+	}
+	return shared.WorkspaceResponse{
+		Id:        w.ID,
+		OwnerId:   w.OwnerId,
+		Name:      w.Name,
+		Domains:   domains,
+		CreatedAt: w.CreatedAt.Unix(),
+	}
+}
+
+// A message to publish, stored in the transaction of the change it announces and
+// published later by the outbox relay
+type OutboxMessage struct {
+	ID        int64      `gorm:"primary_key;index:idx_outbox_messages_pending,where:sent_at IS NULL" json:"id"`
+	Queue     string     `json:"queue"`
+	Payload   string     `json:"payload"`  // JSON body of the message
+	Headers   string     `json:"headers"`  // JSON of the AMQP headers, the trace context of the change
+	Attempts  int        `json:"attempts"` // Failed attempts to publish the message itself, see shared.IsMessageError
+	LastError string     `json:"last_error"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	SentAt    *time.Time `gorm:"index" json:"sent_at"`
+	ParkedAt  *time.Time `json:"parked_at"` // Set once the relay gave up on the message
+}
+
+func NewOutboxMessage(queue string, message interface{}, headers map[string]interface{}) (OutboxMessage, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+
+	encodedHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+
+	return OutboxMessage{
+		Queue:   queue,
+		Payload: string(payload),
+		Headers: string(encodedHeaders),
+	}, nil
+}
+
+// Decoded AMQP headers of the message
+func (m OutboxMessage) HeaderMap() map[string]interface{} {
+	headers := map[string]interface{}{}
+	if m.Headers != "" {
+		json.Unmarshal([]byte(m.Headers), &headers)
+	}
+	return headers
 }
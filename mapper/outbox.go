@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/HungTP-Play/lru/mapper/model"
+	"github.com/HungTP-Play/lru/mapper/repo"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Wakes the relay up when a change stored new messages
+var outboxSignal = make(chan struct{}, 1)
+
+func notifyOutbox() {
+	select {
+	case outboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Event announcing a change of the mapping to the redirect service, and to the analytic
+// service too when notifyAnalytic is set. Both queues get the same event, carrying the
+// trace of ctx.
+func mappingEvents(ctx context.Context, eventType string, notifyAnalytic bool) repo.OutboxEvents {
+	headers := shared.InjectAmqpTraceHeader(ctx)
+	return func(urlMapping model.UrlMapping) ([]model.OutboxMessage, error) {
+		event, err := shared.NewEvent(ctx, eventType, "mapper", linkEventData(eventType, urlMapping))
+		if err != nil {
+			return nil, err
+		}
+
+		queues := []string{os.Getenv("REDIRECT_QUEUE")}
+		if notifyAnalytic {
+			queues = append(queues, os.Getenv("ANALYTIC_QUEUE"))
+		}
+
+		messages := []model.OutboxMessage{}
+		for _, queue := range queues {
+			message, err := model.NewOutboxMessage(queue, event, headers)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, message)
+		}
+		return messages, nil
+	}
+}
+
+func publishOutboxMessage(message model.OutboxMessage) error {
+	headers := amqp.Table(message.HeaderMap())
+	ctx, publishSpan := tracer.StartSpan("PublishOutbox", shared.ExtractAmqpTraceHeader(headers), trace.WithSpanKind(trace.SpanKindProducer))
+	defer publishSpan.End()
+
+	err := bus.Publish(message.Queue, json.RawMessage(message.Payload), shared.InjectAmqpTraceHeader(ctx))
+	if err != nil {
+		publishSpan.RecordError(err)
+		publishSpan.SetStatus(codes.Error, "Cannot publish outbox message")
+		metrics.IncCounter(outboxPublishErrors, message.Queue)
+		return err
+	}
+
+	metrics.IncCounter(outboxPublished, message.Queue)
+	return nil
+}
+
+// Refresh the outbox lag metrics: pending messages and age of the oldest one
+func updateOutboxLag() {
+	pending, oldest, err := outboxRepo.Pending()
+	if err != nil {
+		logger.Error("Cannot measure outbox lag", zap.Error(err))
+		return
+	}
+
+	lag := 0.0
+	if oldest != nil {
+		lag = time.Since(*oldest).Seconds()
+	}
+	metrics.SetGauge(outboxPending, float64(pending))
+	metrics.SetGauge(outboxLag, lag)
+}
+
+// Publish the outbox messages to RabbitMQ, retrying with an exponential backoff while
+// it is unavailable
+//
+// - OUTBOX_POLL_INTERVAL: time between two rounds when nothing wakes the relay up (default 1s)
+// - OUTBOX_BATCH_SIZE: messages published per round (default 100)
+// - OUTBOX_MAX_BACKOFF: longest wait between two failed rounds (default 1m)
+// - OUTBOX_MAX_ATTEMPTS: failed attempts of a message after which it is parked, 0 never
+// parks (default 20). Failures of the bus itself are retried without counting.
+func relayOutbox(ctx context.Context) {
+	interval := shared.GetEnvDuration("OUTBOX_POLL_INTERVAL", time.Second)
+	batchSize := shared.GetEnvInt("OUTBOX_BATCH_SIZE", 100)
+	maxBackoff := shared.GetEnvDuration("OUTBOX_MAX_BACKOFF", time.Minute)
+	maxAttempts := shared.GetEnvInt("OUTBOX_MAX_ATTEMPTS", 20)
+
+	backoff := interval
+	for ctx.Err() == nil {
+		sent, parked, err := outboxRepo.Relay(batchSize, maxAttempts, publishOutboxMessage)
+		for _, message := range parked {
+			metrics.IncCounter(outboxParked, message.Queue)
+			logger.Error("Park outbox message", zap.Int64("id", message.ID), zap.String("queue", message.Queue), zap.Int("attempts", message.Attempts+1))
+		}
+		updateOutboxLag()
+
+		if err != nil {
+			logger.Error("Cannot relay outbox", zap.Int("sent", sent), zap.Duration("retryIn", backoff), zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = interval
+
+		if sent > 0 {
+			logger.Info("Relay outbox", zap.Int("sent", sent))
+		}
+
+		// A full batch means more messages are waiting
+		if sent+len(parked) == batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-outboxSignal:
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Periodically delete the messages sent for longer than OUTBOX_RETENTION (default 24h)
+func purgeOutbox(ctx context.Context) {
+	retention := shared.GetEnvDuration("OUTBOX_RETENTION", 24*time.Hour)
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := outboxRepo.PurgeSent(time.Now().Add(-retention))
+		if err != nil {
+			logger.Error("Cannot purge outbox", zap.Error(err))
+			continue
+		}
+		if purged > 0 {
+			logger.Info("Purge outbox", zap.Int64("purged", purged))
+		}
+	}
+}
+
+// Limit query param, between 1 and 1000 (default 100)
+func parkedLimit(c *fiber.Ctx) int {
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 {
+		return 1
+	}
+	if limit > 1000 {
+		return 1000
+	}
+	return limit
+}
+
+// GET /admin/outbox/parked?limit=N: the oldest parked outbox messages
+func listParkedOutboxHandler(c *fiber.Ctx) error {
+	messages, err := outboxRepo.Parked(parkedLimit(c))
+	if err != nil {
+		logger.Error("Cannot list parked outbox messages", zap.Error(err))
+		return c.Status(500).JSON(map[string]interface{}{
+			"error": "Internal server error",
+		})
+	}
+	return c.Status(200).JSON(map[string]interface{}{
+		"parked": messages,
+	})
+}
+
+// POST /admin/outbox/parked/replay?limit=N: give the oldest parked outbox messages back
+// to the relay
+func replayParkedOutboxHandler(c *fiber.Ctx) error {
+	replayed, err := outboxRepo.ReplayParked(parkedLimit(c))
+	if err != nil {
+		logger.Error("Cannot replay parked outbox messages", zap.Error(err))
+		return c.Status(500).JSON(map[string]interface{}{
+			"error": "Internal server error",
+		})
+	}
+
+	logger.Info("Replay parked outbox messages", zap.Int64("replayed", replayed))
+	notifyOutbox()
+	return c.Status(200).JSON(map[string]interface{}{
+		"replayed": replayed,
+	})
+}
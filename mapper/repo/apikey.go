@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"errors"
+	"time"
+
+	"github.com/HungTP-Play/lru/mapper/model"
+	"github.com/HungTP-Play/lru/shared"
+	"gorm.io/gorm"
+)
+
+var ErrApiKeyNotFound = errors.New("api key not found")
+
+type ApiKeyRepo struct {
+	ConnectionString string
+	DB               shared.PostgresDB
+}
+
+func NewApiKeyRepo(connectionString string) *ApiKeyRepo {
+	db := shared.NewPostgresDB(connectionString)
+	db.Init()
+	return &ApiKeyRepo{
+		ConnectionString: connectionString,
+		DB:               *db,
+	}
+}
+
+func (repo *ApiKeyRepo) Close() error {
+	return repo.DB.Close()
+}
+
+// Create a key for the owner and return it with the key in clear, which is not stored
+func (repo *ApiKeyRepo) Issue(ownerId string, name string) (model.ApiKey, string, error) {
+	key, err := shared.GenerateApiKey()
+	if err != nil {
+		return model.ApiKey{}, "", err
+	}
+
+	apiKey := model.ApiKey{
+		OwnerId: ownerId,
+		Name:    name,
+		Prefix:  key[:shared.ApiKeyDisplayLength],
+		KeyHash: shared.HashApiKey(key),
+	}
+	err = repo.DB.Create(&apiKey)
+	return apiKey, key, err
+}
+
+// Return the valid key with the given hash
+func (repo *ApiKeyRepo) GetByHash(keyHash string) (model.ApiKey, error) {
+	var apiKey model.ApiKey
+	err := repo.DB.GetDB().Where("key_hash = ? AND revoked_at IS NULL", keyHash).First(&apiKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apiKey, ErrApiKeyNotFound
+	}
+	return apiKey, err
+}
+
+// Return the keys of the owner, revoked ones included, newest first
+func (repo *ApiKeyRepo) ListByOwner(ownerId string) ([]model.ApiKey, error) {
+	var apiKeys []model.ApiKey
+	err := repo.DB.GetDB().Where("owner_id = ?", ownerId).Order("id DESC").Find(&apiKeys).Error
+	return apiKeys, err
+}
+
+// Revoke the key and return its last state, an owner id restricts it to the keys of that owner
+func (repo *ApiKeyRepo) Revoke(id int64, ownerId string) (model.ApiKey, error) {
+	var apiKey model.ApiKey
+	query := repo.DB.GetDB().Where("id = ? AND revoked_at IS NULL", id)
+	if ownerId != "" {
+		query = query.Where("owner_id = ?", ownerId)
+	}
+	err := query.First(&apiKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apiKey, ErrApiKeyNotFound
+	}
+	if err != nil {
+		return apiKey, err
+	}
+
+	revokedAt := time.Now().UTC()
+	apiKey.RevokedAt = &revokedAt
+	err = repo.DB.GetDB().Model(&apiKey).Update("revoked_at", revokedAt).Error
+	return apiKey, err
+}
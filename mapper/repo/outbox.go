@@ -0,0 +1,156 @@
+package repo
+
+import (
+	"time"
+
+	"github.com/HungTP-Play/lru/mapper/model"
+	"github.com/HungTP-Play/lru/shared"
+	"gorm.io/gorm"
+)
+
+// Key of the advisory lock held by the relaying mapper instance
+const outboxRelayLock = 7212001
+
+// Build the outbox messages announcing a change of the mapping, they are stored in the
+// transaction of the change. A nil OutboxEvents announces nothing.
+type OutboxEvents func(urlMapping model.UrlMapping) ([]model.OutboxMessage, error)
+
+func writeOutbox(tx *gorm.DB, urlMapping model.UrlMapping, events OutboxEvents) error {
+	if events == nil {
+		return nil
+	}
+
+	messages, err := events(urlMapping)
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+	return tx.Create(&messages).Error
+}
+
+type OutboxRepo struct {
+	ConnectionString string
+	DB               shared.PostgresDB
+}
+
+func NewOutboxRepo(connectionString string) *OutboxRepo {
+	db := shared.NewPostgresDB(connectionString)
+	db.Init()
+	return &OutboxRepo{
+		ConnectionString: connectionString,
+		DB:               *db,
+	}
+}
+
+func (repo *OutboxRepo) Close() error {
+	return repo.DB.Close()
+}
+
+// Publish up to limit pending messages, oldest first, and mark each one sent as soon as
+// it left.
+//
+// Only one mapper instance relays at a time: the relay holds a session advisory lock on
+// a connection of its own while it publishes, outside of any transaction, so messages
+// leave in the order they were written. A failure is recorded on the message and stops
+// the round, the message is retried first next time. Only the failures of the message
+// itself (see shared.IsMessageError) count as attempts, those of the bus do not: a
+// message failing maxAttempts times is parked, so it no longer holds up the ones behind
+// it, and returned in parked. A message that cannot be marked sent after it left is
+// published again: delivery is at least once.
+func (repo *OutboxRepo) Relay(limit int, maxAttempts int, publish func(message model.OutboxMessage) error) (sent int, parked []model.OutboxMessage, err error) {
+	var publishErr error
+	err = repo.DB.GetDB().Connection(func(conn *gorm.DB) error {
+		var locked bool
+		err := conn.Raw("SELECT pg_try_advisory_lock(?)", outboxRelayLock).Scan(&locked).Error
+		if err != nil || !locked {
+			return err
+		}
+		defer conn.Exec("SELECT pg_advisory_unlock(?)", outboxRelayLock)
+
+		var messages []model.OutboxMessage
+		err = conn.Where("sent_at IS NULL AND parked_at IS NULL").Order("id").Limit(limit).Find(&messages).Error
+		if err != nil {
+			return err
+		}
+
+		for _, message := range messages {
+			publishErr = publish(message)
+			if publishErr != nil && !shared.IsMessageError(publishErr) {
+				return conn.Model(&message).Update("last_error", publishErr.Error()).Error
+			}
+			if publishErr != nil {
+				message.Attempts++
+				updates := map[string]interface{}{
+					"attempts":   message.Attempts,
+					"last_error": publishErr.Error(),
+				}
+				poison := maxAttempts > 0 && message.Attempts >= maxAttempts
+				if poison {
+					updates["parked_at"] = time.Now().UTC()
+				}
+				err = conn.Model(&message).Updates(updates).Error
+				if err != nil || !poison {
+					return err
+				}
+
+				publishErr = nil
+				parked = append(parked, message)
+				continue
+			}
+
+			err = conn.Model(&message).Update("sent_at", time.Now().UTC()).Error
+			if err != nil {
+				return err
+			}
+			sent++
+		}
+		return nil
+	})
+
+	if err != nil {
+		return sent, parked, err
+	}
+	return sent, parked, publishErr
+}
+
+// Up to limit parked messages, oldest first
+func (repo *OutboxRepo) Parked(limit int) ([]model.OutboxMessage, error) {
+	var messages []model.OutboxMessage
+	err := repo.DB.GetDB().Where("sent_at IS NULL AND parked_at IS NOT NULL").Order("id").Limit(limit).Find(&messages).Error
+	return messages, err
+}
+
+// Give up to limit parked messages, oldest first, back to the relay with a fresh attempt
+// count. Return the number of messages replayed.
+func (repo *OutboxRepo) ReplayParked(limit int) (int64, error) {
+	parked := repo.DB.GetDB().Model(&model.OutboxMessage{}).
+		Select("id").
+		Where("sent_at IS NULL AND parked_at IS NOT NULL").
+		Order("id").
+		Limit(limit)
+	result := repo.DB.GetDB().Model(&model.OutboxMessage{}).
+		Where("id IN (?)", parked).
+		Updates(map[string]interface{}{
+			"parked_at": nil,
+			"attempts":  0,
+		})
+	return result.RowsAffected, result.Error
+}
+
+// Number of messages waiting to be published and the creation time of the oldest one
+func (repo *OutboxRepo) Pending() (int64, *time.Time, error) {
+	var stats struct {
+		Count  int64
+		Oldest *time.Time
+	}
+	err := repo.DB.GetDB().Model(&model.OutboxMessage{}).
+		Select("COUNT(*) AS count, MIN(created_at) AS oldest").
+		Where("sent_at IS NULL AND parked_at IS NULL").
+		Scan(&stats).Error
+	return stats.Count, stats.Oldest, err
+}
+
+// Delete the messages sent before the given time
+func (repo *OutboxRepo) PurgeSent(before time.Time) (int64, error) {
+	result := repo.DB.GetDB().Where("sent_at < ?", before).Delete(&model.OutboxMessage{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,101 @@
+package repo
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/HungTP-Play/lru/mapper/model"
+	"github.com/HungTP-Play/lru/shared"
+)
+
+func newTestOutboxRepo(t *testing.T, messages []model.OutboxMessage) *OutboxRepo {
+	repo := NewOutboxRepo(newTestDSN(t))
+	t.Cleanup(func() {
+		repo.Close()
+	})
+	err := repo.DB.Migrate(&model.OutboxMessage{})
+	if err != nil {
+		t.Fatalf("Cannot migrate outbox: %v", err)
+	}
+	err = repo.DB.GetDB().Create(&messages).Error
+	if err != nil {
+		t.Fatalf("Cannot create messages: %v", err)
+	}
+	return repo
+}
+
+func TestRelayParksPoisonMessages(t *testing.T) {
+	messages := []model.OutboxMessage{
+		{Queue: "poison", Payload: "{}", Headers: "{}"},
+		{Queue: "redirect", Payload: "{}", Headers: "{}"},
+		{Queue: "redirect", Payload: "{}", Headers: "{}"},
+	}
+	repo := newTestOutboxRepo(t, messages)
+
+	published := []int64{}
+	publish := func(message model.OutboxMessage) error {
+		if message.Queue == "poison" {
+			return fmt.Errorf("%w: 312 NO_ROUTE", shared.ErrMessageUnroutable)
+		}
+		published = append(published, message.ID)
+		return nil
+	}
+
+	sent, parked, err := repo.Relay(10, 2, publish)
+	if err == nil || sent != 0 || len(parked) != 0 {
+		t.Fatalf("First round: sent %d, parked %d, err %v; want the poison message to block the round", sent, len(parked), err)
+	}
+
+	sent, parked, err = repo.Relay(10, 2, publish)
+	if err != nil {
+		t.Fatalf("Second round: %v", err)
+	}
+	if sent != 2 || len(parked) != 1 || parked[0].ID != messages[0].ID {
+		t.Fatalf("Second round: sent %d, parked %v; want the poison message parked and the others sent", sent, parked)
+	}
+	if len(published) != 2 || published[0] != messages[1].ID || published[1] != messages[2].ID {
+		t.Fatalf("Published %v, want %d and %d in order", published, messages[1].ID, messages[2].ID)
+	}
+
+	pending, _, err := repo.Pending()
+	if err != nil || pending != 0 {
+		t.Fatalf("Pending = %d, %v; want 0", pending, err)
+	}
+
+	replayed, err := repo.ReplayParked(10)
+	if err != nil || replayed != 1 {
+		t.Fatalf("ReplayParked() = %d, %v; want 1", replayed, err)
+	}
+	pending, _, err = repo.Pending()
+	if err != nil || pending != 1 {
+		t.Fatalf("Pending = %d, %v after the replay; want 1", pending, err)
+	}
+}
+
+func TestRelayKeepsMessagesWhileBrokerIsDown(t *testing.T) {
+	messages := []model.OutboxMessage{
+		{Queue: "redirect", Payload: "{}", Headers: "{}"},
+		{Queue: "redirect", Payload: "{}", Headers: "{}"},
+	}
+	repo := newTestOutboxRepo(t, messages)
+
+	down := func(message model.OutboxMessage) error {
+		return shared.ErrNotConnected
+	}
+	for round := 0; round < 5; round++ {
+		sent, parked, err := repo.Relay(10, 2, down)
+		if err != shared.ErrNotConnected || sent != 0 || len(parked) != 0 {
+			t.Fatalf("Round %d: sent %d, parked %d, err %v; want the round to stop on the outage", round, sent, len(parked), err)
+		}
+	}
+
+	parked, err := repo.Parked(10)
+	if err != nil || len(parked) != 0 {
+		t.Fatalf("Parked() = %v, %v; want nothing parked by an outage", parked, err)
+	}
+
+	sent, _, err := repo.Relay(10, 2, func(message model.OutboxMessage) error { return nil })
+	if err != nil || sent != 2 {
+		t.Fatalf("Relay() once the broker is back: sent %d, %v; want 2", sent, err)
+	}
+}
@@ -1,16 +1,39 @@
 package repo
 
 import (
+	"errors"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/HungTP-Play/lru/mapper/generator"
 	"github.com/HungTP-Play/lru/mapper/model"
-	"github.com/HungTP-Play/lru/mapper/util"
 	"github.com/HungTP-Play/lru/shared"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var ErrAliasTaken = errors.New("alias is already taken")
+
+// Same error as the other repos, so it is answered with 404 whatever the service
+var ErrNotFound = shared.ErrNotFound
+
 type UrlMappingRepo struct {
 	ConnectionString string
 	DB               shared.PostgresDB
+	Generator        generator.CodeGenerator
+	// Number of codes tried before giving up on a mapping
+	MaxAttempts int
+	// Reuse the existing link of a url when the request does not say otherwise
+	DedupByDefault bool
+}
+
+func getMaxAttempts() int {
+	maxAttempts, err := strconv.Atoi(os.Getenv("CODE_MAX_ATTEMPTS"))
+	if err != nil || maxAttempts <= 0 {
+		return 5
+	}
+	return maxAttempts
 }
 
 func NewUrlMappingRepo(connectionString string) *UrlMappingRepo {
@@ -19,36 +42,543 @@ func NewUrlMappingRepo(connectionString string) *UrlMappingRepo {
 	return &UrlMappingRepo{
 		ConnectionString: connectionString,
 		DB:               *db,
+		MaxAttempts:      getMaxAttempts(),
+		DedupByDefault:   os.Getenv("DEDUP_LONG_URLS") == "true",
+	}
+}
+
+// Build and initialize the code generator selected by the configuration
+func (repo *UrlMappingRepo) InitGenerator(config *generator.Config) error {
+	codeGenerator, err := generator.New(config, repo.DB.GetDB())
+	if err != nil {
+		return err
+	}
+
+	err = codeGenerator.Init()
+	if err != nil {
+		return err
 	}
+
+	repo.Generator = codeGenerator
+	return nil
 }
 
 func (repo *UrlMappingRepo) Close() error {
 	return repo.DB.Close()
 }
 
-func (repo *UrlMappingRepo) Map(urlMappingRequest shared.MapUrlRequest) (string, error) {
+func getBaseHost() string {
+	baseHost := os.Getenv("BASE_HOST")
+	if baseHost == "" {
+		baseHost = "http://localhost/"
+	}
+	return baseHost
+}
+
+// Scheme of the short urls on custom domains
+func getDomainScheme() string {
+	scheme := os.Getenv("CUSTOM_DOMAIN_SCHEME")
+	if scheme == "" {
+		scheme = "https"
+	}
+	return scheme
+}
+
+// Short url of the code, on the domain of a workspace or on BASE_HOST for the default one
+func ShortUrl(domain string, code string) string {
+	if domain == "" {
+		return getBaseHost() + code
+	}
+	return getDomainScheme() + "://" + domain + "/" + code
+}
+
+// Create or upgrade the tables of the mappings, see upgradeMappings for the existing rows
+func (repo *UrlMappingRepo) Migrate() error {
+	db := repo.DB.GetDB()
+	if db.Migrator().HasTable(&model.UrlMapping{}) {
+		err := db.Transaction(upgradeMappings)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := db.AutoMigrate(&model.UrlMapping{}, &model.ArchivedUrlMapping{})
+	if err != nil {
+		return err
+	}
+
+	err = restoreArchivedCodes(db)
+	if err != nil {
+		return err
+	}
+	return repo.DropGlobalCodeIndex()
+}
+
+// Bring back, soft-deleted, the mappings older versions of the sweeper removed after
+// archiving them, so their codes are taken again. A code handed out since then stays
+// with its new mapping.
+func restoreArchivedCodes(db *gorm.DB) error {
+	return db.Exec(`INSERT INTO url_mappings (id, domain, code, short_url, long_url, redirect_type, is_alias, expires_at, max_clicks, disabled, owner_id, deleted_at)
+		SELECT id, COALESCE(domain, ''), code, short_url, long_url, redirect_type, is_alias, expires_at, max_clicks, false, owner_id, archived_at
+		FROM archived_url_mappings ORDER BY id
+		ON CONFLICT DO NOTHING`).Error
+}
+
+// Prepare the mappings created by older versions for the unique index on the domain
+// and code. Mappings created before links had a domain are moved to the default one,
+// which the lookups match with an empty domain. Mappings without code get the code of
+// their short url. A code held by several mappings of a domain stays with the first one,
+// the others are renamed with their id as suffix: they could not be reached by it anyway.
+func upgradeMappings(tx *gorm.DB) error {
+	migrator := tx.Migrator()
+	for _, field := range []string{"Domain", "Code"} {
+		if migrator.HasColumn(&model.UrlMapping{}, field) {
+			continue
+		}
+		err := migrator.AddColumn(&model.UrlMapping{}, field)
+		if err != nil {
+			return err
+		}
+	}
+
+	statements := []string{
+		"UPDATE url_mappings SET domain = '' WHERE domain IS NULL",
+		"UPDATE url_mappings SET code = COALESCE(NULLIF(substring(short_url from '[^/]*$'), ''), id::text) WHERE code IS NULL OR code = ''",
+		`UPDATE url_mappings m SET code = m.code || '-' || m.id, short_url = COALESCE(substring(m.short_url from '^.*/'), '') || m.code || '-' || m.id
+			WHERE EXISTS (SELECT 1 FROM url_mappings o WHERE o.domain = m.domain AND o.code = m.code AND o.id < m.id)`,
+	}
+	for _, statement := range statements {
+		err := tx.Exec(statement).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Codes used to be unique across the deployment, they are unique per domain now
+func (repo *UrlMappingRepo) DropGlobalCodeIndex() error {
+	migrator := repo.DB.GetDB().Migrator()
+	if !migrator.HasIndex(&model.UrlMapping{}, "idx_url_mappings_code") {
+		return nil
+	}
+	return migrator.DropIndex(&model.UrlMapping{}, "idx_url_mappings_code")
+}
+
+// Lock the domain of a new mapping until the end of the transaction, so it cannot be
+// removed from its workspace before the mapping is committed. Return ErrDomainNotFound
+// when it was removed since the request was checked. The default domain is not locked.
+func lockDomain(tx *gorm.DB, domain string) error {
+	if domain == "" {
+		return nil
+	}
+
+	var domains []model.Domain
+	err := tx.Clauses(clause.Locking{Strength: "SHARE"}).Where("host = ?", domain).Limit(1).Find(&domains).Error
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		return ErrDomainNotFound
+	}
+	return nil
+}
+
+// Build the mapping of the request under the given short code
+func newUrlMapping(urlMappingRequest shared.MapUrlRequest, code string) model.UrlMapping {
+	redirectType := urlMappingRequest.RedirectType
+	if redirectType == 0 {
+		redirectType = shared.DefaultRedirectType
+	}
+
+	var expiresAt *time.Time
+	if urlMappingRequest.ExpiresAt > 0 {
+		expiry := time.Unix(urlMappingRequest.ExpiresAt, 0).UTC()
+		expiresAt = &expiry
+	}
+
+	return model.UrlMapping{
+		Domain:       urlMappingRequest.Domain,
+		Code:         code,
+		ShortUrl:     ShortUrl(urlMappingRequest.Domain, code),
+		LongUrl:      urlMappingRequest.Url,
+		RedirectType: redirectType,
+		IsAlias:      urlMappingRequest.Alias != "",
+		ExpiresAt:    expiresAt,
+		MaxClicks:    urlMappingRequest.MaxClicks,
+		OwnerId:      urlMappingRequest.OwnerId,
+	}
+}
+
+// Store the mapping and the outbox messages of its events in one transaction
+func (repo *UrlMappingRepo) create(urlMapping *model.UrlMapping, events OutboxEvents) error {
+	return repo.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		err := lockDomain(tx, urlMapping.Domain)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Create(urlMapping).Error
+		if err != nil {
+			return err
+		}
+		return writeOutbox(tx, *urlMapping, events)
+	})
+}
+
+func (repo *UrlMappingRepo) Map(urlMappingRequest shared.MapUrlRequest, events OutboxEvents) (model.UrlMapping, error) {
 	var urlMapping model.UrlMapping
 
-	totalUrls, err := repo.DB.CountTable(&urlMapping)
+	// A custom alias is reserved by the unique index, there is nothing to retry
+	if urlMappingRequest.Alias != "" {
+		urlMapping = newUrlMapping(urlMappingRequest, urlMappingRequest.Alias)
+
+		err := repo.create(&urlMapping, events)
+		if shared.IsDuplicateKeyError(err) {
+			return urlMapping, ErrAliasTaken
+		}
+		return urlMapping, err
+	}
+
+	// The unique index on the code decides, a collision only costs another attempt
+	for attempt := 1; ; attempt++ {
+		stringEncode, err := repo.Generator.Next()
+		if err != nil {
+			return urlMapping, err
+		}
+
+		urlMapping = newUrlMapping(urlMappingRequest, stringEncode)
+
+		err = repo.create(&urlMapping, events)
+		if err == nil || !shared.IsDuplicateKeyError(err) || attempt >= repo.MaxAttempts {
+			return urlMapping, err
+		}
+	}
+}
+
+// Check if the request should return the existing link of its url.
+// Links with an alias or limits are always created on their own.
+func (repo *UrlMappingRepo) ShouldDedup(urlMappingRequest shared.MapUrlRequest) bool {
+	dedup := repo.DedupByDefault
+	if urlMappingRequest.Dedup != nil {
+		dedup = *urlMappingRequest.Dedup
+	}
+
+	return dedup && urlMappingRequest.Alias == "" && urlMappingRequest.ExpiresAt == 0 && urlMappingRequest.MaxClicks == 0
+}
+
+// Return the existing plain link of the url, or map it when there is none.
+// The boolean is true when an existing link is returned, its events are only stored
+// for a new link.
+//
+// Links are only shared between the requests of the same owner on the same domain. An
+// advisory lock on the owner, domain and url serializes concurrent requests, so two of them cannot both miss
+// and create two links.
+func (repo *UrlMappingRepo) MapDedup(urlMappingRequest shared.MapUrlRequest, events OutboxEvents) (model.UrlMapping, bool, error) {
+	var urlMapping model.UrlMapping
+	existing := false
+
+	redirectType := urlMappingRequest.RedirectType
+	if redirectType == 0 {
+		redirectType = shared.DefaultRedirectType
+	}
+
+	err := repo.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", urlMappingRequest.OwnerId+" "+urlMappingRequest.Domain+" "+urlMappingRequest.Url).Error
+		if err != nil {
+			return err
+		}
+
+		err = lockDomain(tx, urlMappingRequest.Domain)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Where("long_url = ? AND owner_id = ? AND domain = ? AND is_alias = ? AND expires_at IS NULL AND max_clicks = 0 AND disabled = ? AND redirect_type = ?",
+			urlMappingRequest.Url, urlMappingRequest.OwnerId, urlMappingRequest.Domain, false, false, redirectType).
+			Order("id").
+			First(&urlMapping).Error
+		if err == nil {
+			existing = true
+			return nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		// Same retry as Map, a savepoint keeps the transaction usable after a collision
+		for attempt := 1; ; attempt++ {
+			code, err := repo.Generator.Next()
+			if err != nil {
+				return err
+			}
+
+			urlMapping = newUrlMapping(urlMappingRequest, code)
+			err = tx.SavePoint("insert_mapping").Error
+			if err != nil {
+				return err
+			}
+
+			err = tx.Create(&urlMapping).Error
+			if err == nil {
+				return writeOutbox(tx, urlMapping, events)
+			}
+			if !shared.IsDuplicateKeyError(err) || attempt >= repo.MaxAttempts {
+				return err
+			}
+
+			err = tx.RollbackTo("insert_mapping").Error
+			if err != nil {
+				return err
+			}
+		}
+	})
+
+	return urlMapping, existing, err
+}
+
+// Map several urls at once, the result and error of each request share its index.
+//
+// Taken aliases are detected up front and the remaining mappings are inserted in a
+// single transaction. When that transaction hits a concurrent insert, the batch falls
+// back to mapping every item on its own so one conflict does not fail the others.
+func (repo *UrlMappingRepo) MapBatch(urlMappingRequests []shared.MapUrlRequest, events OutboxEvents) ([]model.UrlMapping, []error) {
+	urlMappings := make([]model.UrlMapping, len(urlMappingRequests))
+	errs := make([]error, len(urlMappingRequests))
+
+	// Aliases already used on their domain in the database (deleted ones included) or earlier in the batch
+	var aliases [][]interface{}
+	for _, request := range urlMappingRequests {
+		if request.Alias != "" {
+			aliases = append(aliases, []interface{}{request.Domain, request.Alias})
+		}
+	}
+
+	takenAliases := map[string]bool{}
+	if len(aliases) > 0 {
+		var existing []model.UrlMapping
+		err := repo.DB.GetDB().Unscoped().Select("domain", "code").Where("(domain, code) IN ?", aliases).Find(&existing).Error
+		if err != nil {
+			for i := range errs {
+				errs[i] = err
+			}
+			return urlMappings, errs
+		}
+		for _, mapping := range existing {
+			takenAliases[mapping.Domain+"/"+mapping.Code] = true
+		}
+	}
+
+	generatedCount := len(urlMappingRequests) - len(aliases)
+	codes, err := generator.NextN(repo.Generator, generatedCount)
 	if err != nil {
-		return "", err
+		for i := range errs {
+			errs[i] = err
+		}
+		return urlMappings, errs
 	}
 
-	stringEncode := util.Base62Encode(totalUrls + 1)
+	var pending []int
+	for i, request := range urlMappingRequests {
+		code := request.Alias
+		if code == "" {
+			code, codes = codes[0], codes[1:]
+		} else if takenAliases[request.Domain+"/"+code] {
+			errs[i] = ErrAliasTaken
+			continue
+		}
 
-	baseHost := os.Getenv("BASE_HOST")
-	if baseHost == "" {
-		baseHost = "http://localhost/"
+		takenAliases[request.Domain+"/"+code] = true
+		urlMappings[i] = newUrlMapping(request, code)
+		pending = append(pending, i)
+	}
+
+	if len(pending) == 0 {
+		return urlMappings, errs
 	}
 
-	urlMapping = model.UrlMapping{
-		ShortUrl: baseHost + stringEncode,
-		LongUrl:  urlMappingRequest.Url,
+	err = repo.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		batch := make([]*model.UrlMapping, 0, len(pending))
+		locked := map[string]bool{}
+		for _, i := range pending {
+			batch = append(batch, &urlMappings[i])
+			if locked[urlMappings[i].Domain] {
+				continue
+			}
+			err := lockDomain(tx, urlMappings[i].Domain)
+			if err != nil {
+				return err
+			}
+			locked[urlMappings[i].Domain] = true
+		}
+		err := tx.CreateInBatches(batch, 500).Error
+		if err != nil {
+			return err
+		}
+
+		for _, urlMapping := range batch {
+			err = writeOutbox(tx, *urlMapping, events)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// Retried one by one so only the mappings at fault fail
+	if shared.IsDuplicateKeyError(err) || errors.Is(err, ErrDomainNotFound) {
+		for _, i := range pending {
+			urlMappings[i], errs[i] = repo.Map(urlMappingRequests[i], events)
+		}
+		return urlMappings, errs
 	}
 
-	err = repo.DB.Create(&urlMapping)
 	if err != nil {
-		return baseHost + stringEncode, err
+		for _, i := range pending {
+			errs[i] = err
+		}
 	}
-	return baseHost + stringEncode, err
+	return urlMappings, errs
+}
+
+// Copy a batch of mappings that expired before the given time to the archive table and
+// soft delete them, so their codes are never handed out again. Rows are locked with SKIP
+// LOCKED so several mapper instances can sweep at the same time.
+func (repo *UrlMappingRepo) ArchiveExpired(before time.Time, batchSize int) (int64, error) {
+	var archived int64
+	err := repo.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		var expired []model.UrlMapping
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("expires_at < ?", before).
+			Limit(batchSize).
+			Find(&expired).Error
+		if err != nil || len(expired) == 0 {
+			return err
+		}
+
+		archives := make([]model.ArchivedUrlMapping, 0, len(expired))
+		for _, mapping := range expired {
+			archives = append(archives, model.ArchivedUrlMapping{
+				ID:           mapping.ID,
+				Domain:       mapping.Domain,
+				Code:         mapping.Code,
+				ShortUrl:     mapping.ShortUrl,
+				LongUrl:      mapping.LongUrl,
+				RedirectType: mapping.RedirectType,
+				IsAlias:      mapping.IsAlias,
+				ExpiresAt:    mapping.ExpiresAt,
+				MaxClicks:    mapping.MaxClicks,
+				OwnerId:      mapping.OwnerId,
+			})
+		}
+
+		err = tx.Create(&archives).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete(&expired).Error
+		if err != nil {
+			return err
+		}
+
+		archived = int64(len(expired))
+		return nil
+	})
+	return archived, err
+}
+
+// Return the mapping of the code on the domain, an owner id restricts the lookup to the links of that owner
+func (repo *UrlMappingRepo) GetByCode(domain string, code string, ownerId string) (model.UrlMapping, error) {
+	return findByCode(repo.DB.GetDB(), domain, code, ownerId)
+}
+
+func findByCode(db *gorm.DB, domain string, code string, ownerId string) (model.UrlMapping, error) {
+	var urlMapping model.UrlMapping
+	query := db.Where("domain = ? AND code = ?", domain, code)
+	if ownerId != "" {
+		query = query.Where("owner_id = ?", ownerId)
+	}
+	err := query.First(&urlMapping).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return urlMapping, ErrNotFound
+	}
+	return urlMapping, err
+}
+
+// Apply the non nil fields of the request to the mapping and return its new state.
+// Only those columns are written, on the row locked in the transaction: a concurrent
+// update keeps its other changes and a deleted mapping is not found.
+func (repo *UrlMappingRepo) Update(code string, request shared.UpdateLinkRequest, events OutboxEvents) (model.UrlMapping, error) {
+	var urlMapping model.UrlMapping
+	err := repo.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		var err error
+		urlMapping, err = findByCode(tx.Clauses(clause.Locking{Strength: "UPDATE"}), request.Domain, code, request.OwnerId)
+		if err != nil {
+			return err
+		}
+
+		changes := map[string]interface{}{}
+		if request.Url != nil {
+			urlMapping.LongUrl = *request.Url
+			changes["long_url"] = urlMapping.LongUrl
+		}
+		if request.RedirectType != nil {
+			urlMapping.RedirectType = *request.RedirectType
+			changes["redirect_type"] = urlMapping.RedirectType
+		}
+		if request.ExpiresAt != nil {
+			urlMapping.ExpiresAt = nil
+			if *request.ExpiresAt > 0 {
+				expiresAt := time.Unix(*request.ExpiresAt, 0).UTC()
+				urlMapping.ExpiresAt = &expiresAt
+			}
+			changes["expires_at"] = urlMapping.ExpiresAt
+		}
+		if request.MaxClicks != nil {
+			urlMapping.MaxClicks = *request.MaxClicks
+			changes["max_clicks"] = urlMapping.MaxClicks
+		}
+		if request.Disabled != nil {
+			urlMapping.Disabled = *request.Disabled
+			changes["disabled"] = urlMapping.Disabled
+		}
+
+		if len(changes) > 0 {
+			err = tx.Model(&urlMapping).Updates(changes).Error
+			if err != nil {
+				return err
+			}
+		}
+		return writeOutbox(tx, urlMapping, events)
+	})
+	return urlMapping, err
+}
+
+// Soft delete the mapping and return its last state, see GetByCode for the owner id
+func (repo *UrlMappingRepo) Delete(domain string, code string, ownerId string, events OutboxEvents) (model.UrlMapping, error) {
+	urlMapping, err := repo.GetByCode(domain, code, ownerId)
+	if err != nil {
+		return urlMapping, err
+	}
+
+	err = repo.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(&urlMapping).Error
+		if err != nil {
+			return err
+		}
+		return writeOutbox(tx, urlMapping, events)
+	})
+	return urlMapping, err
+}
+
+// Return up to limit enabled mappings with an id greater than afterId, ordered by id
+func (repo *UrlMappingRepo) ListEnabled(afterId int64, limit int) ([]model.UrlMapping, error) {
+	var urlMappings []model.UrlMapping
+	err := repo.DB.GetDB().
+		Where("id > ? AND disabled = ?", afterId, false).
+		Order("id").
+		Limit(limit).
+		Find(&urlMappings).Error
+	return urlMappings, err
 }
@@ -0,0 +1,304 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HungTP-Play/lru/mapper/model"
+	"github.com/HungTP-Play/lru/shared"
+)
+
+// Connection string of a schema of its own in the database of POSTGRES_TEST_DSN
+// (keyword/value form), dropped after the test. The test is skipped when it is not set.
+func newTestDSN(t *testing.T) string {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+
+	admin := shared.NewPostgresDB(dsn)
+	err := admin.Init()
+	if err != nil {
+		t.Fatalf("Cannot connect to test database: %v", err)
+	}
+	schema := fmt.Sprintf("test_mapper_%d", time.Now().UnixNano())
+	err = admin.DB.Exec("CREATE SCHEMA " + schema).Error
+	if err != nil {
+		t.Fatalf("Cannot create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.DB.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+	return dsn + " search_path=" + schema
+}
+
+func newTestRepo(t *testing.T) *UrlMappingRepo {
+	repo := NewUrlMappingRepo(newTestDSN(t))
+	t.Cleanup(func() {
+		repo.Close()
+	})
+	return repo
+}
+
+func TestMigrateMovesLinksWithoutDomainToDefaultDomain(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy []string
+	}{
+		{
+			name: "no domain column",
+			legacy: []string{
+				"CREATE TABLE url_mappings (id bigserial PRIMARY KEY, code text, short_url text, long_url text)",
+			},
+		},
+		{
+			name: "nullable domain column",
+			legacy: []string{
+				"CREATE TABLE url_mappings (id bigserial PRIMARY KEY, code text, short_url text, long_url text, domain text)",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t)
+			db := repo.DB.GetDB()
+			for _, statement := range test.legacy {
+				err := db.Exec(statement).Error
+				if err != nil {
+					t.Fatalf("Cannot create legacy table: %v", err)
+				}
+			}
+			err := db.Exec("INSERT INTO url_mappings (code, short_url, long_url) VALUES ('abc', 'http://localhost/abc', 'https://example.com')").Error
+			if err != nil {
+				t.Fatalf("Cannot insert legacy row: %v", err)
+			}
+
+			err = repo.Migrate()
+			if err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+
+			urlMapping, err := repo.GetByCode("", "abc", "")
+			if err != nil {
+				t.Fatalf("GetByCode() error = %v", err)
+			}
+			if urlMapping.Domain != "" || urlMapping.LongUrl != "https://example.com" {
+				t.Fatalf("GetByCode() = %+v", urlMapping)
+			}
+
+			_, err = repo.Delete("", "abc", "", nil)
+			if err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestMigrateMakesLegacyCodesUnique(t *testing.T) {
+	repo := newTestRepo(t)
+	db := repo.DB.GetDB()
+	statements := []string{
+		"CREATE TABLE url_mappings (id bigserial PRIMARY KEY, short_url text, long_url text)",
+		"INSERT INTO url_mappings (short_url, long_url) VALUES ('http://localhost/1', 'https://example.com/a')",
+		"INSERT INTO url_mappings (short_url, long_url) VALUES ('http://localhost/1', 'https://example.com/b')",
+		"INSERT INTO url_mappings (short_url, long_url) VALUES ('http://localhost/2', 'https://example.com/c')",
+	}
+	for _, statement := range statements {
+		err := db.Exec(statement).Error
+		if err != nil {
+			t.Fatalf("Cannot create legacy rows: %v", err)
+		}
+	}
+
+	err := repo.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	tests := []struct {
+		code     string
+		shortUrl string
+		longUrl  string
+	}{
+		{"1", "http://localhost/1", "https://example.com/a"},
+		{"1-2", "http://localhost/1-2", "https://example.com/b"},
+		{"2", "http://localhost/2", "https://example.com/c"},
+	}
+	for _, test := range tests {
+		urlMapping, err := repo.GetByCode("", test.code, "")
+		if err != nil {
+			t.Fatalf("GetByCode(%q) error = %v", test.code, err)
+		}
+		if urlMapping.ShortUrl != test.shortUrl || urlMapping.LongUrl != test.longUrl {
+			t.Errorf("GetByCode(%q) = %+v", test.code, urlMapping)
+		}
+	}
+
+	err = db.Exec("INSERT INTO url_mappings (domain, code, short_url, long_url) VALUES ('', '2', 'http://localhost/2-x', 'https://example.com/d')").Error
+	if !shared.IsDuplicateKeyError(err) {
+		t.Fatalf("Insert of a taken code error = %v, want a duplicate key", err)
+	}
+}
+
+func TestArchivedCodesStayTaken(t *testing.T) {
+	repo := newTestRepo(t)
+	err := repo.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	expired := shared.MapUrlRequest{Url: "https://example.com", Alias: "old", ExpiresAt: time.Now().Add(-time.Hour).Unix(), OwnerId: "owner"}
+	_, err = repo.Map(expired, nil)
+	if err != nil {
+		t.Fatalf("Map() error = %v", err)
+	}
+	archived, err := repo.ArchiveExpired(time.Now(), 10)
+	if err != nil || archived != 1 {
+		t.Fatalf("ArchiveExpired() = %d, %v; want 1", archived, err)
+	}
+
+	_, err = repo.GetByCode("", "old", "")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetByCode() of an archived link error = %v, want %v", err, ErrNotFound)
+	}
+	_, err = repo.Map(shared.MapUrlRequest{Url: "https://example.org", Alias: "old", OwnerId: "intruder"}, nil)
+	if !errors.Is(err, ErrAliasTaken) {
+		t.Fatalf("Map() of an archived alias error = %v, want %v", err, ErrAliasTaken)
+	}
+
+	// Links archived by older versions were removed from url_mappings
+	db := repo.DB.GetDB()
+	err = db.Exec("INSERT INTO archived_url_mappings (id, domain, code, short_url, long_url, archived_at) VALUES (1000, '', 'legacy', 'http://localhost/legacy', 'https://example.com', now())").Error
+	if err != nil {
+		t.Fatalf("Cannot insert legacy archive: %v", err)
+	}
+	err = repo.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	_, errs := repo.MapBatch([]shared.MapUrlRequest{{Url: "https://example.org", Alias: "legacy"}}, nil)
+	if !errors.Is(errs[0], ErrAliasTaken) {
+		t.Fatalf("MapBatch() of a legacy archived alias error = %v, want %v", errs[0], ErrAliasTaken)
+	}
+}
+
+func TestUpdateKeepsConcurrentChanges(t *testing.T) {
+	repo := newTestRepo(t)
+	err := repo.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	_, err = repo.Map(shared.MapUrlRequest{Url: "https://example.com", Alias: "promo", OwnerId: "owner"}, nil)
+	if err != nil {
+		t.Fatalf("Map() error = %v", err)
+	}
+
+	// The sweeper disables the link while the owner changes its url
+	tx := repo.DB.GetDB().Begin()
+	err = tx.Exec("SELECT id FROM url_mappings WHERE code = 'promo' FOR UPDATE").Error
+	if err == nil {
+		err = tx.Exec("UPDATE url_mappings SET disabled = true WHERE code = 'promo'").Error
+	}
+	if err != nil {
+		tx.Rollback()
+		t.Fatalf("Cannot disable the link: %v", err)
+	}
+
+	url := "https://example.org"
+	updated := make(chan error, 1)
+	go func() {
+		_, err := repo.Update("promo", shared.UpdateLinkRequest{Url: &url, OwnerId: "owner"}, nil)
+		updated <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	err = tx.Commit().Error
+	if err != nil {
+		t.Fatalf("Cannot commit: %v", err)
+	}
+	err = <-updated
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	urlMapping, err := repo.GetByCode("", "promo", "")
+	if err != nil || urlMapping.LongUrl != url || !urlMapping.Disabled {
+		t.Fatalf("GetByCode() = %+v, %v; want the new url and still disabled", urlMapping, err)
+	}
+
+	// Updating a deleted link does not bring it back
+	_, err = repo.Delete("", "promo", "owner", nil)
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	_, err = repo.Update("promo", shared.UpdateLinkRequest{Url: &url, OwnerId: "owner"}, nil)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Update() of a deleted link error = %v, want %v", err, ErrNotFound)
+	}
+	_, err = repo.GetByCode("", "promo", "")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetByCode() of a deleted link error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestRemoveDomainChecksOwnerThenLinks(t *testing.T) {
+	dsn := newTestDSN(t)
+	mapRepo := NewUrlMappingRepo(dsn)
+	workspaceRepo := NewWorkspaceRepo(dsn)
+	t.Cleanup(func() {
+		mapRepo.Close()
+		workspaceRepo.Close()
+	})
+	err := mapRepo.Migrate()
+	if err == nil {
+		err = workspaceRepo.DB.GetDB().AutoMigrate(&model.Workspace{}, &model.Domain{})
+	}
+	if err != nil {
+		t.Fatalf("Cannot migrate: %v", err)
+	}
+
+	workspace, err := workspaceRepo.Create("owner", "workspace")
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	_, err = workspaceRepo.AddDomain(workspace.ID, "owner", "go.example.com")
+	if err != nil {
+		t.Fatalf("AddDomain() error = %v", err)
+	}
+	request := shared.MapUrlRequest{Url: "https://example.com", Alias: "abc", Domain: "go.example.com", OwnerId: "owner"}
+	_, err = mapRepo.Map(request, nil)
+	if err != nil {
+		t.Fatalf("Map() error = %v", err)
+	}
+
+	// Another owner cannot tell whether the domain has links
+	_, err = workspaceRepo.RemoveDomain(workspace.ID, "intruder", "go.example.com")
+	if !errors.Is(err, ErrWorkspaceNotFound) {
+		t.Fatalf("RemoveDomain() by another owner error = %v, want %v", err, ErrWorkspaceNotFound)
+	}
+
+	_, err = workspaceRepo.RemoveDomain(workspace.ID, "owner", "go.example.com")
+	if !errors.Is(err, ErrDomainHasLinks) {
+		t.Fatalf("RemoveDomain() with links error = %v, want %v", err, ErrDomainHasLinks)
+	}
+
+	_, err = mapRepo.Delete("go.example.com", "abc", "owner", nil)
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	_, err = workspaceRepo.RemoveDomain(workspace.ID, "owner", "go.example.com")
+	if err != nil {
+		t.Fatalf("RemoveDomain() error = %v", err)
+	}
+
+	// A request checked before the removal cannot create a link on the domain anymore
+	request.Alias = "def"
+	_, err = mapRepo.Map(request, nil)
+	if !errors.Is(err, ErrDomainNotFound) {
+		t.Fatalf("Map() on a removed domain error = %v, want %v", err, ErrDomainNotFound)
+	}
+}
@@ -0,0 +1,133 @@
+package repo
+
+import (
+	"errors"
+
+	"github.com/HungTP-Play/lru/mapper/model"
+	"github.com/HungTP-Play/lru/shared"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrWorkspaceNotFound = errors.New("workspace not found")
+var ErrDomainNotFound = errors.New("domain not found")
+var ErrDomainTaken = errors.New("domain is already used by a workspace")
+var ErrDomainHasLinks = errors.New("domain still has links")
+
+type WorkspaceRepo struct {
+	ConnectionString string
+	DB               shared.PostgresDB
+}
+
+func NewWorkspaceRepo(connectionString string) *WorkspaceRepo {
+	db := shared.NewPostgresDB(connectionString)
+	db.Init()
+	return &WorkspaceRepo{
+		ConnectionString: connectionString,
+		DB:               *db,
+	}
+}
+
+func (repo *WorkspaceRepo) Close() error {
+	return repo.DB.Close()
+}
+
+func (repo *WorkspaceRepo) Create(ownerId string, name string) (model.Workspace, error) {
+	workspace := model.Workspace{
+		OwnerId: ownerId,
+		Name:    name,
+	}
+	err := repo.DB.Create(&workspace)
+	return workspace, err
+}
+
+// Return the workspaces of the owner with their domains, oldest first
+func (repo *WorkspaceRepo) ListByOwner(ownerId string) ([]model.Workspace, error) {
+	var workspaces []model.Workspace
+	err := repo.DB.GetDB().Preload("Domains").Where("owner_id = ?", ownerId).Order("id").Find(&workspaces).Error
+	return workspaces, err
+}
+
+// Return the workspace with its domains, an owner id restricts it to the workspaces of that owner
+func (repo *WorkspaceRepo) Get(id int64, ownerId string) (model.Workspace, error) {
+	var workspace model.Workspace
+	query := repo.DB.GetDB().Preload("Domains").Where("id = ?", id)
+	if ownerId != "" {
+		query = query.Where("owner_id = ?", ownerId)
+	}
+	err := query.First(&workspace).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return workspace, ErrWorkspaceNotFound
+	}
+	return workspace, err
+}
+
+// Attach the host to the workspace, a host belongs to a single workspace
+func (repo *WorkspaceRepo) AddDomain(workspaceId int64, ownerId string, host string) (model.Domain, error) {
+	var domain model.Domain
+	workspace, err := repo.Get(workspaceId, ownerId)
+	if err != nil {
+		return domain, err
+	}
+
+	domain = model.Domain{
+		Host:        host,
+		WorkspaceId: workspace.ID,
+	}
+	err = repo.DB.Create(&domain)
+	if shared.IsDuplicateKeyError(err) {
+		return domain, ErrDomainTaken
+	}
+	return domain, err
+}
+
+// Return the domain of the host with the workspace it belongs to
+func (repo *WorkspaceRepo) GetDomain(host string) (model.Domain, model.Workspace, error) {
+	var domain model.Domain
+	var workspace model.Workspace
+	err := repo.DB.GetDB().Where("host = ?", host).First(&domain).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return domain, workspace, ErrDomainNotFound
+	}
+	if err != nil {
+		return domain, workspace, err
+	}
+
+	err = repo.DB.GetDB().Where("id = ?", domain.WorkspaceId).First(&workspace).Error
+	return domain, workspace, err
+}
+
+// Detach the host from the workspace and return it. Refused with ErrDomainHasLinks
+// while the host has links: the domain is locked so no link can be created on it until
+// it is gone (see lockDomain).
+func (repo *WorkspaceRepo) RemoveDomain(workspaceId int64, ownerId string, host string) (model.Domain, error) {
+	var domain model.Domain
+	_, err := repo.Get(workspaceId, ownerId)
+	if err != nil {
+		return domain, err
+	}
+
+	err = repo.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("workspace_id = ? AND host = ?", workspaceId, host).
+			First(&domain).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrDomainNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var links int64
+		err = tx.Model(&model.UrlMapping{}).Where("domain = ?", host).Limit(1).Count(&links).Error
+		if err != nil {
+			return err
+		}
+		if links > 0 {
+			return ErrDomainHasLinks
+		}
+
+		return tx.Delete(&domain).Error
+	})
+	return domain, err
+}
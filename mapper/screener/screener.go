@@ -0,0 +1,232 @@
+package screener
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DomainRule = "domain"
+	RegexRule  = "regex"
+	HashRule   = "hash"
+)
+
+// Shortest hash prefix accepted, in hex characters (4 bytes)
+const minHashPrefixLength = 8
+
+// Match describes the blocklist rule a url was caught by
+type Match struct {
+	Kind string
+	Rule string
+}
+
+// URLScreener decides whether a url can be shortened
+type URLScreener interface {
+	// Screen returns the rule matching the url, or nil when the url is allowed
+	Screen(rawUrl string) *Match
+}
+
+// Blocklist is an immutable set of rules, parsed from a file with one rule per line:
+//
+//	# comment
+//	evil.example                  blocks the domain and its subdomains
+//	domain:evil.example           same as above
+//	regex:^https?://[^/]+/login   blocks the urls matching the regular expression
+//	hash:1a2b3c4d                 blocks the urls whose sha256 starts with the prefix
+//
+// Hashes are computed, in hex, over "host/path?query", "host/path" and "host/"
+// of the url, so a prefix can target a single page or a whole host without
+// publishing it in clear.
+type Blocklist struct {
+	domains      map[string]struct{}
+	regexes      []*regexp.Regexp
+	hashPrefixes []string
+	// Hash of the file content, tells whether two lists are the same
+	Checksum string
+}
+
+func ParseBlocklist(reader io.Reader) (*Blocklist, error) {
+	blocklist := &Blocklist{domains: map[string]struct{}{}}
+	checksum := sha256.New()
+	scanner := bufio.NewScanner(io.TeeReader(reader, checksum))
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, rule, found := strings.Cut(line, ":")
+		if !found {
+			kind, rule = DomainRule, line
+		}
+		rule = strings.TrimSpace(rule)
+
+		switch strings.ToLower(strings.TrimSpace(kind)) {
+		case DomainRule:
+			domain := strings.Trim(strings.TrimPrefix(strings.ToLower(rule), "*."), ".")
+			if domain == "" {
+				return nil, fmt.Errorf("line %d: empty domain", lineNumber)
+			}
+			blocklist.domains[domain] = struct{}{}
+		case RegexRule:
+			regex, err := regexp.Compile(rule)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			blocklist.regexes = append(blocklist.regexes, regex)
+		case HashRule:
+			prefix := strings.ToLower(rule)
+			if _, err := hex.DecodeString(prefix); err != nil || len(prefix) < minHashPrefixLength {
+				return nil, fmt.Errorf("line %d: hash prefix must be at least %d hex characters", lineNumber, minHashPrefixLength)
+			}
+			blocklist.hashPrefixes = append(blocklist.hashPrefixes, prefix)
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule %q", lineNumber, kind)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	blocklist.Checksum = hex.EncodeToString(checksum.Sum(nil))
+	return blocklist, nil
+}
+
+func LoadBlocklist(path string) (*Blocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseBlocklist(file)
+}
+
+// Number of rules in the list
+func (blocklist *Blocklist) Len() int {
+	return len(blocklist.domains) + len(blocklist.regexes) + len(blocklist.hashPrefixes)
+}
+
+func (blocklist *Blocklist) Screen(rawUrl string) *Match {
+	if blocklist == nil || blocklist.Len() == 0 {
+		return nil
+	}
+
+	parsed, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+
+	// The host itself, then each parent domain
+	for domain := host; domain != ""; {
+		if _, ok := blocklist.domains[domain]; ok {
+			return &Match{Kind: DomainRule, Rule: domain}
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			break
+		}
+		domain = parent
+	}
+
+	for _, regex := range blocklist.regexes {
+		if regex.MatchString(rawUrl) {
+			return &Match{Kind: RegexRule, Rule: regex.String()}
+		}
+	}
+
+	if len(blocklist.hashPrefixes) > 0 {
+		path := parsed.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+		expressions := []string{host + "/", host + path}
+		if parsed.RawQuery != "" {
+			expressions = append(expressions, host+path+"?"+parsed.RawQuery)
+		}
+		for _, expression := range expressions {
+			sum := sha256.Sum256([]byte(expression))
+			hash := hex.EncodeToString(sum[:])
+			for _, prefix := range blocklist.hashPrefixes {
+				if strings.HasPrefix(hash, prefix) {
+					return &Match{Kind: HashRule, Rule: prefix}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// FileScreener screens urls against a blocklist file, reloaded when the file changes
+type FileScreener struct {
+	Path string
+
+	mutex     sync.RWMutex
+	blocklist *Blocklist
+	modTime   time.Time
+	size      int64
+}
+
+// Create a screener for the file, an empty path gives a screener allowing every url
+func NewFileScreener(path string) *FileScreener {
+	return &FileScreener{Path: path, blocklist: &Blocklist{}}
+}
+
+func (screener *FileScreener) Screen(rawUrl string) *Match {
+	return screener.Blocklist().Screen(rawUrl)
+}
+
+// The rules currently in use
+func (screener *FileScreener) Blocklist() *Blocklist {
+	screener.mutex.RLock()
+	defer screener.mutex.RUnlock()
+	return screener.blocklist
+}
+
+// Reload the file when it was modified since the last load.
+// Return true when the rules changed; on error the previous rules are kept.
+func (screener *FileScreener) Reload() (bool, error) {
+	if screener.Path == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(screener.Path)
+	if err != nil {
+		return false, err
+	}
+
+	screener.mutex.RLock()
+	unchanged := info.ModTime().Equal(screener.modTime) && info.Size() == screener.size
+	previous := screener.blocklist
+	screener.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	blocklist, err := LoadBlocklist(screener.Path)
+	if err != nil {
+		return false, err
+	}
+
+	screener.mutex.Lock()
+	screener.blocklist = blocklist
+	screener.modTime = info.ModTime()
+	screener.size = info.Size()
+	screener.mutex.Unlock()
+
+	return blocklist.Checksum != previous.Checksum, nil
+}
@@ -0,0 +1,140 @@
+package screener
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hashPrefix(expression string) string {
+	sum := sha256.Sum256([]byte(expression))
+	return hex.EncodeToString(sum[:])[:10]
+}
+
+func TestBlocklistScreen(t *testing.T) {
+	list := strings.Join([]string{
+		"# phishing campaigns",
+		"evil.example",
+		"domain:*.bad.example",
+		"regex:^https?://[^/]+/wp-login\\.php",
+		"hash:" + hashPrefix("hashed.example/"),
+		"hash:" + hashPrefix("shared.example/campaign"),
+		"",
+	}, "\n")
+
+	blocklist, err := ParseBlocklist(strings.NewReader(list))
+	if err != nil {
+		t.Fatalf("Cannot parse blocklist: %v", err)
+	}
+	if blocklist.Len() != 5 {
+		t.Errorf("Blocklist should have 5 rules, got %d", blocklist.Len())
+	}
+
+	tests := []struct {
+		url  string
+		kind string
+	}{
+		{"https://evil.example/", DomainRule},
+		{"https://login.EVIL.example./account", DomainRule},
+		{"https://bad.example/", DomainRule},
+		{"https://a.b.bad.example/", DomainRule},
+		{"https://notevil.example/", ""},
+		{"https://evil.example.com/", ""},
+		{"https://blog.example/wp-login.php", RegexRule},
+		{"https://blog.example/wp-admin", ""},
+		{"https://hashed.example/any/page", HashRule},
+		{"https://shared.example/campaign?utm=1", HashRule},
+		{"https://shared.example/campaign", HashRule},
+		{"https://shared.example/other", ""},
+	}
+
+	for _, test := range tests {
+		match := blocklist.Screen(test.url)
+		if test.kind == "" {
+			if match != nil {
+				t.Errorf("Url %s should be allowed, matched %s %s", test.url, match.Kind, match.Rule)
+			}
+			continue
+		}
+		if match == nil || match.Kind != test.kind {
+			t.Errorf("Url %s should match a %s rule, got %v", test.url, test.kind, match)
+		}
+	}
+}
+
+func TestParseBlocklistErrors(t *testing.T) {
+	lists := []string{
+		"regex:([a-z",
+		"hash:abc",
+		"hash:zzzzzzzzzz",
+		"ip:10.0.0.1",
+		"domain:",
+	}
+
+	for _, list := range lists {
+		if _, err := ParseBlocklist(strings.NewReader(list)); err == nil {
+			t.Errorf("Blocklist %q should be invalid", list)
+		}
+	}
+}
+
+func TestFileScreenerReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(path, []byte("evil.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	screener := NewFileScreener(path)
+	changed, err := screener.Reload()
+	if err != nil || !changed {
+		t.Fatalf("First load should change the rules, got %v, %v", changed, err)
+	}
+	if screener.Screen("https://evil.example/") == nil {
+		t.Errorf("Url should be blocked after the first load")
+	}
+
+	changed, err = screener.Reload()
+	if err != nil || changed {
+		t.Errorf("Reloading an unchanged file should not change the rules, got %v, %v", changed, err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(path, []byte("other.example\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, later, later)
+	changed, err = screener.Reload()
+	if err != nil || !changed {
+		t.Fatalf("Reloading a modified file should change the rules, got %v, %v", changed, err)
+	}
+	if screener.Screen("https://evil.example/") != nil || screener.Screen("https://other.example/") == nil {
+		t.Errorf("Rules should be replaced by the new file")
+	}
+
+	later = later.Add(time.Minute)
+	if err := os.WriteFile(path, []byte("regex:([a-z\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, later, later)
+	if _, err := screener.Reload(); err == nil {
+		t.Errorf("Reloading an invalid file should fail")
+	}
+	if screener.Screen("https://other.example/") == nil {
+		t.Errorf("Previous rules should be kept when the file is invalid")
+	}
+}
+
+func TestEmptyFileScreener(t *testing.T) {
+	screener := NewFileScreener("")
+	changed, err := screener.Reload()
+	if err != nil || changed {
+		t.Errorf("Screener without file should not load anything, got %v, %v", changed, err)
+	}
+	if screener.Screen("https://evil.example/") != nil {
+		t.Errorf("Screener without file should allow every url")
+	}
+}
@@ -1,18 +1,18 @@
 package util
 
-func Base62Encode(n int64) string {
-	const base62Chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+const Base62Chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
+func Base62Encode(n int64) string {
 	if n == 0 {
-		return string(base62Chars[0])
+		return string(Base62Chars[0])
 	}
 
 	encoded := ""
-	base := len(base62Chars)
+	base := int64(len(Base62Chars))
 	for n > 0 {
-		remainder := int(n) % base
-		n /= int64(base)
-		encoded = string(base62Chars[remainder]) + encoded
+		remainder := n % base
+		n /= base
+		encoded = string(Base62Chars[remainder]) + encoded
 	}
 
 	return encoded
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/HungTP-Play/lru/mapper/repo"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Answer a repository error of the workspace endpoints
+func workspaceErrorResponse(c *fiber.Ctx, requestId string, err error) error {
+	if errors.Is(err, repo.ErrWorkspaceNotFound) || errors.Is(err, repo.ErrDomainNotFound) {
+		return c.Status(404).JSON(map[string]interface{}{
+			"error": "Not found",
+		})
+	}
+
+	if errors.Is(err, repo.ErrDomainTaken) {
+		return c.Status(409).JSON(map[string]interface{}{
+			"error": "Domain is already used by a workspace",
+		})
+	}
+
+	if errors.Is(err, repo.ErrDomainHasLinks) {
+		return c.Status(409).JSON(map[string]interface{}{
+			"error": "Domain still has links",
+		})
+	}
+
+	logger.Error("Cannot access workspace", zap.String("id", requestId), zap.Int("code", 500), zap.Error(err))
+	return c.Status(500).JSON(map[string]interface{}{
+		"error": "Internal server error",
+	})
+}
+
+// Check the owner of the request can create links on its domain.
+// Return the status and reason when it cannot, 0 when it can.
+func checkMapDomain(request shared.MapUrlRequest) (int, string, error) {
+	if request.Domain == "" {
+		return 0, "", nil
+	}
+
+	_, workspace, err := workspaceRepo.GetDomain(request.Domain)
+	if errors.Is(err, repo.ErrDomainNotFound) {
+		return 422, "Unknown domain", nil
+	}
+	if err != nil {
+		return 500, "Internal server error", err
+	}
+
+	if request.OwnerId == "" || workspace.OwnerId != request.OwnerId {
+		return 403, "Domain belongs to another workspace", nil
+	}
+	return 0, "", nil
+}
+
+func createWorkspaceHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	_, createSpan := tracer.StartSpan("CreateWorkspace", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer createSpan.End()
+
+	var workspaceRequest shared.WorkspaceRequest
+	err := c.BodyParser(&workspaceRequest)
+	if err != nil {
+		logger.Error("Cannot parse body", zap.String("id", workspaceRequest.Id), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Cannot parse body",
+		})
+	}
+
+	if workspaceRequest.OwnerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	if workspaceRequest.Name == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Name cannot be empty",
+		})
+	}
+
+	workspace, err := workspaceRepo.Create(workspaceRequest.OwnerId, workspaceRequest.Name)
+	if err != nil {
+		createSpan.RecordError(err)
+		createSpan.SetStatus(codes.Error, "Cannot create workspace")
+		return workspaceErrorResponse(c, workspaceRequest.Id, err)
+	}
+
+	logger.Info("Create workspace", zap.String("id", workspaceRequest.Id), zap.Int("code", 201), zap.Int64("workspaceId", workspace.ID), zap.String("ownerId", workspace.OwnerId))
+	return c.Status(201).JSON(workspace.ToWorkspaceResponse())
+}
+
+func listWorkspacesHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	_, listSpan := tracer.StartSpan("ListWorkspaces", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer listSpan.End()
+
+	requestId := c.Get("X-Request-Id")
+	ownerId := c.Get("X-Owner-Id")
+	if ownerId == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Owner id cannot be empty",
+		})
+	}
+
+	workspaces, err := workspaceRepo.ListByOwner(ownerId)
+	if err != nil {
+		listSpan.RecordError(err)
+		return workspaceErrorResponse(c, requestId, err)
+	}
+
+	responses := make([]shared.WorkspaceResponse, 0, len(workspaces))
+	for _, workspace := range workspaces {
+		responses = append(responses, workspace.ToWorkspaceResponse())
+	}
+	return c.Status(200).JSON(responses)
+}
+
+func addDomainHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	_, addSpan := tracer.StartSpan("AddDomain", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer addSpan.End()
+
+	var domainRequest shared.DomainRequest
+	err := c.BodyParser(&domainRequest)
+	if err != nil {
+		logger.Error("Cannot parse body", zap.String("id", domainRequest.Id), zap.Int("code", 400), zap.Error(err))
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Cannot parse body",
+		})
+	}
+
+	workspaceId, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(404).JSON(map[string]interface{}{
+			"error": "Not found",
+		})
+	}
+
+	if domainRequest.Host == "" {
+		return c.Status(400).JSON(map[string]interface{}{
+			"error": "Host cannot be empty",
+		})
+	}
+
+	domain, err := workspaceRepo.AddDomain(workspaceId, c.Get("X-Owner-Id"), domainRequest.Host)
+	if err != nil {
+		addSpan.RecordError(err)
+		return workspaceErrorResponse(c, domainRequest.Id, err)
+	}
+
+	logger.Info("Add domain", zap.String("id", domainRequest.Id), zap.Int("code", 201), zap.Int64("workspaceId", workspaceId), zap.String("host", domain.Host))
+	workspace, err := workspaceRepo.Get(workspaceId, "")
+	if err != nil {
+		return workspaceErrorResponse(c, domainRequest.Id, err)
+	}
+	return c.Status(201).JSON(workspace.ToWorkspaceResponse())
+}
+
+// Remove a domain from its workspace, refused while it still has links
+func removeDomainHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	_, removeSpan := tracer.StartSpan("RemoveDomain", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer removeSpan.End()
+
+	requestId := c.Get("X-Request-Id")
+	workspaceId, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(404).JSON(map[string]interface{}{
+			"error": "Not found",
+		})
+	}
+
+	domain, err := workspaceRepo.RemoveDomain(workspaceId, c.Get("X-Owner-Id"), c.Params("host"))
+	if err != nil {
+		removeSpan.RecordError(err)
+		return workspaceErrorResponse(c, requestId, err)
+	}
+
+	logger.Info("Remove domain", zap.String("id", requestId), zap.Int("code", 204), zap.Int64("workspaceId", workspaceId), zap.String("host", domain.Host))
+	return c.SendStatus(204)
+}
+
+// Tell which workspace serves the host, the gateway resolves short links with it
+func getDomainHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	_, getSpan := tracer.StartSpan("GetDomain", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer getSpan.End()
+
+	domain, workspace, err := workspaceRepo.GetDomain(c.Params("host"))
+	if err != nil {
+		getSpan.RecordError(err)
+		return workspaceErrorResponse(c, c.Get("X-Request-Id"), err)
+	}
+
+	return c.Status(200).JSON(shared.DomainResponse{
+		Host:        domain.Host,
+		WorkspaceId: workspace.ID,
+		OwnerId:     workspace.OwnerId,
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cache tiers, from the closest
+const (
+	localTier = "local"
+	redisTier = "redis"
+)
+
+// Redirects are cached in two tiers: an in-process LRU in front of Redis. The LRU
+// of an instance only hears of the events it consumes itself, so its entries live
+// for LOCAL_CACHE_TTL at most and the other instances see a change after that long.
+var localCache *shared.LRUCache[string, string]
+var localCacheTTL time.Duration
+var cacheRequests *prometheus.CounterVec
+var cacheEvictions *prometheus.CounterVec
+
+// Requests of a key since the start of its window
+type keyWindow struct {
+	hits int
+	ends time.Time
+}
+
+// Requests of the keys in their current window, a key requested HOT_KEY_HITS times
+// within HOT_KEY_WINDOW on this instance is hot
+var keyHits *shared.LRUCache[string, keyWindow]
+var hotKeyHits int
+var hotKeyWindow time.Duration
+
+// Init the local tier and the cache metrics
+//
+// - LOCAL_CACHE_MAX_ENTRIES: maximum number of entries (default 10000)
+// - LOCAL_CACHE_MAX_BYTES: maximum size of the keys and values (default 64MiB)
+// - LOCAL_CACHE_TTL: time an entry is kept (default 30s)
+// - HOT_KEY_HITS: requests making a key hot (default 10)
+// - HOT_KEY_WINDOW: time the requests of a key are counted over (default 1m)
+func initCache() {
+	cacheRequests = metrics.RegisterCounter("cache_requests", "Cache lookups by tier and result", []string{"tier", "result"})
+	cacheEvictions = metrics.RegisterCounter("cache_evictions", "Entries removed from the cache by tier and reason", []string{"tier", "reason"})
+
+	localCacheTTL = shared.GetEnvDuration("LOCAL_CACHE_TTL", 30*time.Second)
+	localCache = shared.NewLRUCache(shared.LRUOptions[string, string]{
+		MaxEntries: shared.GetEnvInt("LOCAL_CACHE_MAX_ENTRIES", 10000),
+		MaxBytes:   int64(shared.GetEnvInt("LOCAL_CACHE_MAX_BYTES", 64<<20)),
+		Size: func(key string, value string) int64 {
+			return int64(len(key) + len(value))
+		},
+		TTL: localCacheTTL,
+		OnEvict: func(key string, value string, reason shared.EvictionReason) {
+			metrics.IncCounter(cacheEvictions, localTier, string(reason))
+		},
+	})
+
+	hotKeyHits = shared.GetEnvInt("HOT_KEY_HITS", 10)
+	hotKeyWindow = shared.GetEnvDuration("HOT_KEY_WINDOW", time.Minute)
+	keyHits = shared.NewLRUCache(shared.LRUOptions[string, keyWindow]{
+		MaxEntries: shared.GetEnvInt("LOCAL_CACHE_MAX_ENTRIES", 10000),
+	})
+}
+
+// Count a request of the key. The count is approximate: concurrent requests may be
+// counted once, which only delays the key becoming hot.
+func countHit(key string) {
+	window, ok := keyHits.Get(key)
+	remaining := time.Until(window.ends)
+	if !ok || remaining <= 0 {
+		// A new window starts with the first request
+		keyHits.SetWithTTL(key, keyWindow{hits: 1, ends: time.Now().Add(hotKeyWindow)}, hotKeyWindow)
+		return
+	}
+	window.hits++
+	keyHits.SetWithTTL(key, window, remaining)
+}
+
+// Check whether the key was requested often enough in its current window
+func isHotKey(key string) bool {
+	window, ok := keyHits.Get(key)
+	return ok && window.hits >= hotKeyHits
+}
+
+// Time to keep an entry in the local tier, never past its time in Redis
+func localTTL(ttl time.Duration) time.Duration {
+	if ttl > 0 && ttl < localCacheTTL {
+		return ttl
+	}
+	return localCacheTTL
+}
+
+// Get the value of the key from the local tier, then from Redis. A value found in
+// Redis is kept in the local tier for the rest of its TTL. Return the remaining TTL of
+// a value read from Redis, 0 for a value of the local tier.
+func getCache(key string) (string, time.Duration, error) {
+	countHit(key)
+
+	value, ok := localCache.Get(key)
+	if ok {
+		metrics.IncCounter(cacheRequests, localTier, "hit")
+		return value, 0, nil
+	}
+	metrics.IncCounter(cacheRequests, localTier, "miss")
+
+	value, ttl, err := cacheClient.GetWithTTL(key)
+	if err != nil {
+		metrics.IncCounter(cacheRequests, redisTier, "miss")
+		return "", 0, err
+	}
+	metrics.IncCounter(cacheRequests, redisTier, "hit")
+
+	localCache.SetWithTTL(key, value, localTTL(ttl))
+	return value, ttl, nil
+}
+
+// Set the value of the key in both tiers
+func setCache(key string, value string, ttl time.Duration) error {
+	localCache.SetWithTTL(key, value, localTTL(ttl))
+	return cacheClient.Set(key, value, ttl)
+}
+
+// Drop the keys from both tiers
+func invalidateCache(keys ...string) error {
+	for _, key := range keys {
+		localCache.Delete(key)
+	}
+	err := cacheClient.Del(keys...)
+	if err == nil {
+		metrics.GetCounter(cacheEvictions, redisTier, "invalidated").Add(float64(len(keys)))
+	}
+	return err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/HungTP-Play/lru/shared/pb"
+	"go.uber.org/zap"
+)
+
+// gRPC API of the redirect service, answering like the HTTP routes of the same operations
+type redirectServer struct {
+	pb.UnimplementedRedirectServiceServer
+}
+
+func (s *redirectServer) Resolve(ctx context.Context, request *pb.ResolveRequest) (*pb.RedirectTarget, error) {
+	logger.Info("Resolve request", zap.String("id", request.GetId()), zap.String("domain", request.GetDomain()), zap.String("code", request.GetCode()))
+	redirectResponse, err := resolveCode(ctx, request.GetId(), request.GetDomain(), request.GetCode())
+	if err != nil {
+		return nil, shared.GrpcError(err)
+	}
+	return shared.RedirectResponseToProto(redirectResponse), nil
+}
+
+func (s *redirectServer) Redirect(ctx context.Context, request *pb.RedirectRequest) (*pb.RedirectTarget, error) {
+	logger.Info("Redirect request", zap.String("id", request.GetId()), zap.String("shorten", request.GetUrl()))
+	redirectResponse, err := redirectShortUrl(ctx, shared.RedirectRequest{Id: request.GetId(), Url: request.GetUrl()})
+	if err != nil {
+		return nil, shared.GrpcError(err)
+	}
+	return shared.RedirectResponseToProto(redirectResponse), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/HungTP-Play/lru/redirect/model"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Cached under the key of a link that does not exist, so unknown codes do not reach
+// the database on every request
+const missingLink = "-"
+
+// Lookups of the database on a cache miss are coalesced per key, unknown keys are
+// cached for NEGATIVE_CACHE_TTL and the Bloom filter of the known keys rejects most
+// of them before the database is queried.
+var redirectLookups *shared.SingleFlight[string, model.RedirectUrl]
+var linkFilter *shared.BloomFilter
+var linkFilterBits *shared.RedisBloomBits
+var negativeCacheTTL time.Duration
+var lookupsAvoided *prometheus.CounterVec
+
+// Init the lookups of the links missing from the cache
+//
+// - NEGATIVE_CACHE_TTL: time an unknown key is cached (default 30s)
+// - BLOOM_EXPECTED_LINKS: number of links the filter is sized for, at 1% false positives (default 1000000)
+func initLookups() {
+	lookupsAvoided = metrics.RegisterCounter("redirect_lookups_avoided", "Database lookups avoided on a cache miss", []string{"reason"})
+
+	redirectLookups = shared.NewSingleFlight[string, model.RedirectUrl]()
+	negativeCacheTTL = shared.GetEnvDuration("NEGATIVE_CACHE_TTL", 30*time.Second)
+
+	// The filter is shared by the instances in Redis: each event is consumed by a
+	// single instance, a filter in memory would miss the links created through the others
+	expectedLinks := shared.GetEnvInt("BLOOM_EXPECTED_LINKS", 1000000)
+	size, hashes := shared.BloomFilterSize(expectedLinks, 0.01)
+	linkFilterBits = &shared.RedisBloomBits{
+		Client: cacheClient,
+		// A filter of another size starts from an empty bitmap
+		Key: fmt.Sprintf("bloom:links:%d:%d", size, hashes),
+	}
+	linkFilter = shared.NewBloomFilter(expectedLinks, 0.01, linkFilterBits)
+}
+
+// Load the link of the key from the database, unless the Bloom filter knows it does
+// not exist. Concurrent lookups of the same key share a single query, a link found is
+// cached and a key without link is cached as missing. Return shared.ErrNotFound when
+// there is no link.
+func lookupRedirect(key string, load func() (model.RedirectUrl, error)) (model.RedirectUrl, error) {
+	known, err := linkFilter.MayContain(key)
+	if err != nil {
+		logger.Error("Cannot check link filter", zap.String("key", key), zap.Error(err))
+	}
+	if err == nil && !known {
+		metrics.IncCounter(lookupsAvoided, "bloom_filter")
+		return model.RedirectUrl{}, shared.ErrNotFound
+	}
+
+	redirectUrl, err, coalesced := loadRedirect(key, "miss", load)
+	if coalesced {
+		metrics.IncCounter(lookupsAvoided, "coalesced")
+	}
+	return redirectUrl, err
+}
+
+// Load the link of the key from the database and cache it, sharing the query with
+// the loads of the key in flight. The reason labels the refresh of the cache in
+// cache_refreshes. Return true when the query was shared.
+func loadRedirect(key string, reason string, load func() (model.RedirectUrl, error)) (model.RedirectUrl, error, bool) {
+	return redirectLookups.Do(key, func() (model.RedirectUrl, error) {
+		start := time.Now()
+		redirectUrl, err := load()
+		if errors.Is(err, shared.ErrNotFound) {
+			cacheErr := setCache(key, missingLink, negativeCacheTTL)
+			if cacheErr != nil {
+				logger.Error("Cannot set cache", zap.String("key", key), zap.Error(cacheErr))
+			}
+		}
+		if err != nil {
+			return redirectUrl, err
+		}
+		earlyRefresh.Observe(time.Since(start))
+
+		// This called the cache-aside pattern
+		cacheErr := cacheRedirect(redirectUrl)
+		if cacheErr != nil {
+			logger.Error("Cannot set cache", zap.String("key", key), zap.Error(cacheErr))
+		} else {
+			metrics.IncCounter(cacheRefreshes, reason)
+		}
+		return redirectUrl, nil
+	})
+}
+
+// Add the keys of a link to the Bloom filter
+func rememberLink(shortUrl string, domain string, code string) error {
+	keys := []string{shortUrl}
+	if code != "" {
+		keys = append(keys, codeCacheKey(domain, code))
+	}
+	for _, key := range keys {
+		err := linkFilter.Add(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fill the Bloom filter with the links of the database whenever Redis does not have
+// it ready, at startup and after Redis lost it, until ctx is cancelled
+//
+// - BLOOM_CHECK_INTERVAL: time between two checks of the filter (default 1m)
+func maintainLinkFilter(ctx context.Context) {
+	ticker := time.NewTicker(shared.GetEnvDuration("BLOOM_CHECK_INTERVAL", time.Minute))
+	defer ticker.Stop()
+
+	for {
+		ready, err := linkFilterBits.IsReady()
+		if err != nil {
+			logger.Error("Cannot check link filter", zap.Error(err))
+		}
+		if err == nil && !ready {
+			err = populateLinkFilter()
+			if err != nil {
+				logger.Error("Cannot populate link filter", zap.Error(err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func populateLinkFilter() error {
+	start := time.Now()
+	count := 0
+	err := redirectRepo.ForEachLinkKey(1000, func(batch []model.RedirectUrl) error {
+		for _, redirectUrl := range batch {
+			err := rememberLink(redirectUrl.ShortUrl, redirectUrl.Domain, redirectUrl.Code)
+			if err != nil {
+				return err
+			}
+		}
+		count += len(batch)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Links created while the filter was populated were added by their event
+	err = linkFilterBits.MarkReady()
+	if err != nil {
+		return err
+	}
+	logger.Info("Populate link filter", zap.Int("links", count), zap.Duration("duration", time.Since(start)))
+	return nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -10,30 +12,36 @@ import (
 	"github.com/HungTP-Play/lru/redirect/model"
 	"github.com/HungTP-Play/lru/redirect/repo"
 	"github.com/HungTP-Play/lru/shared"
+	"github.com/HungTP-Play/lru/shared/pb"
 	"github.com/gofiber/fiber/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rabbitmq/amqp091-go"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
 var logger *shared.Logger
-var rabbitmq *shared.RabbitMQ
+var bus shared.Bus
 var redirectRepo *repo.RedirectUrlRepo
+var deduplicator *shared.EventDeduplicator
 var cacheClient *shared.CacheClient
 var metrics *shared.Metrics
 var requestPerSecond *prometheus.CounterVec
 var TwoXXStatusCode *prometheus.GaugeVec
 var FourXXStatusCode *prometheus.GaugeVec
 var FiveXXStatusCode *prometheus.GaugeVec
+var duplicateEvents *prometheus.CounterVec
 var tracer *shared.Tracer
 
 var (
 	defaultKeyCacheTime = 15 * time.Minute
 )
 
-func init() {
+// Connect the backends and build the globals of the service. Called by main rather than
+// init, so the tests of the package run without the backends.
+func initService() {
 
 	logger = shared.NewLogger("redirect.log", 3, 1024, "info", "redirect")
 	logger.Init()
@@ -42,11 +50,26 @@ func init() {
 	redirectRepo = repo.NewRedirectUrlRepo("")
 
 	// Auto migrate
-	redirectRepo.DB.Migrate(&model.RedirectUrl{})
+	err := redirectRepo.Migrate()
+	if err != nil {
+		logger.Error("Cannot migrate redirects", zap.Error(err))
+		panic(err)
+	}
+
+	// Init deduplication of the redelivered events
+	deduplicator = shared.NewEventDeduplicator(&redirectRepo.DB, "redirect")
+	deduplicator.Migrate()
 
-	// Init rabbitmq
-	rabbitmq = shared.NewRabbitMQ("")
-	rabbitmq.Connect(10 * time.Second)
+	// Init message bus, selected by BUS_DRIVER
+	bus, err = shared.ConnectBus(10 * time.Second)
+	if bus == nil {
+		logger.Error("Cannot init message bus", zap.Error(err))
+		panic(err)
+	}
+	if err != nil {
+		logger.Error("Cannot connect to message bus, retrying in background", zap.Error(err))
+	}
+	bus.SetRetryPolicy(os.Getenv("REDIRECT_QUEUE"), shared.RetryPolicyFromEnv("REDIRECT"))
 
 	// Init cache
 	cacheClient = shared.NewCacheClient(shared.RedisDefaultConfig())
@@ -58,6 +81,16 @@ func init() {
 	TwoXXStatusCode = metrics.RegisterGauge("status_code_2xx", "2xx status code", []string{"method", "path", "code"})
 	FourXXStatusCode = metrics.RegisterGauge("status_code_4xx", "4xx status code", []string{"method", "path", "code"})
 	FiveXXStatusCode = metrics.RegisterGauge("status_code_5xx", "5xx status code", []string{"method", "path", "code"})
+	duplicateEvents = metrics.RegisterCounter("duplicate_events_dropped", "Redelivered events dropped because they were already processed", []string{"consumer", "type"})
+
+	// Init the in-process tier of the cache
+	initCache()
+
+	// Init the lookups of the links missing from the cache
+	initLookups()
+
+	// Init the refresh of the hot entries of the cache
+	initRefresh()
 
 	// Init tracer
 	tracer = shared.NewTracer("redirect", "")
@@ -100,7 +133,7 @@ func metricsHandler(c *fiber.Ctx) error {
 func onGratefulShutDown() {
 	fmt.Println("Shutting down...")
 	redirectRepo.Close()
-	rabbitmq.Close()
+	bus.Close()
 	cacheClient.Close()
 }
 
@@ -119,116 +152,452 @@ func redirectHandler(c *fiber.Ctx) error {
 
 	logger.Info("Redirect request", zap.String("id", redirectRequest.Id), zap.String("method", c.Method()), zap.String("path", c.Path()), zap.String("shorten", redirectRequest.Url))
 
+	redirectResponse, err := redirectShortUrl(ctx, redirectRequest)
+	if err != nil {
+		return shared.ServiceErrorResponse(c, err)
+	}
+	return c.Status(200).JSON(redirectResponse)
+}
+
+// Find the target of the short url, for the HTTP and gRPC APIs
+func redirectShortUrl(ctx context.Context, redirectRequest shared.RedirectRequest) (shared.RedirectResponse, error) {
 	// Check cache first => if not found => get from db
 	// This called the cache-aside pattern
-	var originalUrl string
 	var redirectResponse shared.RedirectResponse
 	ctx, cacheSpan := tracer.StartSpan("GetCache", ctx, trace.WithSpanKind(trace.SpanKindClient))
-	originalUrl, err = cacheClient.Get(redirectRequest.Url)
+	originalUrl, ttl, err := getCache(redirectRequest.Url)
 	cacheSpan.End()
 
-	if err == nil {
-		cacheSpan.RecordError(err)
+	load := func() (model.RedirectUrl, error) {
+		return redirectRepo.GetRedirect(redirectRequest.Url)
+	}
+	if err == nil && originalUrl == missingLink {
+		return shared.RedirectResponse{}, redirectError(redirectRequest.Id, redirectRequest.Url, shared.ErrNotFound)
+	} else if err == nil {
 		logger.Info("Cache hit", zap.String("key", redirectRequest.Url), zap.String("value", originalUrl))
+		// Links cached under their short url do not expire
+		refreshCacheEntry(redirectRequest.Url, ttl, defaultKeyCacheTime, load)
 		redirectResponse = shared.RedirectResponse{
 			Url:         redirectRequest.Url,
 			Id:          redirectRequest.Id,
 			OriginalUrl: originalUrl,
 		}
 	} else {
-		logger.Info("Cache miss", zap.String("key", redirectRequest.Url))
-		logger.Error("Cannot get cache", zap.String("id", redirectRequest.Id), zap.String("key", redirectRequest.Url), zap.Error(err))
+		logCacheMiss(redirectRequest.Id, redirectRequest.Url, err)
 		_, dbSpan := tracer.StartSpan("GetRedirect", ctx, trace.WithSpanKind(trace.SpanKindClient))
 
-		originalUrl, err = redirectRepo.GetRedirect(redirectRequest.Url)
+		redirectUrl, err := lookupRedirect(redirectRequest.Url, load)
 		if err != nil {
 			dbSpan.RecordError(err)
-			logger.Error("Cannot get redirect", zap.String("id", redirectRequest.Id), zap.Int("code", 500), zap.Error(err))
 			dbSpan.End()
-			return c.Status(500).JSON(map[string]interface{}{
-				"error": "Internal server error",
-			})
+			return shared.RedirectResponse{}, redirectError(redirectRequest.Id, redirectRequest.Url, err)
 		}
+		dbSpan.End()
+
+		// Only links without limits are cached under their short url,
+		// so limits are enforced on this path alone
+		err = checkLinkAvailable(redirectUrl)
+		if err != nil {
+			return shared.RedirectResponse{}, redirectError(redirectRequest.Id, redirectRequest.Url, err)
+		}
+		originalUrl = redirectUrl.Url
 
 		redirectResponse = shared.RedirectResponse{
 			Url:         redirectRequest.Url,
 			Id:          redirectRequest.Id,
 			OriginalUrl: originalUrl,
 		}
-		dbSpan.End()
 	}
 
 	// Send analytic message
 	ctx, analyticSpan := tracer.StartSpan("SendAnalytic", ctx, trace.WithSpanKind(trace.SpanKindProducer))
 	headers := shared.InjectAmqpTraceHeader(ctx)
 	go func() {
-		analyticMessage := shared.AnalyticMessage{
-			Id:        redirectRequest.Id,
-			Url:       originalUrl,
-			Shorten:   redirectRequest.Url,
-			Type:      "redirect",
-			Timestamp: time.Now().Unix(),
+		event, err := shared.NewEvent(ctx, shared.EventLinkClicked, "redirect", shared.LinkClickedV1{
+			Url:      originalUrl,
+			ShortUrl: redirectRequest.Url,
+		})
+		if err != nil {
+			analyticSpan.RecordError(err)
+			analyticSpan.End()
+			logger.Error("Cannot build click event", zap.String("id", redirectRequest.Id), zap.String("shorten", redirectRequest.Url), zap.Error(err))
+			return
 		}
 
 		analyticQueue := os.Getenv("ANALYTIC_QUEUE")
-		err := rabbitmq.Publish(analyticQueue, analyticMessage, headers)
+		err = bus.Publish(analyticQueue, event, headers)
 		if err != nil {
 			analyticSpan.RecordError(err)
-			analyticSpan.End()
 			logger.Error("Cannot publish analytic message", zap.String("id", redirectRequest.Id), zap.String("url", originalUrl), zap.String("shorten", redirectRequest.Url), zap.Error(err))
 		}
 		analyticSpan.End()
 	}()
 
+	return redirectResponse, nil
+}
+
+// Check the link can still be followed, counting the click of click-limited links.
+// Return shared.ErrDisabled or shared.ErrExpired when it cannot, the link is out of
+// clicks once it reached its maximum number of clicks.
+func checkLinkAvailable(redirectUrl model.RedirectUrl) error {
+	err := redirectUrl.Available(time.Now())
+	if err != nil {
+		return err
+	}
+
+	if redirectUrl.IsClickLimited() {
+		consumed, err := redirectRepo.ConsumeClick(redirectUrl.ID)
+		if err != nil {
+			return err
+		}
+		if !consumed {
+			return shared.ErrExpired
+		}
+	}
+
+	return nil
+}
+
+// Log why the link of the key cannot be followed and return the error, answered
+// with its status (see shared.AsServiceError)
+func redirectError(requestId string, key string, err error) error {
+	status := shared.ServiceErrorStatus(err)
+	switch {
+	case errors.Is(err, shared.ErrNotFound):
+		logger.Info("Redirect not found", zap.String("id", requestId), zap.Int("code", status), zap.String("key", key))
+	case errors.Is(err, shared.ErrExpired), errors.Is(err, shared.ErrDisabled):
+		logger.Info("Redirect gone", zap.String("id", requestId), zap.Int("code", status), zap.String("key", key), zap.Error(err))
+	default:
+		logger.Error("Cannot get redirect", zap.String("id", requestId), zap.Int("code", status), zap.String("key", key), zap.Error(err))
+	}
+	return err
+}
+
+// A missing key is a normal miss, any other failure means the cache is unreachable
+func logCacheMiss(requestId string, key string, err error) {
+	if errors.Is(err, shared.ErrNotFound) {
+		logger.Info("Cache miss", zap.String("key", key))
+		return
+	}
+	logger.Error("Cannot get cache", zap.String("id", requestId), zap.String("key", key), zap.Error(err))
+}
+
+// Time to keep a link in the cache, never past the link expiry.
+// Return 0 when the link should not be cached at all.
+func cacheTTL(expiresAt int64) time.Duration {
+	if expiresAt == 0 {
+		return defaultKeyCacheTime
+	}
+
+	remaining := time.Until(time.Unix(expiresAt, 0))
+	if remaining <= 0 {
+		return 0
+	}
+	if remaining < defaultKeyCacheTime {
+		return remaining
+	}
+	return defaultKeyCacheTime
+}
+
+// Cache key of a redirect looked up by its domain and short code
+func codeCacheKey(domain string, code string) string {
+	if domain == "" {
+		return "code:" + code
+	}
+	return "code:" + domain + "/" + code
+}
+
+func resolveHandler(c *fiber.Ctx) error {
+	ctx := shared.GetParentContext(c)
+	ctx, resolveSpan := tracer.StartSpan("ResolveHandler", ctx, trace.WithSpanKind(trace.SpanKindServer))
+	defer resolveSpan.End()
+
+	requestId := c.Get("X-Request-Id")
+	code := c.Params("code")
+	domain := c.Query("domain")
+	logger.Info("Resolve request", zap.String("id", requestId), zap.String("method", c.Method()), zap.String("path", c.Path()), zap.String("domain", domain), zap.String("code", code))
+
+	redirectResponse, err := resolveCode(ctx, requestId, domain, code)
+	if err != nil {
+		return shared.ServiceErrorResponse(c, err)
+	}
 	return c.Status(200).JSON(redirectResponse)
 }
 
-func redirectQueueHandler(msg []byte, headers amqp091.Table) error {
-	ctx := shared.ExtractAmqpTraceHeader(headers)
-	ctx, redirectSpan := tracer.StartSpan("RedirectQueueHandler", ctx, trace.WithSpanKind(trace.SpanKindConsumer))
+// Find the target of the short code on the domain, for the HTTP and gRPC APIs
+func resolveCode(ctx context.Context, requestId string, domain string, code string) (shared.RedirectResponse, error) {
+	// Same cache-aside pattern as redirectHandler, keyed by the domain and short code
+	var redirectUrl model.RedirectUrl
+	key := codeCacheKey(domain, code)
+	ctx, cacheSpan := tracer.StartSpan("GetCache", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	cached, ttl, err := getCache(key)
+	cacheSpan.End()
+
+	load := func() (model.RedirectUrl, error) {
+		return redirectRepo.GetRedirectByCode(domain, code)
+	}
+	if err == nil && cached == missingLink {
+		return shared.RedirectResponse{}, redirectError(requestId, key, shared.ErrNotFound)
+	} else if err == nil && json.Unmarshal([]byte(cached), &redirectUrl) == nil {
+		logger.Info("Cache hit", zap.String("key", key), zap.String("value", redirectUrl.Url))
+		var expiresAt int64
+		if redirectUrl.ExpiresAt != nil {
+			expiresAt = redirectUrl.ExpiresAt.Unix()
+		}
+		refreshCacheEntry(key, ttl, cacheTTL(expiresAt), load)
+	} else {
+		if err == nil {
+			err = fmt.Errorf("malformed cache entry %q", cached)
+		}
+		logCacheMiss(requestId, key, err)
+		_, dbSpan := tracer.StartSpan("GetRedirectByCode", ctx, trace.WithSpanKind(trace.SpanKindClient))
+
+		redirectUrl, err = lookupRedirect(key, load)
+		if err != nil {
+			dbSpan.RecordError(err)
+			dbSpan.End()
+			return shared.RedirectResponse{}, redirectError(requestId, key, err)
+		}
+		dbSpan.End()
+	}
+
+	err = checkLinkAvailable(redirectUrl)
+	if err != nil {
+		return shared.RedirectResponse{}, redirectError(requestId, key, err)
+	}
+
+	redirectType := redirectUrl.RedirectType
+	if !shared.IsRedirectTypeValid(redirectType) {
+		redirectType = shared.DefaultRedirectType
+	}
+
+	redirectResponse := shared.RedirectResponse{
+		Id:           requestId,
+		Url:          redirectUrl.ShortUrl,
+		Code:         code,
+		OriginalUrl:  redirectUrl.Url,
+		RedirectType: redirectType,
+	}
+
+	// Send analytic message
+	ctx, analyticSpan := tracer.StartSpan("SendAnalytic", ctx, trace.WithSpanKind(trace.SpanKindProducer))
+	headers := shared.InjectAmqpTraceHeader(ctx)
+	go func() {
+		event, err := shared.NewEvent(ctx, shared.EventLinkClicked, "redirect", shared.LinkClickedV1{
+			Code:     code,
+			Domain:   domain,
+			Url:      redirectUrl.Url,
+			ShortUrl: redirectUrl.ShortUrl,
+		})
+		if err != nil {
+			analyticSpan.RecordError(err)
+			analyticSpan.End()
+			logger.Error("Cannot build click event", zap.String("id", requestId), zap.String("shorten", redirectUrl.ShortUrl), zap.Error(err))
+			return
+		}
+
+		analyticQueue := os.Getenv("ANALYTIC_QUEUE")
+		err = bus.Publish(analyticQueue, event, headers)
+		if err != nil {
+			analyticSpan.RecordError(err)
+			logger.Error("Cannot publish analytic message", zap.String("id", requestId), zap.String("url", redirectUrl.Url), zap.String("shorten", redirectUrl.ShortUrl), zap.Error(err))
+		}
+		analyticSpan.End()
+	}()
+
+	return redirectResponse, nil
+}
+
+func redirectQueueHandler(ctx context.Context, msg []byte, headers amqp091.Table) error {
+	event, err := shared.DecodeEvent(msg)
+	ctx, redirectSpan := tracer.StartSpan("RedirectQueueHandler", event.Context(ctx), trace.WithSpanKind(trace.SpanKindConsumer))
 	defer redirectSpan.End()
 	innerLogger := shared.NewLogger("redirect.log", 3, 1024, "info", "redirect")
 	innerLogger.Init()
 
-	innerRepo := repo.NewRedirectUrlRepo("")
-
-	var redirectMessage shared.RedirectMessage
-	err := json.Unmarshal(msg, &redirectMessage)
+	// Events of other types are not for this service, retrying them would not help
+	if errors.Is(err, shared.ErrUnknownEventType) {
+		innerLogger.Info("Skip event", zap.String("eventId", event.Id), zap.String("type", event.Type))
+		return nil
+	}
 	if err != nil {
 		redirectSpan.RecordError(err)
-		innerLogger.Error("Cannot unmarshal redirect message: %s", zap.Error(err))
+		innerLogger.Error("Cannot decode redirect event", zap.String("eventId", event.Id), zap.String("type", event.Type), zap.Int("schemaVersion", event.SchemaVersion), zap.Error(err))
 		return err
 	}
 
-	innerLogger.Info("Receive add redirect message", zap.String("id", redirectMessage.Id), zap.String("url", redirectMessage.Url), zap.String("shorten", redirectMessage.Shorten))
+	switch event.Type {
+	case shared.EventLinkUpdated:
+		var link shared.LinkUpdatedV1
+		err = event.DecodeData(&link)
+		if err != nil {
+			break
+		}
+		return changeRedirect(ctx, innerLogger, event, link.Domain, link.Code, link.ShortUrl, func(innerRepo *repo.RedirectUrlRepo) error {
+			return innerRepo.UpdateRedirect(link)
+		})
+	case shared.EventLinkDeleted:
+		var link shared.LinkDeletedV1
+		err = event.DecodeData(&link)
+		if err != nil {
+			break
+		}
+		return changeRedirect(ctx, innerLogger, event, link.Domain, link.Code, link.ShortUrl, func(innerRepo *repo.RedirectUrlRepo) error {
+			return innerRepo.DeleteRedirect(link.Domain, link.Code)
+		})
+	case shared.EventLinkCreated:
+		var link shared.LinkCreatedV1
+		err = event.DecodeData(&link)
+		if err != nil {
+			break
+		}
+		return addRedirect(ctx, innerLogger, event, link)
+	default:
+		innerLogger.Info("Skip event", zap.String("eventId", event.Id), zap.String("type", event.Type))
+		return nil
+	}
+
+	redirectSpan.RecordError(err)
+	innerLogger.Error("Cannot decode redirect event data", zap.String("eventId", event.Id), zap.String("type", event.Type), zap.Error(err))
+	return err
+}
+
+// Apply the change of the event to the database, once: a redelivered event is dropped.
+// Return false for a duplicate.
+func applyRedirectEvent(event shared.Event, change func(innerRepo *repo.RedirectUrlRepo) error) (bool, error) {
+	processed, err := deduplicator.Process(event.Id, func(tx *gorm.DB) error {
+		return change(redirectRepo.WithTx(tx))
+	})
+	if err == nil && !processed {
+		metrics.IncCounter(duplicateEvents, "redirect", event.Type)
+	}
+	return processed, err
+}
+
+// Store a new link, then cache it
+func addRedirect(ctx context.Context, innerLogger *shared.Logger, event shared.Event, link shared.LinkCreatedV1) error {
+	innerLogger.Info("Receive add redirect event", zap.String("eventId", event.Id), zap.String("url", link.Url), zap.String("shorten", link.ShortUrl))
+
+	_, dbSpan := tracer.StartSpan("UpdateDB", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	processed, err := applyRedirectEvent(event, func(innerRepo *repo.RedirectUrlRepo) error {
+		return innerRepo.AddRedirect(link)
+	})
+	if err != nil {
+		dbSpan.RecordError(err)
+		dbSpan.SetStatus(codes.Error, "Cannot add redirect")
+		innerLogger.Error("Cannot add redirect", zap.String("eventId", event.Id), zap.String("url", link.Url), zap.String("shorten", link.ShortUrl), zap.Error(err))
+		dbSpan.End()
+		return err
+	}
+	dbSpan.End()
+	if !processed {
+		innerLogger.Info("Drop duplicate event", zap.String("eventId", event.Id), zap.String("type", event.Type), zap.String("shorten", link.ShortUrl))
+	}
 
-	// Add to cache, use shorten as key, original url as value
+	// Known to the filter before its cache entries are dropped, so the next lookup
+	// cannot be rejected
+	err = rememberLink(link.ShortUrl, link.Domain, link.Code)
+	if err != nil {
+		innerLogger.Error("Cannot add link to filter", zap.String("eventId", event.Id), zap.String("shorten", link.ShortUrl), zap.Error(err))
+		return err
+	}
+
+	// Drop the entries caching the link as missing
+	_, cacheSpan := tracer.StartSpan("SetCache", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer cacheSpan.End()
+	keys := []string{link.ShortUrl}
+	if link.Code != "" {
+		keys = append(keys, codeCacheKey(link.Domain, link.Code))
+	}
+	err = invalidateCache(keys...)
+	if err != nil {
+		cacheSpan.RecordError(err)
+		cacheSpan.SetStatus(codes.Error, "Cannot invalidate cache")
+		innerLogger.Error("Cannot invalidate cache", zap.String("eventId", event.Id), zap.String("shorten", link.ShortUrl), zap.Error(err))
+		return err
+	}
+
+	// Add to cache, read back after the insert so the entries carry the row id
 	// This called the write-through cache pattern
-	ctx, cacheSpan := tracer.StartSpan("SetCache", ctx, trace.WithSpanKind(trace.SpanKindClient))
-	err = cacheClient.Set(redirectMessage.Shorten, redirectMessage.Url, defaultKeyCacheTime)
+	redirectUrl, err := redirectRepo.GetRedirect(link.ShortUrl)
+	if err == nil {
+		err = cacheRedirect(redirectUrl)
+	}
 	if err != nil {
 		cacheSpan.RecordError(err)
 		cacheSpan.SetStatus(codes.Error, "Cannot set cache")
-		innerLogger.Error("Cannot set cache", zap.String("id", redirectMessage.Id), zap.String("key", redirectMessage.Shorten), zap.String("value", redirectMessage.Url), zap.Error(err))
+		innerLogger.Error("Cannot set cache", zap.String("eventId", event.Id), zap.String("shorten", link.ShortUrl), zap.Error(err))
+		// The link is cached on its first lookup instead
+		return nil
 	}
-	cacheSpan.End()
+	innerLogger.Info("Set cache", zap.String("shorten", link.ShortUrl), zap.String("value", link.Url))
 
-	innerLogger.Info("Set cache", zap.String("key", redirectMessage.Shorten), zap.String("value", redirectMessage.Url))
+	return nil
+}
 
-	_, dbSpan := tracer.StartSpan("UpdateDB", ctx, trace.WithSpanKind(trace.SpanKindClient))
-	err = innerRepo.AddRedirect(redirectMessage)
+// Apply an update or a delete of a link, then drop its cache entries so the
+// next request reads the new state from the database
+func changeRedirect(ctx context.Context, innerLogger *shared.Logger, event shared.Event, domain string, code string, shorten string, change func(innerRepo *repo.RedirectUrlRepo) error) error {
+	innerLogger.Info("Receive change redirect event", zap.String("eventId", event.Id), zap.String("type", event.Type), zap.String("shorten", shorten))
+
+	ctx, dbSpan := tracer.StartSpan("UpdateDB", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	processed, err := applyRedirectEvent(event, change)
 	if err != nil {
 		dbSpan.RecordError(err)
-		dbSpan.SetStatus(codes.Error, "Cannot add redirect")
-		innerLogger.Error("Cannot add redirect", zap.String("id", redirectMessage.Id), zap.String("url", redirectMessage.Url), zap.String("shorten", redirectMessage.Shorten), zap.Error(err))
+		dbSpan.SetStatus(codes.Error, "Cannot change redirect")
+		dbSpan.End()
+		innerLogger.Error("Cannot change redirect", zap.String("eventId", event.Id), zap.String("type", event.Type), zap.String("shorten", shorten), zap.Error(err))
 		return err
 	}
 	dbSpan.End()
+	if !processed {
+		innerLogger.Info("Drop duplicate event", zap.String("eventId", event.Id), zap.String("type", event.Type), zap.String("shorten", shorten))
+	}
+
+	// Invalidated after the commit, and for a duplicate too in case the cache could
+	// not be reached when the event was first processed
+	_, cacheSpan := tracer.StartSpan("InvalidateCache", ctx, trace.WithSpanKind(trace.SpanKindClient))
+	defer cacheSpan.End()
+	err = invalidateCache(shorten, codeCacheKey(domain, code))
+	if err != nil {
+		cacheSpan.RecordError(err)
+		cacheSpan.SetStatus(codes.Error, "Cannot invalidate cache")
+		innerLogger.Error("Cannot invalidate cache", zap.String("eventId", event.Id), zap.String("shorten", shorten), zap.Error(err))
+		return err
+	}
+	reinvalidateCache(shorten, codeCacheKey(domain, code))
 
 	return nil
 }
 
+// Periodically delete the links expired for longer than the retention period,
+// until then they are answered with 410 Gone
+//
+// - EXPIRED_SWEEP_INTERVAL: time between two sweeps (default 10m)
+// - EXPIRED_LINK_RETENTION: how long an expired link is kept (default 168h)
+func sweepExpiredRedirects() {
+	interval := shared.GetEnvDuration("EXPIRED_SWEEP_INTERVAL", 10*time.Minute)
+	retention := shared.GetEnvDuration("EXPIRED_LINK_RETENTION", 7*24*time.Hour)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := redirectRepo.PurgeExpired(time.Now().Add(-retention))
+		if err != nil {
+			logger.Error("Cannot purge expired redirects", zap.Error(err))
+			continue
+		}
+
+		if purged > 0 {
+			logger.Info("Purge expired redirects", zap.Int64("purged", purged))
+		}
+	}
+}
+
 func main() {
+	initService()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "1111"
@@ -242,12 +611,44 @@ func main() {
 	redirectService.Use(ResponseStatusCodeMiddleware)
 
 	redirectService.Routes("/redirect", redirectHandler, "GET")
+	redirectService.Routes("/resolve/:code", resolveHandler, "GET")
 	redirectService.Routes("/metrics", metricsHandler, "GET")
 
+	go sweepExpiredRedirects()
+
 	redirectQueue := os.Getenv("REDIRECT_QUEUE")
-	go func() {
-		rabbitmq.Consume(redirectQueue, redirectQueueHandler, 9)
-	}()
+	shared.RegisterDeadLetterRoutes(redirectService, bus, redirectQueue)
+
+	// Internal gRPC API, alongside the HTTP routes
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "9222"
+	}
+	grpcServer := shared.NewGrpcServer()
+	pb.RegisterRedirectServiceServer(grpcServer, &redirectServer{})
+	redirectService.Background(func(ctx context.Context) {
+		err := shared.ServeGrpc(ctx, grpcServer, grpcPort)
+		if err != nil {
+			logger.Error("Cannot serve gRPC", zap.String("port", grpcPort), zap.Error(err))
+		}
+	})
+
+	redirectService.Background(maintainLinkFilter)
+
+	redirectService.Background(warmUpCache)
+
+	redirectService.Background(func(ctx context.Context) {
+		deduplicator.PurgeLoop(ctx, func(err error) {
+			logger.Error("Cannot purge processed events", zap.Error(err))
+		})
+	})
+
+	redirectService.Background(func(ctx context.Context) {
+		err := bus.Subscribe(ctx, redirectQueue, redirectQueueHandler, 9)
+		if err != nil {
+			logger.Error("Cannot drain redirect queue", zap.Error(err))
+		}
+	})
 
 	redirectService.Start(onGratefulShutDown)
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+// Queue consumed by redirectQueueHandler on a MemoryBus, retrying a failed event once
+func newTestRedirectQueue(t *testing.T) (*shared.MemoryBus, string) {
+	if tracer == nil {
+		tracer = shared.NewTracer("redirect", "")
+		tracer.Init()
+	}
+
+	queue := "redirect-test"
+	bus := shared.NewMemoryBus()
+	bus.DrainTimeout = time.Second
+	bus.SetRetryPolicy(queue, shared.RetryPolicy{MaxAttempts: 2, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- bus.Subscribe(ctx, queue, redirectQueueHandler, 1)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		bus.Close()
+	})
+	return bus, queue
+}
+
+func testEventBody(id string, eventType string, schemaVersion int, data string) string {
+	return fmt.Sprintf(`{"id":%q,"type":%q,"schemaVersion":%d,"occurredAt":"2024-01-01T00:00:00Z","producer":"mapper","data":%s}`, id, eventType, schemaVersion, data)
+}
+
+// Wait for count dead letters on the queue
+func waitDeadLetters(t *testing.T, bus *shared.MemoryBus, queue string, count int) []shared.DeadLetter {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deadLetters, err := bus.DeadLetters(queue, 100)
+		if err != nil {
+			t.Fatalf("DeadLetters() error = %v", err)
+		}
+		if len(deadLetters) >= count || time.Now().After(deadline) {
+			return deadLetters
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedirectQueueHandlerDeadLettersUndecodableEvents(t *testing.T) {
+	bus, queue := newTestRedirectQueue(t)
+
+	messages := []string{
+		// Not for this service, dropped
+		testEventBody("e1", "link.renamed", 1, `{}`),
+		`not json`,
+		// Published by a newer mapper, kept until this service knows its schema
+		testEventBody("e2", shared.EventLinkCreated, 2, `{}`),
+		testEventBody("e3", shared.EventLinkUpdated, 1, `{"code":"abc"}`),
+	}
+	for _, message := range messages {
+		err := bus.PublishRaw(queue, []byte(message), nil)
+		if err != nil {
+			t.Fatalf("PublishRaw() error = %v", err)
+		}
+	}
+
+	waitDeadLetters(t, bus, queue, 3)
+	// Leave the skipped event the time to be dead lettered by mistake
+	time.Sleep(50 * time.Millisecond)
+	deadLetters := waitDeadLetters(t, bus, queue, 3)
+	if len(deadLetters) != 3 {
+		t.Fatalf("got %d dead letters, want 3: %+v", len(deadLetters), deadLetters)
+	}
+
+	for _, want := range []string{"invalid character", "unsupported event schema version", "in LinkUpdatedV1: required"} {
+		found := false
+		for _, deadLetter := range deadLetters {
+			if strings.Contains(deadLetter.Error, want) {
+				found = true
+				if deadLetter.Attempts != 2 {
+					t.Errorf("dead letter %q after %d attempts, want 2", deadLetter.Error, deadLetter.Attempts)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("no dead letter failing with %q: %+v", want, deadLetters)
+		}
+	}
+	for _, deadLetter := range deadLetters {
+		if strings.Contains(string(deadLetter.Payload), "link.renamed") {
+			t.Errorf("event of an unknown type was dead lettered: %+v", deadLetter)
+		}
+	}
+}
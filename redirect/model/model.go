@@ -1,7 +1,42 @@
 package model
 
+import (
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
 type RedirectUrl struct {
-	ID       uint   `gorm:"primaryKey" json:"id"`
-	Url      string `json:"url"`
-	ShortUrl string `gorm:"unique,index" json:"shortUrl"`
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	Url          string     `json:"url"`
+	ShortUrl     string     `gorm:"unique,index" json:"shortUrl"`
+	Domain       string     `gorm:"not null;default:'';index:idx_redirect_urls_domain_code,priority:1" json:"domain"` // Empty for the default domain
+	Code         string     `gorm:"index:idx_redirect_urls_domain_code,priority:2" json:"code"`
+	RedirectType int        `json:"redirectType"`
+	ExpiresAt    *time.Time `gorm:"index" json:"expiresAt"`
+	MaxClicks    int64      `json:"maxClicks"`
+	Clicks       int64      `json:"clicks"`
+	Disabled     bool       `json:"disabled"`
+}
+
+// Check if the link expiry time is reached
+func (r RedirectUrl) IsExpired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+// Check if the link can only be followed a limited number of times
+func (r RedirectUrl) IsClickLimited() bool {
+	return r.MaxClicks > 0
+}
+
+// Check the link can be followed at the given time, its click limit aside.
+// Return shared.ErrDisabled or shared.ErrExpired when it cannot.
+func (r RedirectUrl) Available(now time.Time) error {
+	if r.Disabled {
+		return shared.ErrDisabled
+	}
+	if r.IsExpired(now) {
+		return shared.ErrExpired
+	}
+	return nil
 }
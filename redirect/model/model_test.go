@@ -0,0 +1,31 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+func TestRedirectUrlAvailable(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+
+	cases := []struct {
+		name        string
+		redirectUrl RedirectUrl
+		want        error
+	}{
+		{"active", RedirectUrl{Url: "https://example.com"}, nil},
+		{"not expired yet", RedirectUrl{ExpiresAt: &future}, nil},
+		{"expired", RedirectUrl{ExpiresAt: &past}, shared.ErrExpired},
+		{"expiring now", RedirectUrl{ExpiresAt: &now}, shared.ErrExpired},
+		{"disabled", RedirectUrl{Disabled: true, ExpiresAt: &past}, shared.ErrDisabled},
+	}
+	for _, c := range cases {
+		if got := c.redirectUrl.Available(now); got != c.want {
+			t.Errorf("%s: Available() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/HungTP-Play/lru/redirect/model"
+	"github.com/HungTP-Play/lru/shared"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Held by the instance warming the cache up, so instances started together do it once
+const warmUpLockKey = "warmup:redirect"
+
+// Entries read from Redis are refreshed from the database shortly before they
+// expire, and the TTL of the hot ones is extended while they are requested
+var earlyRefresh *shared.EarlyRefresh
+var reinvalidateDelay time.Duration
+var cacheRefreshes *prometheus.CounterVec
+
+// Init the refresh of the cache entries
+//
+// - EARLY_REFRESH_BETA: scale of the early refresh window, above 1 refreshes earlier (default 1)
+// - CACHE_REINVALIDATE_DELAY: delay of the second invalidation of a changed link, 0 disables it (default 2s)
+func initRefresh() {
+	cacheRefreshes = metrics.RegisterCounter("cache_refreshes", "Cache entries written or extended outside of the link events", []string{"reason"})
+
+	earlyRefresh = shared.NewEarlyRefresh(shared.GetEnvFloat("EARLY_REFRESH_BETA", 1))
+	reinvalidateDelay = shared.GetEnvDuration("CACHE_REINVALIDATE_DELAY", 2*time.Second)
+}
+
+// Cache the link under its short url and under its code. Only links without limits
+// nor expiry are cached under their short url: the limits are enforced on a miss of
+// that path alone, and their entries can be extended without reading the link.
+func cacheRedirect(redirectUrl model.RedirectUrl) error {
+	var expiresAt int64
+	if redirectUrl.ExpiresAt != nil {
+		expiresAt = redirectUrl.ExpiresAt.Unix()
+	}
+	// Never cache a link past its expiry
+	ttl := cacheTTL(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+
+	if redirectUrl.ExpiresAt == nil && !redirectUrl.IsClickLimited() && !redirectUrl.Disabled {
+		err := setCache(redirectUrl.ShortUrl, redirectUrl.Url, ttl)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The entry carries the row id used to count clicks
+	if redirectUrl.Code == "" {
+		return nil
+	}
+	cached, err := json.Marshal(redirectUrl)
+	if err != nil {
+		return err
+	}
+	return setCache(codeCacheKey(redirectUrl.Domain, redirectUrl.Code), string(cached), ttl)
+}
+
+// Keep the entry of the key cached while it is requested, given its remaining TTL in
+// Redis: reload it from the database in the background shortly before it expires,
+// otherwise extend the TTL of a hot key once half of maxTTL is left. The TTL is never
+// extended past maxTTL. An entry read from the local tier (remaining 0) is left as is.
+func refreshCacheEntry(key string, remaining time.Duration, maxTTL time.Duration, load func() (model.RedirectUrl, error)) {
+	if remaining <= 0 {
+		return
+	}
+
+	if earlyRefresh.Due(remaining) {
+		go func() {
+			_, err, _ := loadRedirect(key, "early", load)
+			if err != nil && !errors.Is(err, shared.ErrNotFound) {
+				logger.Error("Cannot refresh cache", zap.String("key", key), zap.Error(err))
+			}
+		}()
+		return
+	}
+
+	if remaining >= maxTTL/2 || !isHotKey(key) {
+		return
+	}
+	extended, err := cacheClient.Expire(key, maxTTL)
+	if err != nil {
+		logger.Error("Cannot extend cache", zap.String("key", key), zap.Error(err))
+		return
+	}
+	if extended {
+		metrics.IncCounter(cacheRefreshes, "extended")
+	}
+}
+
+// Drop the keys again after CACHE_REINVALIDATE_DELAY: a lookup that read the link
+// before its change may cache the old state after the first invalidation
+func reinvalidateCache(keys ...string) {
+	if reinvalidateDelay <= 0 {
+		return
+	}
+	time.AfterFunc(reinvalidateDelay, func() {
+		err := invalidateCache(keys...)
+		if err != nil {
+			logger.Error("Cannot invalidate cache", zap.Strings("keys", keys), zap.Error(err))
+		}
+	})
+}
+
+// Load the most visited links, as counted by the analytic service, into the cache at
+// startup. A single instance of those started within defaultKeyCacheTime does it.
+//
+// - WARMUP_TOP_N: number of links loaded, 0 disables the warm-up (default 1000)
+// - WARMUP_ATTEMPTS: tries to reach the analytic service, started along (default 5)
+func warmUpCache(ctx context.Context) {
+	topN := shared.GetEnvInt("WARMUP_TOP_N", 1000)
+	if topN <= 0 {
+		return
+	}
+
+	acquired, err := cacheClient.SetNX(warmUpLockKey, "1", defaultKeyCacheTime)
+	if err != nil {
+		logger.Error("Cannot lock cache warm-up", zap.Error(err))
+		return
+	}
+	if !acquired {
+		logger.Info("Skip cache warm-up, done by another instance")
+		return
+	}
+
+	start := time.Now()
+	topLinks, err := fetchTopLinks(ctx, topN, shared.GetEnvInt("WARMUP_ATTEMPTS", 5))
+	if err != nil {
+		logger.Error("Cannot get top links", zap.Error(err))
+		// Let the next instance started try again
+		cacheClient.Del(warmUpLockKey)
+		return
+	}
+
+	warmed := 0
+	for _, link := range topLinks {
+		if ctx.Err() != nil {
+			return
+		}
+
+		redirectUrl, err := redirectRepo.GetRedirect(link.Shortened)
+		if errors.Is(err, shared.ErrNotFound) {
+			continue
+		}
+		if err == nil {
+			err = cacheRedirect(redirectUrl)
+		}
+		if err != nil {
+			logger.Error("Cannot warm up cache", zap.String("shorten", link.Shortened), zap.Error(err))
+			continue
+		}
+		warmed++
+	}
+
+	metrics.GetCounter(cacheRefreshes, "warmup").Add(float64(warmed))
+	logger.Info("Warm up cache", zap.Int("links", warmed), zap.Duration("duration", time.Since(start)))
+}
+
+// Get the statistics of the most visited links from the analytic service, trying
+// again every few seconds until it answers
+func fetchTopLinks(ctx context.Context, limit int, attempts int) ([]shared.LinkStats, error) {
+	url := fmt.Sprintf("%s/top?limit=%d", getAnalyticUrl(), limit)
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+		}
+
+		var topLinks []shared.LinkStats
+		topLinks, err = getTopLinks(ctx, client, url)
+		if err == nil {
+			return topLinks, nil
+		}
+		logger.Info("Cannot reach analytic service", zap.Int("attempt", attempt), zap.Error(err))
+	}
+	return nil, err
+}
+
+func getTopLinks(ctx context.Context, client *http.Client, url string) ([]shared.LinkStats, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("analytic service answered %d", response.StatusCode)
+	}
+	var topLinks []shared.LinkStats
+	err = json.NewDecoder(response.Body).Decode(&topLinks)
+	return topLinks, err
+}
+
+func getAnalyticUrl() string {
+	host := os.Getenv("ANALYTIC_HOST")
+	if host == "" {
+		host = "analytic"
+	}
+
+	port := os.Getenv("ANALYTIC_PORT")
+	if port == "" {
+		port = "4444"
+	}
+
+	return fmt.Sprintf("http://%s:%s", host, port)
+}
@@ -1,8 +1,12 @@
 package repo
 
 import (
+	"errors"
+	"time"
+
 	"github.com/HungTP-Play/lru/redirect/model"
 	"github.com/HungTP-Play/lru/shared"
+	"gorm.io/gorm"
 )
 
 type RedirectUrlRepo struct {
@@ -19,29 +23,130 @@ func NewRedirectUrlRepo(connectionString string) *RedirectUrlRepo {
 	}
 }
 
+// Create or upgrade the table of the redirects. Redirects created before links had a
+// domain are moved to the default one, which the lookups match with an empty domain.
+func (repo *RedirectUrlRepo) Migrate() error {
+	db := repo.DB.GetDB()
+	if db.Migrator().HasColumn(&model.RedirectUrl{}, "Domain") {
+		err := db.Model(&model.RedirectUrl{}).Where("domain IS NULL").Update("domain", "").Error
+		if err != nil {
+			return err
+		}
+	}
+	return db.AutoMigrate(&model.RedirectUrl{})
+}
+
 func (repo *RedirectUrlRepo) Close() error {
 	return repo.DB.Close()
 }
 
-func (repo *RedirectUrlRepo) AddRedirect(message shared.RedirectMessage) error {
+// Same repo, running its queries in the transaction
+func (repo *RedirectUrlRepo) WithTx(tx *gorm.DB) *RedirectUrlRepo {
+	return &RedirectUrlRepo{
+		ConnectionString: repo.ConnectionString,
+		DB:               shared.PostgresDB{ConnectionString: repo.ConnectionString, DB: tx},
+	}
+}
+
+func (repo *RedirectUrlRepo) AddRedirect(link shared.LinkCreatedV1) error {
 	redirectUrl := model.RedirectUrl{
-		ShortUrl: message.Shorten,
-		Url:      message.Url,
+		ShortUrl:     link.ShortUrl,
+		Url:          link.Url,
+		Code:         link.Code,
+		Domain:       link.Domain,
+		RedirectType: link.RedirectType,
+		MaxClicks:    link.MaxClicks,
+		Disabled:     link.Disabled,
+	}
+
+	if link.ExpiresAt > 0 {
+		expiresAt := time.Unix(link.ExpiresAt, 0).UTC()
+		redirectUrl.ExpiresAt = &expiresAt
 	}
 
-	err := repo.DB.Create(&redirectUrl)
-	if err != nil {
-		return err
+	// An alias can be reused on its domain once its previous link has been archived,
+	// the new link replaces whatever is left of the old one
+	return repo.DB.GetDB().Transaction(func(tx *gorm.DB) error {
+		if link.Code != "" {
+			err := tx.Where("domain = ? AND code = ?", link.Domain, link.Code).Delete(&model.RedirectUrl{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Create(&redirectUrl).Error
+	})
+}
+
+// Replace the target and limits of a link, keeping its click count
+func (repo *RedirectUrlRepo) UpdateRedirect(link shared.LinkUpdatedV1) error {
+	var expiresAt *time.Time
+	if link.ExpiresAt > 0 {
+		expiry := time.Unix(link.ExpiresAt, 0).UTC()
+		expiresAt = &expiry
 	}
-	return nil
+
+	return repo.DB.GetDB().Model(&model.RedirectUrl{}).
+		Where("domain = ? AND code = ?", link.Domain, link.Code).
+		Updates(map[string]interface{}{
+			"url":           link.Url,
+			"redirect_type": link.RedirectType,
+			"expires_at":    expiresAt,
+			"max_clicks":    link.MaxClicks,
+			"disabled":      link.Disabled,
+		}).Error
 }
 
-func (repo *RedirectUrlRepo) GetRedirect(shorten string) (string, error) {
+func (repo *RedirectUrlRepo) DeleteRedirect(domain string, code string) error {
+	return repo.DB.GetDB().Where("domain = ? AND code = ?", domain, code).Delete(&model.RedirectUrl{}).Error
+}
+
+// Return shared.ErrNotFound when no link matches the query, and wrap the other
+// failures of the database in shared.ErrBackendUnavailable
+func (repo *RedirectUrlRepo) first(query interface{}, args ...interface{}) (model.RedirectUrl, error) {
 	var redirectUrl model.RedirectUrl
-	err := repo.DB.Find(&redirectUrl, "short_url = ?", shorten)
-	if err != nil {
-		return "", err
+	err := repo.DB.GetDB().Where(query, args...).First(&redirectUrl).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return redirectUrl, shared.ErrNotFound
 	}
+	return redirectUrl, shared.BackendError(err)
+}
+
+// Return the redirect of the short url, shared.ErrNotFound when there is none
+func (repo *RedirectUrlRepo) GetRedirect(shorten string) (model.RedirectUrl, error) {
+	return repo.first("short_url = ?", shorten)
+}
+
+// Return the redirect of the code on the domain, empty for the default domain.
+// shared.ErrNotFound when there is none.
+func (repo *RedirectUrlRepo) GetRedirectByCode(domain string, code string) (model.RedirectUrl, error) {
+	return repo.first("domain = ? AND code = ?", domain, code)
+}
+
+// Count one click on a click-limited link.
+// Return false when the link already reached its maximum number of clicks.
+func (repo *RedirectUrlRepo) ConsumeClick(id uint) (bool, error) {
+	result := repo.DB.GetDB().Model(&model.RedirectUrl{}).
+		Where("id = ? AND clicks < max_clicks", id).
+		UpdateColumn("clicks", gorm.Expr("clicks + 1"))
+	if result.Error != nil {
+		return false, shared.BackendError(result.Error)
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// Delete the links that expired before the given time
+func (repo *RedirectUrlRepo) PurgeExpired(before time.Time) (int64, error) {
+	result := repo.DB.GetDB().Where("expires_at < ?", before).Delete(&model.RedirectUrl{})
+	return result.RowsAffected, result.Error
+}
 
-	return redirectUrl.Url, nil
+// Call fn with the links in batches of the given size, with only their id, short url,
+// domain and code loaded
+func (repo *RedirectUrlRepo) ForEachLinkKey(batchSize int, fn func(batch []model.RedirectUrl) error) error {
+	var batch []model.RedirectUrl
+	return repo.DB.GetDB().Select("id", "short_url", "domain", "code").
+		FindInBatches(&batch, batchSize, func(tx *gorm.DB, _ int) error {
+			return fn(batch)
+		}).Error
 }
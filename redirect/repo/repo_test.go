@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HungTP-Play/lru/shared"
+)
+
+// Repo on a schema of its own in the database of POSTGRES_TEST_DSN (keyword/value
+// form), dropped after the test. The test is skipped when it is not set.
+func newTestRepo(t *testing.T) *RedirectUrlRepo {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+
+	admin := shared.NewPostgresDB(dsn)
+	err := admin.Init()
+	if err != nil {
+		t.Fatalf("Cannot connect to test database: %v", err)
+	}
+	schema := fmt.Sprintf("test_redirect_%d", time.Now().UnixNano())
+	err = admin.DB.Exec("CREATE SCHEMA " + schema).Error
+	if err != nil {
+		t.Fatalf("Cannot create schema: %v", err)
+	}
+
+	repo := NewRedirectUrlRepo(dsn + " search_path=" + schema)
+	t.Cleanup(func() {
+		repo.Close()
+		admin.DB.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+	return repo
+}
+
+func TestMigrateMovesRedirectsWithoutDomainToDefaultDomain(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy string
+	}{
+		{"no domain column", "CREATE TABLE redirect_urls (id bigserial PRIMARY KEY, url text, short_url text, code text)"},
+		{"nullable domain column", "CREATE TABLE redirect_urls (id bigserial PRIMARY KEY, url text, short_url text, code text, domain text)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t)
+			db := repo.DB.GetDB()
+			err := db.Exec(test.legacy).Error
+			if err != nil {
+				t.Fatalf("Cannot create legacy table: %v", err)
+			}
+			err = db.Exec("INSERT INTO redirect_urls (url, short_url, code) VALUES ('https://example.com', 'http://localhost/abc', 'abc')").Error
+			if err != nil {
+				t.Fatalf("Cannot insert legacy row: %v", err)
+			}
+
+			err = repo.Migrate()
+			if err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+
+			redirectUrl, err := repo.GetRedirectByCode("", "abc")
+			if err != nil {
+				t.Fatalf("GetRedirectByCode() error = %v", err)
+			}
+			if redirectUrl.Url != "https://example.com" {
+				t.Fatalf("GetRedirectByCode() = %+v", redirectUrl)
+			}
+
+			err = repo.DeleteRedirect("", "abc")
+			if err != nil {
+				t.Fatalf("DeleteRedirect() error = %v", err)
+			}
+			_, err = repo.GetRedirectByCode("", "abc")
+			if err != shared.ErrNotFound {
+				t.Fatalf("GetRedirectByCode() after delete error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+)
+
+const apiKeyPrefix = "lru_"
+const apiKeyChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// Length of the random part of an API key, about 190 bits
+const apiKeyLength = 32
+
+// Number of characters of a key kept in clear to recognize it
+const ApiKeyDisplayLength = 12
+
+// Generate a new random API key, e.g. "lru_3kTq..."
+func GenerateApiKey() (string, error) {
+	key := make([]byte, apiKeyLength)
+	max := big.NewInt(int64(len(apiKeyChars)))
+	for i := range key {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		key[i] = apiKeyChars[n.Int64()]
+	}
+	return apiKeyPrefix + string(key), nil
+}
+
+// Hash stored in place of an API key. Keys are random enough for a plain sha256.
+func HashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,106 @@
+package shared
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// Bit array of a BloomFilter
+type BloomBits interface {
+	// Set the bits at the offsets
+	SetBits(offsets []uint64) error
+	// Return true when all the bits at the offsets are set
+	TestBits(offsets []uint64) (bool, error)
+}
+
+// Probabilistic set of strings: a key that was added is always reported, a key that
+// was not is reported with the false positive rate the filter was sized for. Keys
+// cannot be removed, a removed key only counts as a false positive.
+type BloomFilter struct {
+	Size   uint64 // Number of bits
+	Hashes int    // Bits set per key
+	bits   BloomBits
+}
+
+// Number of bits and hashes for the expected number of keys at the false positive rate
+func BloomFilterSize(expected int, falsePositiveRate float64) (uint64, int) {
+	if expected < 1 {
+		expected = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+	size := math.Ceil(-float64(expected) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Round(size / float64(expected) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return uint64(size), hashes
+}
+
+// Filter sized for the expected number of keys at the false positive rate, storing
+// its bits in bits (see NewMemoryBloomBits)
+func NewBloomFilter(expected int, falsePositiveRate float64, bits BloomBits) *BloomFilter {
+	size, hashes := BloomFilterSize(expected, falsePositiveRate)
+	return &BloomFilter{
+		Size:   size,
+		Hashes: hashes,
+		bits:   bits,
+	}
+}
+
+// Offsets of the bits of the key, by double hashing of its FNV-1a hash
+func (f *BloomFilter) offsets(key string) []uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+
+	offsets := make([]uint64, f.Hashes)
+	for i := range offsets {
+		offsets[i] = (h1 + uint64(i)*h2) % f.Size
+	}
+	return offsets
+}
+
+func (f *BloomFilter) Add(key string) error {
+	return f.bits.SetBits(f.offsets(key))
+}
+
+// Return false when the key was certainly never added
+func (f *BloomFilter) MayContain(key string) (bool, error) {
+	return f.bits.TestBits(f.offsets(key))
+}
+
+// Bits of a filter kept in memory, safe for concurrent use
+type MemoryBloomBits struct {
+	mutex sync.RWMutex
+	words []uint64
+}
+
+func NewMemoryBloomBits(size uint64) *MemoryBloomBits {
+	return &MemoryBloomBits{
+		words: make([]uint64, (size+63)/64),
+	}
+}
+
+func (b *MemoryBloomBits) SetBits(offsets []uint64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, offset := range offsets {
+		b.words[offset/64] |= 1 << (offset % 64)
+	}
+	return nil
+}
+
+func (b *MemoryBloomBits) TestBits(offsets []uint64) (bool, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, offset := range offsets {
+		if b.words[offset/64]&(1<<(offset%64)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
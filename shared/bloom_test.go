@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilterSize(t *testing.T) {
+	size, hashes := BloomFilterSize(1000000, 0.01)
+	if size < 9000000 || size > 10000000 || hashes != 7 {
+		t.Errorf("BloomFilterSize() = %d, %d, want about 9.6M bits and 7 hashes", size, hashes)
+	}
+}
+
+func TestBloomFilterContainsAddedKeys(t *testing.T) {
+	size, _ := BloomFilterSize(1000, 0.01)
+	filter := NewBloomFilter(1000, 0.01, NewMemoryBloomBits(size))
+
+	for i := 0; i < 1000; i++ {
+		filter.Add(fmt.Sprintf("code:%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if ok, _ := filter.MayContain(fmt.Sprintf("code:%d", i)); !ok {
+			t.Fatalf("MayContain(code:%d) = false for an added key", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 1000; i < 11000; i++ {
+		if ok, _ := filter.MayContain(fmt.Sprintf("code:%d", i)); ok {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("%d false positives out of 10000, want about 100", falsePositives)
+	}
+}
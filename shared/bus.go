@@ -0,0 +1,88 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Message bus the services exchange events through.
+//
+// A message is acked once the handler of the subscriber returns nil. When the handler
+// fails the message is delivered again following the retry policy of the queue, then
+// kept aside as a dead letter after its last attempt.
+type Bus interface {
+	// Publish the message as JSON to the queue, returns once the bus stored it
+	Publish(queue string, message interface{}, headers amqp.Table) error
+	// Publish an already encoded body
+	PublishRaw(queue string, body []byte, headers amqp.Table) error
+	// Handle the messages of the queue with several workers until ctx is cancelled, then
+	// wait for the messages in flight
+	Subscribe(ctx context.Context, queue string, handler ConsumeHandler, numberOfWorker int) error
+	SetRetryPolicy(queue string, policy RetryPolicy)
+
+	// Inspect, replay or drop the dead letters of the queue
+	DeadLetters(queue string, limit int) ([]DeadLetter, error)
+	ReplayDeadLetters(queue string, limit int) (int, error)
+	PurgeDeadLetters(queue string) (int, error)
+
+	Close() error
+}
+
+var ErrBusClosed = errors.New("bus is closed")
+
+// Tell a failure of the message itself, which publishing it again cannot fix, from a
+// failure of the bus such as an outage: the message cannot be encoded, is too large or
+// was returned by the broker
+func IsMessageError(err error) bool {
+	var marshalerError *json.MarshalerError
+	var syntaxError *json.SyntaxError
+	var unsupportedType *json.UnsupportedTypeError
+	var unsupportedValue *json.UnsupportedValueError
+	return errors.Is(err, ErrMessageUnroutable) ||
+		errors.Is(err, nats.ErrMaxPayload) ||
+		errors.As(err, &marshalerError) ||
+		errors.As(err, &syntaxError) ||
+		errors.As(err, &unsupportedType) ||
+		errors.As(err, &unsupportedValue)
+}
+
+var (
+	_ Bus = (*RabbitMQ)(nil)
+	_ Bus = (*MemoryBus)(nil)
+	_ Bus = (*NatsBus)(nil)
+)
+
+// Build the bus named by BUS_DRIVER and connect it after the delay:
+//
+// - rabbitmq (default): RabbitMQ at RABBITMQ_HOST:RABBITMQ_PORT
+// - nats: NATS JetStream at NATS_HOST:NATS_PORT
+// - memory: in-process queues, for tests and running every service in one binary
+//
+// When the first connection fails its error is returned along with the bus, which
+// keeps connecting in the background.
+func ConnectBus(delay time.Duration) (Bus, error) {
+	switch driver := os.Getenv("BUS_DRIVER"); driver {
+	case "", "rabbitmq":
+		rabbitmq := NewRabbitMQ("")
+		return rabbitmq, rabbitmq.Connect(delay)
+	case "nats":
+		natsBus := NewNatsBus("")
+		return natsBus, natsBus.Connect(delay)
+	case "memory":
+		return NewMemoryBus(), nil
+	default:
+		return nil, fmt.Errorf("unknown BUS_DRIVER %q", driver)
+	}
+}
+
+// Same as Consume, for the Bus interface
+func (r *RabbitMQ) Subscribe(ctx context.Context, queue string, handler ConsumeHandler, numberOfWorker int) error {
+	return r.Consume(ctx, queue, handler, numberOfWorker)
+}
@@ -0,0 +1,82 @@
+package shared
+
+import (
+	"crypto/subtle"
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Let through the requests whose X-Admin-Token header matches ADMIN_TOKEN, admin
+// access is off when it is not set
+func AdminTokenMiddleware(c *fiber.Ctx) error {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	token := c.Get("X-Admin-Token")
+	if adminToken == "" || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		return c.Status(401).JSON(map[string]interface{}{
+			"error": "Unauthorized",
+		})
+	}
+	return c.Next()
+}
+
+// Register the admin endpoints of the dead-letter queue of the queue consumed by the service
+//
+// - GET /admin/dead-letters?limit=N: inspect the oldest messages, leaving them in place
+// - POST /admin/dead-letters/replay?limit=N: send the oldest messages back to the queue
+// - DELETE /admin/dead-letters: drop every message
+func RegisterDeadLetterRoutes(service *HttpService, bus Bus, queue string) {
+	service.Use(AdminTokenMiddleware, "/admin")
+
+	service.Routes("/admin/dead-letters", func(c *fiber.Ctx) error {
+		deadLetters, err := bus.DeadLetters(queue, deadLetterLimit(c))
+		if err != nil {
+			return deadLetterErrorResponse(c, err)
+		}
+		return c.Status(200).JSON(map[string]interface{}{
+			"queue":       DeadLetterQueueName(queue),
+			"deadLetters": deadLetters,
+		})
+	}, "GET")
+
+	service.Routes("/admin/dead-letters/replay", func(c *fiber.Ctx) error {
+		replayed, err := bus.ReplayDeadLetters(queue, deadLetterLimit(c))
+		if err != nil {
+			return c.Status(503).JSON(map[string]interface{}{
+				"error":    "Cannot replay dead letters: " + err.Error(),
+				"replayed": replayed,
+			})
+		}
+		return c.Status(200).JSON(map[string]interface{}{
+			"replayed": replayed,
+		})
+	}, "POST")
+
+	service.Routes("/admin/dead-letters", func(c *fiber.Ctx) error {
+		purged, err := bus.PurgeDeadLetters(queue)
+		if err != nil {
+			return deadLetterErrorResponse(c, err)
+		}
+		return c.Status(200).JSON(map[string]interface{}{
+			"purged": purged,
+		})
+	}, "DELETE")
+}
+
+// Limit query param, between 1 and 1000 (default 100)
+func deadLetterLimit(c *fiber.Ctx) int {
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 {
+		return 1
+	}
+	if limit > 1000 {
+		return 1000
+	}
+	return limit
+}
+
+func deadLetterErrorResponse(c *fiber.Ctx, err error) error {
+	return c.Status(503).JSON(map[string]interface{}{
+		"error": "Cannot reach the dead-letter queue: " + err.Error(),
+	})
+}
@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errDuplicateEvent = errors.New("event already processed")
+
+// Event handled by a consumer, the primary key lets each consumer process an event once
+type ProcessedEvent struct {
+	Consumer    string    `gorm:"primaryKey" json:"consumer"`
+	EventId     string    `gorm:"primaryKey" json:"eventId"`
+	ProcessedAt time.Time `gorm:"index" json:"processedAt"`
+}
+
+// Make the handling of an event idempotent, so a redelivered event is not applied twice.
+//
+// The id of the event is recorded in the same transaction as the changes of the
+// handler: either both are committed or none is, and the redelivery of a committed
+// event finds its id and is dropped. Two workers handling the same event at the same
+// time are serialized by the primary key, the second one sees it as a duplicate once
+// the first commits.
+type EventDeduplicator struct {
+	Consumer string
+	DB       *gorm.DB
+	// How long the ids are kept, an event redelivered after that is handled again
+	Retention time.Duration
+	// Time between two purges of the expired ids
+	PurgeInterval time.Duration
+}
+
+// Deduplicator of the events of the consumer, stored in the database. Its retention is
+// read from DEDUP_RETENTION (default 168h) and DEDUP_PURGE_INTERVAL (default 1h).
+func NewEventDeduplicator(db *PostgresDB, consumer string) *EventDeduplicator {
+	return &EventDeduplicator{
+		Consumer:      consumer,
+		DB:            db.GetDB(),
+		Retention:     GetEnvDuration("DEDUP_RETENTION", 7*24*time.Hour),
+		PurgeInterval: GetEnvDuration("DEDUP_PURGE_INTERVAL", time.Hour),
+	}
+}
+
+func (d *EventDeduplicator) Migrate() error {
+	return d.DB.AutoMigrate(&ProcessedEvent{})
+}
+
+// Run handle in a transaction recording the event as processed. Return false without
+// calling handle when the event was already processed. Nothing is recorded when handle
+// fails, so the event is handled again on its next delivery.
+func (d *EventDeduplicator) Process(eventId string, handle func(tx *gorm.DB) error) (bool, error) {
+	err := d.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ProcessedEvent{
+			Consumer:    d.Consumer,
+			EventId:     eventId,
+			ProcessedAt: time.Now().UTC(),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errDuplicateEvent
+		}
+		return handle(tx)
+	})
+	if errors.Is(err, errDuplicateEvent) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete the ids processed before the given time
+func (d *EventDeduplicator) Purge(before time.Time) (int64, error) {
+	result := d.DB.Where("consumer = ? AND processed_at < ?", d.Consumer, before).Delete(&ProcessedEvent{})
+	return result.RowsAffected, result.Error
+}
+
+// Purge the ids older than the retention every interval until ctx is cancelled,
+// reporting the failures to onError
+func (d *EventDeduplicator) PurgeLoop(ctx context.Context, onError func(err error)) {
+	ticker := time.NewTicker(d.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := d.Purge(time.Now().Add(-d.Retention))
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Deduplicator on a schema of its own in the database of POSTGRES_TEST_DSN (keyword/value
+// form), dropped after the test. The test is skipped when it is not set.
+func newTestDeduplicator(t *testing.T, consumer string) *EventDeduplicator {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+
+	admin := NewPostgresDB(dsn)
+	err := admin.Init()
+	if err != nil {
+		t.Fatalf("Cannot connect to test database: %v", err)
+	}
+	schema := fmt.Sprintf("test_shared_%d", time.Now().UnixNano())
+	err = admin.DB.Exec("CREATE SCHEMA " + schema).Error
+	if err != nil {
+		t.Fatalf("Cannot create schema: %v", err)
+	}
+
+	db := NewPostgresDB(dsn + " search_path=" + schema)
+	err = db.Init()
+	if err != nil {
+		t.Fatalf("Cannot connect to test schema: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		admin.DB.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	deduplicator := NewEventDeduplicator(db, consumer)
+	err = deduplicator.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	return deduplicator
+}
+
+func countProcessedEvents(t *testing.T, deduplicator *EventDeduplicator) int64 {
+	var count int64
+	err := deduplicator.DB.Model(&ProcessedEvent{}).Count(&count).Error
+	if err != nil {
+		t.Fatalf("Cannot count processed events: %v", err)
+	}
+	return count
+}
+
+func TestEventDeduplicatorProcessesEventsOnce(t *testing.T) {
+	deduplicator := newTestDeduplicator(t, "analytic")
+
+	calls := 0
+	handle := func(tx *gorm.DB) error {
+		calls++
+		return nil
+	}
+	processed, err := deduplicator.Process("event-1", handle)
+	if !processed || err != nil {
+		t.Fatalf("Process() = %v, %v; want true", processed, err)
+	}
+
+	processed, err = deduplicator.Process("event-1", handle)
+	if processed || err != nil || calls != 1 {
+		t.Fatalf("Process() of a duplicate = %v, %v after %d calls; want false without calling handle", processed, err, calls)
+	}
+
+	// Each consumer processes the event once
+	other := &EventDeduplicator{Consumer: "redirect", DB: deduplicator.DB}
+	processed, err = other.Process("event-1", handle)
+	if !processed || err != nil || calls != 2 {
+		t.Fatalf("Process() by another consumer = %v, %v after %d calls; want true", processed, err, calls)
+	}
+}
+
+func TestEventDeduplicatorForgetsFailedEvents(t *testing.T) {
+	deduplicator := newTestDeduplicator(t, "analytic")
+
+	handleErr := errors.New("handler failed")
+	processed, err := deduplicator.Process("event-1", func(tx *gorm.DB) error {
+		return handleErr
+	})
+	if processed || !errors.Is(err, handleErr) {
+		t.Fatalf("Process() = %v, %v; want %v", processed, err, handleErr)
+	}
+	if count := countProcessedEvents(t, deduplicator); count != 0 {
+		t.Fatalf("%d events recorded after a failure, want 0", count)
+	}
+
+	// The redelivery is handled again
+	calls := 0
+	processed, err = deduplicator.Process("event-1", func(tx *gorm.DB) error {
+		calls++
+		return nil
+	})
+	if !processed || err != nil || calls != 1 {
+		t.Fatalf("Process() of the redelivery = %v, %v after %d calls; want true", processed, err, calls)
+	}
+}
+
+func TestEventDeduplicatorPurge(t *testing.T) {
+	deduplicator := newTestDeduplicator(t, "analytic")
+
+	old := ProcessedEvent{Consumer: "analytic", EventId: "old", ProcessedAt: time.Now().Add(-2 * time.Hour).UTC()}
+	otherConsumer := ProcessedEvent{Consumer: "redirect", EventId: "old", ProcessedAt: old.ProcessedAt}
+	err := deduplicator.DB.Create([]ProcessedEvent{old, otherConsumer}).Error
+	if err != nil {
+		t.Fatalf("Cannot insert processed events: %v", err)
+	}
+	_, err = deduplicator.Process("recent", func(tx *gorm.DB) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Process() error = %v", err)
+	}
+
+	purged, err := deduplicator.Purge(time.Now().Add(-time.Hour))
+	if purged != 1 || err != nil {
+		t.Fatalf("Purge() = %d, %v; want 1", purged, err)
+	}
+	if count := countProcessedEvents(t, deduplicator); count != 2 {
+		t.Fatalf("%d events left after the purge, want 2", count)
+	}
+
+	// A purged event is handled again
+	processed, err := deduplicator.Process("old", func(tx *gorm.DB) error {
+		return nil
+	})
+	if !processed || err != nil {
+		t.Fatalf("Process() of a purged event = %v, %v; want true", processed, err)
+	}
+}
@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Return the duration stored in the environment variable (e.g. "15m"), or the fallback
+// when it is missing or malformed
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Return the integer stored in the environment variable, or the fallback
+// when it is missing or malformed
+func GetEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Return the number stored in the environment variable, or the fallback
+// when it is missing or malformed
+func GetEnvFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
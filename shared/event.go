@@ -0,0 +1,269 @@
+package shared
+
+//go:generate go run github.com/atombender/go-jsonschema@v0.17.0 -p shared -t --tags json -o events_gen.go schemas/event.json schemas/link.created.v1.json schemas/link.updated.v1.json schemas/link.deleted.v1.json schemas/link.clicked.v1.json
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Types of the events, their payloads are defined in schemas/ and generated into
+// events_gen.go
+const (
+	EventLinkCreated = "link.created" // LinkCreatedV1
+	EventLinkUpdated = "link.updated" // LinkUpdatedV1
+	EventLinkDeleted = "link.deleted" // LinkDeletedV1
+	EventLinkClicked = "link.clicked" // LinkClickedV1
+)
+
+var (
+	ErrUnknownEventType        = errors.New("unknown event type")
+	ErrUnsupportedEventVersion = errors.New("unsupported event schema version")
+)
+
+// Turn the data of an event into the data of the next schema version
+type Upcaster func(data json.RawMessage) (json.RawMessage, error)
+
+// Versions of the event schemas a service knows.
+//
+// Producers publish the latest version of each type. Consumers upcast older versions
+// step by step and reject newer ones, which are retried until the consumer is deployed
+// with their schema.
+type EventSchemas struct {
+	latest    map[string]int
+	upcasters map[string]map[int]Upcaster
+}
+
+func NewEventSchemas() *EventSchemas {
+	return &EventSchemas{
+		latest:    map[string]int{},
+		upcasters: map[string]map[int]Upcaster{},
+	}
+}
+
+// Declare the latest version of the event type
+func (s *EventSchemas) Register(eventType string, version int) {
+	s.latest[eventType] = version
+}
+
+// Declare how to upcast the event type from a version to the next one
+func (s *EventSchemas) RegisterUpcaster(eventType string, fromVersion int, upcaster Upcaster) {
+	if s.upcasters[eventType] == nil {
+		s.upcasters[eventType] = map[int]Upcaster{}
+	}
+	s.upcasters[eventType][fromVersion] = upcaster
+}
+
+func (s *EventSchemas) Latest(eventType string) (int, bool) {
+	version, ok := s.latest[eventType]
+	return version, ok
+}
+
+// Schemas of this version of the services
+var Events = defaultEventSchemas()
+
+func defaultEventSchemas() *EventSchemas {
+	schemas := NewEventSchemas()
+	schemas.Register(EventLinkCreated, 1)
+	schemas.Register(EventLinkUpdated, 1)
+	schemas.Register(EventLinkDeleted, 1)
+	schemas.Register(EventLinkClicked, 1)
+	return schemas
+}
+
+// Wrap the payload in an event of the latest version of its type, carrying the trace of ctx
+func (s *EventSchemas) NewEvent(ctx context.Context, eventType string, producer string, data interface{}) (Event, error) {
+	version, ok := s.Latest(eventType)
+	if !ok {
+		return Event{}, fmt.Errorf("%w: %s", ErrUnknownEventType, eventType)
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	return Event{
+		Id:            uuid.NewString(),
+		Type:          eventType,
+		SchemaVersion: version,
+		OccurredAt:    time.Now().UTC(),
+		Producer:      producer,
+		TraceParent:   carrier.Get("traceparent"),
+		TraceState:    carrier.Get("tracestate"),
+		Data:          encoded,
+	}, nil
+}
+
+// Read an event and upcast it to the latest version of its type. Messages published
+// before the envelope existed are read as events too.
+func (s *EventSchemas) Decode(body []byte) (Event, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
+	if err != nil {
+		return Event{}, err
+	}
+
+	var event Event
+	if _, ok := fields["schemaVersion"]; ok {
+		err = json.Unmarshal(body, &event)
+	} else {
+		event, err = upcastLegacyMessage(fields, body)
+	}
+	if err != nil {
+		return Event{}, err
+	}
+
+	latest, ok := s.Latest(event.Type)
+	if !ok {
+		return event, fmt.Errorf("%w: %s", ErrUnknownEventType, event.Type)
+	}
+	if event.SchemaVersion > latest {
+		return event, fmt.Errorf("%w: %s version %d, latest known is %d", ErrUnsupportedEventVersion, event.Type, event.SchemaVersion, latest)
+	}
+
+	for event.SchemaVersion < latest {
+		upcaster, ok := s.upcasters[event.Type][event.SchemaVersion]
+		if !ok {
+			return event, fmt.Errorf("%w: cannot upcast %s from version %d", ErrUnsupportedEventVersion, event.Type, event.SchemaVersion)
+		}
+		event.Data, err = upcaster(event.Data)
+		if err != nil {
+			return event, err
+		}
+		event.SchemaVersion++
+	}
+	return event, nil
+}
+
+// Same as Events.NewEvent
+func NewEvent(ctx context.Context, eventType string, producer string, data interface{}) (Event, error) {
+	return Events.NewEvent(ctx, eventType, producer, data)
+}
+
+// Same as Events.Decode
+func DecodeEvent(body []byte) (Event, error) {
+	return Events.Decode(body)
+}
+
+// Read the payload, checked against its schema
+func (e Event) DecodeData(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// Return ctx, or a context carrying the trace of the producer when ctx has none
+func (e Event) Context(ctx context.Context) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() || e.TraceParent == "" {
+		return ctx
+	}
+
+	carrier := propagation.MapCarrier{"traceparent": e.TraceParent}
+	if e.TraceState != "" {
+		carrier["tracestate"] = e.TraceState
+	}
+	return propagation.TraceContext{}.Extract(ctx, carrier)
+}
+
+// Types of the AnalyticMessage published before the event envelope
+var legacyAnalyticTypes = map[string]string{
+	"map":      EventLinkCreated,
+	"redirect": EventLinkClicked,
+	"update":   EventLinkUpdated,
+	"delete":   EventLinkDeleted,
+}
+
+var legacyRedirectActions = map[string]string{
+	"":                   EventLinkCreated,
+	RedirectActionCreate: EventLinkCreated,
+	RedirectActionUpdate: EventLinkUpdated,
+	RedirectActionDelete: EventLinkDeleted,
+}
+
+// Last path segment of a short url, the code of the link
+func codeFromShortUrl(shortUrl string) string {
+	return shortUrl[strings.LastIndex(shortUrl, "/")+1:]
+}
+
+// Read a RedirectMessage or AnalyticMessage still in a queue from before the envelope
+// as an event of version 1. Its id is derived from the message so redeliveries keep it.
+func upcastLegacyMessage(fields map[string]json.RawMessage, body []byte) (Event, error) {
+	var legacyType string
+	json.Unmarshal(fields["type"], &legacyType)
+
+	if eventType, ok := legacyAnalyticTypes[legacyType]; ok {
+		var message AnalyticMessage
+		err := json.Unmarshal(body, &message)
+		if err != nil {
+			return Event{}, err
+		}
+
+		code := codeFromShortUrl(message.Shorten)
+		var data interface{}
+		switch eventType {
+		case EventLinkCreated:
+			data = LinkCreatedV1{Code: code, Url: message.Url, ShortUrl: message.Shorten, OwnerId: message.OwnerId}
+		case EventLinkUpdated:
+			data = LinkUpdatedV1{Code: code, Url: message.Url, ShortUrl: message.Shorten, OwnerId: message.OwnerId}
+		case EventLinkDeleted:
+			data = LinkDeletedV1{Code: code, Url: message.Url, ShortUrl: message.Shorten, OwnerId: message.OwnerId}
+		default:
+			data = LinkClickedV1{Url: message.Url, ShortUrl: message.Shorten}
+		}
+		return legacyEvent(message.Id, eventType, code, time.Unix(message.Timestamp, 0), data)
+	}
+
+	var message RedirectMessage
+	err := json.Unmarshal(body, &message)
+	if err != nil {
+		return Event{}, err
+	}
+	eventType, ok := legacyRedirectActions[message.Action]
+	if !ok {
+		return Event{}, fmt.Errorf("%w: legacy action %q", ErrUnknownEventType, message.Action)
+	}
+
+	var data interface{}
+	switch eventType {
+	case EventLinkDeleted:
+		data = LinkDeletedV1{Code: message.Code, Domain: message.Domain, Url: message.Url, ShortUrl: message.Shorten}
+	default:
+		data = LinkCreatedV1{
+			Code:         message.Code,
+			Domain:       message.Domain,
+			Url:          message.Url,
+			ShortUrl:     message.Shorten,
+			RedirectType: message.RedirectType,
+			ExpiresAt:    message.ExpiresAt,
+			MaxClicks:    message.MaxClicks,
+			Disabled:     message.Disabled,
+		}
+	}
+	return legacyEvent(message.Id, eventType, message.Code, time.Now().UTC(), data)
+}
+
+func legacyEvent(id string, eventType string, code string, occurredAt time.Time, data interface{}) (Event, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{
+		Id:            id + ":" + eventType + ":" + code,
+		Type:          eventType,
+		SchemaVersion: 1,
+		OccurredAt:    occurredAt.UTC(),
+		Producer:      "legacy",
+		Data:          encoded,
+	}, nil
+}
@@ -0,0 +1,138 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewEventDecodeRoundTrip(t *testing.T) {
+	traceId, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanId, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceId,
+		SpanID:     spanId,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	event, err := NewEvent(ctx, EventLinkCreated, "mapper", LinkCreatedV1{Code: "abc", Url: "https://example.com", ShortUrl: "http://lru/abc", MaxClicks: 3})
+	if err != nil {
+		t.Fatalf("NewEvent() error = %v", err)
+	}
+	if event.Id == "" || event.SchemaVersion != 1 || event.TraceParent == "" {
+		t.Fatalf("NewEvent() = %+v", event)
+	}
+
+	body, _ := json.Marshal(event)
+	decoded, err := DecodeEvent(body)
+	if err != nil {
+		t.Fatalf("DecodeEvent() error = %v", err)
+	}
+	var link LinkCreatedV1
+	if err := decoded.DecodeData(&link); err != nil {
+		t.Fatalf("DecodeData() error = %v", err)
+	}
+	if decoded.Id != event.Id || link.Code != "abc" || link.MaxClicks != 3 {
+		t.Errorf("DecodeEvent() = %+v, data %+v", decoded, link)
+	}
+
+	consumerCtx := decoded.Context(context.Background())
+	if trace.SpanContextFromContext(consumerCtx).TraceID() != traceId {
+		t.Errorf("Context() lost the trace of the producer")
+	}
+}
+
+func TestDecodeEventRejectsInvalidData(t *testing.T) {
+	event, _ := NewEvent(context.Background(), EventLinkCreated, "mapper", map[string]string{"code": "abc"})
+	body, _ := json.Marshal(event)
+	decoded, err := DecodeEvent(body)
+	if err != nil {
+		t.Fatalf("DecodeEvent() error = %v", err)
+	}
+
+	var link LinkCreatedV1
+	if err := decoded.DecodeData(&link); err == nil {
+		t.Errorf("DecodeData() should reject a payload without url")
+	}
+}
+
+func TestDecodeEventUnknownTypeAndVersion(t *testing.T) {
+	body := []byte(`{"id":"1","type":"link.archived","schemaVersion":1,"occurredAt":"2023-07-01T00:00:00Z","producer":"mapper","data":{}}`)
+	if _, err := DecodeEvent(body); !errors.Is(err, ErrUnknownEventType) {
+		t.Errorf("DecodeEvent() error = %v, want ErrUnknownEventType", err)
+	}
+
+	body = []byte(`{"id":"1","type":"link.created","schemaVersion":2,"occurredAt":"2023-07-01T00:00:00Z","producer":"mapper","data":{}}`)
+	if _, err := DecodeEvent(body); !errors.Is(err, ErrUnsupportedEventVersion) {
+		t.Errorf("DecodeEvent() error = %v, want ErrUnsupportedEventVersion", err)
+	}
+}
+
+func TestDecodeEventUpcasts(t *testing.T) {
+	schemas := NewEventSchemas()
+	schemas.Register(EventLinkClicked, 3)
+	schemas.RegisterUpcaster(EventLinkClicked, 1, func(data json.RawMessage) (json.RawMessage, error) {
+		var fields map[string]interface{}
+		json.Unmarshal(data, &fields)
+		fields["shortUrl"] = fields["short"]
+		delete(fields, "short")
+		return json.Marshal(fields)
+	})
+	schemas.RegisterUpcaster(EventLinkClicked, 2, func(data json.RawMessage) (json.RawMessage, error) {
+		var fields map[string]interface{}
+		json.Unmarshal(data, &fields)
+		fields["code"] = "abc"
+		return json.Marshal(fields)
+	})
+
+	body := []byte(`{"id":"1","type":"link.clicked","schemaVersion":1,"occurredAt":"2023-07-01T00:00:00Z","producer":"redirect","data":{"short":"http://lru/abc"}}`)
+	event, err := schemas.Decode(body)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	var click LinkClickedV1
+	if err := event.DecodeData(&click); err != nil {
+		t.Fatalf("DecodeData() error = %v", err)
+	}
+	if event.SchemaVersion != 3 || click.ShortUrl != "http://lru/abc" || click.Code != "abc" {
+		t.Errorf("Decode() = %+v, data %+v", event, click)
+	}
+
+	schemas.Register(EventLinkCreated, 2)
+	body = []byte(`{"id":"1","type":"link.created","schemaVersion":1,"occurredAt":"2023-07-01T00:00:00Z","producer":"mapper","data":{}}`)
+	if _, err := schemas.Decode(body); !errors.Is(err, ErrUnsupportedEventVersion) {
+		t.Errorf("Decode() error = %v, want ErrUnsupportedEventVersion without upcaster", err)
+	}
+}
+
+func TestDecodeLegacyMessages(t *testing.T) {
+	analytic, _ := json.Marshal(AnalyticMessage{Id: "req-1", Url: "https://example.com", Shorten: "http://lru/abc", Type: "delete", Timestamp: 1688169600})
+	event, err := DecodeEvent(analytic)
+	if err != nil {
+		t.Fatalf("DecodeEvent() error = %v", err)
+	}
+	var deleted LinkDeletedV1
+	if err := event.DecodeData(&deleted); err != nil {
+		t.Fatalf("DecodeData() error = %v", err)
+	}
+	if event.Type != EventLinkDeleted || event.Id != "req-1:link.deleted:abc" || !event.OccurredAt.Equal(time.Unix(1688169600, 0)) || deleted.Code != "abc" {
+		t.Errorf("DecodeEvent() = %+v, data %+v", event, deleted)
+	}
+
+	redirect, _ := json.Marshal(RedirectMessage{Id: "req-2", Url: "https://example.com", Shorten: "http://lru/xyz", Code: "xyz", Action: RedirectActionUpdate, MaxClicks: 5})
+	event, err = DecodeEvent(redirect)
+	if err != nil {
+		t.Fatalf("DecodeEvent() error = %v", err)
+	}
+	var updated LinkUpdatedV1
+	if err := event.DecodeData(&updated); err != nil {
+		t.Fatalf("DecodeData() error = %v", err)
+	}
+	if event.Type != EventLinkUpdated || updated.Code != "xyz" || updated.MaxClicks != 5 {
+		t.Errorf("DecodeEvent() = %+v, data %+v", event, updated)
+	}
+}
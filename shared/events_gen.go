@@ -0,0 +1,343 @@
+// Code generated by github.com/atombender/go-jsonschema, DO NOT EDIT.
+
+package shared
+
+import "encoding/json"
+import "fmt"
+import "time"
+
+// Envelope of every message exchanged between the services
+type Event struct {
+	// Payload, its schema depends on type and schemaVersion
+	Data json.RawMessage `json:"data"`
+
+	// Unique id of the event, the same on every delivery
+	Id string `json:"id"`
+
+	// When it happened
+	OccurredAt time.Time `json:"occurredAt"`
+
+	// Service that published the event
+	Producer string `json:"producer"`
+
+	// Version of the schema of data
+	SchemaVersion int `json:"schemaVersion"`
+
+	// W3C trace context of the producer
+	TraceParent string `json:"traceParent,omitempty"`
+
+	// TraceState corresponds to the JSON schema field "traceState".
+	TraceState string `json:"traceState,omitempty"`
+
+	// What happened, e.g. link.created
+	Type string `json:"type"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *Event) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if _, ok := raw["data"]; raw != nil && !ok {
+		return fmt.Errorf("field data in Event: required")
+	}
+	if _, ok := raw["id"]; raw != nil && !ok {
+		return fmt.Errorf("field id in Event: required")
+	}
+	if _, ok := raw["occurredAt"]; raw != nil && !ok {
+		return fmt.Errorf("field occurredAt in Event: required")
+	}
+	if _, ok := raw["producer"]; raw != nil && !ok {
+		return fmt.Errorf("field producer in Event: required")
+	}
+	if _, ok := raw["schemaVersion"]; raw != nil && !ok {
+		return fmt.Errorf("field schemaVersion in Event: required")
+	}
+	if _, ok := raw["type"]; raw != nil && !ok {
+		return fmt.Errorf("field type in Event: required")
+	}
+	type Plain Event
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	if len(plain.Id) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "id", 1)
+	}
+	if len(plain.Producer) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "producer", 1)
+	}
+	if 1 > plain.SchemaVersion {
+		return fmt.Errorf("field %s: must be >= %v", "schemaVersion", 1)
+	}
+	if v, ok := raw["traceParent"]; !ok || v == nil {
+		plain.TraceParent = ""
+	}
+	if v, ok := raw["traceState"]; !ok || v == nil {
+		plain.TraceState = ""
+	}
+	*j = Event(plain)
+	return nil
+}
+
+// Payload of link.clicked version 1: a short link was followed
+type LinkClickedV1 struct {
+	// Empty when the link was followed by its short url
+	Code string `json:"code,omitempty"`
+
+	// Empty for the default domain
+	Domain string `json:"domain,omitempty"`
+
+	// ShortUrl corresponds to the JSON schema field "shortUrl".
+	ShortUrl string `json:"shortUrl"`
+
+	// Url corresponds to the JSON schema field "url".
+	Url string `json:"url,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *LinkClickedV1) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if _, ok := raw["shortUrl"]; raw != nil && !ok {
+		return fmt.Errorf("field shortUrl in LinkClickedV1: required")
+	}
+	type Plain LinkClickedV1
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	if v, ok := raw["code"]; !ok || v == nil {
+		plain.Code = ""
+	}
+	if v, ok := raw["domain"]; !ok || v == nil {
+		plain.Domain = ""
+	}
+	if len(plain.ShortUrl) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "shortUrl", 1)
+	}
+	if v, ok := raw["url"]; !ok || v == nil {
+		plain.Url = ""
+	}
+	*j = LinkClickedV1(plain)
+	return nil
+}
+
+// Payload of link.created version 1: a short link was created
+type LinkCreatedV1 struct {
+	// Code corresponds to the JSON schema field "code".
+	Code string `json:"code"`
+
+	// Disabled corresponds to the JSON schema field "disabled".
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Empty for the default domain
+	Domain string `json:"domain,omitempty"`
+
+	// Unix timestamp, 0 means never
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+
+	// 0 means unlimited
+	MaxClicks int64 `json:"maxClicks,omitempty"`
+
+	// Empty for anonymous links
+	OwnerId string `json:"ownerId,omitempty"`
+
+	// HTTP status of the redirect
+	RedirectType int `json:"redirectType,omitempty"`
+
+	// ShortUrl corresponds to the JSON schema field "shortUrl".
+	ShortUrl string `json:"shortUrl"`
+
+	// Long url the link leads to
+	Url string `json:"url"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *LinkCreatedV1) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if _, ok := raw["code"]; raw != nil && !ok {
+		return fmt.Errorf("field code in LinkCreatedV1: required")
+	}
+	if _, ok := raw["shortUrl"]; raw != nil && !ok {
+		return fmt.Errorf("field shortUrl in LinkCreatedV1: required")
+	}
+	if _, ok := raw["url"]; raw != nil && !ok {
+		return fmt.Errorf("field url in LinkCreatedV1: required")
+	}
+	type Plain LinkCreatedV1
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	if len(plain.Code) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "code", 1)
+	}
+	if v, ok := raw["disabled"]; !ok || v == nil {
+		plain.Disabled = false
+	}
+	if v, ok := raw["domain"]; !ok || v == nil {
+		plain.Domain = ""
+	}
+	if v, ok := raw["expiresAt"]; !ok || v == nil {
+		plain.ExpiresAt = 0.0
+	}
+	if v, ok := raw["maxClicks"]; !ok || v == nil {
+		plain.MaxClicks = 0.0
+	}
+	if v, ok := raw["ownerId"]; !ok || v == nil {
+		plain.OwnerId = ""
+	}
+	if v, ok := raw["redirectType"]; !ok || v == nil {
+		plain.RedirectType = 0.0
+	}
+	if len(plain.ShortUrl) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "shortUrl", 1)
+	}
+	if len(plain.Url) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "url", 1)
+	}
+	*j = LinkCreatedV1(plain)
+	return nil
+}
+
+// Payload of link.deleted version 1: a short link was deleted
+type LinkDeletedV1 struct {
+	// Code corresponds to the JSON schema field "code".
+	Code string `json:"code"`
+
+	// Empty for the default domain
+	Domain string `json:"domain,omitempty"`
+
+	// OwnerId corresponds to the JSON schema field "ownerId".
+	OwnerId string `json:"ownerId,omitempty"`
+
+	// ShortUrl corresponds to the JSON schema field "shortUrl".
+	ShortUrl string `json:"shortUrl"`
+
+	// Url corresponds to the JSON schema field "url".
+	Url string `json:"url,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *LinkDeletedV1) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if _, ok := raw["code"]; raw != nil && !ok {
+		return fmt.Errorf("field code in LinkDeletedV1: required")
+	}
+	if _, ok := raw["shortUrl"]; raw != nil && !ok {
+		return fmt.Errorf("field shortUrl in LinkDeletedV1: required")
+	}
+	type Plain LinkDeletedV1
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	if len(plain.Code) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "code", 1)
+	}
+	if v, ok := raw["domain"]; !ok || v == nil {
+		plain.Domain = ""
+	}
+	if v, ok := raw["ownerId"]; !ok || v == nil {
+		plain.OwnerId = ""
+	}
+	if len(plain.ShortUrl) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "shortUrl", 1)
+	}
+	if v, ok := raw["url"]; !ok || v == nil {
+		plain.Url = ""
+	}
+	*j = LinkDeletedV1(plain)
+	return nil
+}
+
+// Payload of link.updated version 1: the new state of a short link
+type LinkUpdatedV1 struct {
+	// Code corresponds to the JSON schema field "code".
+	Code string `json:"code"`
+
+	// Disabled corresponds to the JSON schema field "disabled".
+	Disabled bool `json:"disabled,omitempty"`
+
+	// Empty for the default domain
+	Domain string `json:"domain,omitempty"`
+
+	// Unix timestamp, 0 means never
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+
+	// 0 means unlimited
+	MaxClicks int64 `json:"maxClicks,omitempty"`
+
+	// Empty for anonymous links
+	OwnerId string `json:"ownerId,omitempty"`
+
+	// HTTP status of the redirect
+	RedirectType int `json:"redirectType,omitempty"`
+
+	// ShortUrl corresponds to the JSON schema field "shortUrl".
+	ShortUrl string `json:"shortUrl"`
+
+	// Long url the link leads to
+	Url string `json:"url"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (j *LinkUpdatedV1) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if _, ok := raw["code"]; raw != nil && !ok {
+		return fmt.Errorf("field code in LinkUpdatedV1: required")
+	}
+	if _, ok := raw["shortUrl"]; raw != nil && !ok {
+		return fmt.Errorf("field shortUrl in LinkUpdatedV1: required")
+	}
+	if _, ok := raw["url"]; raw != nil && !ok {
+		return fmt.Errorf("field url in LinkUpdatedV1: required")
+	}
+	type Plain LinkUpdatedV1
+	var plain Plain
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return err
+	}
+	if len(plain.Code) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "code", 1)
+	}
+	if v, ok := raw["disabled"]; !ok || v == nil {
+		plain.Disabled = false
+	}
+	if v, ok := raw["domain"]; !ok || v == nil {
+		plain.Domain = ""
+	}
+	if v, ok := raw["expiresAt"]; !ok || v == nil {
+		plain.ExpiresAt = 0.0
+	}
+	if v, ok := raw["maxClicks"]; !ok || v == nil {
+		plain.MaxClicks = 0.0
+	}
+	if v, ok := raw["ownerId"]; !ok || v == nil {
+		plain.OwnerId = ""
+	}
+	if v, ok := raw["redirectType"]; !ok || v == nil {
+		plain.RedirectType = 0.0
+	}
+	if len(plain.ShortUrl) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "shortUrl", 1)
+	}
+	if len(plain.Url) < 1 {
+		return fmt.Errorf("field %s length: must be >= %d", "url", 1)
+	}
+	*j = LinkUpdatedV1(plain)
+	return nil
+}
@@ -0,0 +1,140 @@
+package shared
+
+//go:generate buf generate proto
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Domain of the error details carrying the HTTP status of a ServiceError
+const grpcErrorDomain = "lru"
+
+// gRPC codes of the HTTP statuses answered by the services
+var grpcCodes = map[int]codes.Code{
+	400: codes.InvalidArgument,
+	401: codes.Unauthenticated,
+	403: codes.PermissionDenied,
+	404: codes.NotFound,
+	409: codes.AlreadyExists,
+	410: codes.FailedPrecondition,
+	422: codes.FailedPrecondition,
+	429: codes.ResourceExhausted,
+	500: codes.Internal,
+	503: codes.Unavailable,
+	504: codes.DeadlineExceeded,
+}
+
+// HTTP statuses of the gRPC codes, for errors without details
+var grpcHttpStatuses = map[codes.Code]int{
+	codes.InvalidArgument:    400,
+	codes.Unauthenticated:    401,
+	codes.PermissionDenied:   403,
+	codes.NotFound:           404,
+	codes.AlreadyExists:      409,
+	codes.FailedPrecondition: 422,
+	codes.ResourceExhausted:  429,
+}
+
+// Trace the calls with the W3C trace context, the same propagation as the HTTP services
+func grpcTraceOptions() []otelgrpc.Option {
+	return []otelgrpc.Option{
+		otelgrpc.WithPropagators(propagation.TraceContext{}),
+	}
+}
+
+// gRPC server continuing the trace of its callers
+func NewGrpcServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.UnaryInterceptor(otelgrpc.UnaryServerInterceptor(grpcTraceOptions()...)))
+	return grpc.NewServer(opts...)
+}
+
+// Serve on the port until ctx is cancelled, then wait for the calls in flight
+func ServeGrpc(ctx context.Context, server *grpc.Server, port string) error {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+
+	err = server.Serve(listener)
+	<-stopped
+	return err
+}
+
+// Connection to an internal gRPC service, propagating the trace of the calls.
+// The connection is established lazily, on the first call.
+func DialGrpc(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor(grpcTraceOptions()...)),
+	}, opts...)
+	return grpc.Dial(target, opts...)
+}
+
+// gRPC status of the error returned by a server. The HTTP status of the error (see
+// AsServiceError) travels in the details so the caller gets it back exactly.
+func GrpcError(err error) error {
+	serviceError := AsServiceError(err)
+	if serviceError == nil {
+		return nil
+	}
+	code, ok := grpcCodes[serviceError.Status]
+	if !ok {
+		code = codes.Unknown
+	}
+	st, detailsErr := status.New(code, serviceError.Message).WithDetails(&errdetails.ErrorInfo{
+		Domain:   grpcErrorDomain,
+		Reason:   code.String(),
+		Metadata: map[string]string{"status": strconv.Itoa(serviceError.Status)},
+	})
+	if detailsErr != nil {
+		return status.Error(code, serviceError.Message)
+	}
+	return st.Err()
+}
+
+// ServiceError answered by the service called by a gRPC client. The error is wrapped
+// in ErrBackendUnavailable when the call did not reach the service (unreachable, timed
+// out or cancelled).
+func ServiceErrorFromGrpc(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return BackendError(err)
+	}
+
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != grpcErrorDomain {
+			continue
+		}
+		if httpStatus, err := strconv.Atoi(info.Metadata["status"]); err == nil {
+			return NewServiceError(httpStatus, st.Message())
+		}
+	}
+
+	switch st.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return BackendError(err)
+	}
+	httpStatus, ok := grpcHttpStatuses[st.Code()]
+	if !ok {
+		httpStatus = 500
+	}
+	return NewServiceError(httpStatus, st.Message())
+}
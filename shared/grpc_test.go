@@ -0,0 +1,74 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGrpcErrorRoundTrip(t *testing.T) {
+	for _, httpStatus := range []int{400, 404, 409, 410, 422, 500, 503} {
+		err := ServiceErrorFromGrpc(GrpcError(fmt.Errorf("wrapped: %w", NewServiceError(httpStatus, "reason"))))
+		var serviceError *ServiceError
+		if !errors.As(err, &serviceError) || serviceError.Status != httpStatus || serviceError.Message != "reason" {
+			t.Errorf("round trip of %d = %v", httpStatus, err)
+		}
+	}
+
+	err := ServiceErrorFromGrpc(GrpcError(errors.New("db down")))
+	if ServiceErrorStatus(err) != 500 {
+		t.Errorf("round trip of a plain error = %v, want 500", err)
+	}
+}
+
+func TestServiceErrorFromGrpcWithoutDetails(t *testing.T) {
+	err := ServiceErrorFromGrpc(status.Error(codes.NotFound, "missing"))
+	if ServiceErrorStatus(err) != 404 {
+		t.Errorf("ServiceErrorFromGrpc(NotFound) = %v, want 404", err)
+	}
+
+	unavailable := status.Error(codes.Unavailable, "connection refused")
+	err = ServiceErrorFromGrpc(unavailable)
+	var serviceError *ServiceError
+	if errors.As(err, &serviceError) || !errors.Is(err, ErrBackendUnavailable) || !errors.Is(err, unavailable) {
+		t.Errorf("ServiceErrorFromGrpc(Unavailable) = %v, want the transport error as ErrBackendUnavailable", err)
+	}
+	if ServiceErrorStatus(err) != 503 {
+		t.Errorf("ServiceErrorStatus() = %d, want 503", ServiceErrorStatus(err))
+	}
+}
+
+func TestUpdateLinkRequestProtoRoundTrip(t *testing.T) {
+	url := "https://example.com"
+	redirectType := 307
+	disabled := false
+	request := UpdateLinkRequest{Id: "req-1", Url: &url, RedirectType: &redirectType, Disabled: &disabled, OwnerId: "owner", Domain: "go.example.com"}
+
+	code, decoded := UpdateLinkRequestFromProto(UpdateLinkRequestToProto("abc", request))
+	if code != "abc" || decoded.Id != "req-1" || decoded.OwnerId != "owner" || decoded.Domain != "go.example.com" {
+		t.Errorf("UpdateLinkRequestFromProto() = %v, %+v", code, decoded)
+	}
+	if decoded.Url == nil || *decoded.Url != url || decoded.RedirectType == nil || *decoded.RedirectType != 307 || decoded.Disabled == nil || *decoded.Disabled {
+		t.Errorf("UpdateLinkRequestFromProto() lost the set fields: %+v", decoded)
+	}
+	if decoded.ExpiresAt != nil || decoded.MaxClicks != nil {
+		t.Errorf("UpdateLinkRequestFromProto() set the absent fields: %+v", decoded)
+	}
+}
+
+func TestGrpcErrorOfDomainErrors(t *testing.T) {
+	cases := map[error]int{
+		ErrNotFound:                            404,
+		fmt.Errorf("link abc: %w", ErrExpired): 410,
+		ErrDisabled:                            410,
+		BackendError(errors.New("dial tcp")):   503,
+	}
+	for err, httpStatus := range cases {
+		if got := ServiceErrorStatus(ServiceErrorFromGrpc(GrpcError(err))); got != httpStatus {
+			t.Errorf("round trip of %v = %d, want %d", err, got, httpStatus)
+		}
+	}
+}
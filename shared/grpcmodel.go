@@ -0,0 +1,140 @@
+package shared
+
+import "github.com/HungTP-Play/lru/shared/pb"
+
+// Conversions between the models of the HTTP API and the messages of the gRPC API
+
+func MapUrlRequestToProto(request MapUrlRequest) *pb.MapRequest {
+	return &pb.MapRequest{
+		Id:           request.Id,
+		Url:          request.Url,
+		Alias:        request.Alias,
+		RedirectType: int32(request.RedirectType),
+		ExpiresAt:    request.ExpiresAt,
+		MaxClicks:    request.MaxClicks,
+		Dedup:        request.Dedup,
+		OwnerId:      request.OwnerId,
+		Domain:       request.Domain,
+	}
+}
+
+func MapUrlRequestFromProto(request *pb.MapRequest) MapUrlRequest {
+	return MapUrlRequest{
+		Id:           request.GetId(),
+		Url:          request.GetUrl(),
+		Alias:        request.GetAlias(),
+		RedirectType: int(request.GetRedirectType()),
+		ExpiresAt:    request.GetExpiresAt(),
+		MaxClicks:    request.GetMaxClicks(),
+		Dedup:        request.Dedup,
+		OwnerId:      request.GetOwnerId(),
+		Domain:       request.GetDomain(),
+	}
+}
+
+func MapUrlResponseToProto(response MapUrlResponse) *pb.MapResponse {
+	return &pb.MapResponse{
+		Id:           response.Id,
+		Url:          response.Url,
+		Code:         response.Code,
+		Shortened:    response.Shortened,
+		Deduplicated: response.Deduplicated,
+	}
+}
+
+func MapUrlResponseFromProto(response *pb.MapResponse) MapUrlResponse {
+	return MapUrlResponse{
+		Id:           response.GetId(),
+		Url:          response.GetUrl(),
+		Code:         response.GetCode(),
+		Shortened:    response.GetShortened(),
+		Deduplicated: response.GetDeduplicated(),
+	}
+}
+
+func LinkResponseToProto(link LinkResponse) *pb.Link {
+	return &pb.Link{
+		Code:         link.Code,
+		Domain:       link.Domain,
+		Url:          link.Url,
+		Shortened:    link.Shortened,
+		IsAlias:      link.IsAlias,
+		RedirectType: int32(link.RedirectType),
+		ExpiresAt:    link.ExpiresAt,
+		MaxClicks:    link.MaxClicks,
+		Disabled:     link.Disabled,
+	}
+}
+
+func LinkResponseFromProto(link *pb.Link) LinkResponse {
+	return LinkResponse{
+		Code:         link.GetCode(),
+		Domain:       link.GetDomain(),
+		Url:          link.GetUrl(),
+		Shortened:    link.GetShortened(),
+		IsAlias:      link.GetIsAlias(),
+		RedirectType: int(link.GetRedirectType()),
+		ExpiresAt:    link.GetExpiresAt(),
+		MaxClicks:    link.GetMaxClicks(),
+		Disabled:     link.GetDisabled(),
+	}
+}
+
+// Update of the link with the code, its domain and owner are taken from the request
+func UpdateLinkRequestToProto(code string, request UpdateLinkRequest) *pb.UpdateLinkRequest {
+	update := &pb.UpdateLinkRequest{
+		Link: &pb.LinkRef{
+			Id:      request.Id,
+			Domain:  request.Domain,
+			Code:    code,
+			OwnerId: request.OwnerId,
+		},
+		Url:       request.Url,
+		ExpiresAt: request.ExpiresAt,
+		MaxClicks: request.MaxClicks,
+		Disabled:  request.Disabled,
+	}
+	if request.RedirectType != nil {
+		redirectType := int32(*request.RedirectType)
+		update.RedirectType = &redirectType
+	}
+	return update
+}
+
+// Return the code of the link and its update
+func UpdateLinkRequestFromProto(update *pb.UpdateLinkRequest) (string, UpdateLinkRequest) {
+	request := UpdateLinkRequest{
+		Id:        update.GetLink().GetId(),
+		Url:       update.Url,
+		ExpiresAt: update.ExpiresAt,
+		MaxClicks: update.MaxClicks,
+		Disabled:  update.Disabled,
+		OwnerId:   update.GetLink().GetOwnerId(),
+		Domain:    update.GetLink().GetDomain(),
+	}
+	if update.RedirectType != nil {
+		redirectType := int(*update.RedirectType)
+		request.RedirectType = &redirectType
+	}
+	return update.GetLink().GetCode(), request
+}
+
+func RedirectResponseToProto(response RedirectResponse) *pb.RedirectTarget {
+	return &pb.RedirectTarget{
+		Id:           response.Id,
+		Url:          response.Url,
+		Code:         response.Code,
+		OriginalUrl:  response.OriginalUrl,
+		RedirectType: int32(response.RedirectType),
+	}
+}
+
+func RedirectResponseFromProto(target *pb.RedirectTarget) RedirectResponse {
+	return RedirectResponse{
+		Id:           target.GetId(),
+		Url:          target.GetUrl(),
+		Code:         target.GetCode(),
+		OriginalUrl:  target.GetOriginalUrl(),
+		RedirectType: int(target.GetRedirectType()),
+	}
+}
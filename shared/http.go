@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/gofiber/fiber/v2"
 	"go.opentelemetry.io/otel/propagation"
@@ -16,6 +19,8 @@ type HttpService struct {
 	Prefork bool   `json:"prefork"`
 	App     *fiber.App
 	AppCtx  context.Context
+
+	workers []func(ctx context.Context)
 }
 
 func NewHttpService(name string, port string, prefork bool) *HttpService {
@@ -56,6 +61,8 @@ func (h *HttpService) Routes(path string, handler fiber.Handler, method string)
 		h.App.Post(path, handler)
 	case "PUT":
 		h.App.Put(path, handler)
+	case "PATCH":
+		h.App.Patch(path, handler)
 	case "DELETE":
 		h.App.Delete(path, handler)
 	default:
@@ -71,25 +78,53 @@ func (h *HttpService) CtxGet(key string) interface{} {
 	return h.AppCtx.Value(key)
 }
 
+// Run the worker next to the server once it starts, e.g. a queue consumer. Its context
+// is cancelled on shutdown and the server waits for it to return before cleaning up.
+func (h *HttpService) Background(worker func(ctx context.Context)) {
+	h.workers = append(h.workers, worker)
+}
+
 func (h *HttpService) Start(onGratefulShutDown func()) error {
 	port := fmt.Sprintf(":%s", h.Port)
 
+	ctx, stop := context.WithCancel(h.AppCtx)
+	defer stop()
+
+	var workers sync.WaitGroup
+	for _, worker := range h.workers {
+		workers.Add(1)
+		go func(worker func(ctx context.Context)) {
+			defer workers.Done()
+			worker(ctx)
+		}(worker)
+	}
+
 	// Do prepare for gratefully shutdown
 	shutdownChan := make(chan os.Signal, 1)
+	signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-shutdownChan
+		_, ok := <-shutdownChan
+		if !ok {
+			return
+		}
 		fmt.Println("Shutting down the server...")
+		stop()
 		h.App.Shutdown()
 	}()
 
 	err := h.App.Listen(port)
-	if err != nil {
-		return err
-	}
 
 	// Clean up
+	signal.Stop(shutdownChan)
 	close(shutdownChan)
 
+	// Let the workers finish what they are doing before the resources go away
+	stop()
+	workers.Wait()
+	if err != nil {
+		return err
+	}
+
 	onGratefulShutDown()
 	return nil
 }
@@ -0,0 +1,202 @@
+package shared
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Why an entry left an LRUCache
+type EvictionReason string
+
+const (
+	EvictionCapacity EvictionReason = "capacity" // Least recently used entry dropped to make room
+	EvictionExpired  EvictionReason = "expired"  // Entry read after its TTL
+	EvictionDeleted  EvictionReason = "deleted"  // Entry removed by Delete or Purge
+)
+
+// Bounds of an LRUCache, a zero value disables the bound
+type LRUOptions[K comparable, V any] struct {
+	// Maximum number of entries
+	MaxEntries int
+	// Maximum total size of the entries, as measured by Size
+	MaxBytes int64
+	// Size of an entry, required by MaxBytes
+	Size func(key K, value V) int64
+	// Time to live of the entries set without their own
+	TTL time.Duration
+	// Called after an entry left the cache, outside of its lock
+	OnEvict func(key K, value V, reason EvictionReason)
+}
+
+type lruEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	size      int64
+	expiresAt time.Time // Zero when the entry does not expire
+}
+
+type lruEviction[K comparable, V any] struct {
+	entry  *lruEntry[K, V]
+	reason EvictionReason
+}
+
+// In-process cache dropping its least recently used entries once it is full.
+// It is safe for concurrent use.
+type LRUCache[K comparable, V any] struct {
+	options LRUOptions[K, V]
+
+	mutex   sync.Mutex
+	order   *list.List // Most recently used first
+	entries map[K]*list.Element
+	bytes   int64
+	now     func() time.Time
+}
+
+func NewLRUCache[K comparable, V any](options LRUOptions[K, V]) *LRUCache[K, V] {
+	return &LRUCache[K, V]{
+		options: options,
+		order:   list.New(),
+		entries: make(map[K]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Return the value of the key and mark it as the most recently used
+func (c *LRUCache[K, V]) Get(key K) (V, bool) {
+	var evicted []lruEviction[K, V]
+	defer func() { c.notify(evicted) }()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	entry := element.Value.(*lruEntry[K, V])
+	if !entry.expiresAt.IsZero() && !c.now().Before(entry.expiresAt) {
+		c.remove(element)
+		evicted = append(evicted, lruEviction[K, V]{entry, EvictionExpired})
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Set the value of the key with the TTL of the options
+func (c *LRUCache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.options.TTL)
+}
+
+// Set the value of the key for ttl, forever when ttl is 0. Entries are evicted from
+// the least recently used until the cache fits its bounds again; a value larger than
+// MaxBytes is not stored.
+func (c *LRUCache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	var evicted []lruEviction[K, V]
+	defer func() { c.notify(evicted) }()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := &lruEntry[K, V]{key: key, value: value}
+	if c.options.Size != nil {
+		entry.size = c.options.Size(key, value)
+	}
+	if ttl > 0 {
+		entry.expiresAt = c.now().Add(ttl)
+	}
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	if c.options.MaxBytes > 0 && entry.size > c.options.MaxBytes {
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += entry.size
+
+	for c.overflows() {
+		oldest := c.order.Back()
+		c.remove(oldest)
+		evicted = append(evicted, lruEviction[K, V]{oldest.Value.(*lruEntry[K, V]), EvictionCapacity})
+	}
+}
+
+// Remove the key, return false when it was not cached
+func (c *LRUCache[K, V]) Delete(key K) bool {
+	var evicted []lruEviction[K, V]
+	defer func() { c.notify(evicted) }()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	c.remove(element)
+	evicted = append(evicted, lruEviction[K, V]{element.Value.(*lruEntry[K, V]), EvictionDeleted})
+	return true
+}
+
+// Remove all the entries
+func (c *LRUCache[K, V]) Purge() {
+	var evicted []lruEviction[K, V]
+	defer func() { c.notify(evicted) }()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		evicted = append(evicted, lruEviction[K, V]{element.Value.(*lruEntry[K, V]), EvictionDeleted})
+	}
+	c.order.Init()
+	c.entries = make(map[K]*list.Element)
+	c.bytes = 0
+}
+
+// Number of entries, including the expired ones not read since they expired
+func (c *LRUCache[K, V]) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// Total size of the entries
+func (c *LRUCache[K, V]) Bytes() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.bytes
+}
+
+func (c *LRUCache[K, V]) overflows() bool {
+	if c.order.Len() == 0 {
+		return false
+	}
+	if c.options.MaxEntries > 0 && c.order.Len() > c.options.MaxEntries {
+		return true
+	}
+	return c.options.MaxBytes > 0 && c.bytes > c.options.MaxBytes
+}
+
+func (c *LRUCache[K, V]) remove(element *list.Element) {
+	entry := element.Value.(*lruEntry[K, V])
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
+
+func (c *LRUCache[K, V]) notify(evicted []lruEviction[K, V]) {
+	if c.options.OnEvict == nil {
+		return
+	}
+	for _, eviction := range evicted {
+		c.options.OnEvict(eviction.entry.key, eviction.entry.value, eviction.reason)
+	}
+}
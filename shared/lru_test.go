@@ -0,0 +1,129 @@
+package shared
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var evicted []string
+	cache := NewLRUCache(LRUOptions[string, int]{
+		MaxEntries: 2,
+		OnEvict: func(key string, value int, reason EvictionReason) {
+			evicted = append(evicted, fmt.Sprintf("%s:%s", key, reason))
+		},
+	})
+
+	cache.Set("a", 1)
+	cache.Set("b", 2)
+	cache.Get("a")
+	cache.Set("c", 3)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("Get(b) should miss, it was the least recently used")
+	}
+	if value, ok := cache.Get("a"); !ok || value != 1 {
+		t.Errorf("Get(a) = %v, %v", value, ok)
+	}
+	if cache.Len() != 2 || len(evicted) != 1 || evicted[0] != "b:capacity" {
+		t.Errorf("Len() = %d, evicted %v", cache.Len(), evicted)
+	}
+
+	cache.Delete("a")
+	if len(evicted) != 2 || evicted[1] != "a:deleted" {
+		t.Errorf("evicted %v after Delete", evicted)
+	}
+}
+
+func TestLRUCacheMaxBytes(t *testing.T) {
+	cache := NewLRUCache(LRUOptions[string, string]{
+		MaxBytes: 10,
+		Size: func(key string, value string) int64 {
+			return int64(len(key) + len(value))
+		},
+	})
+
+	cache.Set("a", "1234")
+	cache.Set("b", "1234")
+	if cache.Bytes() != 10 || cache.Len() != 2 {
+		t.Fatalf("Bytes() = %d, Len() = %d", cache.Bytes(), cache.Len())
+	}
+
+	cache.Set("c", "12")
+	if _, ok := cache.Get("a"); ok || cache.Bytes() != 8 {
+		t.Errorf("a should be evicted to fit c, Bytes() = %d", cache.Bytes())
+	}
+
+	// Replacing a key frees the size of its previous value
+	cache.Set("c", "123456")
+	if cache.Bytes() != 7 || cache.Len() != 1 {
+		t.Errorf("Bytes() = %d, Len() = %d after replacing c", cache.Bytes(), cache.Len())
+	}
+
+	cache.Set("d", "this value does not fit")
+	if _, ok := cache.Get("d"); ok {
+		t.Errorf("a value larger than MaxBytes should not be stored")
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	now := time.Now()
+	var reasons []EvictionReason
+	cache := NewLRUCache(LRUOptions[string, int]{
+		TTL: time.Minute,
+		OnEvict: func(key string, value int, reason EvictionReason) {
+			reasons = append(reasons, reason)
+		},
+	})
+	cache.now = func() time.Time { return now }
+
+	cache.Set("a", 1)
+	cache.SetWithTTL("b", 2, 10*time.Second)
+	cache.SetWithTTL("c", 3, 0)
+
+	now = now.Add(30 * time.Second)
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("Get(b) should miss after its own TTL")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Errorf("Get(a) should hit before the default TTL")
+	}
+
+	now = now.Add(time.Hour)
+	if _, ok := cache.Get("a"); ok {
+		t.Errorf("Get(a) should miss after the default TTL")
+	}
+	if _, ok := cache.Get("c"); !ok {
+		t.Errorf("Get(c) should hit, it does not expire")
+	}
+	if len(reasons) != 2 || reasons[0] != EvictionExpired || reasons[1] != EvictionExpired {
+		t.Errorf("reasons = %v", reasons)
+	}
+}
+
+func TestLRUCacheConcurrentUse(t *testing.T) {
+	cache := NewLRUCache(LRUOptions[int, int]{MaxEntries: 64})
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := (worker*1000 + i) % 100
+				cache.Set(key, i)
+				cache.Get(key)
+				if i%10 == 0 {
+					cache.Delete(key)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if cache.Len() > 64 {
+		t.Errorf("Len() = %d, want at most 64", cache.Len())
+	}
+}
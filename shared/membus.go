@@ -0,0 +1,249 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type memoryMessage struct {
+	body    []byte
+	headers amqp.Table
+}
+
+type memoryQueue struct {
+	pending []memoryMessage
+	ready   chan struct{} // Signaled when pending gets a message
+	dead    []memoryMessage
+}
+
+// Bus keeping its queues in memory, for tests and running every service in one binary.
+// Messages are lost when the process exits.
+type MemoryBus struct {
+	// How long a cancelled subscriber waits for the messages in flight
+	DrainTimeout time.Duration
+
+	mutex         sync.Mutex
+	queues        map[string]*memoryQueue
+	retryPolicies map[string]RetryPolicy
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		DrainTimeout:  GetEnvDuration("RABBITMQ_DRAIN_TIMEOUT", 30*time.Second),
+		queues:        map[string]*memoryQueue{},
+		retryPolicies: map[string]RetryPolicy{},
+		closed:        make(chan struct{}),
+	}
+}
+
+// Return the queue, creating it on first use. Called with the mutex held.
+func (b *MemoryBus) queue(name string) *memoryQueue {
+	queue, ok := b.queues[name]
+	if !ok {
+		queue = &memoryQueue{ready: make(chan struct{}, 1)}
+		b.queues[name] = queue
+	}
+	return queue
+}
+
+func (b *MemoryBus) push(name string, message memoryMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	queue := b.queue(name)
+	queue.pending = append(queue.pending, message)
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Take the oldest message of the queue, waiting for one until ctx is cancelled
+func (b *MemoryBus) take(ctx context.Context, name string) (memoryMessage, bool) {
+	for {
+		b.mutex.Lock()
+		queue := b.queue(name)
+		if len(queue.pending) > 0 {
+			message := queue.pending[0]
+			queue.pending = queue.pending[1:]
+			// Wake another worker up for the next one
+			if len(queue.pending) > 0 {
+				select {
+				case queue.ready <- struct{}{}:
+				default:
+				}
+			}
+			b.mutex.Unlock()
+			return message, true
+		}
+		ready := queue.ready
+		b.mutex.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return memoryMessage{}, false
+		case <-b.closed:
+			return memoryMessage{}, false
+		}
+	}
+}
+
+func (b *MemoryBus) Publish(queue string, message interface{}, headers amqp.Table) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return b.PublishRaw(queue, body, headers)
+}
+
+func (b *MemoryBus) PublishRaw(queue string, body []byte, headers amqp.Table) error {
+	select {
+	case <-b.closed:
+		return ErrBusClosed
+	default:
+	}
+
+	b.push(queue, memoryMessage{body: body, headers: copyHeaders(headers)})
+	return nil
+}
+
+func (b *MemoryBus) SetRetryPolicy(queue string, policy RetryPolicy) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.retryPolicies[queue] = policy
+}
+
+func (b *MemoryBus) retryPolicy(queue string) RetryPolicy {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if policy, ok := b.retryPolicies[queue]; ok {
+		return policy
+	}
+	return DefaultRetryPolicy()
+}
+
+// Deliver the failed message again after the delay of its attempt, or keep it as a dead
+// letter after the last one
+func (b *MemoryBus) retryOrDeadLetter(queue string, message memoryMessage, cause error) {
+	policy := b.retryPolicy(queue)
+	attempt := deliveryAttempt(message.headers)
+	headers := copyHeaders(message.headers)
+
+	if attempt < policy.MaxAttempts {
+		headers[AttemptHeader] = int32(attempt + 1)
+		time.AfterFunc(policy.Delay(attempt), func() {
+			b.push(queue, memoryMessage{body: message.body, headers: headers})
+		})
+		return
+	}
+
+	headers[LastErrorHeader] = cause.Error()
+	headers[FailedAtHeader] = time.Now().Unix()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	deadQueue := b.queue(queue)
+	deadQueue.dead = append(deadQueue.dead, memoryMessage{body: message.body, headers: headers})
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, queue string, handler ConsumeHandler, numberOfWorker int) error {
+	var workers sync.WaitGroup
+	for i := 0; i < numberOfWorker; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				message, ok := b.take(ctx, queue)
+				if !ok {
+					return
+				}
+
+				err := handler(ExtractAmqpTraceHeader(message.headers), message.body, message.headers)
+				if err != nil {
+					b.retryOrDeadLetter(queue, message, err)
+				}
+			}
+		}()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	case <-b.closed:
+	}
+
+	timeout := time.NewTimer(b.DrainTimeout)
+	defer timeout.Stop()
+	select {
+	case <-drained:
+		return nil
+	case <-timeout.C:
+		return ErrDrainTimeout
+	}
+}
+
+func (b *MemoryBus) DeadLetters(queue string, limit int) ([]DeadLetter, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	deadLetters := []DeadLetter{}
+	for _, message := range b.queue(queue).dead {
+		if len(deadLetters) == limit {
+			break
+		}
+		deadLetters = append(deadLetters, toDeadLetter(queue, amqp.Delivery{Body: message.body, Headers: message.headers}))
+	}
+	return deadLetters, nil
+}
+
+func (b *MemoryBus) ReplayDeadLetters(queue string, limit int) (int, error) {
+	b.mutex.Lock()
+	deadQueue := b.queue(queue)
+	count := len(deadQueue.dead)
+	if count > limit {
+		count = limit
+	}
+	replayed := deadQueue.dead[:count]
+	deadQueue.dead = deadQueue.dead[count:]
+	b.mutex.Unlock()
+
+	for _, message := range replayed {
+		headers := copyHeaders(message.headers)
+		delete(headers, AttemptHeader)
+		delete(headers, LastErrorHeader)
+		delete(headers, FailedAtHeader)
+		b.push(queue, memoryMessage{body: message.body, headers: headers})
+	}
+	return count, nil
+}
+
+func (b *MemoryBus) PurgeDeadLetters(queue string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	deadQueue := b.queue(queue)
+	purged := len(deadQueue.dead)
+	deadQueue.dead = nil
+	return purged, nil
+}
+
+// Stop the subscribers, messages still queued are dropped
+func (b *MemoryBus) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+	return nil
+}
@@ -0,0 +1,178 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestMemoryBus(t *testing.T) *MemoryBus {
+	bus := NewMemoryBus()
+	bus.DrainTimeout = time.Second
+	t.Cleanup(func() {
+		bus.Close()
+	})
+	return bus
+}
+
+func TestMemoryBusPublishSubscribe(t *testing.T) {
+	bus := newTestMemoryBus(t)
+
+	received := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- bus.Subscribe(ctx, "redirect", func(ctx context.Context, body []byte, headers amqp.Table) error {
+			received <- string(body) + " " + headers["traceparent"].(string)
+			return nil
+		}, 3)
+	}()
+
+	for _, code := range []string{"a", "b", "c"} {
+		err := bus.Publish("redirect", code, amqp.Table{"traceparent": "00-1"})
+		if err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case message := <-received:
+			seen[message] = true
+		case <-time.After(time.Second):
+			t.Fatalf("received %d messages, want 3", i)
+		}
+	}
+	if !seen[`"a" 00-1`] || !seen[`"b" 00-1`] || !seen[`"c" 00-1`] {
+		t.Errorf("received %v", seen)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Subscribe() error = %v", err)
+	}
+}
+
+func TestMemoryBusRetriesThenDeadLetters(t *testing.T) {
+	bus := newTestMemoryBus(t)
+	bus.SetRetryPolicy("analytic", testRetryPolicy())
+
+	attempts := make(chan int, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Subscribe(ctx, "analytic", func(ctx context.Context, body []byte, headers amqp.Table) error {
+		attempts <- deliveryAttempt(headers)
+		return errors.New("database is down")
+	}, 1)
+
+	if err := bus.Publish("analytic", "hello", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	for _, expected := range []int{1, 2, 3} {
+		select {
+		case attempt := <-attempts:
+			if attempt != expected {
+				t.Errorf("attempt %d, want %d", attempt, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d was not delivered", expected)
+		}
+	}
+
+	var deadLetters []DeadLetter
+	deadline := time.Now().Add(time.Second)
+	for len(deadLetters) == 0 && time.Now().Before(deadline) {
+		deadLetters, _ = bus.DeadLetters("analytic", 10)
+		time.Sleep(time.Millisecond)
+	}
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != 3 || deadLetters[0].Error != "database is down" || string(deadLetters[0].Payload) != `"hello"` {
+		t.Fatalf("DeadLetters() = %+v", deadLetters)
+	}
+}
+
+func TestMemoryBusReplayAndPurge(t *testing.T) {
+	bus := newTestMemoryBus(t)
+	bus.SetRetryPolicy("redirect", RetryPolicy{MaxAttempts: 1})
+
+	var failing atomic.Bool
+	failing.Store(true)
+	received := make(chan amqp.Table, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bus.Subscribe(ctx, "redirect", func(ctx context.Context, body []byte, headers amqp.Table) error {
+		if failing.Load() {
+			return errors.New("boom")
+		}
+		received <- headers
+		return nil
+	}, 1)
+
+	for i := 0; i < 3; i++ {
+		bus.Publish("redirect", i, nil)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		deadLetters, _ := bus.DeadLetters("redirect", 10)
+		if len(deadLetters) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dead-letter queue has %d messages, want 3", len(deadLetters))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	failing.Store(false)
+	replayed, err := bus.ReplayDeadLetters("redirect", 1)
+	if err != nil || replayed != 1 {
+		t.Fatalf("ReplayDeadLetters() = %d, %v", replayed, err)
+	}
+	select {
+	case headers := <-received:
+		if _, ok := headers[LastErrorHeader]; ok {
+			t.Errorf("replayed message still carries its error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("replayed message was not delivered")
+	}
+
+	purged, err := bus.PurgeDeadLetters("redirect")
+	if err != nil || purged != 2 {
+		t.Fatalf("PurgeDeadLetters() = %d, %v", purged, err)
+	}
+}
+
+func TestConnectBusSelectsDriver(t *testing.T) {
+	t.Setenv("BUS_DRIVER", "memory")
+	bus, err := ConnectBus(0)
+	if err != nil {
+		t.Fatalf("ConnectBus() error = %v", err)
+	}
+	if _, ok := bus.(*MemoryBus); !ok {
+		t.Errorf("ConnectBus() = %T, want *MemoryBus", bus)
+	}
+
+	t.Setenv("BUS_DRIVER", "kafka")
+	if _, err := ConnectBus(0); err == nil {
+		t.Errorf("ConnectBus() should reject an unknown driver")
+	}
+}
+
+func TestNatsNames(t *testing.T) {
+	if name := natsStreamName("link.events"); name != "LINK_EVENTS" {
+		t.Errorf("natsStreamName() = %s", name)
+	}
+	if name := natsDeadStreamName("redirect"); name != "REDIRECT_DEAD" {
+		t.Errorf("natsDeadStreamName() = %s", name)
+	}
+
+	headers := fromNatsHeader(toNatsHeader(amqp.Table{"traceparent": "00-1", AttemptHeader: int32(2)}))
+	if headers["traceparent"] != "00-1" || headers[AttemptHeader] != "2" {
+		t.Errorf("headers did not survive the round trip: %v", headers)
+	}
+}
@@ -1,37 +1,186 @@
 package shared
 
+// Supported HTTP status codes for a short link redirect
+const (
+	RedirectMovedPermanently = 301
+	RedirectFound            = 302
+	RedirectTemporary        = 307
+	RedirectPermanent        = 308
+	DefaultRedirectType      = RedirectFound
+)
+
+// Check if the provided status code can be used to redirect a short link
+func IsRedirectTypeValid(redirectType int) bool {
+	switch redirectType {
+	case RedirectMovedPermanently, RedirectFound, RedirectTemporary, RedirectPermanent:
+		return true
+	default:
+		return false
+	}
+}
+
 type MapUrlRequest struct {
-	Id  string `json:"id"`
-	Url string `json:"url"`
+	Id           string `json:"id"`
+	Url          string `json:"url"`
+	Alias        string `json:"alias"` // Optional custom short code
+	RedirectType int    `json:"redirectType"`
+	ExpiresAt    int64  `json:"expiresAt"` // Unix timestamp, 0 means never
+	MaxClicks    int64  `json:"maxClicks"` // 0 means unlimited
+	Dedup        *bool  `json:"dedup"`     // Reuse the existing link of the same url, nil follows the mapper default
+	OwnerId      string `json:"ownerId"`   // Owner of the API key that created the link, empty when anonymous
+	Domain       string `json:"domain"`    // Custom short domain of a workspace of the owner, empty for the default one
 }
 
 type MapUrlResponse struct {
-	Id        string `json:"id"`
+	Id           string `json:"id"`
+	Url          string `json:"url"`
+	Code         string `json:"code"`
+	Shortened    string `json:"shortened"`
+	Deduplicated bool   `json:"deduplicated"` // True when an existing link is returned
+}
+
+type MapBatchRequest struct {
+	Id    string          `json:"id"`
+	Items []MapUrlRequest `json:"items"`
+}
+
+// Outcome of one item of a batch, either a short link or an error
+type MapBatchResult struct {
+	Index     int    `json:"index"`
 	Url       string `json:"url"`
-	Shortened string `json:"shortened"`
+	Code      string `json:"code,omitempty"`
+	Shortened string `json:"shortened,omitempty"`
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+type MapBatchResponse struct {
+	Id      string           `json:"id"`
+	Results []MapBatchResult `json:"results"`
 }
 
 type RedirectRequest struct {
-	Id  string `json:"id"`
-	Url string `json:"url"`
+	Id   string `json:"id"`
+	Url  string `json:"url"`
+	Code string `json:"code"`
 }
 
 type RedirectResponse struct {
-	Id          string `json:"id"`
-	Url         string `json:"url"`
-	OriginalUrl string `json:"originalUrl"`
+	Id           string `json:"id"`
+	Url          string `json:"url"`
+	Code         string `json:"code"`
+	OriginalUrl  string `json:"originalUrl"`
+	RedirectType int    `json:"redirectType"`
+}
+
+// Full state of a short link, as exposed by the link management API
+type LinkResponse struct {
+	Code         string `json:"code"`
+	Domain       string `json:"domain,omitempty"`
+	Url          string `json:"url"`
+	Shortened    string `json:"shortened"`
+	IsAlias      bool   `json:"isAlias"`
+	RedirectType int    `json:"redirectType"`
+	ExpiresAt    int64  `json:"expiresAt"` // Unix timestamp, 0 means never
+	MaxClicks    int64  `json:"maxClicks"` // 0 means unlimited
+	Disabled     bool   `json:"disabled"`
 }
 
+// Partial update of a short link, nil fields are left untouched
+type UpdateLinkRequest struct {
+	Id           string  `json:"id"`
+	Url          *string `json:"url"`
+	RedirectType *int    `json:"redirectType"`
+	ExpiresAt    *int64  `json:"expiresAt"` // 0 removes the expiry
+	MaxClicks    *int64  `json:"maxClicks"` // 0 removes the limit
+	Disabled     *bool   `json:"disabled"`
+	OwnerId      string  `json:"ownerId"` // Only the links of this owner can be updated, empty for any link
+	Domain       string  `json:"domain"`  // Domain of the link, empty for the default one
+}
+
+// Message of the analytic queue before the event envelope, only read to upcast the
+// messages still queued, see Event
 type AnalyticMessage struct {
 	Id        string `json:"id"`
 	Url       string `json:"url"`
 	Shorten   string `json:"shorten"`
-	Type      string `json:"type"` // Can be "map" or "redirect"
+	Type      string `json:"type"` // Can be "map", "redirect", "update" or "delete"
 	Timestamp int64  `json:"timestamp"`
+	OwnerId   string `json:"ownerId"` // Set on "map" messages
 }
 
+type IssueApiKeyRequest struct {
+	Id      string `json:"id"`
+	OwnerId string `json:"ownerId"`
+	Name    string `json:"name"`
+}
+
+// An API key as exposed by the key management API, the key itself is only known when issued
+type ApiKeyResponse struct {
+	Id        int64  `json:"id"`
+	OwnerId   string `json:"ownerId"`
+	Name      string `json:"name"`
+	Prefix    string `json:"prefix"`              // First characters of the key, to recognize it
+	Key       string `json:"key,omitempty"`       // Only set when the key is issued
+	KeyHash   string `json:"keyHash,omitempty"`   // Only set between services
+	CreatedAt int64  `json:"createdAt"`           // Unix timestamp
+	RevokedAt int64  `json:"revokedAt,omitempty"` // Unix timestamp, 0 while the key is valid
+}
+
+// Statistics of a short link, as exposed by the stats API
+type LinkStats struct {
+	Shortened     string `json:"shortened"`
+	Url           string `json:"url"`
+	RedirectCount int    `json:"redirectCount"`
+	CreatedAt     int64  `json:"createdAt"`    // Unix timestamp
+	LatestAccess  int64  `json:"latestAccess"` // Unix timestamp
+}
+
+// Actions carried by a RedirectMessage
+const (
+	RedirectActionCreate = "create"
+	RedirectActionUpdate = "update"
+	RedirectActionDelete = "delete"
+)
+
+// Message of the redirect queue before the event envelope, only read to upcast the
+// messages still queued, see Event
 type RedirectMessage struct {
+	Id           string `json:"id"`
+	Action       string `json:"action"` // Can be "create" (default), "update" or "delete"
+	Url          string `json:"url"`
+	Shorten      string `json:"shorten"`
+	Code         string `json:"code"`
+	Domain       string `json:"domain"` // Empty for the default domain
+	RedirectType int    `json:"redirectType"`
+	ExpiresAt    int64  `json:"expiresAt"` // Unix timestamp, 0 means never
+	MaxClicks    int64  `json:"maxClicks"` // 0 means unlimited
+	Disabled     bool   `json:"disabled"`
+}
+
+type WorkspaceRequest struct {
 	Id      string `json:"id"`
-	Url     string `json:"url"`
-	Shorten string `json:"shorten"`
+	OwnerId string `json:"ownerId"`
+	Name    string `json:"name"`
+}
+
+// A workspace groups the branded short domains of an owner
+type WorkspaceResponse struct {
+	Id        int64    `json:"id"`
+	OwnerId   string   `json:"ownerId"`
+	Name      string   `json:"name"`
+	Domains   []string `json:"domains"`
+	CreatedAt int64    `json:"createdAt"` // Unix timestamp
+}
+
+type DomainRequest struct {
+	Id      string `json:"id"`
+	OwnerId string `json:"ownerId"`
+	Host    string `json:"host"` // e.g. "go.acme.com"
+}
+
+type DomainResponse struct {
+	Host        string `json:"host"`
+	WorkspaceId int64  `json:"workspaceId"`
+	OwnerId     string `json:"ownerId"`
 }
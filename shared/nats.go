@@ -0,0 +1,466 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Bus on NATS JetStream.
+//
+// Each queue is a work-queue stream of the same name holding a single subject, consumed
+// through a durable pull consumer shared by every instance of the service. Failed
+// messages are redelivered by JetStream after the delay of the retry policy, then moved
+// to the "<queue>.dead" subject of a separate stream after their last attempt.
+type NatsBus struct {
+	url string
+
+	// Unacked messages a subscriber holds, 0 for twice its workers
+	Prefetch int
+	// How long JetStream waits for a handler before delivering its message again
+	AckWait time.Duration
+	// How long a cancelled subscriber waits for the messages in flight
+	DrainTimeout time.Duration
+
+	mutex         sync.Mutex
+	connection    *nats.Conn
+	jetStream     nats.JetStreamContext
+	streams       map[string]bool // Streams known to exist
+	retryPolicies map[string]RetryPolicy
+	closed        bool
+}
+
+func getNatsUrl() string {
+	natsHost := os.Getenv("NATS_HOST")
+	natsPort := os.Getenv("NATS_PORT")
+	if natsHost == "" {
+		natsHost = "localhost"
+	}
+	if natsPort == "" {
+		natsPort = "4222"
+	}
+
+	return fmt.Sprintf("nats://%v:%v", natsHost, natsPort)
+}
+
+// Build a NATS bus, tuned with RABBITMQ_PREFETCH, RABBITMQ_DRAIN_TIMEOUT like the
+// RabbitMQ client and NATS_ACK_WAIT (default 30s)
+func NewNatsBus(url string) *NatsBus {
+	if url == "" {
+		url = getNatsUrl()
+	}
+
+	return &NatsBus{
+		url:           url,
+		Prefetch:      GetEnvInt("RABBITMQ_PREFETCH", 0),
+		AckWait:       GetEnvDuration("NATS_ACK_WAIT", 30*time.Second),
+		DrainTimeout:  GetEnvDuration("RABBITMQ_DRAIN_TIMEOUT", 30*time.Second),
+		streams:       map[string]bool{},
+		retryPolicies: map[string]RetryPolicy{},
+	}
+}
+
+// Connect after the delay. The client reconnects on its own, also when this first
+// attempt fails: its error is returned and the bus keeps trying in the background.
+func (b *NatsBus) Connect(delay time.Duration) error {
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	connection, err := nats.Connect(b.url, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+
+	jetStream, err := connection.JetStream()
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	b.mutex.Lock()
+	b.connection = connection
+	b.jetStream = jetStream
+	b.mutex.Unlock()
+
+	if !connection.IsConnected() {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+func (b *NatsBus) js() (nats.JetStreamContext, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+	if b.jetStream == nil {
+		return nil, ErrNotConnected
+	}
+	return b.jetStream, nil
+}
+
+// Stream names cannot hold dots
+func natsStreamName(queue string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(queue))
+}
+
+func natsDeadStreamName(queue string) string {
+	return natsStreamName(queue) + "_DEAD"
+}
+
+func natsConsumerName(queue string) string {
+	return natsStreamName(queue) + "_WORKERS"
+}
+
+// Create the stream holding the subject unless it exists
+func (b *NatsBus) ensureStream(js nats.JetStreamContext, name string, subject string, retention nats.RetentionPolicy) error {
+	b.mutex.Lock()
+	known := b.streams[name]
+	b.mutex.Unlock()
+	if known {
+		return nil
+	}
+
+	_, err := js.StreamInfo(name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:      name,
+			Subjects:  []string{subject},
+			Retention: retention,
+			Storage:   nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	b.streams[name] = true
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *NatsBus) ensureQueue(js nats.JetStreamContext, queue string) error {
+	return b.ensureStream(js, natsStreamName(queue), queue, nats.WorkQueuePolicy)
+}
+
+func (b *NatsBus) ensureDeadQueue(js nats.JetStreamContext, queue string) error {
+	return b.ensureStream(js, natsDeadStreamName(queue), DeadLetterQueueName(queue), nats.LimitsPolicy)
+}
+
+func toNatsHeader(headers amqp.Table) nats.Header {
+	header := nats.Header{}
+	for key, value := range headers {
+		header.Set(key, fmt.Sprint(value))
+	}
+	return header
+}
+
+func fromNatsHeader(header nats.Header) amqp.Table {
+	headers := amqp.Table{}
+	for key := range header {
+		headers[key] = header.Get(key)
+	}
+	return headers
+}
+
+func (b *NatsBus) publish(subject string, body []byte, header nats.Header) error {
+	js, err := b.js()
+	if err != nil {
+		return err
+	}
+
+	_, err = js.PublishMsg(&nats.Msg{Subject: subject, Data: body, Header: header})
+	return err
+}
+
+func (b *NatsBus) Publish(queue string, message interface{}, headers amqp.Table) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return b.PublishRaw(queue, body, headers)
+}
+
+func (b *NatsBus) PublishRaw(queue string, body []byte, headers amqp.Table) error {
+	js, err := b.js()
+	if err != nil {
+		return err
+	}
+
+	err = b.ensureQueue(js, queue)
+	if err != nil {
+		return err
+	}
+	return b.publish(queue, body, toNatsHeader(headers))
+}
+
+func (b *NatsBus) SetRetryPolicy(queue string, policy RetryPolicy) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.retryPolicies[queue] = policy
+}
+
+func (b *NatsBus) retryPolicy(queue string) RetryPolicy {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if policy, ok := b.retryPolicies[queue]; ok {
+		return policy
+	}
+	return DefaultRetryPolicy()
+}
+
+// Ask JetStream to deliver the failed message again after the delay of its attempt, or
+// move it to the dead-letter stream after the last one
+func (b *NatsBus) retryOrDeadLetter(js nats.JetStreamContext, queue string, msg *nats.Msg, cause error) {
+	policy := b.retryPolicy(queue)
+	attempt := 1
+	if metadata, err := msg.Metadata(); err == nil {
+		attempt = int(metadata.NumDelivered)
+	}
+
+	if attempt < policy.MaxAttempts {
+		msg.NakWithDelay(policy.Delay(attempt))
+		return
+	}
+
+	header := nats.Header{}
+	for key, values := range msg.Header {
+		header[key] = values
+	}
+	header.Set(AttemptHeader, fmt.Sprint(attempt))
+	header.Set(LastErrorHeader, cause.Error())
+	header.Set(FailedAtHeader, fmt.Sprint(time.Now().Unix()))
+
+	err := b.ensureDeadQueue(js, queue)
+	if err == nil {
+		err = b.publish(DeadLetterQueueName(queue), msg.Data, header)
+	}
+	if err != nil {
+		msg.NakWithDelay(policy.MaxDelay)
+		return
+	}
+	msg.Ack()
+}
+
+func (b *NatsBus) subscribe(js nats.JetStreamContext, queue string, numberOfWorker int) (*nats.Subscription, error) {
+	err := b.ensureQueue(js, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	prefetch := b.Prefetch
+	if prefetch <= 0 {
+		prefetch = 2 * numberOfWorker
+	}
+	config := &nats.ConsumerConfig{
+		Durable:       natsConsumerName(queue),
+		FilterSubject: queue,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       b.AckWait,
+		MaxAckPending: prefetch,
+	}
+	_, err = js.AddConsumer(natsStreamName(queue), config)
+	if errors.Is(err, nats.ErrConsumerNameAlreadyInUse) {
+		_, err = js.UpdateConsumer(natsStreamName(queue), config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Bound to the durable consumer, so unsubscribing leaves it for the other instances
+	return js.PullSubscribe(queue, config.Durable, nats.Bind(natsStreamName(queue), config.Durable))
+}
+
+func (b *NatsBus) Subscribe(ctx context.Context, queue string, handler ConsumeHandler, numberOfWorker int) error {
+	var js nats.JetStreamContext
+	var sub *nats.Subscription
+	for sub == nil {
+		var err error
+		js, err = b.js()
+		if err == nil {
+			sub, err = b.subscribe(js, queue, numberOfWorker)
+		}
+		if errors.Is(err, ErrBusClosed) {
+			return nil
+		}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+		}
+	}
+	defer sub.Unsubscribe()
+
+	var workers sync.WaitGroup
+	for i := 0; i < numberOfWorker; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for ctx.Err() == nil {
+				fetchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				msgs, err := sub.Fetch(1, nats.Context(fetchCtx))
+				cancel()
+				if errors.Is(err, nats.ErrConnectionClosed) || errors.Is(err, nats.ErrBadSubscription) {
+					return
+				}
+				if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) && !errors.Is(err, nats.ErrTimeout) {
+					// Disconnected, the client is reconnecting
+					select {
+					case <-ctx.Done():
+					case <-time.After(time.Second):
+					}
+				}
+
+				for _, msg := range msgs {
+					headers := fromNatsHeader(msg.Header)
+					err := handler(ExtractAmqpTraceHeader(headers), msg.Data, headers)
+					if err != nil {
+						b.retryOrDeadLetter(js, queue, msg, err)
+						continue
+					}
+					msg.Ack()
+				}
+			}
+		}()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	timeout := time.NewTimer(b.DrainTimeout)
+	defer timeout.Stop()
+	select {
+	case <-drained:
+		return nil
+	case <-timeout.C:
+		return ErrDrainTimeout
+	}
+}
+
+// Walk the dead-letter stream of the queue oldest first, until visit returns false
+func (b *NatsBus) walkDeadLetters(queue string, visit func(js nats.JetStreamContext, msg *nats.RawStreamMsg) (bool, error)) error {
+	js, err := b.js()
+	if err != nil {
+		return err
+	}
+	err = b.ensureDeadQueue(js, queue)
+	if err != nil {
+		return err
+	}
+
+	info, err := js.StreamInfo(natsDeadStreamName(queue))
+	if err != nil {
+		return err
+	}
+
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq && info.State.Msgs > 0; seq++ {
+		msg, err := js.GetMsg(natsDeadStreamName(queue), seq)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		more, err := visit(js, msg)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *NatsBus) DeadLetters(queue string, limit int) ([]DeadLetter, error) {
+	deadLetters := []DeadLetter{}
+	err := b.walkDeadLetters(queue, func(js nats.JetStreamContext, msg *nats.RawStreamMsg) (bool, error) {
+		headers := fromNatsHeader(msg.Header)
+		deadLetter := toDeadLetter(queue, amqp.Delivery{Body: msg.Data, Headers: headers})
+		fmt.Sscan(msg.Header.Get(AttemptHeader), &deadLetter.Attempts)
+		fmt.Sscan(msg.Header.Get(FailedAtHeader), &deadLetter.FailedAt)
+
+		deadLetters = append(deadLetters, deadLetter)
+		return len(deadLetters) < limit, nil
+	})
+	return deadLetters, err
+}
+
+func (b *NatsBus) ReplayDeadLetters(queue string, limit int) (int, error) {
+	replayed := 0
+	err := b.walkDeadLetters(queue, func(js nats.JetStreamContext, msg *nats.RawStreamMsg) (bool, error) {
+		header := nats.Header{}
+		for key, values := range msg.Header {
+			header[key] = values
+		}
+		header.Del(AttemptHeader)
+		header.Del(LastErrorHeader)
+		header.Del(FailedAtHeader)
+
+		err := b.ensureQueue(js, queue)
+		if err != nil {
+			return false, err
+		}
+		err = b.publish(queue, msg.Data, header)
+		if err != nil {
+			return false, err
+		}
+
+		err = js.DeleteMsg(natsDeadStreamName(queue), msg.Sequence)
+		if err != nil {
+			return false, err
+		}
+		replayed++
+		return replayed < limit, nil
+	})
+	return replayed, err
+}
+
+func (b *NatsBus) PurgeDeadLetters(queue string) (int, error) {
+	js, err := b.js()
+	if err != nil {
+		return 0, err
+	}
+	err = b.ensureDeadQueue(js, queue)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := js.StreamInfo(natsDeadStreamName(queue))
+	if err != nil {
+		return 0, err
+	}
+	return int(info.State.Msgs), js.PurgeStream(natsDeadStreamName(queue))
+}
+
+func (b *NatsBus) Close() error {
+	b.mutex.Lock()
+	connection := b.connection
+	b.closed = true
+	b.mutex.Unlock()
+
+	if connection != nil {
+		connection.Close()
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: lru/v1/mapper.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	MapperService_Map_FullMethodName        = "/lru.v1.MapperService/Map"
+	MapperService_GetLink_FullMethodName    = "/lru.v1.MapperService/GetLink"
+	MapperService_UpdateLink_FullMethodName = "/lru.v1.MapperService/UpdateLink"
+	MapperService_DeleteLink_FullMethodName = "/lru.v1.MapperService/DeleteLink"
+)
+
+// MapperServiceClient is the client API for MapperService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MapperServiceClient interface {
+	// Shorten a url
+	Map(ctx context.Context, in *MapRequest, opts ...grpc.CallOption) (*MapResponse, error)
+	// Manage the link of an owner, any link when the owner is empty
+	GetLink(ctx context.Context, in *LinkRef, opts ...grpc.CallOption) (*Link, error)
+	UpdateLink(ctx context.Context, in *UpdateLinkRequest, opts ...grpc.CallOption) (*Link, error)
+	DeleteLink(ctx context.Context, in *LinkRef, opts ...grpc.CallOption) (*DeleteLinkResponse, error)
+}
+
+type mapperServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMapperServiceClient(cc grpc.ClientConnInterface) MapperServiceClient {
+	return &mapperServiceClient{cc}
+}
+
+func (c *mapperServiceClient) Map(ctx context.Context, in *MapRequest, opts ...grpc.CallOption) (*MapResponse, error) {
+	out := new(MapResponse)
+	err := c.cc.Invoke(ctx, MapperService_Map_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mapperServiceClient) GetLink(ctx context.Context, in *LinkRef, opts ...grpc.CallOption) (*Link, error) {
+	out := new(Link)
+	err := c.cc.Invoke(ctx, MapperService_GetLink_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mapperServiceClient) UpdateLink(ctx context.Context, in *UpdateLinkRequest, opts ...grpc.CallOption) (*Link, error) {
+	out := new(Link)
+	err := c.cc.Invoke(ctx, MapperService_UpdateLink_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mapperServiceClient) DeleteLink(ctx context.Context, in *LinkRef, opts ...grpc.CallOption) (*DeleteLinkResponse, error) {
+	out := new(DeleteLinkResponse)
+	err := c.cc.Invoke(ctx, MapperService_DeleteLink_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MapperServiceServer is the server API for MapperService service.
+// All implementations must embed UnimplementedMapperServiceServer
+// for forward compatibility
+type MapperServiceServer interface {
+	// Shorten a url
+	Map(context.Context, *MapRequest) (*MapResponse, error)
+	// Manage the link of an owner, any link when the owner is empty
+	GetLink(context.Context, *LinkRef) (*Link, error)
+	UpdateLink(context.Context, *UpdateLinkRequest) (*Link, error)
+	DeleteLink(context.Context, *LinkRef) (*DeleteLinkResponse, error)
+	mustEmbedUnimplementedMapperServiceServer()
+}
+
+// UnimplementedMapperServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedMapperServiceServer struct {
+}
+
+func (UnimplementedMapperServiceServer) Map(context.Context, *MapRequest) (*MapResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Map not implemented")
+}
+func (UnimplementedMapperServiceServer) GetLink(context.Context, *LinkRef) (*Link, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetLink not implemented")
+}
+func (UnimplementedMapperServiceServer) UpdateLink(context.Context, *UpdateLinkRequest) (*Link, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateLink not implemented")
+}
+func (UnimplementedMapperServiceServer) DeleteLink(context.Context, *LinkRef) (*DeleteLinkResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteLink not implemented")
+}
+func (UnimplementedMapperServiceServer) mustEmbedUnimplementedMapperServiceServer() {}
+
+// UnsafeMapperServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MapperServiceServer will
+// result in compilation errors.
+type UnsafeMapperServiceServer interface {
+	mustEmbedUnimplementedMapperServiceServer()
+}
+
+func RegisterMapperServiceServer(s grpc.ServiceRegistrar, srv MapperServiceServer) {
+	s.RegisterService(&MapperService_ServiceDesc, srv)
+}
+
+func _MapperService_Map_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MapRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MapperServiceServer).Map(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MapperService_Map_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MapperServiceServer).Map(ctx, req.(*MapRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MapperService_GetLink_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LinkRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MapperServiceServer).GetLink(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MapperService_GetLink_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MapperServiceServer).GetLink(ctx, req.(*LinkRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MapperService_UpdateLink_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateLinkRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MapperServiceServer).UpdateLink(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MapperService_UpdateLink_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MapperServiceServer).UpdateLink(ctx, req.(*UpdateLinkRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MapperService_DeleteLink_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LinkRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MapperServiceServer).DeleteLink(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MapperService_DeleteLink_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MapperServiceServer).DeleteLink(ctx, req.(*LinkRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// MapperService_ServiceDesc is the grpc.ServiceDesc for MapperService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MapperService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "lru.v1.MapperService",
+	HandlerType: (*MapperServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Map",
+			Handler:    _MapperService_Map_Handler,
+		},
+		{
+			MethodName: "GetLink",
+			Handler:    _MapperService_GetLink_Handler,
+		},
+		{
+			MethodName: "UpdateLink",
+			Handler:    _MapperService_UpdateLink_Handler,
+		},
+		{
+			MethodName: "DeleteLink",
+			Handler:    _MapperService_DeleteLink_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "lru/v1/mapper.proto",
+}
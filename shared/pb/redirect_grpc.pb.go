@@ -0,0 +1,150 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: lru/v1/redirect.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	RedirectService_Resolve_FullMethodName  = "/lru.v1.RedirectService/Resolve"
+	RedirectService_Redirect_FullMethodName = "/lru.v1.RedirectService/Redirect"
+)
+
+// RedirectServiceClient is the client API for RedirectService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RedirectServiceClient interface {
+	// Find the target of a short code, counting the click of click-limited links
+	Resolve(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*RedirectTarget, error)
+	// Find the target of a short url
+	Redirect(ctx context.Context, in *RedirectRequest, opts ...grpc.CallOption) (*RedirectTarget, error)
+}
+
+type redirectServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRedirectServiceClient(cc grpc.ClientConnInterface) RedirectServiceClient {
+	return &redirectServiceClient{cc}
+}
+
+func (c *redirectServiceClient) Resolve(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*RedirectTarget, error) {
+	out := new(RedirectTarget)
+	err := c.cc.Invoke(ctx, RedirectService_Resolve_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *redirectServiceClient) Redirect(ctx context.Context, in *RedirectRequest, opts ...grpc.CallOption) (*RedirectTarget, error) {
+	out := new(RedirectTarget)
+	err := c.cc.Invoke(ctx, RedirectService_Redirect_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RedirectServiceServer is the server API for RedirectService service.
+// All implementations must embed UnimplementedRedirectServiceServer
+// for forward compatibility
+type RedirectServiceServer interface {
+	// Find the target of a short code, counting the click of click-limited links
+	Resolve(context.Context, *ResolveRequest) (*RedirectTarget, error)
+	// Find the target of a short url
+	Redirect(context.Context, *RedirectRequest) (*RedirectTarget, error)
+	mustEmbedUnimplementedRedirectServiceServer()
+}
+
+// UnimplementedRedirectServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedRedirectServiceServer struct {
+}
+
+func (UnimplementedRedirectServiceServer) Resolve(context.Context, *ResolveRequest) (*RedirectTarget, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Resolve not implemented")
+}
+func (UnimplementedRedirectServiceServer) Redirect(context.Context, *RedirectRequest) (*RedirectTarget, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Redirect not implemented")
+}
+func (UnimplementedRedirectServiceServer) mustEmbedUnimplementedRedirectServiceServer() {}
+
+// UnsafeRedirectServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RedirectServiceServer will
+// result in compilation errors.
+type UnsafeRedirectServiceServer interface {
+	mustEmbedUnimplementedRedirectServiceServer()
+}
+
+func RegisterRedirectServiceServer(s grpc.ServiceRegistrar, srv RedirectServiceServer) {
+	s.RegisterService(&RedirectService_ServiceDesc, srv)
+}
+
+func _RedirectService_Resolve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RedirectServiceServer).Resolve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RedirectService_Resolve_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RedirectServiceServer).Resolve(ctx, req.(*ResolveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RedirectService_Redirect_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RedirectRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RedirectServiceServer).Redirect(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RedirectService_Redirect_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RedirectServiceServer).Redirect(ctx, req.(*RedirectRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// RedirectService_ServiceDesc is the grpc.ServiceDesc for RedirectService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RedirectService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "lru.v1.RedirectService",
+	HandlerType: (*RedirectServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Resolve",
+			Handler:    _RedirectService_Resolve_Handler,
+		},
+		{
+			MethodName: "Redirect",
+			Handler:    _RedirectService_Redirect_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "lru/v1/redirect.proto",
+}
@@ -1,6 +1,7 @@
 package shared
 
 import (
+	"errors"
 	"os"
 
 	"gorm.io/driver/postgres"
@@ -33,7 +34,10 @@ func NewPostgresDB(connectionString string) *PostgresDB {
 
 func (db *PostgresDB) Init() error {
 
-	gdb, err := gorm.Open(postgres.Open(db.ConnectionString), &gorm.Config{})
+	gdb, err := gorm.Open(postgres.Open(db.ConnectionString), &gorm.Config{
+		// Translate driver errors into gorm errors (e.g. gorm.ErrDuplicatedKey)
+		TranslateError: true,
+	})
 	if err != nil {
 		return err
 	}
@@ -93,3 +97,8 @@ func (db *PostgresDB) CountTable(model interface{}) (int64, error) {
 	}
 	return count, nil
 }
+
+// Check if the error is caused by a unique constraint violation
+func IsDuplicateKeyError(err error) bool {
+	return errors.Is(err, gorm.ErrDuplicatedKey)
+}
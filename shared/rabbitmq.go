@@ -3,18 +3,114 @@ package shared
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"go.opentelemetry.io/otel/propagation"
 )
 
+var (
+	ErrRabbitMQClosed    = errors.New("rabbitmq client is closed")
+	ErrNotConnected      = errors.New("not connected to rabbitmq")
+	ErrConfirmTimeout    = errors.New("rabbitmq did not confirm the message in time")
+	ErrPublishNacked     = errors.New("rabbitmq refused the message")
+	ErrMessageUnroutable = errors.New("message was returned as unroutable")
+	ErrDrainTimeout      = errors.New("consumer did not drain in time")
+)
+
+// What the client needs from an AMQP connection, *amqp.Connection in production
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// What the client needs from an AMQP channel, *amqp.Channel in production
+type amqpChannel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(returns chan amqp.Return) chan amqp.Return
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Cancel(consumer string, noWait bool) error
+	QueuePurge(name string, noWait bool) (int, error)
+	IsClosed() bool
+	Close() error
+}
+
+type amqpConnectionAdapter struct {
+	*amqp.Connection
+}
+
+func (c amqpConnectionAdapter) Channel() (amqpChannel, error) {
+	channel, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+func dialAmqp(connectionString string) (amqpConnection, error) {
+	connection, err := amqp.Dial(connectionString)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnectionAdapter{connection}, nil
+}
+
+// A channel in confirm mode, used by one publisher at a time
+type publisherChannel struct {
+	channel  amqpChannel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	declared map[string]bool
+}
+
+// RabbitMQ client that survives broker restarts.
+//
+// A supervisor redials with an exponential backoff as soon as the connection reports
+// it is closed. Publishers share a pool of long-lived channels in confirm mode: a
+// publish returns once the broker confirmed the message, and messages the broker
+// cannot route are returned as errors instead of being dropped.
 type RabbitMQ struct {
 	connectionString string
-	connection       *amqp.Connection
 	ctx              context.Context
+
+	// First wait before redialing, doubled after each failure up to MaxReconnectDelay
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+	// How long a publish waits for the broker to confirm the message
+	ConfirmTimeout time.Duration
+	// How long a publish waits for a connection and a free channel
+	PublishTimeout time.Duration
+	// Unacked messages a consumer channel holds, 0 for twice its workers
+	Prefetch int
+	// How long a cancelled consumer waits for the messages in flight
+	DrainTimeout time.Duration
+
+	dial func(connectionString string) (amqpConnection, error)
+
+	mutex      sync.Mutex
+	connection amqpConnection
+	connected  chan struct{} // Closed once connection is set, replaced when it is lost
+
+	retryPolicies map[string]RetryPolicy
+	queueArgs     map[string]amqp.Table // Declare arguments of the delay queues
+
+	slots     chan struct{} // One per publisher channel, RABBITMQ_POOL_SIZE of them
+	idle      chan *publisherChannel
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func getRabbitConnectionString() string {
@@ -24,103 +120,472 @@ func getRabbitConnectionString() string {
 	return fmt.Sprintf("amqp://guest:guest@%v:%v/", rabbitHost, rabbitPort)
 }
 
+// Build a client, tuned with RABBITMQ_POOL_SIZE (default 4), RABBITMQ_CONFIRM_TIMEOUT
+// (default 5s), RABBITMQ_PUBLISH_TIMEOUT (default 10s), RABBITMQ_PREFETCH (default twice
+// the workers of a consumer) and RABBITMQ_DRAIN_TIMEOUT (default 30s)
 func NewRabbitMQ(connectionString string) *RabbitMQ {
 	if connectionString == "" {
 		connectionString = getRabbitConnectionString()
 	}
+
+	poolSize := GetEnvInt("RABBITMQ_POOL_SIZE", 4)
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
 	return &RabbitMQ{
-		connectionString: connectionString,
-		ctx:              context.Background(),
+		connectionString:  connectionString,
+		ctx:               context.Background(),
+		MinReconnectDelay: 500 * time.Millisecond,
+		MaxReconnectDelay: 30 * time.Second,
+		ConfirmTimeout:    GetEnvDuration("RABBITMQ_CONFIRM_TIMEOUT", 5*time.Second),
+		PublishTimeout:    GetEnvDuration("RABBITMQ_PUBLISH_TIMEOUT", 10*time.Second),
+		Prefetch:          GetEnvInt("RABBITMQ_PREFETCH", 0),
+		DrainTimeout:      GetEnvDuration("RABBITMQ_DRAIN_TIMEOUT", 30*time.Second),
+		dial:              dialAmqp,
+		connected:         make(chan struct{}),
+		retryPolicies:     map[string]RetryPolicy{},
+		queueArgs:         map[string]amqp.Table{},
+		slots:             make(chan struct{}, poolSize),
+		idle:              make(chan *publisherChannel, poolSize),
+		closed:            make(chan struct{}),
 	}
 }
 
+// Dial the broker after the delay and keep the connection up until Close.
+// When the first dial fails its error is returned and the client keeps retrying in the
+// background: publishes wait for the connection up to PublishTimeout.
 func (r *RabbitMQ) Connect(delay time.Duration) error {
 	if delay > 0 {
 		time.Sleep(delay)
 	}
 
-	connection, err := amqp.Dial(r.connectionString)
-	if err != nil {
-		return err
+	connection, err := r.dial(r.connectionString)
+	if err == nil {
+		r.setConnection(connection)
 	}
 
+	go r.superviseConnection(connection)
+	return err
+}
+
+func (r *RabbitMQ) setConnection(connection amqpConnection) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 	r.connection = connection
-	return nil
+	close(r.connected)
+}
+
+func (r *RabbitMQ) loseConnection() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.connection = nil
+	r.connected = make(chan struct{})
+}
+
+// Wait for the connection to close and dial again, until Close
+func (r *RabbitMQ) superviseConnection(connection amqpConnection) {
+	for {
+		if connection == nil {
+			connection = r.redial()
+			if connection == nil {
+				return
+			}
+			r.setConnection(connection)
+		}
+
+		closeNotification := connection.NotifyClose(make(chan *amqp.Error, 1))
+		select {
+		case <-closeNotification:
+		case <-r.closed:
+			return
+		}
+
+		r.loseConnection()
+		connection = nil
+	}
+}
+
+// Dial until it works, waiting longer after each failure. Nil once the client is closed.
+func (r *RabbitMQ) redial() amqpConnection {
+	delay := r.MinReconnectDelay
+	for {
+		select {
+		case <-r.closed:
+			return nil
+		case <-time.After(delay):
+		}
+
+		connection, err := r.dial(r.connectionString)
+		if err == nil {
+			return connection
+		}
+
+		delay *= 2
+		if delay > r.MaxReconnectDelay {
+			delay = r.MaxReconnectDelay
+		}
+	}
+}
+
+// Return the open connection, waiting for the supervisor to bring it back if needed
+func (r *RabbitMQ) waitConnection(ctx context.Context) (amqpConnection, error) {
+	for {
+		r.mutex.Lock()
+		connection := r.connection
+		connected := r.connected
+		r.mutex.Unlock()
+
+		if connection != nil && !connection.IsClosed() {
+			return connection, nil
+		}
+
+		// A closed connection is replaced as soon as the supervisor notices it
+		wait := connected
+		if connection != nil {
+			wait = nil
+		}
+
+		select {
+		case <-wait:
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %v", ErrNotConnected, ctx.Err())
+		case <-r.closed:
+			return nil, ErrRabbitMQClosed
+		}
+	}
 }
 
 func (r *RabbitMQ) Close() error {
-	return r.connection.Close()
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+
+	for {
+		select {
+		case publisher := <-r.idle:
+			publisher.channel.Close()
+			continue
+		default:
+		}
+		break
+	}
+
+	r.mutex.Lock()
+	connection := r.connection
+	r.mutex.Unlock()
+	if connection == nil || connection.IsClosed() {
+		return nil
+	}
+	return connection.Close()
 }
 
-func (r *RabbitMQ) Publish(queue string, message interface{}, headers amqp.Table) error {
-	if r.connection.IsClosed() {
-		r.Connect(0)
+func newPublisherChannel(connection amqpConnection) (*publisherChannel, error) {
+	channel, err := connection.Channel()
+	if err != nil {
+		return nil, err
 	}
 
-	channel, err := r.connection.Channel()
+	err = channel.Confirm(false)
 	if err != nil {
-		return err
+		channel.Close()
+		return nil, err
 	}
 
-	defer channel.Close()
+	// A single message is in flight per channel, one slot is enough
+	return &publisherChannel{
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, 1)),
+		declared: map[string]bool{},
+	}, nil
+}
 
-	_, err = channel.QueueDeclare(queue, true, false, false, false, nil)
+// Take a channel of the pool, or open one while the pool is not full
+func (r *RabbitMQ) acquire(ctx context.Context) (*publisherChannel, error) {
+	select {
+	case r.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: no free channel: %v", ErrNotConnected, ctx.Err())
+	case <-r.closed:
+		return nil, ErrRabbitMQClosed
+	}
+
+	for {
+		select {
+		case publisher := <-r.idle:
+			if publisher.channel.IsClosed() {
+				continue
+			}
+			return publisher, nil
+		default:
+		}
+		break
+	}
+
+	connection, err := r.waitConnection(ctx)
+	if err != nil {
+		<-r.slots
+		return nil, err
+	}
+
+	publisher, err := newPublisherChannel(connection)
+	if err != nil {
+		<-r.slots
+		return nil, err
+	}
+	return publisher, nil
+}
+
+// Give the channel back to the pool, or close it when its state is unknown
+func (r *RabbitMQ) release(publisher *publisherChannel, healthy bool) {
+	if healthy && !publisher.channel.IsClosed() {
+		select {
+		case r.idle <- publisher:
+		default:
+			publisher.channel.Close()
+		}
+	} else {
+		publisher.channel.Close()
+	}
+	<-r.slots
+}
+
+// Publish the body and wait for the broker to confirm it
+func (r *RabbitMQ) publishOn(ctx context.Context, publisher *publisherChannel, queue string, body []byte, headers amqp.Table) error {
+	if !publisher.declared[queue] {
+		_, err := publisher.channel.QueueDeclare(queue, true, false, false, false, r.queueArguments(queue))
+		if err != nil {
+			return err
+		}
+		publisher.declared[queue] = true
+	}
+
+	err := publisher.channel.PublishWithContext(ctx, "", queue, true, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+		Headers:      headers,
+	})
 	if err != nil {
 		return err
 	}
 
-	body, err := json.Marshal(message)
+	// The broker sends the return of an unroutable message before its confirmation
+	timeout := time.NewTimer(r.ConfirmTimeout)
+	defer timeout.Stop()
+
+	var returned *amqp.Return
+	returns := publisher.returns
+	for {
+		select {
+		case message, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			returned = &message
+		case confirmation, ok := <-publisher.confirms:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			if returned == nil {
+				select {
+				case message, ok := <-returns:
+					if ok {
+						returned = &message
+					}
+				default:
+				}
+			}
+			if !confirmation.Ack {
+				return ErrPublishNacked
+			}
+			if returned != nil {
+				return fmt.Errorf("%w: %d %s", ErrMessageUnroutable, returned.ReplyCode, returned.ReplyText)
+			}
+			return nil
+		case <-timeout.C:
+			return ErrConfirmTimeout
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Channel errors mean the channel can still be used for the next message
+func isPublishOutcome(err error) bool {
+	return err == nil || errors.Is(err, ErrPublishNacked) || errors.Is(err, ErrMessageUnroutable)
+}
+
+// Publish the message as JSON to the queue and wait for the broker to confirm it
+func (r *RabbitMQ) Publish(queue string, message interface{}, headers amqp.Table) error {
+	return r.PublishBatch(queue, []interface{}{message}, headers)
+}
+
+// Publish several messages to the same queue over a single channel, each one confirmed
+// before the next is sent
+func (r *RabbitMQ) PublishBatch(queue string, messages []interface{}, headers amqp.Table) error {
+	ctx, cancel := context.WithTimeout(r.ctx, r.PublishTimeout)
+	defer cancel()
+
+	publisher, err := r.acquire(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = channel.PublishWithContext(r.ctx, "", queue, true, false, amqp.Publishing{
-		ContentType: "application/json",
-		Body:        body,
-		Headers:     headers,
-	})
+	healthy := true
+	defer func() {
+		r.release(publisher, healthy)
+	}()
+
+	for _, message := range messages {
+		body, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
 
+		err = r.publishOn(ctx, publisher, queue, body, headers)
+		if err != nil {
+			healthy = isPublishOutcome(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Publish an already encoded body and wait for the broker to confirm it
+func (r *RabbitMQ) PublishRaw(queue string, body []byte, headers amqp.Table) error {
+	ctx, cancel := context.WithTimeout(r.ctx, r.PublishTimeout)
+	defer cancel()
+
+	publisher, err := r.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = r.publishOn(ctx, publisher, queue, body, headers)
+	r.release(publisher, isPublishOutcome(err))
 	return err
 }
 
-func (r *RabbitMQ) Consume(queue string, callback func(body []byte, headers amqp.Table) error, numberOfWorker int) error {
-	if r.connection.IsClosed() {
-		r.Connect(0)
+// Handle a consumed message. ctx carries the trace of the publisher and is not cancelled
+// by the shutdown: a handler in flight is left to finish.
+type ConsumeHandler func(ctx context.Context, body []byte, headers amqp.Table) error
+
+// Tells consumers apart on a connection, the tag is needed to cancel them
+var consumerSeq uint64
+
+// Consume the queue with several workers until ctx is cancelled or the client is closed,
+// subscribing again after each reconnection. A message is acked once the handler succeeds.
+// When it fails the message is retried later following the retry policy of the queue,
+// see SetRetryPolicy.
+//
+// Once ctx is cancelled no new message is taken and Consume returns when the messages
+// in flight are handled. Those still running after DrainTimeout are left unacked, the
+// broker delivers them again, and ErrDrainTimeout is returned.
+func (r *RabbitMQ) Consume(ctx context.Context, queue string, handler ConsumeHandler, numberOfWorker int) error {
+	for {
+		err := r.consumeOnce(ctx, queue, handler, numberOfWorker)
+		if errors.Is(err, ErrDrainTimeout) {
+			return err
+		}
+		if errors.Is(err, ErrRabbitMQClosed) || ctx.Err() != nil {
+			return nil
+		}
+
+		select {
+		case <-r.closed:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.MinReconnectDelay):
+		}
 	}
+}
+
+// Messages a consumer channel gets ahead of its workers: Prefetch, or twice the workers
+func (r *RabbitMQ) prefetch(numberOfWorker int) int {
+	if r.Prefetch > 0 {
+		return r.Prefetch
+	}
+	return 2 * numberOfWorker
+}
 
-	channel, err := r.connection.Channel()
+// Consume until the channel closes or ctx is cancelled
+func (r *RabbitMQ) consumeOnce(ctx context.Context, queue string, handler ConsumeHandler, numberOfWorker int) error {
+	connection, err := r.waitConnection(ctx)
 	if err != nil {
 		return err
 	}
+
+	channel, err := connection.Channel()
+	if err != nil {
+		return err
+	}
+	// Closing the channel requeues the messages that were not acked
 	defer channel.Close()
 
-	_, err = channel.QueueDeclare(queue, true, false, false, false, nil)
+	err = channel.Qos(r.prefetch(numberOfWorker), 0, false)
 	if err != nil {
 		return err
 	}
 
-	forever := make(chan bool)
+	_, err = channel.QueueDeclare(queue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
 
-	msgs, err := channel.Consume(queue, "", false, false, false, false, nil)
+	consumerTag := fmt.Sprintf("%s.%d.%d", queue, os.Getpid(), atomic.AddUint64(&consumerSeq, 1))
+	msgs, err := channel.Consume(queue, consumerTag, false, false, false, false, nil)
 	if err != nil {
 		return err
 	}
 
+	var workers sync.WaitGroup
 	for i := 0; i < numberOfWorker; i++ {
+		workers.Add(1)
 		go func() {
+			defer workers.Done()
 			for d := range msgs {
-				err := callback(d.Body, d.Headers)
+				err := handler(ExtractAmqpTraceHeader(d.Headers), d.Body, d.Headers)
 				if err != nil {
-					d.Nack(false, true)
+					r.retryOrDeadLetter(queue, d, err)
+					continue
 				}
 				d.Ack(false)
 			}
 		}()
 	}
 
-	<-forever
+	drained := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(drained)
+	}()
 
-	return nil
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// The broker stops delivering and msgs closes once the workers took what they had
+	err = channel.Cancel(consumerTag, false)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(r.DrainTimeout)
+	defer timeout.Stop()
+	select {
+	case <-drained:
+		return nil
+	case <-timeout.C:
+		return ErrDrainTimeout
+	}
 }
 
 type AmqpHeadersCarrier amqp.Table
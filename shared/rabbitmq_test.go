@@ -0,0 +1,1048 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// In-process broker speaking the subset of AMQP the client uses
+type fakeBroker struct {
+	mutex sync.Mutex
+	// Messages published to each queue and not delivered to a consumer yet
+	queues    map[string][]amqp.Publishing
+	consumers map[string][]*fakeChannel
+	// Arguments each queue was declared with and messages that went through delay queues
+	queueArgs map[string]amqp.Table
+	delayed   map[string]int
+	// Queues the broker cannot route to, messages sent there are returned
+	unroutable map[string]bool
+	// Dials failing before one succeeds
+	failDials      int
+	dials          int
+	channelsOpened int
+	nack           bool
+	holdConfirms   bool
+	connections    []*fakeConnection
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		queues:     map[string][]amqp.Publishing{},
+		consumers:  map[string][]*fakeChannel{},
+		queueArgs:  map[string]amqp.Table{},
+		delayed:    map[string]int{},
+		unroutable: map[string]bool{},
+	}
+}
+
+func (b *fakeBroker) dial(connectionString string) (amqpConnection, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.dials++
+	if b.failDials > 0 {
+		b.failDials--
+		return nil, errors.New("connection refused")
+	}
+
+	connection := &fakeConnection{broker: b}
+	b.connections = append(b.connections, connection)
+	return connection, nil
+}
+
+// Drop every connection, as a broker restart does
+func (b *fakeBroker) kill() {
+	b.mutex.Lock()
+	connections := b.connections
+	b.connections = nil
+	b.mutex.Unlock()
+
+	for _, connection := range connections {
+		connection.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "broker restart"})
+	}
+}
+
+func (b *fakeBroker) stats() (dials int, channelsOpened int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.dials, b.channelsOpened
+}
+
+func (b *fakeBroker) queued(queue string) []amqp.Publishing {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]amqp.Publishing(nil), b.queues[queue]...)
+}
+
+func (b *fakeBroker) delayedCount(queue string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.delayed[queue]
+}
+
+// Hand the message to a consumer of the queue or store it. Messages sent to a queue with
+// a TTL are dead-lettered to its routing key once it expires. Called with the mutex held.
+func (b *fakeBroker) route(queue string, msg amqp.Publishing) {
+	if ttl, ok := b.queueArgs[queue]["x-message-ttl"].(int64); ok {
+		b.delayed[queue]++
+		target := b.queueArgs[queue]["x-dead-letter-routing-key"].(string)
+		time.AfterFunc(time.Duration(ttl)*time.Millisecond, func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			b.route(target, msg)
+		})
+		return
+	}
+
+	if consumers := b.consumers[queue]; len(consumers) > 0 {
+		consumers[0].deliver(queue, msg)
+	} else {
+		b.queues[queue] = append(b.queues[queue], msg)
+	}
+}
+
+func (b *fakeBroker) removeConsumer(ch *fakeChannel) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for queue, consumers := range b.consumers {
+		for i, consumer := range consumers {
+			if consumer == ch {
+				b.consumers[queue] = append(consumers[:i], consumers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Put an unacked message back at the head of its queue. Called with the mutex held.
+func (b *fakeBroker) requeue(queue string, msg amqp.Publishing) {
+	if consumers := b.consumers[queue]; len(consumers) > 0 {
+		consumers[0].deliver(queue, msg)
+	} else {
+		b.queues[queue] = append([]amqp.Publishing{msg}, b.queues[queue]...)
+	}
+}
+
+type fakeConnection struct {
+	broker    *fakeBroker
+	mutex     sync.Mutex
+	closed    bool
+	listeners []chan *amqp.Error
+	channels  []*fakeChannel
+}
+
+func (c *fakeConnection) Channel() (amqpChannel, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	channel := &fakeChannel{connection: c}
+	c.channels = append(c.channels, channel)
+
+	c.broker.mutex.Lock()
+	c.broker.channelsOpened++
+	c.broker.mutex.Unlock()
+	return channel, nil
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.listeners = append(c.listeners, receiver)
+	return receiver
+}
+
+func (c *fakeConnection) IsClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *fakeConnection) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *fakeConnection) shutdown(reason *amqp.Error) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	c.closed = true
+	listeners := c.listeners
+	channels := c.channels
+	c.mutex.Unlock()
+
+	for _, channel := range channels {
+		channel.Close()
+	}
+	for _, listener := range listeners {
+		if reason != nil {
+			listener <- reason
+		}
+		close(listener)
+	}
+}
+
+type fakeChannel struct {
+	connection *fakeConnection
+	mutex      sync.Mutex
+	closed     bool
+	tag        uint64
+	confirms   []chan amqp.Confirmation
+	returns    []chan amqp.Return
+	listeners  []chan *amqp.Error
+	deliveries chan amqp.Delivery
+	consumer   string
+	prefetch   int
+
+	// Messages delivered and not acked yet, requeued when the channel closes
+	ackMutex    sync.Mutex
+	deliveryTag uint64
+	unacked     map[uint64]unackedMessage
+}
+
+type unackedMessage struct {
+	queue string
+	msg   amqp.Publishing
+}
+
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if ch.IsClosed() {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+
+	broker := ch.connection.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+	if args != nil {
+		broker.queueArgs[name] = args
+	}
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (ch *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *fakeChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.returns = append(ch.returns, returns)
+	return returns
+}
+
+func (ch *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.listeners = append(ch.listeners, receiver)
+	return receiver
+}
+
+func (ch *fakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+
+	broker := ch.connection.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	ch.tag++
+	if broker.unroutable[key] {
+		for _, returns := range ch.returns {
+			returns <- amqp.Return{ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE", RoutingKey: key, Body: msg.Body}
+		}
+	} else if !broker.nack {
+		broker.route(key, msg)
+	}
+
+	if !broker.holdConfirms {
+		for _, confirms := range ch.confirms {
+			confirms <- amqp.Confirmation{DeliveryTag: ch.tag, Ack: !broker.nack}
+		}
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+
+	broker := ch.connection.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	ch.deliveries = make(chan amqp.Delivery, 100)
+	ch.consumer = consumer
+	for _, msg := range broker.queues[queue] {
+		ch.deliver(queue, msg)
+	}
+	broker.queues[queue] = nil
+	broker.consumers[queue] = append(broker.consumers[queue], ch)
+	return ch.deliveries, nil
+}
+
+func (ch *fakeChannel) deliver(queue string, msg amqp.Publishing) {
+	ch.deliveries <- ch.track(queue, msg)
+}
+
+func (ch *fakeChannel) track(queue string, msg amqp.Publishing) amqp.Delivery {
+	ch.ackMutex.Lock()
+	defer ch.ackMutex.Unlock()
+	if ch.unacked == nil {
+		ch.unacked = map[uint64]unackedMessage{}
+	}
+	ch.deliveryTag++
+	ch.unacked[ch.deliveryTag] = unackedMessage{queue: queue, msg: msg}
+	return amqp.Delivery{Acknowledger: ch, DeliveryTag: ch.deliveryTag, Body: msg.Body, Headers: msg.Headers}
+}
+
+func (ch *fakeChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	if ch.IsClosed() {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+
+	broker := ch.connection.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	if len(broker.queues[queue]) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	msg := broker.queues[queue][0]
+	broker.queues[queue] = broker.queues[queue][1:]
+
+	d := ch.track(queue, msg)
+	if autoAck {
+		ch.Ack(d.DeliveryTag, false)
+	}
+	return d, true, nil
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+// Stop delivering to the consumer and close its deliveries, as the broker does
+func (ch *fakeChannel) Cancel(consumer string, noWait bool) error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if ch.consumer != consumer || ch.deliveries == nil {
+		return nil
+	}
+
+	ch.connection.broker.removeConsumer(ch)
+	close(ch.deliveries)
+	ch.deliveries = nil
+	return nil
+}
+
+func (ch *fakeChannel) QueuePurge(name string, noWait bool) (int, error) {
+	broker := ch.connection.broker
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	purged := len(broker.queues[name])
+	broker.queues[name] = nil
+	return purged, nil
+}
+
+func (ch *fakeChannel) Ack(tag uint64, multiple bool) error {
+	ch.ackMutex.Lock()
+	defer ch.ackMutex.Unlock()
+	delete(ch.unacked, tag)
+	return nil
+}
+
+func (ch *fakeChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	ch.ackMutex.Lock()
+	message, ok := ch.unacked[tag]
+	delete(ch.unacked, tag)
+	ch.ackMutex.Unlock()
+
+	if ok && requeue {
+		broker := ch.connection.broker
+		broker.mutex.Lock()
+		broker.requeue(message.queue, message.msg)
+		broker.mutex.Unlock()
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+func (ch *fakeChannel) IsClosed() bool {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	return ch.closed
+}
+
+func (ch *fakeChannel) Close() error {
+	ch.mutex.Lock()
+	if ch.closed {
+		ch.mutex.Unlock()
+		return nil
+	}
+	ch.closed = true
+	ch.mutex.Unlock()
+
+	ch.ackMutex.Lock()
+	unacked := ch.unacked
+	lastTag := ch.deliveryTag
+	ch.unacked = nil
+	ch.ackMutex.Unlock()
+
+	broker := ch.connection.broker
+	broker.removeConsumer(ch)
+	broker.mutex.Lock()
+	// Requeue newest first so the queue keeps its order
+	for tag := lastTag; tag > 0 && len(unacked) > 0; tag-- {
+		if message, ok := unacked[tag]; ok {
+			broker.requeue(message.queue, message.msg)
+			delete(unacked, tag)
+		}
+	}
+	broker.mutex.Unlock()
+
+	ch.mutex.Lock()
+	if ch.deliveries != nil {
+		close(ch.deliveries)
+		ch.deliveries = nil
+	}
+	ch.mutex.Unlock()
+	for _, confirms := range ch.confirms {
+		close(confirms)
+	}
+	for _, returns := range ch.returns {
+		close(returns)
+	}
+	for _, listener := range ch.listeners {
+		close(listener)
+	}
+	return nil
+}
+
+func newTestRabbitMQ(t *testing.T, broker *fakeBroker) *RabbitMQ {
+	t.Setenv("RABBITMQ_POOL_SIZE", "2")
+	rabbitmq := NewRabbitMQ("amqp://fake")
+	rabbitmq.dial = broker.dial
+	rabbitmq.MinReconnectDelay = 5 * time.Millisecond
+	rabbitmq.MaxReconnectDelay = 20 * time.Millisecond
+	rabbitmq.ConfirmTimeout = 50 * time.Millisecond
+	rabbitmq.PublishTimeout = time.Second
+	t.Cleanup(func() {
+		rabbitmq.Close()
+	})
+	return rabbitmq
+}
+
+func TestPublishConfirmed(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	if err := rabbitmq.Connect(0); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+
+	err := rabbitmq.Publish("redirect", map[string]string{"code": "abc"}, amqp.Table{"traceparent": "00-1"})
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	queued := broker.queued("redirect")
+	if len(queued) != 1 {
+		t.Fatalf("queue has %d messages, want 1", len(queued))
+	}
+	if string(queued[0].Body) != `{"code":"abc"}` || queued[0].Headers["traceparent"] != "00-1" {
+		t.Errorf("unexpected message %s %v", queued[0].Body, queued[0].Headers)
+	}
+	if queued[0].DeliveryMode != amqp.Persistent {
+		t.Errorf("message should be persistent")
+	}
+}
+
+func TestPublishUnroutable(t *testing.T) {
+	broker := newFakeBroker()
+	broker.unroutable["nowhere"] = true
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	err := rabbitmq.Publish("nowhere", "hello", nil)
+	if !errors.Is(err, ErrMessageUnroutable) {
+		t.Fatalf("Publish() error = %v, want ErrMessageUnroutable", err)
+	}
+
+	// The channel is still fine for the next message
+	err = rabbitmq.Publish("redirect", "hello", nil)
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if _, channels := broker.stats(); channels != 1 {
+		t.Errorf("opened %d channels, want 1", channels)
+	}
+}
+
+func TestPublishNacked(t *testing.T) {
+	broker := newFakeBroker()
+	broker.nack = true
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	err := rabbitmq.Publish("redirect", "hello", nil)
+	if !errors.Is(err, ErrPublishNacked) {
+		t.Fatalf("Publish() error = %v, want ErrPublishNacked", err)
+	}
+}
+
+func TestPublishConfirmTimeout(t *testing.T) {
+	broker := newFakeBroker()
+	broker.holdConfirms = true
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	err := rabbitmq.Publish("redirect", "hello", nil)
+	if !errors.Is(err, ErrConfirmTimeout) {
+		t.Fatalf("Publish() error = %v, want ErrConfirmTimeout", err)
+	}
+
+	// A late confirmation would be mistaken for the next one, the channel is replaced
+	broker.mutex.Lock()
+	broker.holdConfirms = false
+	broker.mutex.Unlock()
+	err = rabbitmq.Publish("redirect", "hello", nil)
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if _, channels := broker.stats(); channels != 2 {
+		t.Errorf("opened %d channels, want 2", channels)
+	}
+}
+
+func TestPublishReusesPooledChannels(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rabbitmq.Publish("redirect", "hello", nil); err != nil {
+				t.Errorf("Publish() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, channels := broker.stats(); channels > 2 {
+		t.Errorf("opened %d channels, want at most the pool size 2", channels)
+	}
+	if queued := broker.queued("redirect"); len(queued) != 20 {
+		t.Errorf("queue has %d messages, want 20", len(queued))
+	}
+}
+
+func TestReconnectAfterConnectionLoss(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	if err := rabbitmq.Publish("redirect", "before", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	broker.mutex.Lock()
+	broker.failDials = 2
+	broker.mutex.Unlock()
+	broker.kill()
+
+	if err := rabbitmq.Publish("redirect", "after", nil); err != nil {
+		t.Fatalf("Publish() after restart error = %v", err)
+	}
+
+	// The first dial, two failures with backoff and the successful one
+	if dials, _ := broker.stats(); dials != 4 {
+		t.Errorf("dialed %d times, want 4", dials)
+	}
+	if queued := broker.queued("redirect"); len(queued) != 2 {
+		t.Errorf("queue has %d messages, want 2", len(queued))
+	}
+}
+
+func TestConnectFailureRetriesInBackground(t *testing.T) {
+	broker := newFakeBroker()
+	broker.failDials = 3
+	rabbitmq := newTestRabbitMQ(t, broker)
+
+	if err := rabbitmq.Connect(0); err == nil {
+		t.Fatalf("Connect() should report the failed dial")
+	}
+
+	if err := rabbitmq.Publish("redirect", "hello", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+}
+
+func TestPublishTimesOutWithoutBroker(t *testing.T) {
+	broker := newFakeBroker()
+	broker.failDials = 1000
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.PublishTimeout = 50 * time.Millisecond
+	rabbitmq.Connect(0)
+
+	err := rabbitmq.Publish("redirect", "hello", nil)
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Publish() error = %v, want ErrNotConnected", err)
+	}
+}
+
+func TestPublishAfterClose(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+	rabbitmq.Close()
+
+	err := rabbitmq.Publish("redirect", "hello", nil)
+	if !errors.Is(err, ErrRabbitMQClosed) {
+		t.Fatalf("Publish() error = %v, want ErrRabbitMQClosed", err)
+	}
+}
+
+func TestConsumeResubscribesAfterConnectionLoss(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	received := make(chan string, 10)
+	go rabbitmq.Consume(context.Background(), "analytic", func(ctx context.Context, body []byte, headers amqp.Table) error {
+		received <- string(body)
+		return nil
+	}, 2)
+
+	expectMessage := func(expected string) {
+		t.Helper()
+		select {
+		case body := <-received:
+			if body != expected {
+				t.Errorf("received %s, want %s", body, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("did not receive %s", expected)
+		}
+	}
+
+	if err := rabbitmq.Publish("analytic", "first", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	expectMessage(`"first"`)
+
+	broker.kill()
+
+	if err := rabbitmq.Publish("analytic", "second", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	expectMessage(`"second"`)
+}
+
+func testRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 3, InitialDelay: 5 * time.Millisecond, MaxDelay: 20 * time.Millisecond}
+}
+
+func waitQueued(t *testing.T, broker *fakeBroker, queue string, count int) []amqp.Publishing {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		queued := broker.queued(queue)
+		if len(queued) == count {
+			return queued
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue %s has %d messages, want %d", queue, len(queued), count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, delay := range expected {
+		if got := policy.Delay(i + 1); got != delay {
+			t.Errorf("Delay(%d) = %v, want %v", i+1, got, delay)
+		}
+	}
+	if got := policy.Delay(20); got != policy.MaxDelay {
+		t.Errorf("Delay(20) = %v, want the max delay %v", got, policy.MaxDelay)
+	}
+
+	t.Setenv("ANALYTIC_RETRY_MAX_ATTEMPTS", "8")
+	t.Setenv("ANALYTIC_RETRY_INITIAL_DELAY", "200ms")
+	policy = RetryPolicyFromEnv("analytic")
+	if policy.MaxAttempts != 8 || policy.InitialDelay != 200*time.Millisecond || policy.MaxDelay != 5*time.Minute {
+		t.Errorf("RetryPolicyFromEnv() = %+v", policy)
+	}
+}
+
+func TestConsumeRetriesThenDeadLetters(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.SetRetryPolicy("analytic", testRetryPolicy())
+	rabbitmq.Connect(0)
+
+	attempts := make(chan int, 10)
+	go rabbitmq.Consume(context.Background(), "analytic", func(ctx context.Context, body []byte, headers amqp.Table) error {
+		attempts <- deliveryAttempt(headers)
+		return errors.New("database is down")
+	}, 2)
+
+	if err := rabbitmq.Publish("analytic", "hello", amqp.Table{"traceparent": "00-1"}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	dead := waitQueued(t, broker, DeadLetterQueueName("analytic"), 1)
+	if dead[0].Headers["traceparent"] != "00-1" {
+		t.Errorf("dead letter lost its headers: %v", dead[0].Headers)
+	}
+
+	close(attempts)
+	seen := []int{}
+	for attempt := range attempts {
+		seen = append(seen, attempt)
+	}
+	if len(seen) != 3 || seen[0] != 1 || seen[1] != 2 || seen[2] != 3 {
+		t.Errorf("callback saw attempts %v, want [1 2 3]", seen)
+	}
+
+	policy := testRetryPolicy()
+	for attempt := 1; attempt < policy.MaxAttempts; attempt++ {
+		queue := DelayQueueName("analytic", policy.Delay(attempt))
+		if delayed := broker.delayedCount(queue); delayed != 1 {
+			t.Errorf("%s delayed %d messages, want 1", queue, delayed)
+		}
+	}
+
+	deadLetters, err := rabbitmq.DeadLetters("analytic", 10)
+	if err != nil {
+		t.Fatalf("DeadLetters() error = %v", err)
+	}
+	if len(deadLetters) != 1 {
+		t.Fatalf("DeadLetters() returned %d messages, want 1", len(deadLetters))
+	}
+	deadLetter := deadLetters[0]
+	if deadLetter.Attempts != 3 || deadLetter.Error != "database is down" || string(deadLetter.Payload) != `"hello"` || deadLetter.FailedAt == 0 {
+		t.Errorf("unexpected dead letter %+v", deadLetter)
+	}
+}
+
+func TestIsMessageError(t *testing.T) {
+	_, marshalError := json.Marshal(json.RawMessage("{"))
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("%w: 312 NO_ROUTE", ErrMessageUnroutable), true},
+		{marshalError, true},
+		{ErrNotConnected, false},
+		{ErrConfirmTimeout, false},
+		{ErrBusClosed, false},
+		{context.DeadlineExceeded, false},
+	}
+	for _, test := range tests {
+		if got := IsMessageError(test.err); got != test.want {
+			t.Errorf("IsMessageError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestConsumeRetriesWithDefaultPolicy(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	go rabbitmq.Consume(context.Background(), "analytic", func(ctx context.Context, body []byte, headers amqp.Table) error {
+		return errors.New("database is down")
+	}, 1)
+
+	if err := rabbitmq.Publish("analytic", "hello", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	// The message waits for the TTL of the first delay instead of sitting in a plain queue
+	queue := DelayQueueName("analytic", DefaultRetryPolicy().Delay(1))
+	deadline := time.Now().Add(time.Second)
+	for broker.delayedCount(queue) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s delayed nothing, queued %d messages", queue, len(broker.queued(queue)))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConsumeRetrySucceeds(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.SetRetryPolicy("analytic", testRetryPolicy())
+	rabbitmq.Connect(0)
+
+	received := make(chan int, 10)
+	go rabbitmq.Consume(context.Background(), "analytic", func(ctx context.Context, body []byte, headers amqp.Table) error {
+		attempt := deliveryAttempt(headers)
+		received <- attempt
+		if attempt == 1 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}, 1)
+
+	if err := rabbitmq.Publish("analytic", "hello", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	for _, expected := range []int{1, 2} {
+		select {
+		case attempt := <-received:
+			if attempt != expected {
+				t.Errorf("attempt %d, want %d", attempt, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d was not delivered", expected)
+		}
+	}
+
+	select {
+	case attempt := <-received:
+		t.Errorf("unexpected attempt %d after a success", attempt)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if dead := broker.queued(DeadLetterQueueName("analytic")); len(dead) != 0 {
+		t.Errorf("dead-letter queue has %d messages, want 0", len(dead))
+	}
+}
+
+func TestDeadLettersReplayAndPurge(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	deadQueue := DeadLetterQueueName("redirect")
+	for _, code := range []string{"a", "b", "c"} {
+		headers := amqp.Table{AttemptHeader: int32(5), LastErrorHeader: "boom", FailedAtHeader: int64(1700000000)}
+		if err := rabbitmq.PublishRaw(deadQueue, []byte(`{"code":"`+code+`"}`), headers); err != nil {
+			t.Fatalf("PublishRaw() error = %v", err)
+		}
+	}
+
+	// Inspecting leaves the messages in place
+	for i := 0; i < 2; i++ {
+		deadLetters, err := rabbitmq.DeadLetters("redirect", 2)
+		if err != nil {
+			t.Fatalf("DeadLetters() error = %v", err)
+		}
+		if len(deadLetters) != 2 || string(deadLetters[0].Payload) != `{"code":"a"}` {
+			t.Fatalf("DeadLetters() = %+v", deadLetters)
+		}
+	}
+	waitQueued(t, broker, deadQueue, 3)
+
+	replayed, err := rabbitmq.ReplayDeadLetters("redirect", 1)
+	if err != nil || replayed != 1 {
+		t.Fatalf("ReplayDeadLetters() = %d, %v", replayed, err)
+	}
+	queued := broker.queued("redirect")
+	if len(queued) != 1 || string(queued[0].Body) != `{"code":"a"}` {
+		t.Fatalf("queue has %v after replay", queued)
+	}
+	if _, ok := queued[0].Headers[AttemptHeader]; ok {
+		t.Errorf("replayed message should start over from the first attempt")
+	}
+
+	purged, err := rabbitmq.PurgeDeadLetters("redirect")
+	if err != nil || purged != 2 {
+		t.Fatalf("PurgeDeadLetters() = %d, %v", purged, err)
+	}
+	if dead := broker.queued(deadQueue); len(dead) != 0 {
+		t.Errorf("dead-letter queue has %d messages after purge", len(dead))
+	}
+}
+
+func TestConsumeDrainsOnCancel(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	started := make(chan context.Context, 1)
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- rabbitmq.Consume(ctx, "analytic", func(ctx context.Context, body []byte, headers amqp.Table) error {
+			started <- ctx
+			<-release
+			return nil
+		}, 3)
+	}()
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	if err := rabbitmq.Publish("analytic", "in flight", amqp.Table{"traceparent": traceparent}); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	var handlerCtx context.Context
+	select {
+	case handlerCtx = <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("message was not delivered")
+	}
+	if traceId := trace.SpanContextFromContext(handlerCtx).TraceID().String(); traceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("handler context has trace %s, want the publisher's", traceId)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		t.Fatalf("Consume() returned %v with a message in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if handlerCtx.Err() != nil {
+		t.Errorf("handler context should outlive the shutdown")
+	}
+
+	// No new message is taken while draining
+	if err := rabbitmq.Publish("analytic", "after shutdown", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Consume() error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Consume() did not return once drained")
+	}
+
+	queued := broker.queued("analytic")
+	if len(queued) != 1 || string(queued[0].Body) != `"after shutdown"` {
+		t.Errorf("queue has %v, want only the message published after shutdown", queued)
+	}
+}
+
+func TestConsumeDrainTimeout(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.DrainTimeout = 50 * time.Millisecond
+	rabbitmq.Connect(0)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- rabbitmq.Consume(ctx, "analytic", func(ctx context.Context, body []byte, headers amqp.Table) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		}, 1)
+	}()
+
+	if err := rabbitmq.Publish("analytic", "stuck", nil); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	<-started
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDrainTimeout) {
+			t.Fatalf("Consume() error = %v, want ErrDrainTimeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Consume() did not give up draining")
+	}
+
+	// The unacked message goes back to the queue for the next consumer
+	waitQueued(t, broker, "analytic", 1)
+}
+
+func TestConsumeSetsPrefetch(t *testing.T) {
+	broker := newFakeBroker()
+	rabbitmq := newTestRabbitMQ(t, broker)
+	rabbitmq.Connect(0)
+
+	consumeWithPrefetch := func(prefetch int, workers int) int {
+		t.Helper()
+		rabbitmq.Prefetch = prefetch
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- rabbitmq.Consume(ctx, "analytic", func(ctx context.Context, body []byte, headers amqp.Table) error {
+				return nil
+			}, workers)
+		}()
+
+		var consumer *fakeChannel
+		deadline := time.Now().Add(time.Second)
+		for consumer == nil && time.Now().Before(deadline) {
+			broker.mutex.Lock()
+			if consumers := broker.consumers["analytic"]; len(consumers) > 0 {
+				consumer = consumers[0]
+			}
+			broker.mutex.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		<-done
+		if consumer == nil {
+			t.Fatalf("Consume() did not subscribe")
+		}
+
+		consumer.mutex.Lock()
+		defer consumer.mutex.Unlock()
+		return consumer.prefetch
+	}
+
+	if prefetch := consumeWithPrefetch(0, 3); prefetch != 6 {
+		t.Errorf("prefetch = %d, want twice the workers", prefetch)
+	}
+	if prefetch := consumeWithPrefetch(10, 3); prefetch != 10 {
+		t.Errorf("prefetch = %d, want 10", prefetch)
+	}
+}
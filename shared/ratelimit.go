@@ -0,0 +1,139 @@
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	TokenBucketAlgorithm   = "token_bucket"
+	SlidingWindowAlgorithm = "sliding_window"
+)
+
+// Outcome of a rate limited call
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	// Time to wait before the call can be allowed, zero when it is allowed
+	RetryAfter time.Duration
+	// Time until the limit is fully available again
+	ResetAfter time.Duration
+}
+
+// Refill the bucket for the elapsed time, then take one token when there is one.
+// The clock of Redis is used so every replica agrees on the elapsed time.
+//
+// KEYS[1]: bucket, ARGV[1]: capacity, ARGV[2]: refill period in ms
+// Return {allowed, remaining, retry after ms, reset after ms}
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local rate = capacity / period
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], period)
+return {allowed, math.floor(tokens), retry, math.ceil((capacity - tokens) / rate)}
+`)
+
+// Drop the calls older than the window, then record this one when the window is not full.
+//
+// KEYS[1]: window, ARGV[1]: limit, ARGV[2]: window in ms, ARGV[3]: unique call id
+// Return {allowed, remaining, retry after ms, reset after ms}
+var slidingWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[3])
+	count = count + 1
+	allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], window)
+
+local retry = 0
+local reset = 0
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+	if allowed == 0 then
+		retry = reset
+	end
+end
+return {allowed, limit - count, retry, reset}
+`)
+
+// Take a token from the bucket stored at key, holding up to limit tokens refilled over period
+func (c *CacheClient) TokenBucket(key string, limit int64, period time.Duration) (*RateLimitResult, error) {
+	values, err := tokenBucketScript.Run(c.Ctx, c.rdClient, []string{key}, limit, period.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimitResult(limit, values)
+}
+
+// Record a call in the window stored at key, allowing up to limit calls over the last period
+func (c *CacheClient) SlidingWindow(key string, limit int64, period time.Duration) (*RateLimitResult, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	callId := fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(id))
+
+	values, err := slidingWindowScript.Run(c.Ctx, c.rdClient, []string{key}, limit, period.Milliseconds(), callId).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	return newRateLimitResult(limit, values)
+}
+
+// Rate limit a call with the given algorithm, see TokenBucket and SlidingWindow
+func (c *CacheClient) RateLimit(algorithm string, key string, limit int64, period time.Duration) (*RateLimitResult, error) {
+	switch algorithm {
+	case TokenBucketAlgorithm:
+		return c.TokenBucket(key, limit, period)
+	case SlidingWindowAlgorithm:
+		return c.SlidingWindow(key, limit, period)
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+}
+
+func newRateLimitResult(limit int64, values []int64) (*RateLimitResult, error) {
+	if len(values) != 4 {
+		return nil, fmt.Errorf("unexpected rate limit script result %v", values)
+	}
+	return &RateLimitResult{
+		Allowed:    values[0] == 1,
+		Limit:      limit,
+		Remaining:  values[1],
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		ResetAfter: time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
@@ -2,6 +2,7 @@ package shared
 
 import (
 	"context"
+	"errors"
 	"os"
 	"time"
 
@@ -62,14 +63,110 @@ func (c *CacheClient) Close() {
 	c.rdClient.Close()
 }
 
-// Get the value of key. If the key does not exist the special value nil is returned.
-// An error is returned if the value stored at key is not a string, because GET only handles string values.
+// ErrNotFound for a missing key, the other failures wrapped in ErrBackendUnavailable
+func cacheError(err error) error {
+	if errors.Is(err, redis.Nil) {
+		return ErrNotFound
+	}
+	return BackendError(err)
+}
+
+// Get the value of key. ErrNotFound is returned when the key does not exist, and
+// ErrBackendUnavailable when Redis cannot be reached.
 func (c *CacheClient) Get(key string) (string, error) {
-	return c.rdClient.Get(c.Ctx, key).Result()
+	value, err := c.rdClient.Get(c.Ctx, key).Result()
+	return value, cacheError(err)
 }
 
 // Set key to hold the string value. If key already holds a value, it is overwritten, regardless of its type.
 // Any previous time to live associated with the key is discarded on successful SET operation. Require TTL.
 func (c *CacheClient) Set(key string, value interface{}, ttl time.Duration) error {
-	return c.rdClient.Set(c.Ctx, key, value, ttl).Err()
+	return cacheError(c.rdClient.Set(c.Ctx, key, value, ttl).Err())
+}
+
+// Delete the given keys. Keys that do not exist are ignored.
+func (c *CacheClient) Del(keys ...string) error {
+	return cacheError(c.rdClient.Del(c.Ctx, keys...).Err())
+}
+
+// Set key to hold the value only if it does not exist yet. Return true when the key was set.
+func (c *CacheClient) SetNX(key string, value interface{}, ttl time.Duration) (bool, error) {
+	set, err := c.rdClient.SetNX(c.Ctx, key, value, ttl).Result()
+	return set, cacheError(err)
+}
+
+// Set a new time to live on key. Return false when the key does not exist.
+func (c *CacheClient) Expire(key string, ttl time.Duration) (bool, error) {
+	set, err := c.rdClient.Expire(c.Ctx, key, ttl).Result()
+	return set, cacheError(err)
+}
+
+// Get the value of key and its remaining time to live in a single round trip.
+// The TTL is 0 for a key without expiry. Fails like Get.
+func (c *CacheClient) GetWithTTL(key string) (string, time.Duration, error) {
+	pipe := c.rdClient.Pipeline()
+	get := pipe.Get(c.Ctx, key)
+	ttl := pipe.PTTL(c.Ctx, key)
+	_, err := pipe.Exec(c.Ctx)
+	if err != nil {
+		return "", 0, cacheError(err)
+	}
+
+	remaining := ttl.Val()
+	if remaining < 0 {
+		remaining = 0
+	}
+	return get.Val(), remaining, nil
+}
+
+// Bits of a BloomFilter in a Redis bitmap, shared by the instances of a service.
+//
+// Bit 0 of the bitmap tells the filter was fully populated, the bits of the filter
+// follow it. Until MarkReady is called, or once Redis lost the bitmap, every key is
+// reported as present so the filter never rejects a key it was not told about.
+type RedisBloomBits struct {
+	Client *CacheClient
+	Key    string
+}
+
+func (b *RedisBloomBits) SetBits(offsets []uint64) error {
+	pipe := b.Client.rdClient.Pipeline()
+	for _, offset := range offsets {
+		pipe.SetBit(b.Client.Ctx, b.Key, int64(offset+1), 1)
+	}
+	_, err := pipe.Exec(b.Client.Ctx)
+	return BackendError(err)
+}
+
+func (b *RedisBloomBits) TestBits(offsets []uint64) (bool, error) {
+	pipe := b.Client.rdClient.Pipeline()
+	ready := pipe.GetBit(b.Client.Ctx, b.Key, 0)
+	bits := make([]*redis.IntCmd, len(offsets))
+	for i, offset := range offsets {
+		bits[i] = pipe.GetBit(b.Client.Ctx, b.Key, int64(offset+1))
+	}
+	_, err := pipe.Exec(b.Client.Ctx)
+	if err != nil {
+		return true, BackendError(err)
+	}
+
+	if ready.Val() == 0 {
+		return true, nil
+	}
+	for _, bit := range bits {
+		if bit.Val() == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Mark the filter as populated, it starts rejecting the keys it does not contain
+func (b *RedisBloomBits) MarkReady() error {
+	return BackendError(b.Client.rdClient.SetBit(b.Client.Ctx, b.Key, 0, 1).Err())
+}
+
+func (b *RedisBloomBits) IsReady() (bool, error) {
+	bit, err := b.Client.rdClient.GetBit(b.Client.Ctx, b.Key, 0).Result()
+	return bit == 1, BackendError(err)
 }
@@ -0,0 +1,64 @@
+package shared
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Probabilistic early refresh of cache entries ("XFetch"): each read of an entry
+// decides to recompute it before it expires, with a probability growing as its expiry
+// nears and as its recomputation gets slower. The readers of a hot entry refresh it
+// one at a time ahead of its expiry instead of all missing it at once.
+type EarlyRefresh struct {
+	// Scale of the refresh window, above 1 refreshes earlier (1 when zero)
+	Beta float64
+
+	recompute atomic.Int64 // Moving average of the recomputation time, in nanoseconds
+	random    func() float64
+}
+
+func NewEarlyRefresh(beta float64) *EarlyRefresh {
+	return &EarlyRefresh{
+		Beta:   beta,
+		random: rand.Float64,
+	}
+}
+
+// Record the time taken to recompute an entry
+func (r *EarlyRefresh) Observe(duration time.Duration) {
+	for {
+		previous := r.recompute.Load()
+		next := int64(duration)
+		if previous > 0 {
+			// Each sample weighs for a tenth of the average
+			next = previous + (int64(duration)-previous)/10
+		}
+		if r.recompute.CompareAndSwap(previous, next) {
+			return
+		}
+	}
+}
+
+// Average time to recompute an entry, 0 before the first one was observed
+func (r *EarlyRefresh) RecomputeTime() time.Duration {
+	return time.Duration(r.recompute.Load())
+}
+
+// Tell whether an entry read with the remaining time to live should be refreshed now
+func (r *EarlyRefresh) Due(remaining time.Duration) bool {
+	recompute := r.RecomputeTime()
+	if remaining <= 0 || recompute <= 0 {
+		return false
+	}
+
+	beta := r.Beta
+	if beta <= 0 {
+		beta = 1
+	}
+	// -ln(u) for u in (0, 1] is exponentially distributed: most reads fall in a window
+	// of a few recomputation times before the expiry
+	window := float64(recompute) * beta * -math.Log(1-r.random())
+	return float64(remaining) <= window
+}
@@ -0,0 +1,76 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEarlyRefreshObserve(t *testing.T) {
+	refresh := NewEarlyRefresh(1)
+	if refresh.RecomputeTime() != 0 {
+		t.Fatalf("RecomputeTime() = %v before any observation", refresh.RecomputeTime())
+	}
+
+	refresh.Observe(100 * time.Millisecond)
+	if refresh.RecomputeTime() != 100*time.Millisecond {
+		t.Fatalf("RecomputeTime() = %v, want the first observation", refresh.RecomputeTime())
+	}
+
+	refresh.Observe(200 * time.Millisecond)
+	if refresh.RecomputeTime() != 110*time.Millisecond {
+		t.Fatalf("RecomputeTime() = %v, want 110ms", refresh.RecomputeTime())
+	}
+}
+
+func TestEarlyRefreshDue(t *testing.T) {
+	refresh := NewEarlyRefresh(2)
+	if refresh.Due(time.Millisecond) {
+		t.Fatal("Due() before any observation")
+	}
+
+	refresh.Observe(10 * time.Millisecond)
+	tests := []struct {
+		name      string
+		random    float64
+		remaining time.Duration
+		want      bool
+	}{
+		{"expired", 0.5, 0, false},
+		{"far from expiry", 0.99, time.Hour, false},
+		// Window of 10ms * 2 * ln(2) = 13.9ms
+		{"inside window", 0.5, 13 * time.Millisecond, true},
+		{"outside window", 0.5, 14 * time.Millisecond, false},
+		{"unlucky draw", 0, time.Millisecond, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			refresh.random = func() float64 { return test.random }
+			if got := refresh.Due(test.remaining); got != test.want {
+				t.Errorf("Due(%v) = %v, want %v", test.remaining, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEarlyRefreshDueGrowsNearExpiry(t *testing.T) {
+	refresh := NewEarlyRefresh(1)
+	refresh.Observe(10 * time.Millisecond)
+
+	due := func(remaining time.Duration) int {
+		count := 0
+		for i := 0; i < 10000; i++ {
+			if refresh.Due(remaining) {
+				count++
+			}
+		}
+		return count
+	}
+
+	near, far := due(time.Millisecond), due(30*time.Millisecond)
+	if near <= far {
+		t.Fatalf("Due() %d times near the expiry, %d times far from it", near, far)
+	}
+	if near < 8500 || far > 1000 {
+		t.Fatalf("Due() %d times near the expiry, %d times far from it", near, far)
+	}
+}
@@ -0,0 +1,291 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers a failed message carries
+const (
+	AttemptHeader   = "x-attempt"    // Number of the next delivery, 1 for the first one
+	LastErrorHeader = "x-last-error" // Error of the last attempt of a dead-lettered message
+	FailedAtHeader  = "x-failed-at"  // Unix timestamp of the last attempt of a dead-lettered message
+)
+
+// How the messages of a queue are retried when the consumer fails.
+//
+// A failed message waits in a delay queue whose TTL sends it back to the queue, the
+// delay doubling after each attempt. Once MaxAttempts deliveries failed the message
+// goes to the dead-letter queue of the queue.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: time.Second,
+		MaxDelay:     5 * time.Minute,
+	}
+}
+
+// Read the policy of a queue from <PREFIX>_RETRY_MAX_ATTEMPTS, <PREFIX>_RETRY_INITIAL_DELAY
+// and <PREFIX>_RETRY_MAX_DELAY, e.g. REDIRECT_RETRY_MAX_ATTEMPTS
+func RetryPolicyFromEnv(prefix string) RetryPolicy {
+	policy := DefaultRetryPolicy()
+	prefix = strings.ToUpper(prefix) + "_RETRY_"
+	policy.MaxAttempts = GetEnvInt(prefix+"MAX_ATTEMPTS", policy.MaxAttempts)
+	policy.InitialDelay = GetEnvDuration(prefix+"INITIAL_DELAY", policy.InitialDelay)
+	policy.MaxDelay = GetEnvDuration(prefix+"MAX_DELAY", policy.MaxDelay)
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return policy
+}
+
+// Wait before the delivery following the given failed attempt
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Queue where failed messages wait for the delay, named after it so a new policy
+// never redeclares an existing queue with another TTL
+func DelayQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queue, delay)
+}
+
+func DeadLetterQueueName(queue string) string {
+	return queue + ".dead"
+}
+
+// Set the retry policy of the queue, DefaultRetryPolicy is used for the others
+func (r *RabbitMQ) SetRetryPolicy(queue string, policy RetryPolicy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.setRetryPolicy(queue, policy)
+}
+
+// Register the policy and the arguments of its delay queues. Called with the mutex held.
+func (r *RabbitMQ) setRetryPolicy(queue string, policy RetryPolicy) {
+	r.retryPolicies[queue] = policy
+
+	for attempt := 1; attempt < policy.MaxAttempts; attempt++ {
+		delay := policy.Delay(attempt)
+		r.queueArgs[DelayQueueName(queue, delay)] = amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		}
+	}
+}
+
+// Policy of the queue, DefaultRetryPolicy is registered for a queue without one so its
+// delay queues are declared with their TTL
+func (r *RabbitMQ) retryPolicy(queue string) RetryPolicy {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if policy, ok := r.retryPolicies[queue]; ok {
+		return policy
+	}
+	policy := DefaultRetryPolicy()
+	r.setRetryPolicy(queue, policy)
+	return policy
+}
+
+// Arguments the queue is declared with, nil for a plain durable queue
+func (r *RabbitMQ) queueArguments(queue string) amqp.Table {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.queueArgs[queue]
+}
+
+// Delivery number of the message, from its attempt header
+func deliveryAttempt(headers amqp.Table) int {
+	switch attempt := headers[AttemptHeader].(type) {
+	case int32:
+		return int(attempt)
+	case int64:
+		return int(attempt)
+	case int:
+		return attempt
+	}
+	return 1
+}
+
+func copyHeaders(headers amqp.Table) amqp.Table {
+	copied := amqp.Table{}
+	for key, value := range headers {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Send a message the consumer failed on to its delay queue, or to the dead-letter queue
+// after its last attempt. The delivery is requeued when neither can be reached.
+func (r *RabbitMQ) retryOrDeadLetter(queue string, d amqp.Delivery, cause error) {
+	policy := r.retryPolicy(queue)
+	attempt := deliveryAttempt(d.Headers)
+	headers := copyHeaders(d.Headers)
+
+	target := DeadLetterQueueName(queue)
+	if attempt < policy.MaxAttempts {
+		target = DelayQueueName(queue, policy.Delay(attempt))
+		headers[AttemptHeader] = int32(attempt + 1)
+	} else {
+		headers[LastErrorHeader] = cause.Error()
+		headers[FailedAtHeader] = time.Now().Unix()
+	}
+
+	err := r.PublishRaw(target, d.Body, headers)
+	if err != nil {
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// A message of a dead-letter queue
+type DeadLetter struct {
+	Queue    string          `json:"queue"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	FailedAt int64           `json:"failedAt"` // Unix timestamp
+	Payload  json.RawMessage `json:"payload"`
+}
+
+func toDeadLetter(queue string, d amqp.Delivery) DeadLetter {
+	deadLetter := DeadLetter{
+		Queue:    queue,
+		Attempts: deliveryAttempt(d.Headers),
+		Payload:  json.RawMessage(d.Body),
+	}
+	if lastError, ok := d.Headers[LastErrorHeader].(string); ok {
+		deadLetter.Error = lastError
+	}
+	if failedAt, ok := d.Headers[FailedAtHeader].(int64); ok {
+		deadLetter.FailedAt = failedAt
+	}
+	if !json.Valid(d.Body) {
+		encoded, _ := json.Marshal(string(d.Body))
+		deadLetter.Payload = encoded
+	}
+	return deadLetter
+}
+
+// Open a channel on the connection, waiting for it up to PublishTimeout
+func (r *RabbitMQ) openChannel() (amqpChannel, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, r.PublishTimeout)
+	defer cancel()
+
+	connection, err := r.waitConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return connection.Channel()
+}
+
+// Return up to limit messages of the dead-letter queue of the queue, oldest first,
+// leaving them in place
+func (r *RabbitMQ) DeadLetters(queue string, limit int) ([]DeadLetter, error) {
+	channel, err := r.openChannel()
+	if err != nil {
+		return nil, err
+	}
+	// Closing the channel puts the messages that were read back in the queue
+	defer channel.Close()
+
+	deadQueue := DeadLetterQueueName(queue)
+	_, err = channel.QueueDeclare(deadQueue, true, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := []DeadLetter{}
+	for len(deadLetters) < limit {
+		d, ok, err := channel.Get(deadQueue, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		deadLetters = append(deadLetters, toDeadLetter(queue, d))
+	}
+	return deadLetters, nil
+}
+
+// Move up to limit messages of the dead-letter queue back to the queue, oldest first,
+// with a fresh attempt count. Return the number of messages replayed.
+func (r *RabbitMQ) ReplayDeadLetters(queue string, limit int) (int, error) {
+	channel, err := r.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+
+	deadQueue := DeadLetterQueueName(queue)
+	_, err = channel.QueueDeclare(deadQueue, true, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for replayed < limit {
+		d, ok, err := channel.Get(deadQueue, false)
+		if err != nil {
+			return replayed, err
+		}
+		if !ok {
+			break
+		}
+
+		headers := copyHeaders(d.Headers)
+		delete(headers, AttemptHeader)
+		delete(headers, LastErrorHeader)
+		delete(headers, FailedAtHeader)
+		delete(headers, "x-death")
+
+		// The message stays dead-lettered when it cannot be published
+		err = r.PublishRaw(queue, d.Body, headers)
+		if err != nil {
+			return replayed, err
+		}
+
+		err = d.Ack(false)
+		if err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// Drop every message of the dead-letter queue of the queue, return how many there were
+func (r *RabbitMQ) PurgeDeadLetters(queue string) (int, error) {
+	channel, err := r.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer channel.Close()
+
+	deadQueue := DeadLetterQueueName(queue)
+	_, err = channel.QueueDeclare(deadQueue, true, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+	return channel.QueuePurge(deadQueue, false)
+}
@@ -0,0 +1,97 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Errors of the repos and the cache, answered with their status by the services
+var (
+	ErrNotFound           = errors.New("not found")           // 404
+	ErrExpired            = errors.New("expired")             // 410, past its expiry or out of clicks
+	ErrDisabled           = errors.New("disabled")            // 410
+	ErrBackendUnavailable = errors.New("backend unavailable") // 503, the database, the cache or a service failed
+)
+
+// Failure of a backend, it is ErrBackendUnavailable and unwraps to its cause
+type backendError struct {
+	err error
+}
+
+func (e *backendError) Error() string {
+	return ErrBackendUnavailable.Error() + ": " + e.err.Error()
+}
+
+func (e *backendError) Unwrap() error {
+	return e.err
+}
+
+func (e *backendError) Is(target error) bool {
+	return target == ErrBackendUnavailable
+}
+
+// Wrap the failure of a backend in ErrBackendUnavailable, keeping its cause. nil stays nil.
+func BackendError(err error) error {
+	if err == nil || errors.Is(err, ErrBackendUnavailable) {
+		return err
+	}
+	return &backendError{err: err}
+}
+
+// Failure of a call to an internal service, carrying the HTTP status it is answered with
+// whatever the transport (HTTP or gRPC)
+type ServiceError struct {
+	Status  int
+	Message string
+}
+
+func NewServiceError(status int, message string) *ServiceError {
+	return &ServiceError{
+		Status:  status,
+		Message: message,
+	}
+}
+
+func (e *ServiceError) Error() string {
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+// ServiceError answering the error: a ServiceError as is, the errors of the repos with
+// their status and any other error with 500. nil for no error.
+func AsServiceError(err error) *ServiceError {
+	var serviceError *ServiceError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &serviceError):
+		return serviceError
+	case errors.Is(err, ErrNotFound):
+		return NewServiceError(404, "Not found")
+	case errors.Is(err, ErrExpired), errors.Is(err, ErrDisabled):
+		return NewServiceError(410, "Link is no longer available")
+	case errors.Is(err, ErrBackendUnavailable):
+		return NewServiceError(503, "Service unavailable")
+	}
+	return NewServiceError(500, "Internal server error")
+}
+
+// HTTP status of the error (see AsServiceError), 200 for no error
+func ServiceErrorStatus(err error) int {
+	if err == nil {
+		return 200
+	}
+	return AsServiceError(err).Status
+}
+
+// Answer the error with its status, see AsServiceError
+func ServiceErrorResponse(c *fiber.Ctx, err error) error {
+	serviceError := AsServiceError(err)
+	if serviceError == nil {
+		serviceError = NewServiceError(500, "Internal server error")
+	}
+	return c.Status(serviceError.Status).JSON(map[string]interface{}{
+		"error": serviceError.Message,
+	})
+}
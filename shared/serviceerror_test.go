@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestAsServiceError(t *testing.T) {
+	cases := []struct {
+		err     error
+		status  int
+		message string
+	}{
+		{NewServiceError(409, "Alias is already taken"), 409, "Alias is already taken"},
+		{fmt.Errorf("get link: %w", ErrNotFound), 404, "Not found"},
+		{ErrExpired, 410, "Link is no longer available"},
+		{ErrDisabled, 410, "Link is no longer available"},
+		{BackendError(errors.New("connection refused")), 503, "Service unavailable"},
+		{errors.New("boom"), 500, "Internal server error"},
+	}
+	for _, c := range cases {
+		serviceError := AsServiceError(c.err)
+		if serviceError.Status != c.status || serviceError.Message != c.message {
+			t.Errorf("AsServiceError(%v) = %v, want %d %s", c.err, serviceError, c.status, c.message)
+		}
+	}
+
+	if AsServiceError(nil) != nil || ServiceErrorStatus(nil) != 200 {
+		t.Errorf("AsServiceError(nil) should be nil and its status 200")
+	}
+}
+
+func TestBackendErrorKeepsItsCause(t *testing.T) {
+	err := BackendError(context.DeadlineExceeded)
+	if !errors.Is(err, ErrBackendUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("BackendError() = %v, want both ErrBackendUnavailable and its cause", err)
+	}
+	if BackendError(err) != err || BackendError(nil) != nil {
+		t.Errorf("BackendError() should not wrap twice nor wrap nil")
+	}
+}
+
+func TestCacheError(t *testing.T) {
+	if err := cacheError(redis.Nil); err != ErrNotFound {
+		t.Errorf("cacheError(redis.Nil) = %v, want ErrNotFound", err)
+	}
+	if err := cacheError(errors.New("dial tcp: connection refused")); !errors.Is(err, ErrBackendUnavailable) {
+		t.Errorf("cacheError() = %v, want ErrBackendUnavailable", err)
+	}
+	if err := cacheError(nil); err != nil {
+		t.Errorf("cacheError(nil) = %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package shared
+
+import (
+	"errors"
+	"sync"
+)
+
+// Returned to the callers waiting for a call whose fn panicked
+var ErrFlightPanicked = errors.New("single flight call panicked")
+
+type flightCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// Coalesce concurrent calls for the same key: while a call is in flight, callers of
+// the same key wait for its result instead of running their own.
+type SingleFlight[K comparable, V any] struct {
+	mutex sync.Mutex
+	calls map[K]*flightCall[V]
+}
+
+func NewSingleFlight[K comparable, V any]() *SingleFlight[K, V] {
+	return &SingleFlight[K, V]{
+		calls: make(map[K]*flightCall[V]),
+	}
+}
+
+// Run fn for the key, or wait for the call of the key already in flight.
+// Return true when the result was shared with another caller.
+func (s *SingleFlight[K, V]) Do(key K, fn func() (V, error)) (V, error, bool) {
+	s.mutex.Lock()
+	if call, ok := s.calls[key]; ok {
+		s.mutex.Unlock()
+		<-call.done
+		return call.value, call.err, true
+	}
+	call := &flightCall[V]{done: make(chan struct{})}
+	s.calls[key] = call
+	s.mutex.Unlock()
+
+	// Release the waiters even if fn panics, with ErrFlightPanicked: the panic goes on
+	// in the caller running fn only
+	call.err = ErrFlightPanicked
+	defer func() {
+		s.mutex.Lock()
+		delete(s.calls, key)
+		s.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.value, call.err = fn()
+	return call.value, call.err, false
+}
@@ -0,0 +1,96 @@
+package shared
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSingleFlightCoalescesConcurrentCalls(t *testing.T) {
+	flight := NewSingleFlight[string, int]()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+	var sharedResults int32
+
+	call := func() {
+		value, err, wasShared := flight.Do("abc", func() (int, error) {
+			atomic.AddInt32(&calls, 1)
+			close(entered)
+			<-release
+			return 42, nil
+		})
+		if value != 42 || err != nil {
+			t.Errorf("Do() = %v, %v", value, err)
+		}
+		if wasShared {
+			atomic.AddInt32(&sharedResults, 1)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		call()
+	}()
+	<-entered
+
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			call()
+		}()
+	}
+	// Let the followers join the flight before it lands
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 || sharedResults != 9 {
+		t.Errorf("%d calls and %d shared results, want 1 and 9", calls, sharedResults)
+	}
+
+	value, _, wasShared := flight.Do("abc", func() (int, error) { return 7, nil })
+	if value != 7 || wasShared {
+		t.Errorf("Do() after the flight = %v, shared %v, want a new call", value, wasShared)
+	}
+}
+
+func TestSingleFlightPanicFailsWaiters(t *testing.T) {
+	flight := NewSingleFlight[string, int]()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	leader := make(chan interface{})
+	go func() {
+		defer func() {
+			leader <- recover()
+		}()
+		flight.Do("abc", func() (int, error) {
+			close(entered)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-entered
+
+	waiter := make(chan error)
+	go func() {
+		_, err, _ := flight.Do("abc", func() (int, error) { return 7, nil })
+		waiter <- err
+	}()
+	// Let the waiter join the flight before it panics
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if recovered := <-leader; recovered != "boom" {
+		t.Errorf("leader recovered %v, want the panic of fn", recovered)
+	}
+	if err := <-waiter; !errors.Is(err, ErrFlightPanicked) {
+		t.Errorf("waiter error = %v, want ErrFlightPanicked", err)
+	}
+}
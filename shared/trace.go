@@ -69,8 +69,12 @@ func NewTracerProvider(serviceName string, collectorURL string, ctx context.Cont
 	return tp
 }
 
+// Collector of OTEL_ENDPOINT, the local OTLP port when it is not set (e.g. in tests)
 func GetDefaultCollectorURL() string {
-	return os.Getenv("OTEL_ENDPOINT")
+	if endpoint := os.Getenv("OTEL_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	return "localhost:4317"
 }
 
 func NewTracer(serviceName string, collectorURL string) *Tracer {